@@ -0,0 +1,694 @@
+// gdprshare-cli uploads and downloads files end-to-end encrypted, compatible
+// with the web client: links created here open in the browser and links of
+// web uploads can be downloaded here.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lixmal/gdprshare/pkg/client"
+)
+
+const (
+	Version       = "0.9.0"
+	DefaultServer = "http://localhost:8080"
+	ServerEnv     = "GDPRSHARE_SERVER"
+	APIKeyEnv     = "GDPRSHARE_API_KEY"
+
+	timeFormat = "2006-01-02 15:04"
+)
+
+var flagServer *string
+var flagAPIKey *string
+var flagVersion *bool
+
+func init() {
+	server := os.Getenv(ServerEnv)
+	if server == "" {
+		server = DefaultServer
+	}
+
+	// cmdline arg "-server"
+	flagServer = flag.String("server", server, "gdprshare server URL, defaults to $"+ServerEnv)
+	// cmdline arg "-api-key"
+	flagAPIKey = flag.String("api-key", os.Getenv(APIKeyEnv), "API key of the server, defaults to $"+APIKeyEnv)
+	// cmdline arg "-version"
+	flagVersion = flag.Bool("version", false, "print program version")
+	flag.Usage = usage
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [-server URL] [-api-key KEY] <command> [arguments]
+
+Commands:
+  upload [options] FILE            encrypt and upload a file, "-" reads stdin
+  upload -request LINK FILE        upload a file into a file request
+  download [-o PATH] [-code CODE] LINK
+  download -private-key PEM [-o PATH] FILEID
+                                   download and decrypt a shared or received file
+  delete FILEID OWNERTOKEN         delete an uploaded file
+  status FILEID OWNERTOKEN [...]   show downloads, latest access and expiry
+                                   with -api-key, both take file ids only
+  update [options] FILEID OWNERTOKEN
+                                   change downloads left, expiry or allowed countries
+  approvals FILEID OWNERTOKEN      list download requests of a file that needs approval
+  approve FILEID OWNERTOKEN REQUESTID
+  deny FILEID OWNERTOKEN REQUESTID decide on a download request
+  record [-pdf] [-o PATH] FILEID OWNERTOKEN
+                                   save the signed transfer record or PDF receipt
+  request [options]                create a file request to receive files
+  received REQUESTID OWNERTOKEN    list the files received through a file request
+  close-request REQUESTID OWNERTOKEN
+                                   stop a file request from taking uploads
+  usage                            show stored files and quota of the API key
+
+Options:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Parse()
+
+	if *flagVersion {
+		version()
+		os.Exit(0)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	c := client.New(*flagServer)
+	c.APIKey = *flagAPIKey
+
+	var err error
+	args := flag.Args()
+	switch flag.Arg(0) {
+	case "upload":
+		err = upload(ctx, c, args[1:])
+	case "download":
+		err = download(ctx, c, args[1:])
+	case "delete":
+		err = remove(ctx, c, args[1:])
+	case "status":
+		err = status(ctx, c, args[1:])
+	case "update":
+		err = update(ctx, c, args[1:])
+	case "approvals":
+		err = approvals(ctx, c, args[1:])
+	case "approve", "deny":
+		err = decide(ctx, c, args[1:], flag.Arg(0) == "approve")
+	case "record":
+		err = saveRecord(ctx, c, args[1:])
+	case "request":
+		err = request(ctx, c, args[1:])
+	case "received":
+		err = received(ctx, c, args[1:])
+	case "close-request":
+		err = closeRequest(ctx, c, args[1:])
+	case "usage":
+		err = showUsage(ctx, c, args[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func upload(ctx context.Context, c *client.Client, args []string) error {
+	var opts client.UploadOptions
+	flags := flag.NewFlagSet("upload", flag.ExitOnError)
+	flags.StringVar(&opts.Type, "type", "file", "file, text or image, decides how the download page shows it")
+	flags.StringVar(&opts.Email, "email", "", "notify this address on download attempts")
+	flags.StringVar(&opts.RecipientEmail, "recipient-email", "", "require a code mailed to this address for each download")
+	flags.UintVar(&opts.Count, "count", 1, "number of allowed downloads")
+	flags.UintVar(&opts.Expiry, "expiry", 14, "days until the file expires")
+	flags.UintVar(&opts.ExpiryHours, "expiry-hours", 0, "hours until the file expires, instead of -expiry")
+	flags.UintVar(&opts.Delay, "delay", 0, "minutes until the file can be downloaded")
+	countries := flags.String("allowed-countries", "", "comma separated country codes to allow downloads from")
+	flags.BoolVar(&opts.OnlyEEA, "only-eea", false, "only allow downloads from the EEA")
+	flags.BoolVar(&opts.IncludeOther, "include-other", false, "with -only-eea, also allow adequate countries")
+	flags.BoolVar(&opts.Approval, "approval", false, "approve each download, requests are mailed with -email")
+	name := flags.String("name", "", "filename shown to the recipient, defaults to the file's name")
+	requestLink := flags.String("request", "", "upload into the file request of this link, the requester's settings apply")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("expected exactly one file")
+	}
+	if *countries != "" {
+		opts.AllowedCountries = strings.Split(*countries, ",")
+	}
+
+	in := os.Stdin
+	if path := flags.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		in = f
+		if *name == "" {
+			*name = filepath.Base(path)
+		}
+	}
+	if *name == "" {
+		*name = "stdin"
+	}
+
+	if *requestLink != "" {
+		// the link decides the server, the key is for ours only
+		baseURL, requestId, key, err := client.ParseRequestLink(*requestLink)
+		if err != nil {
+			return err
+		}
+		c.BaseURL, c.APIKey = baseURL, ""
+
+		fileId, err := c.UploadToRequest(ctx, requestId, key, in, *name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("uploaded %s\n", fileId)
+		return nil
+	}
+
+	share, err := c.Upload(ctx, in, *name, opts)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "link:\t%s\n", share.Link)
+	fmt.Fprintf(w, "file id:\t%s\n", share.FileId)
+	fmt.Fprintf(w, "owner token:\t%s\n", share.OwnerToken)
+	return w.Flush()
+}
+
+func download(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	output := flags.String("o", "", `output path, "-" for stdout, defaults to the shared filename`)
+	code := flags.String("code", "", "code mailed to the recipient, asked for if needed and not given")
+	privateKey := flags.String("private-key", "", "PEM file with the private key of a file request, takes a file id instead of a link")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("expected exactly one link or file id")
+	}
+
+	var fileId string
+	var key client.Key
+	if *privateKey != "" {
+		// files received with a public key have no key in a link
+		priv, err := readPrivateKey(*privateKey)
+		if err != nil {
+			return err
+		}
+		c.PrivateKey = priv
+		fileId = flags.Arg(0)
+	} else {
+		// the link decides the server, the key is for ours only
+		baseURL, id, k, err := client.ParseLink(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		c.BaseURL, c.APIKey = baseURL, ""
+		fileId, key = id, k
+	}
+	c.ApprovalPending = func(string) {
+		fmt.Fprintln(os.Stderr, "waiting for the sender to approve the download ...")
+	}
+	c.Code = func(context.Context) (string, error) {
+		if *code != "" {
+			return *code, nil
+		}
+
+		fmt.Fprint(os.Stderr, "a code was mailed to the recipient, enter it: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(line), nil
+	}
+
+	clearText := &bytes.Buffer{}
+	file, err := c.Download(ctx, fileId, key, clearText)
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "-":
+		_, err = clearText.WriteTo(os.Stdout)
+	case "":
+		// the download is already used up, pick a free name like browsers do
+		*output, err = writeFreeFile(safeFilename(file.Filename), clearText.Bytes())
+	default:
+		err = writeNewFile(*output, clearText.Bytes())
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := c.ConfirmReceipt(ctx, fileId); err != nil {
+		return fmt.Errorf("confirm receipt: %w", err)
+	}
+
+	if *output != "-" {
+		fmt.Printf("saved %s\n", *output)
+	}
+	return nil
+}
+
+func remove(ctx context.Context, c *client.Client, args []string) error {
+	// files uploaded with the API key need no owner token
+	if c.APIKey != "" && len(args) == 1 {
+		args = append(args, "")
+	}
+	if len(args) != 2 {
+		return errors.New("expected file id and owner token")
+	}
+
+	if err := c.Delete(ctx, args[0], args[1]); err != nil {
+		return err
+	}
+
+	fmt.Printf("deleted %s\n", args[0])
+	return nil
+}
+
+func status(ctx context.Context, c *client.Client, args []string) error {
+	var files []client.OwnedFile
+	if c.APIKey != "" {
+		// files uploaded with the API key need no owner token
+		for _, fileId := range args {
+			files = append(files, client.OwnedFile{FileId: fileId})
+		}
+	} else {
+		if len(args)%2 != 0 {
+			return errors.New("expected pairs of file id and owner token")
+		}
+		for i := 0; i < len(args); i += 2 {
+			files = append(files, client.OwnedFile{FileId: args[i], OwnerToken: args[i+1]})
+		}
+	}
+	if len(files) == 0 {
+		return errors.New("expected file ids")
+	}
+
+	statuses, err := c.Status(ctx, files...)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE ID\tDOWNLOADS LEFT\tDOWNLOADED\tDENIED\tLAST ACCESS\tEXPIRES")
+	for _, f := range files {
+		status := statuses[f.FileId]
+		switch {
+		case status.Code == client.ErrCodeOwnerTokenMismatch:
+			fmt.Fprintf(w, "%s\towner token mismatch\t\t\t\t\n", f.FileId)
+		case status.Code == client.ErrCodeFileNotFound:
+			fmt.Fprintf(w, "%s\tnot found\t\t\t\t\n", f.FileId)
+		case status.Code != "" && status.Code != client.ErrCodeFileExpired:
+			fmt.Fprintf(w, "%s\t%s\t\t\t\t\n", f.FileId, status.Code)
+		default:
+			left := strconv.FormatUint(uint64(status.Count), 10)
+			if status.Code == client.ErrCodeFileExpired {
+				left = "expired"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n",
+				f.FileId, left, status.Downloads, status.Denied,
+				formatAccess(status.LastAccess), status.ExpiryDate.Local().Format(timeFormat))
+		}
+	}
+	return w.Flush()
+}
+
+func showUsage(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 0 {
+		return errors.New("expected no arguments")
+	}
+	if c.APIKey == "" {
+		return errors.New("usage is only tracked for API keys, set -api-key")
+	}
+
+	u, err := c.Usage(ctx)
+	if err != nil {
+		return err
+	}
+
+	limit := func(quota uint64) string {
+		if quota == 0 {
+			return "unlimited"
+		}
+		return strconv.FormatUint(quota, 10)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tUSED\tQUOTA")
+	fmt.Fprintf(w, "files\t%d\t%s\n", u.Files, limit(uint64(u.QuotaFiles)))
+	fmt.Fprintf(w, "MiB\t%.1f\t%s\n", float64(u.Bytes)/(1024*1024), limit(uint64(u.QuotaBytes/(1024*1024))))
+	fmt.Fprintf(w, "uploads in 24h\t%d\t%s\n", u.Uploads, limit(uint64(u.QuotaUploads)))
+	return w.Flush()
+}
+
+func update(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("update", flag.ExitOnError)
+	count := flags.Uint("count", 1, "number of downloads left")
+	expiry := flags.Uint("expiry", 14, "days after upload until the file expires")
+	expiryHours := flags.Uint("expiry-hours", 0, "hours after upload until the file expires, instead of -expiry")
+	delay := flags.Uint("delay", 0, "minutes after upload until the file can be downloaded")
+	countries := flags.String("allowed-countries", "", `comma separated country codes to allow downloads from, "" allows all`)
+	onlyEEA := flags.Bool("only-eea", false, "only allow downloads from the EEA")
+	includeOther := flags.Bool("include-other", false, "with -only-eea, also allow adequate countries")
+	approval := flags.Bool("approval", false, "approve each download")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return errors.New("expected file id and owner token")
+	}
+
+	// only send what was given, the rest stays as it is
+	var u client.FileUpdate
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "count":
+			u.Count = count
+		case "expiry":
+			u.Expiry = expiry
+		case "expiry-hours":
+			u.ExpiryHours = expiryHours
+		case "delay":
+			u.Delay = delay
+		case "allowed-countries":
+			var list []string
+			if *countries != "" {
+				list = strings.Split(*countries, ",")
+			}
+			u.AllowedCountries = &list
+		case "only-eea":
+			u.OnlyEEA = onlyEEA
+		case "include-other":
+			u.IncludeOther = includeOther
+		case "approval":
+			u.Approval = approval
+		}
+	})
+
+	status, err := c.Update(ctx, flags.Arg(0), flags.Arg(1), u)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("updated %s: %d download(s) left, expires %s\n", flags.Arg(0), status.Count, status.ExpiryDate.Local().Format(timeFormat))
+	return nil
+}
+
+func approvals(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 2 {
+		return errors.New("expected file id and owner token")
+	}
+
+	approvals, err := c.Approvals(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REQUEST ID\tSTATE\tTIME\tADDRESS\tLOCATION\tTLS\tUSER AGENT")
+	for _, a := range approvals {
+		state := a.State
+		if a.Used {
+			state += ", used"
+		}
+		location := strings.Trim(a.City+", "+a.Country, ", ")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			a.RequestId, state, a.Time.Local().Format(timeFormat), a.Addr, location,
+			strings.TrimSpace(a.TLSVersion+" "+a.TLSCipherSuite), a.UserAgent)
+	}
+	return w.Flush()
+}
+
+func decide(ctx context.Context, c *client.Client, args []string, approve bool) error {
+	if len(args) != 3 {
+		return errors.New("expected file id, owner token and request id")
+	}
+
+	approval, err := c.Decide(ctx, args[0], args[1], args[2], approve)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s %s\n", approval.State, approval.RequestId)
+	return nil
+}
+
+func formatAccess(access *client.FileAccess) string {
+	if access == nil {
+		return "-"
+	}
+
+	text := access.Time.Local().Format(timeFormat)
+	switch {
+	case access.City != "" && access.Country != "":
+		text += " " + access.City + ", " + access.Country
+	case access.Country != "":
+		text += " " + access.Country
+	}
+	if access.Denied {
+		text += " (denied)"
+	}
+	return text
+}
+
+func saveRecord(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("record", flag.ExitOnError)
+	pdf := flags.Bool("pdf", false, "save the PDF receipt instead of the signed JSON record")
+	output := flags.String("o", "", `output file, "-" for stdout, defaults to gdprshare-record-FILEID.json or gdprshare-receipt-FILEID.pdf`)
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return errors.New("expected file id and owner token")
+	}
+	fileId := flags.Arg(0)
+
+	fetch, name := c.Record, "gdprshare-record-"+safeFilename(fileId)+".json"
+	if *pdf {
+		fetch, name = c.Receipt, "gdprshare-receipt-"+safeFilename(fileId)+".pdf"
+	}
+
+	data, err := fetch(ctx, fileId, flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	switch *output {
+	case "-":
+		_, err = os.Stdout.Write(data)
+		return err
+	case "":
+		*output = name
+	}
+
+	if err := os.WriteFile(*output, data, 0o644); err != nil {
+		return err
+	}
+
+	fmt.Printf("saved %s\n", *output)
+	return nil
+}
+
+func request(ctx context.Context, c *client.Client, args []string) error {
+	var opts client.RequestOptions
+	flags := flag.NewFlagSet("request", flag.ExitOnError)
+	flags.StringVar(&opts.Email, "email", "", "notify this address of each upload")
+	flags.StringVar(&opts.Message, "message", "", "message shown to the uploader")
+	flags.UintVar(&opts.Expiry, "expiry", 14, "days the request takes uploads")
+	flags.UintVar(&opts.ExpiryHours, "expiry-hours", 0, "hours the request takes uploads, instead of -expiry")
+	flags.UintVar(&opts.MaxFiles, "max-files", 1, "number of files that can be uploaded")
+	flags.Int64Var(&opts.MaxSize, "max-size", 0, "MiB per file, defaults to the server's limit")
+	publicKey := flags.String("public-key", "", "PEM file with an RSA public key to encrypt the files for, instead of a key in the link")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("unexpected arguments")
+	}
+	if *publicKey != "" {
+		pub, err := readPublicKey(*publicKey)
+		if err != nil {
+			return err
+		}
+		opts.PublicKey = pub
+	}
+
+	fileRequest, err := c.CreateRequest(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "link:\t%s\n", fileRequest.Link)
+	fmt.Fprintf(w, "request id:\t%s\n", fileRequest.RequestId)
+	fmt.Fprintf(w, "owner token:\t%s\n", fileRequest.OwnerToken)
+	return w.Flush()
+}
+
+func received(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 2 {
+		return errors.New("expected request id and owner token")
+	}
+
+	info, err := c.Request(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	state := fmt.Sprintf("%d of %d upload(s) left, expires %s", info.Remaining, info.MaxFiles, info.ExpiryDate.Local().Format(timeFormat))
+	if info.Closed {
+		state = "closed"
+	}
+	fmt.Printf("request %s: %s\n", info.RequestId, state)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE ID\tSIZE\tUPLOADED\tDOWNLOADS LEFT\tDOWNLOADED\tEXPIRES")
+	for _, f := range info.Files {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%s\n",
+			f.FileId, f.Size, f.UploadedAt.Local().Format(timeFormat), f.Count, f.Downloads,
+			f.ExpiryDate.Local().Format(timeFormat))
+	}
+	return w.Flush()
+}
+
+func closeRequest(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 2 {
+		return errors.New("expected request id and owner token")
+	}
+
+	if err := c.CloseRequest(ctx, args[0], args[1]); err != nil {
+		return err
+	}
+
+	fmt.Printf("closed %s\n", args[0])
+	return nil
+}
+
+// readPublicKey reads an RSA public key in PKIX PEM format, as written by
+// "openssl pkey -pubout"
+func readPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", path)
+	}
+	return rsaPub, nil
+}
+
+// readPrivateKey reads an RSA private key in PKCS #8 or PKCS #1 PEM format
+func readPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if priv, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return priv, nil
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rsaPriv, ok := priv.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", path)
+	}
+	return rsaPriv, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block, nil
+}
+
+// safeFilename strips directories and control characters from the name the
+// uploader chose, so it can't write outside the working directory.
+func safeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "download"
+	}
+	return name
+}
+
+// writeNewFile writes data to path, refusing to replace an existing file.
+func writeNewFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// writeFreeFile writes data to name, or to "name (n)" if it exists.
+func writeFreeFile(name string, data []byte) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	path := name
+	for i := 1; ; i++ {
+		err := writeNewFile(path, data)
+		if !errors.Is(err, fs.ErrExist) || i > 100 {
+			return path, err
+		}
+		path = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+func version() {
+	fmt.Printf("%s version: %s\ngo version: %s %s/%s\n", os.Args[0], Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -10,13 +10,18 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/lixmal/gdprshare/pkg/config"
 	"github.com/lixmal/gdprshare/pkg/database"
 	"github.com/lixmal/gdprshare/pkg/misc"
+	"github.com/lixmal/gdprshare/pkg/record"
 	"github.com/lixmal/gdprshare/pkg/server"
+	"github.com/lixmal/gdprshare/pkg/storage"
 )
 
 const (
@@ -48,6 +53,17 @@ func main() {
 		os.Exit(0)
 	}
 
+	switch flag.Arg(0) {
+	case "verify":
+		if err := verify(flag.Args()[1:]); err != nil {
+			log.Fatalf("Verification failed: %s", err)
+		}
+		os.Exit(0)
+	case "", "audit", "apikey", "admin":
+	default:
+		log.Fatalf("Unknown command %q", flag.Arg(0))
+	}
+
 	conf, err := config.New(*flagConfig)
 	if err != nil {
 		log.Fatalf("Failed to load config: %s", err)
@@ -58,8 +74,39 @@ func main() {
 		log.Fatalf("Creating database: %s", err)
 	}
 
+	if flag.Arg(0) == "audit" {
+		if err := audit(db, flag.Args()[1:]); err != nil {
+			log.Fatalf("Audit log: %s", err)
+		}
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "apikey" {
+		if err := apiKey(db, flag.Args()[1:]); err != nil {
+			log.Fatalf("API key: %s", err)
+		}
+		os.Exit(0)
+	}
+
+	store, err := storage.New(conf)
+	if err != nil {
+		log.Fatalf("Creating storage backend: %s", err)
+	}
+
+	if flag.Arg(0) == "admin" {
+		if err := admin(db, store, conf, flag.Args()[1:]); err != nil {
+			log.Fatalf("Admin: %s", err)
+		}
+		os.Exit(0)
+	}
+
 	if *flagCleanup {
-		if errors := misc.Cleanup(db, conf); len(errors) > 0 {
+		ran, errors := server.CleanupOnce(db, store, conf)
+		if !ran && len(errors) == 0 {
+			log.Println("Cleanup skipped: another instance holds the cleanup lease")
+			os.Exit(0)
+		}
+		if len(errors) > 0 {
 			log.Println("File cleanup errors:")
 			for _, err := range errors {
 				log.Printf("%s\n", err)
@@ -69,14 +116,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	if _, err := os.Stat(conf.StorePath); os.IsNotExist(err) {
-		// create files directory
-		if err = os.Mkdir(conf.StorePath, 0700); err != nil {
-			log.Fatalf("Failed to create file store path: %s\n", err)
-		}
-	}
-
-	srv := server.New(db, conf)
+	srv := server.New(db, store, conf)
 
 	go func() {
 		err := srv.Start()
@@ -99,6 +139,363 @@ func main() {
 	log.Println("Finished")
 }
 
+// verify checks the signature of a transfer record, with the public key given
+// or the one belonging to the configured signing key.
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyPath := flags.String("key", "", "PEM encoded Ed25519 public key, defaults to the configured signing key")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: gdprshare verify [-key public.pem] record.json")
+	}
+
+	if *keyPath == "" {
+		conf, err := config.New(*flagConfig)
+		if err != nil {
+			return fmt.Errorf("load config: %w", err)
+		}
+		if conf.Records.SigningKey == "" {
+			return errors.New("no key given and no signing key configured")
+		}
+		*keyPath = conf.Records.SigningKey
+	}
+
+	pub, err := record.LoadPublicKey(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	r, err := record.Verify(data, pub)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("valid record of file %s issued at %s, %d transfer(s)\n", r.FileId, r.IssuedAt.Format(time.RFC3339), len(r.Transfers))
+	return nil
+}
+
+// audit runs the audit log commands, currently only verifying the chain
+func audit(db *database.Database, args []string) error {
+	if len(args) != 1 || args[0] != "verify" {
+		return errors.New("usage: gdprshare audit verify")
+	}
+
+	count, head, err := db.VerifyAudit()
+	if err != nil {
+		return fmt.Errorf("%w (%d entries verified before)", err, count)
+	}
+
+	fmt.Printf("audit log intact, %d entries, last hash %s\n", count, head)
+	return nil
+}
+
+// apiKey creates, lists and revokes the API keys of machine senders
+func apiKey(db *database.Database, args []string) error {
+	const usage = "usage: gdprshare apikey create -name NAME [-scopes upload,delete,status,admin] [-expiry DAYS] [-rps N -burst N] [-quota-mib N] [-quota-files N] [-quota-uploads N] | list [-all] | revoke ID"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("apikey create", flag.ExitOnError)
+		name := flags.String("name", "", "name of the sending system, e.g. payroll")
+		scopes := flags.String("scopes", database.ScopeUpload, "comma separated: "+strings.Join(database.Scopes, ", "))
+		expiry := flags.Uint("expiry", 0, "days the key is valid, 0 for no expiry")
+		rps := flags.Float64("rps", 0, "requests per second, 0 for the configured rate limit")
+		burst := flags.Int("burst", 0, "maximum burst size, with -rps")
+		quotaBytes := flags.Int64("quota-mib", 0, "MiB stored, 0 for the configured quota")
+		quotaFiles := flags.Uint("quota-files", 0, "available files, 0 for the configured quota")
+		quotaUploads := flags.Uint("quota-uploads", 0, "uploads per day, 0 for the configured quota")
+		_ = flags.Parse(args[1:])
+
+		if *name == "" || flags.NArg() != 0 {
+			return errors.New(usage)
+		}
+
+		k := &database.APIKey{
+			Name:               *name,
+			Scopes:             strings.ReplaceAll(*scopes, " ", ""),
+			RateLimit:          *rps,
+			Burst:              *burst,
+			QuotaBytes:         *quotaBytes,
+			QuotaFiles:         *quotaFiles,
+			QuotaUploadsPerDay: *quotaUploads,
+		}
+		if *expiry > 0 {
+			expiresAt := time.Now().AddDate(0, 0, int(*expiry))
+			k.ExpiresAt = &expiresAt
+		}
+
+		key, err := db.CreateAPIKey(k)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		fmt.Fprintf(w, "key:\t%s\n", key)
+		fmt.Fprintf(w, "id:\t%d\n", k.ID)
+		fmt.Fprintf(w, "scopes:\t%s\n", k.Scopes)
+		if k.ExpiresAt != nil {
+			fmt.Fprintf(w, "expires:\t%s\n", k.ExpiresAt.Format(time.RFC3339))
+		}
+		fmt.Fprintln(w, "\nThe key is shown only once.")
+		return w.Flush()
+
+	case "list":
+		flags := flag.NewFlagSet("apikey list", flag.ExitOnError)
+		all := flags.Bool("all", false, "include revoked keys")
+		_ = flags.Parse(args[1:])
+
+		query := db.Order("id")
+		if *all {
+			query = query.Unscoped()
+		}
+		var keys []database.APIKey
+		if err := query.Find(&keys).Error; err != nil {
+			return fmt.Errorf("list API keys: %w", err)
+		}
+
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tKEY\tSCOPES\tRATE LIMIT\tQUOTA\tEXPIRES\tLAST USED\tSTATE")
+		for _, k := range keys {
+			rateLimit, quota, expires, lastUsed, state := "default", "default", "never", "never", "active"
+			if k.RateLimit > 0 {
+				rateLimit = fmt.Sprintf("%g/s burst %d", k.RateLimit, k.Burst)
+			}
+			var quotas []string
+			if k.QuotaBytes > 0 {
+				quotas = append(quotas, fmt.Sprintf("%d MiB", k.QuotaBytes))
+			}
+			if k.QuotaFiles > 0 {
+				quotas = append(quotas, fmt.Sprintf("%d files", k.QuotaFiles))
+			}
+			if k.QuotaUploadsPerDay > 0 {
+				quotas = append(quotas, fmt.Sprintf("%d/day", k.QuotaUploadsPerDay))
+			}
+			if len(quotas) > 0 {
+				quota = strings.Join(quotas, ", ")
+			}
+			if k.ExpiresAt != nil {
+				expires = k.ExpiresAt.Format(time.RFC3339)
+			}
+			if k.LastUsedAt != nil {
+				lastUsed = k.LastUsedAt.Format(time.RFC3339)
+			}
+			switch {
+			case k.DeletedAt != nil:
+				state = "revoked"
+			case k.Expired(now):
+				state = "expired"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s...\t%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Prefix, k.Scopes, rateLimit, quota, expires, lastUsed, state)
+		}
+		return w.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		id, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid id %q", args[1])
+		}
+		if err := db.RevokeAPIKey(uint(id)); err != nil {
+			return err
+		}
+		fmt.Printf("revoked API key %d\n", id)
+		return nil
+	}
+
+	return errors.New(usage)
+}
+
+// admin lists, inspects and force-deletes files and repairs orphans, like
+// the admin API
+func admin(db *database.Database, store storage.Backend, conf *config.Config, args []string) error {
+	const usage = "usage: gdprshare admin files [-state active|expired|exhausted|deleted] [-user ID] [-api-key ID] [-email ADDRESS] [-limit N] | inspect FILEID | delete FILEID | orphans [-repair]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	now := time.Now()
+	switch args[0] {
+	case "files":
+		flags := flag.NewFlagSet("admin files", flag.ExitOnError)
+		state := flags.String("state", "", "one of "+strings.Join(database.FileStates, ", ")+", all but deleted if empty")
+		userId := flags.Uint("user", 0, "id of the logged in sender")
+		apiKeyId := flags.Uint("api-key", 0, "id of the sender's API key")
+		email := flags.String("email", "", "address of the sender")
+		limit := flags.Int("limit", server.AdminListLimit, "maximum files listed, 0 for all")
+		_ = flags.Parse(args[1:])
+		if flags.NArg() != 0 {
+			return errors.New(usage)
+		}
+
+		files, err := db.ListFiles(database.FileFilter{
+			State:    *state,
+			UserId:   *userId,
+			APIKeyId: *apiKeyId,
+			Email:    *email,
+			Limit:    *limit,
+		}, now)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "FILE ID\tSTATE\tSIZE\tDOWNLOADS\tSENDER\tCREATED\tEXPIRES")
+		for i := range files {
+			f := &files[i]
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d/%d\t%s\t%s\t%s\n", f.FileId, f.State(now), f.Size, f.Downloads, f.Count, sender(f),
+				f.CreatedAt.Format(time.RFC3339), f.ExpiresAt().Format(time.RFC3339))
+		}
+		return w.Flush()
+
+	case "inspect":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		f, err := db.FindFile(args[1])
+		if err != nil {
+			return fmt.Errorf("find file %s: %w", args[1], err)
+		}
+		return inspectFile(f, store, now)
+
+	case "delete":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		var f database.StoredFile
+		if err := db.Where("file_id = ?", args[1]).First(&f).Error; err != nil {
+			return fmt.Errorf("find file %s: %w", args[1], err)
+		}
+		if errs := misc.ForceDeleteStoredFile(&f, db, store, conf); len(errs) > 0 {
+			return errors.Join(errs...)
+		}
+		err := db.AppendAudit(&database.AuditEntry{
+			Event:  database.AuditAdminDelete,
+			FileId: f.FileId,
+			Detail: "command line, " + f.DeletionMethod,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deleted file %s (%s)\n", f.FileId, f.DeletionMethod)
+		return nil
+
+	case "orphans":
+		flags := flag.NewFlagSet("admin orphans", flag.ExitOnError)
+		repair := flags.Bool("repair", false, "remove the orphaned blobs and delete the files without blob")
+		_ = flags.Parse(args[1:])
+		if flags.NArg() != 0 {
+			return errors.New(usage)
+		}
+
+		o, err := misc.FindOrphans(db, store, now)
+		if err != nil {
+			return err
+		}
+		for _, b := range o.Blobs {
+			fmt.Printf("blob without file: %s (%d bytes, %s)\n", b.Name, b.Size, b.ModTime.Format(time.RFC3339))
+		}
+		for _, f := range o.Files {
+			fmt.Printf("file without blob: %s (blob %s)\n", f.FileId, f.Name)
+		}
+		if !*repair {
+			fmt.Printf("%d orphaned blob(s), %d file(s) without blob\n", len(o.Blobs), len(o.Files))
+			return nil
+		}
+
+		if errs := misc.RepairOrphans(o, db, store, conf); len(errs) > 0 {
+			return errors.Join(errs...)
+		}
+		fmt.Printf("removed %d orphaned blob(s), deleted %d file(s) without blob\n", len(o.Blobs), len(o.Files))
+		return nil
+	}
+
+	return errors.New(usage)
+}
+
+// sender describes who uploaded f
+func sender(f *database.StoredFile) string {
+	var parts []string
+	if f.Email != "" {
+		parts = append(parts, f.Email)
+	}
+	if f.UserId != 0 {
+		parts = append(parts, fmt.Sprintf("user %d", f.UserId))
+	}
+	if f.APIKeyId != 0 {
+		parts = append(parts, fmt.Sprintf("api key %d", f.APIKeyId))
+	}
+	if f.FileRequestId != 0 {
+		parts = append(parts, fmt.Sprintf("request %d", f.FileRequestId))
+	}
+	if len(parts) == 0 {
+		return "anonymous"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// inspectFile prints the metadata and transfers of f
+func inspectFile(f *database.StoredFile, store storage.Backend, now time.Time) error {
+	blob := "removed"
+	if f.ContentDeletedAt == nil {
+		blob = "present"
+		if _, err := store.Stat(f.Name); err != nil {
+			blob = "missing: " + err.Error()
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "file id:\t%s\n", f.FileId)
+	fmt.Fprintf(w, "state:\t%s\n", f.State(now))
+	fmt.Fprintf(w, "sender:\t%s\n", sender(f))
+	if f.RecipientEmail != "" {
+		fmt.Fprintf(w, "recipient:\t%s\n", f.RecipientEmail)
+	}
+	fmt.Fprintf(w, "size:\t%d\n", f.Size)
+	fmt.Fprintf(w, "sha-256:\t%s\n", f.Hash)
+	fmt.Fprintf(w, "blob:\t%s (%s)\n", f.Name, blob)
+	fmt.Fprintf(w, "downloads:\t%d of %d\n", f.Downloads, f.Count)
+	fmt.Fprintf(w, "created:\t%s\n", f.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "expires:\t%s\n", f.ExpiresAt().Format(time.RFC3339))
+	if f.ContentDeletedAt != nil {
+		fmt.Fprintf(w, "content deleted:\t%s (%s)\n", f.ContentDeletedAt.Format(time.RFC3339), f.DeletionMethod)
+	}
+	if f.DeletedAt != nil {
+		fmt.Fprintf(w, "deleted:\t%s\n", f.DeletedAt.Format(time.RFC3339))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "EVENT\tTIME\tCOUNTRY\tCITY\tTLS\tDETAIL")
+	if src := f.SrcClient; src != nil {
+		fmt.Fprintf(w, "upload\t%s\t%s\t%s\t%s %s\t\n", src.CreatedAt.Format(time.RFC3339), src.Country, src.City, src.TLSVersion, src.TLSCipherSuite)
+	}
+	for _, dst := range f.DstClients {
+		fmt.Fprintf(w, "download\t%s\t%s\t%s\t%s %s\t\n", dst.CreatedAt.Format(time.RFC3339), dst.Country, dst.City, dst.TLSVersion, dst.TLSCipherSuite)
+	}
+	for _, denied := range f.DeniedClients {
+		fmt.Fprintf(w, "denied\t%s\t%s\t%s\t%s %s\t%s\n", denied.CreatedAt.Format(time.RFC3339), denied.Country, denied.City, denied.TLSVersion, denied.TLSCipherSuite, denied.Reason)
+	}
+	for _, req := range f.ApprovalRequests {
+		fmt.Fprintf(w, "approval\t%s\t%s\t%s\t%s %s\t%s\n", req.CreatedAt.Format(time.RFC3339), req.Country, req.City, req.TLSVersion, req.TLSCipherSuite, req.State)
+	}
+	return w.Flush()
+}
+
 func version() {
 	fmt.Printf("%s version: %s\ngo version: %s %s/%s\n", os.Args[0], Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
 }
@@ -0,0 +1,714 @@
+// Package client talks to a gdprshare server and encrypts in the same format
+// as the web client, so shares created here open in the browser and the
+// other way around.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	APIPrefix       = "/api/v1"
+	DownloadPrefix  = "/d/"
+	DownloadRetries = 3
+)
+
+// StoredFileInfo is the state of an owned file, see Client.Validate. Code is
+// set for files that are gone for a known reason, e.g. ErrCodeFileExpired.
+type StoredFileInfo struct {
+	ExpiryDate time.Time `json:"expiryDate"`
+	Count      uint      `json:"count"`
+	Error      string    `json:"error"`
+	Code       ErrorCode `json:"code"`
+}
+
+// FileStatus is the full state of an owned file, see Client.Status. Files
+// that are unknown, expired or not owned only carry a Code.
+type FileStatus struct {
+	Filename         string      `json:"filename"`
+	Type             string      `json:"type"`
+	Count            uint        `json:"count"`
+	ExpiryDate       time.Time   `json:"expiryDate"`
+	AvailableAt      time.Time   `json:"availableAt"`
+	AllowedCountries []string    `json:"allowedCountries"`
+	OnlyEEA          bool        `json:"onlyEEA"`
+	Approval         bool        `json:"approval"`
+	Pending          uint        `json:"pending"` // approval requests awaiting a decision
+	Downloads        uint        `json:"downloads"`
+	Denied           uint        `json:"denied"`
+	LastAccess       *FileAccess `json:"lastAccess"`
+	Error            string      `json:"error"`
+	Code             ErrorCode   `json:"code"`
+}
+
+// FileAccess is the latest download attempt of a file
+type FileAccess struct {
+	Time    time.Time `json:"time"`
+	Country string    `json:"country"`
+	City    string    `json:"city"`
+	Denied  bool      `json:"denied"`
+}
+
+// OwnedFile identifies a file by its id and the owner token returned on upload
+type OwnedFile struct {
+	FileId     string `json:"fileId"`
+	OwnerToken string `json:"ownerToken"`
+}
+
+// UploadOptions are the sharing settings of an upload, zero values leave the
+// server defaults
+type UploadOptions struct {
+	Type             string // file, text or image
+	Email            string
+	RecipientEmail   string // downloads need a code mailed to this address
+	Count            uint
+	Expiry           uint // days
+	ExpiryHours      uint // takes precedence over Expiry
+	Delay            uint // minutes
+	AllowedCountries []string
+	OnlyEEA          bool
+	IncludeOther     bool
+	Approval         bool // each download needs the owner's approval
+}
+
+// FileUpdate changes the sharing settings of an uploaded file, nil fields are
+// left as they are. Count is the number of downloads left.
+type FileUpdate struct {
+	Count            *uint
+	Expiry           *uint // days after upload
+	ExpiryHours      *uint // hours after upload, exclusive with Expiry
+	Delay            *uint // minutes after upload
+	AllowedCountries *[]string
+	OnlyEEA          *bool
+	IncludeOther     *bool
+	Approval         *bool
+}
+
+// Share is an uploaded file
+type Share struct {
+	FileId     string
+	OwnerToken string
+	Key        Key
+	// Link is the download link for the recipient, including the key
+	Link string
+}
+
+// Approval is a download attempt of a file that needs the owner's approval,
+// see Client.Approvals
+type Approval struct {
+	RequestId      string     `json:"requestId"`
+	State          string     `json:"state"` // pending, approved or denied
+	Time           time.Time  `json:"time"`
+	DecidedAt      *time.Time `json:"decidedAt"`
+	Used           bool       `json:"used"`
+	Addr           string     `json:"addr"`
+	UserAgent      string     `json:"userAgent"`
+	TLSVersion     string     `json:"tlsVersion"`
+	TLSCipherSuite string     `json:"tlsCipherSuite"`
+	Country        string     `json:"country"`
+	City           string     `json:"city"`
+}
+
+// Usage is what the API key or logged in user has stored, see Client.Usage.
+// Quota fields of 0 are unlimited.
+type Usage struct {
+	Files        uint  // available files
+	Bytes        int64 // size of available files and unfinished uploads
+	Uploads      uint  // uploads within the last 24 hours
+	QuotaFiles   uint
+	QuotaBytes   int64
+	QuotaUploads uint // per 24 hours
+}
+
+// File is the metadata of a downloaded file
+type File struct {
+	Filename  string
+	Type      string
+	Ephemeral uint // seconds an image is shown
+}
+
+var errNoKey = errors.New("no key: the file needs the key from its link or the private key of its file request")
+
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// ApprovalPending, if set, is called when a download waits for the
+	// owner's approval
+	ApprovalPending func(requestId string)
+	// Code, if set, is asked for the code the server mailed to the
+	// recipient of a file. Without it, such downloads fail with
+	// ErrCodeCodeRequired.
+	Code func(ctx context.Context) (string, error)
+	// PrivateKey unwraps the keys of files received through a file request
+	// with its public key, see Download
+	PrivateKey *rsa.PrivateKey
+	// APIKey, if set, is sent as Bearer token with every request. Files
+	// uploaded with it can be deleted and queried without owner token,
+	// depending on its scopes.
+	APIKey string
+}
+
+// New creates a client for the server at baseURL, e.g. https://share.example.com
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// ParseLink splits a download link into server, file id and key
+func ParseLink(link string) (baseURL, fileId string, key Key, err error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("invalid link: %w", err)
+	}
+
+	fileId = strings.TrimPrefix(u.Path, DownloadPrefix)
+	if u.Scheme == "" || u.Host == "" || fileId == u.Path || fileId == "" || u.Fragment == "" {
+		return "", "", nil, errors.New("invalid link: expected https://<server>/d/<file id>#<key>")
+	}
+
+	if key, err = ParseKey(u.Fragment); err != nil {
+		return "", "", nil, err
+	}
+
+	return u.Scheme + "://" + u.Host, fileId, key, nil
+}
+
+// Upload encrypts r and filename with a new key and uploads them
+func (c *Client) Upload(ctx context.Context, r io.Reader, filename string, opts UploadOptions) (*Share, error) {
+	key, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := [][2]string{
+		{"type", opts.Type},
+		{"email", opts.Email},
+		{"recipient-email", opts.RecipientEmail},
+		{"allowed-countries", strings.Join(opts.AllowedCountries, ",")},
+	}
+	if opts.Count > 0 {
+		fields = append(fields, [2]string{"count", strconv.FormatUint(uint64(opts.Count), 10)})
+	}
+	if opts.Expiry > 0 {
+		fields = append(fields, [2]string{"expiry", strconv.FormatUint(uint64(opts.Expiry), 10)})
+	}
+	if opts.ExpiryHours > 0 {
+		fields = append(fields, [2]string{"expiry-hours", strconv.FormatUint(uint64(opts.ExpiryHours), 10)})
+	}
+	if opts.Delay > 0 {
+		fields = append(fields, [2]string{"delay", strconv.FormatUint(uint64(opts.Delay), 10)})
+	}
+	if opts.OnlyEEA {
+		fields = append(fields, [2]string{"only-eea", "true"})
+	}
+	if opts.IncludeOther {
+		fields = append(fields, [2]string{"include-other", "true"})
+	}
+	if opts.Approval {
+		fields = append(fields, [2]string{"approval", "true"})
+	}
+
+	var result struct {
+		FileId     string `json:"fileId"`
+		OwnerToken string `json:"ownerToken"`
+	}
+	resp, err := c.postFile(ctx, "/files", r, filename, key, fields, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		location = DownloadPrefix + result.FileId
+	}
+
+	return &Share{
+		FileId:     result.FileId,
+		OwnerToken: result.OwnerToken,
+		Key:        key,
+		Link:       c.BaseURL + location + "#" + key.String(),
+	}, nil
+}
+
+// postFile encrypts r and filename with key and posts them with the non-empty
+// form fields. The JSON response is decoded into result.
+func (c *Client) postFile(ctx context.Context, path string, r io.Reader, filename string, key Key, fields [][2]string, result interface{}) (*http.Response, error) {
+	encName, err := Seal([]byte(filename), key)
+	if err != nil {
+		return nil, err
+	}
+	encFilename := base64.StdEncoding.EncodeToString(encName)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	fields = append(fields, [2]string{"filename", encFilename})
+	for _, field := range fields {
+		if field[1] == "" {
+			continue
+		}
+		if err := writer.WriteField(field[0], field[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	part, err := writer.CreateFormFile("file", encFilename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := Encrypt(part, r, key); err != nil {
+		return nil, fmt.Errorf("encrypt file: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return resp, nil
+}
+
+// Download fetches a file, decrypts it with key and writes it to w. An
+// interrupted transfer is resumed with its download token. Nothing is written
+// if decryption fails. The receipt isn't confirmed, see ConfirmReceipt.
+//
+// Files received through a file request with a public key are downloaded with
+// a nil key, it is unwrapped with the client's PrivateKey.
+func (c *Client) Download(ctx context.Context, fileId string, key Key, w io.Writer) (*File, error) {
+	// checked before the download counts
+	if key == nil && c.PrivateKey == nil {
+		return nil, errNoKey
+	}
+	path := "/files/" + url.PathEscape(fileId)
+
+	// approval and code of the recipient are sent with the retries
+	retry := http.Header{}
+	resp, err := c.get(ctx, path, retry)
+	if err == nil && resp.StatusCode == http.StatusAccepted {
+		requestId, aerr := c.awaitApproval(ctx, fileId, resp)
+		if aerr != nil {
+			return nil, aerr
+		}
+		retry.Set("X-Approval-Request", requestId)
+		resp, err = c.get(ctx, path, retry)
+	}
+	if errors.Is(err, ErrCodeCodeRequired) && c.Code != nil {
+		code, cerr := c.Code(ctx)
+		if cerr != nil {
+			return nil, fmt.Errorf("get code: %w", cerr)
+		}
+		retry.Set("X-Verification-Code", code)
+		resp, err = c.get(ctx, path, retry)
+	}
+	if err != nil {
+		return nil, err
+	}
+	header := resp.Header
+
+	if key == nil {
+		wrapped := header.Get("X-Wrapped-Key")
+		if wrapped == "" {
+			resp.Body.Close()
+			return nil, errNoKey
+		}
+		if key, err = UnwrapKey(c.PrivateKey, wrapped); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+
+	data := &bytes.Buffer{}
+	for retries := DownloadRetries; ; retries-- {
+		_, err = data.ReadFrom(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			break
+		}
+
+		token := header.Get("X-Download-Token")
+		if token == "" || retries < 1 || ctx.Err() != nil {
+			return nil, fmt.Errorf("read file: %w", err)
+		}
+
+		req, rerr := c.newRequest(ctx, http.MethodGet, path, nil)
+		if rerr != nil {
+			return nil, rerr
+		}
+		req.Header.Set("X-Download-Token", token)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", data.Len()))
+		if resp, rerr = c.do(req); rerr != nil {
+			return nil, fmt.Errorf("resume download after %s: %w", err, rerr)
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return nil, fmt.Errorf("resume download after %s: server ignored range", err)
+		}
+	}
+
+	file := &File{
+		Filename: fileId,
+		Type:     header.Get("X-Type"),
+	}
+	if ephemeral, err := strconv.ParseUint(header.Get("X-Ephemeral"), 10, 32); err == nil {
+		file.Ephemeral = uint(ephemeral)
+	}
+	// files uploaded without a name carry the server side name instead
+	if encName, err := base64.StdEncoding.DecodeString(header.Get("X-Filename")); err == nil {
+		if name, err := Open(encName, key); err == nil {
+			file.Filename = string(name)
+		}
+	}
+
+	if _, err := Decrypt(w, data, key); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// get requests path with the given headers
+func (c *Client) get(ctx context.Context, path string, header http.Header) (*http.Response, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name := range header {
+		req.Header.Set(name, header.Get(name))
+	}
+
+	return c.do(req)
+}
+
+// awaitApproval waits until the owner decided on a download that needs
+// approval and returns the request to retry it with, which fails if it was
+// denied
+func (c *Client) awaitApproval(ctx context.Context, fileId string, pending *http.Response) (string, error) {
+	var p struct {
+		RequestId string `json:"requestId"`
+	}
+	err := json.NewDecoder(pending.Body).Decode(&p)
+	pending.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("decode response: %w", err)
+	}
+	if c.ApprovalPending != nil {
+		c.ApprovalPending(p.RequestId)
+	}
+
+	path := "/files/" + url.PathEscape(fileId)
+	for state := "pending"; state == "pending"; {
+		req, err := c.newRequest(ctx, http.MethodGet, path+"/approvals/"+url.PathEscape(p.RequestId)+"?wait=30", nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return "", err
+		}
+
+		var approval Approval
+		err = json.NewDecoder(resp.Body).Decode(&approval)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("decode response: %w", err)
+		}
+		state = approval.State
+	}
+
+	return p.RequestId, nil
+}
+
+// ConfirmReceipt tells the sender the file arrived. After the last download
+// it also removes the remaining metadata.
+func (c *Client) ConfirmReceipt(ctx context.Context, fileId string) error {
+	req, err := c.newRequest(ctx, http.MethodPost, "/files/"+url.PathEscape(fileId), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Delete removes an uploaded file
+func (c *Client) Delete(ctx context.Context, fileId, ownerToken string) error {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if err := writer.WriteField("ownerToken", ownerToken); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodDelete, "/files/"+url.PathEscape(fileId), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Update changes the sharing settings of an owned file and returns its new
+// status
+func (c *Client) Update(ctx context.Context, fileId, ownerToken string, u FileUpdate) (*FileStatus, error) {
+	form := url.Values{}
+	form.Set("ownerToken", ownerToken)
+	for name, v := range map[string]*uint{"count": u.Count, "expiry": u.Expiry, "expiry-hours": u.ExpiryHours, "delay": u.Delay} {
+		if v != nil {
+			form.Set(name, strconv.FormatUint(uint64(*v), 10))
+		}
+	}
+	for name, v := range map[string]*bool{"only-eea": u.OnlyEEA, "include-other": u.IncludeOther, "approval": u.Approval} {
+		if v != nil {
+			form.Set(name, strconv.FormatBool(*v))
+		}
+	}
+	if u.AllowedCountries != nil {
+		form.Set("allowed-countries", strings.Join(*u.AllowedCountries, ","))
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPatch, "/files/"+url.PathEscape(fileId), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status FileStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &status, nil
+}
+
+// Approvals lists the approval requests of an owned file
+func (c *Client) Approvals(ctx context.Context, fileId, ownerToken string) ([]Approval, error) {
+	data, err := c.getOwned(ctx, fileId, ownerToken, "approvals")
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Approvals []Approval `json:"approvals"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return result.Approvals, nil
+}
+
+// Decide approves or denies a pending approval request of an owned file
+func (c *Client) Decide(ctx context.Context, fileId, ownerToken, requestId string, approve bool) (*Approval, error) {
+	form := url.Values{"ownerToken": {ownerToken}, "decision": {"deny"}}
+	if approve {
+		form.Set("decision", "approve")
+	}
+
+	path := "/files/" + url.PathEscape(fileId) + "/approvals/" + url.PathEscape(requestId)
+	req, err := c.newRequest(ctx, http.MethodPost, path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var approval Approval
+	if err := json.NewDecoder(resp.Body).Decode(&approval); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &approval, nil
+}
+
+// Record fetches the signed transfer record of an owned file, as JSON to be
+// checked with "gdprshare verify".
+func (c *Client) Record(ctx context.Context, fileId, ownerToken string) ([]byte, error) {
+	return c.getOwned(ctx, fileId, ownerToken, "record")
+}
+
+// Receipt fetches the transfer record of an owned file rendered as PDF
+func (c *Client) Receipt(ctx context.Context, fileId, ownerToken string) ([]byte, error) {
+	return c.getOwned(ctx, fileId, ownerToken, "receipt")
+}
+
+func (c *Client) getOwned(ctx context.Context, fileId, ownerToken, resource string) ([]byte, error) {
+	query := url.Values{"ownerToken": {ownerToken}}
+	req, err := c.newRequest(ctx, http.MethodGet, "/files/"+url.PathEscape(fileId)+"/"+resource+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// Validate returns the remaining downloads and expiry of owned files, keyed
+// by file id. Unknown files have a zero StoredFileInfo.
+func (c *Client) Validate(ctx context.Context, files ...OwnedFile) (map[string]StoredFileInfo, error) {
+	var result struct {
+		FileInfo map[string]StoredFileInfo `json:"fileInfo"`
+	}
+	if err := c.postOwned(ctx, "/files/validate", files, &result); err != nil {
+		return nil, err
+	}
+
+	return result.FileInfo, nil
+}
+
+// Status returns the full state of owned files, including download counts and
+// the latest access, keyed by file id.
+func (c *Client) Status(ctx context.Context, files ...OwnedFile) (map[string]FileStatus, error) {
+	var result struct {
+		Files map[string]FileStatus `json:"files"`
+	}
+	if err := c.postOwned(ctx, "/files/status", files, &result); err != nil {
+		return nil, err
+	}
+
+	return result.Files, nil
+}
+
+// Usage returns the usage and quota of the client's API key
+func (c *Client) Usage(ctx context.Context) (*Usage, error) {
+	resp, err := c.get(ctx, "/usage", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Usage struct {
+			Files   uint  `json:"files"`
+			Bytes   int64 `json:"bytes"`
+			Uploads uint  `json:"uploads"`
+		} `json:"usage"`
+		Quota struct {
+			Bytes         int64 `json:"bytes"`
+			Files         uint  `json:"files"`
+			UploadsPerDay uint  `json:"uploadsPerDay"`
+		} `json:"quota"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	return &Usage{
+		Files:        result.Usage.Files,
+		Bytes:        result.Usage.Bytes,
+		Uploads:      result.Usage.Uploads,
+		QuotaFiles:   result.Quota.Files,
+		QuotaBytes:   result.Quota.Bytes,
+		QuotaUploads: result.Quota.UploadsPerDay,
+	}, nil
+}
+
+func (c *Client) postOwned(ctx context.Context, path string, files []OwnedFile, result interface{}) error {
+	body, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+APIPrefix+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	return req, nil
+}
+
+// do sends the request and turns error responses into an *Error
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+
+		e := &Error{StatusCode: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil {
+			e.Code, e.Message = "", ""
+		}
+		return nil, e
+	}
+
+	return resp, nil
+}
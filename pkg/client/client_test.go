@@ -0,0 +1,341 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/client"
+	"github.com/lixmal/gdprshare/pkg/config"
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/server"
+	"github.com/lixmal/gdprshare/pkg/storage"
+)
+
+func setupTestServer(t *testing.T) *client.Client {
+	t.Helper()
+
+	c, _ := setupTestServerDB(t)
+	return c
+}
+
+func setupTestServerDB(t *testing.T) (*client.Client, *database.Database) {
+	t.Helper()
+
+	conf := config.Default()
+	conf.Database.Driver = "sqlite3"
+	conf.Database.Args = ":memory:"
+	conf.StorePath = t.TempDir()
+	conf.MaxUploadSize = 10
+	conf.IDLength = 20
+	conf.Download.ResumeWindow = 10
+	conf.Approval.Wait = 5
+	conf.Approval.MaxRequests = 5
+
+	db, err := database.New(conf)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	srv := httptest.NewServer(server.New(db, storage.NewLocal(conf.StorePath), conf).Handler)
+	t.Cleanup(srv.Close)
+
+	return client.New(srv.URL), db
+}
+
+func TestClientFlow(t *testing.T) {
+	c := setupTestServer(t)
+	ctx := context.Background()
+
+	share, err := c.Upload(ctx, strings.NewReader("client content"), "report.txt", client.UploadOptions{
+		Count:  2,
+		Expiry: 3,
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, share.FileId)
+	require.NotEmpty(t, share.OwnerToken)
+
+	baseURL, fileId, key, err := client.ParseLink(share.Link)
+	require.NoError(t, err)
+	assert.Equal(t, c.BaseURL, baseURL)
+	assert.Equal(t, share.FileId, fileId)
+	assert.Equal(t, share.Key, key)
+
+	infos, err := c.Validate(ctx, client.OwnedFile{FileId: share.FileId, OwnerToken: share.OwnerToken})
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), infos[share.FileId].Count)
+
+	out := &bytes.Buffer{}
+	file, err := c.Download(ctx, fileId, key, out)
+	require.NoError(t, err)
+	assert.Equal(t, "client content", out.String())
+	assert.Equal(t, "report.txt", file.Filename)
+	assert.Equal(t, "file", file.Type)
+	require.NoError(t, c.ConfirmReceipt(ctx, fileId))
+
+	statuses, err := c.Status(ctx, client.OwnedFile{FileId: fileId, OwnerToken: share.OwnerToken})
+	require.NoError(t, err)
+	status := statuses[fileId]
+	assert.Equal(t, uint(1), status.Count)
+	assert.Equal(t, uint(1), status.Downloads)
+	require.NotNil(t, status.LastAccess)
+	assert.False(t, status.LastAccess.Denied)
+
+	hours := uint(48)
+	updated, err := c.Update(ctx, fileId, share.OwnerToken, client.FileUpdate{ExpiryHours: &hours})
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(48*time.Hour), updated.ExpiryDate, time.Minute)
+	assert.Equal(t, uint(1), updated.Count)
+
+	// the server only ever sees ciphertext
+	other, err := client.NewKey()
+	require.NoError(t, err)
+	out.Reset()
+	_, err = c.Download(ctx, fileId, other, out)
+	assert.ErrorIs(t, err, client.ErrDecryption)
+	assert.Zero(t, out.Len())
+
+	_, err = c.Download(ctx, fileId, key, out)
+	assert.ErrorIs(t, err, client.ErrCodeCountExpired)
+
+	err = c.Delete(ctx, fileId, "wrongtoken")
+	assert.ErrorIs(t, err, client.ErrCodeOwnerTokenMismatch)
+	var apiErr *client.Error
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, 401, apiErr.StatusCode)
+
+	require.NoError(t, c.Delete(ctx, fileId, share.OwnerToken))
+
+	// no signing key configured
+	_, err = c.Record(ctx, fileId, share.OwnerToken)
+	assert.ErrorIs(t, err, client.ErrCodeRecordUnavailable)
+
+	receipt, err := c.Receipt(ctx, fileId, share.OwnerToken)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(receipt, []byte("%PDF-")))
+}
+
+func TestClientApproval(t *testing.T) {
+	c := setupTestServer(t)
+	ctx := context.Background()
+
+	share, err := c.Upload(ctx, strings.NewReader("approved content"), "secret.txt", client.UploadOptions{
+		Count:    2,
+		Approval: true,
+	})
+	require.NoError(t, err)
+	_, fileId, key, err := client.ParseLink(share.Link)
+	require.NoError(t, err)
+
+	decide := func(approve bool) func(string) {
+		return func(requestId string) {
+			go func() {
+				_, err := c.Decide(ctx, fileId, share.OwnerToken, requestId, approve)
+				assert.NoError(t, err)
+			}()
+		}
+	}
+
+	c.ApprovalPending = decide(true)
+	out := &bytes.Buffer{}
+	_, err = c.Download(ctx, fileId, key, out)
+	require.NoError(t, err)
+	assert.Equal(t, "approved content", out.String())
+
+	c.ApprovalPending = decide(false)
+	_, err = c.Download(ctx, fileId, key, out)
+	assert.ErrorIs(t, err, client.ErrCodeApprovalDenied)
+
+	approvals, err := c.Approvals(ctx, fileId, share.OwnerToken)
+	require.NoError(t, err)
+	require.Len(t, approvals, 2)
+	assert.Equal(t, "approved", approvals[0].State)
+	assert.True(t, approvals[0].Used)
+	assert.Equal(t, "denied", approvals[1].State)
+}
+
+func TestClientRequest(t *testing.T) {
+	c := setupTestServer(t)
+	ctx := context.Background()
+
+	fileRequest, err := c.CreateRequest(ctx, client.RequestOptions{MaxFiles: 2, Message: "Your documents, please"})
+	require.NoError(t, err)
+
+	// the uploader only has the link
+	baseURL, requestId, key, err := client.ParseRequestLink(fileRequest.Link)
+	require.NoError(t, err)
+	assert.Equal(t, c.BaseURL, baseURL)
+	assert.Equal(t, fileRequest.Key, key)
+
+	info, err := c.Request(ctx, requestId, "")
+	require.NoError(t, err)
+	assert.Equal(t, "Your documents, please", info.Message)
+	assert.Equal(t, uint(2), info.Remaining)
+
+	fileId, err := c.UploadToRequest(ctx, requestId, key, strings.NewReader("passport scan"), "passport.pdf")
+	require.NoError(t, err)
+
+	info, err = c.Request(ctx, requestId, fileRequest.OwnerToken)
+	require.NoError(t, err)
+	require.Len(t, info.Files, 1)
+	assert.Equal(t, fileId, info.Files[0].FileId)
+
+	out := &bytes.Buffer{}
+	file, err := c.Download(ctx, fileId, fileRequest.Key, out)
+	require.NoError(t, err)
+	assert.Equal(t, "passport scan", out.String())
+	assert.Equal(t, "passport.pdf", file.Filename)
+
+	require.NoError(t, c.CloseRequest(ctx, requestId, fileRequest.OwnerToken))
+	_, err = c.UploadToRequest(ctx, requestId, key, strings.NewReader("late"), "late.txt")
+	assert.ErrorIs(t, err, client.ErrCodeRequestExpired)
+
+	t.Run("public key", func(t *testing.T) {
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+
+		keyRequest, err := c.CreateRequest(ctx, client.RequestOptions{PublicKey: &priv.PublicKey})
+		require.NoError(t, err)
+		assert.Nil(t, keyRequest.Key)
+
+		_, requestId, key, err := client.ParseRequestLink(keyRequest.Link)
+		require.NoError(t, err)
+		assert.Nil(t, key)
+
+		fileId, err := c.UploadToRequest(ctx, requestId, nil, strings.NewReader("tax return"), "tax.pdf")
+		require.NoError(t, err)
+
+		_, err = c.Download(ctx, fileId, nil, out)
+		assert.Error(t, err, "private key missing")
+
+		c.PrivateKey = priv
+		defer func() { c.PrivateKey = nil }()
+		out := &bytes.Buffer{}
+		file, err := c.Download(ctx, fileId, nil, out)
+		require.NoError(t, err)
+		assert.Equal(t, "tax return", out.String())
+		assert.Equal(t, "tax.pdf", file.Filename)
+	})
+}
+
+func TestClientAPIKey(t *testing.T) {
+	c, db := setupTestServerDB(t)
+	ctx := context.Background()
+
+	key, err := db.CreateAPIKey(&database.APIKey{Name: "payroll", Scopes: "upload,delete,status", QuotaFiles: 5})
+	require.NoError(t, err)
+
+	c.APIKey = database.APIKeyPrefix + "unknown"
+	_, err = c.Upload(ctx, strings.NewReader("payslip"), "payslip.pdf", client.UploadOptions{})
+	assert.ErrorIs(t, err, client.ErrCodeAPIKeyInvalid)
+
+	c.APIKey = key
+	share, err := c.Upload(ctx, strings.NewReader("payslip"), "payslip.pdf", client.UploadOptions{})
+	require.NoError(t, err)
+
+	var storedFile database.StoredFile
+	require.NoError(t, db.Where("file_id = ?", share.FileId).First(&storedFile).Error)
+	assert.NotZero(t, storedFile.APIKeyId)
+
+	usage, err := c.Usage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), usage.Files)
+	assert.Equal(t, storedFile.Size, usage.Bytes)
+	assert.Equal(t, uint(5), usage.QuotaFiles)
+	assert.Zero(t, usage.QuotaBytes)
+
+	// the key stands in for the owner token
+	require.NoError(t, c.Delete(ctx, share.FileId, ""))
+}
+
+func TestClientContext(t *testing.T) {
+	c := setupTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := c.Upload(ctx, strings.NewReader("content"), "canceled.txt", client.UploadOptions{})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// TestErrorCodesMatchServer keeps the client's codes in step with the server
+func TestErrorCodesMatchServer(t *testing.T) {
+	pairs := map[client.ErrorCode]server.ErrorCode{
+		client.ErrCodeInvalidUpload:      server.ErrCodeInvalidUpload,
+		client.ErrCodeTempFilename:       server.ErrCodeTempFilename,
+		client.ErrCodeFileIDFailed:       server.ErrCodeFileIDFailed,
+		client.ErrCodeOwnerTokenFailed:   server.ErrCodeOwnerTokenFailed,
+		client.ErrCodeTransactionStart:   server.ErrCodeTransactionStart,
+		client.ErrCodeStoreFailed:        server.ErrCodeStoreFailed,
+		client.ErrCodeSaveFailed:         server.ErrCodeSaveFailed,
+		client.ErrCodeUploadNotFound:     server.ErrCodeUploadNotFound,
+		client.ErrCodeInvalidChunk:       server.ErrCodeInvalidChunk,
+		client.ErrCodeChunkTooLarge:      server.ErrCodeChunkTooLarge,
+		client.ErrCodeUploadTooLarge:     server.ErrCodeUploadTooLarge,
+		client.ErrCodeUploadIncomplete:   server.ErrCodeUploadIncomplete,
+		client.ErrCodeUploadFinalizing:   server.ErrCodeUploadFinalizing,
+		client.ErrCodeChunkInProgress:    server.ErrCodeChunkInProgress,
+		client.ErrCodeInvalidFileID:      server.ErrCodeInvalidFileID,
+		client.ErrCodeCountExpired:       server.ErrCodeCountExpired,
+		client.ErrCodeFileNotFound:       server.ErrCodeFileNotFound,
+		client.ErrCodeNotYetDownloadble:  server.ErrCodeNotYetDownloadble,
+		client.ErrCodeLocationForbidden:  server.ErrCodeLocationForbidden,
+		client.ErrCodeFileGone:           server.ErrCodeFileGone,
+		client.ErrCodeRetrievalFailed:    server.ErrCodeRetrievalFailed,
+		client.ErrCodeDownloadActive:     server.ErrCodeDownloadActive,
+		client.ErrCodeDownloadToken:      server.ErrCodeDownloadToken,
+		client.ErrCodeFileExpired:        server.ErrCodeFileExpired,
+		client.ErrCodeApprovalPending:    server.ErrCodeApprovalPending,
+		client.ErrCodeApprovalDenied:     server.ErrCodeApprovalDenied,
+		client.ErrCodeApprovalInvalid:    server.ErrCodeApprovalInvalid,
+		client.ErrCodeApprovalDecided:    server.ErrCodeApprovalDecided,
+		client.ErrCodeApprovalLimit:      server.ErrCodeApprovalLimit,
+		client.ErrCodeCodeRequired:       server.ErrCodeCodeRequired,
+		client.ErrCodeCodeInvalid:        server.ErrCodeCodeInvalid,
+		client.ErrCodeCodeLimit:          server.ErrCodeCodeLimit,
+		client.ErrCodeRequestNotFound:    server.ErrCodeRequestNotFound,
+		client.ErrCodeRequestExpired:     server.ErrCodeRequestExpired,
+		client.ErrCodeRequestFull:        server.ErrCodeRequestFull,
+		client.ErrCodeLoginRequired:      server.ErrCodeLoginRequired,
+		client.ErrCodeLoginFailed:        server.ErrCodeLoginFailed,
+		client.ErrCodeLoginForbidden:     server.ErrCodeLoginForbidden,
+		client.ErrCodeAPIKeyInvalid:      server.ErrCodeAPIKeyInvalid,
+		client.ErrCodeAPIKeyScope:        server.ErrCodeAPIKeyScope,
+		client.ErrCodeQuotaBytes:         server.ErrCodeQuotaBytes,
+		client.ErrCodeQuotaFiles:         server.ErrCodeQuotaFiles,
+		client.ErrCodeQuotaUploads:       server.ErrCodeQuotaUploads,
+		client.ErrCodeStorageFull:        server.ErrCodeStorageFull,
+		client.ErrCodeRecordUnavailable:  server.ErrCodeRecordUnavailable,
+		client.ErrCodeOwnerTokenMismatch: server.ErrCodeOwnerTokenMismatch,
+		client.ErrCodeDeleteFailed:       server.ErrCodeDeleteFailed,
+		client.ErrCodeTLSRequirements:    server.ErrCodeTLSRequirements,
+		client.ErrCodeRateLimited:        server.ErrCodeRateLimited,
+		client.ErrCodeInvalidRequest:     server.ErrCodeInvalidRequest,
+		client.ErrCodeStatsFailed:        server.ErrCodeStatsFailed,
+	}
+
+	for c, s := range pairs {
+		assert.Equal(t, string(s), string(c))
+	}
+}
+
+func TestParseLink(t *testing.T) {
+	_, _, _, err := client.ParseLink("https://share.example.com/d/abc")
+	assert.Error(t, err, "key missing")
+
+	_, _, _, err = client.ParseLink("https://share.example.com/other/abc#BwcH")
+	assert.Error(t, err)
+
+	baseURL, fileId, _, err := client.ParseLink("https://share.example.com:8443/d/abc#BwcH")
+	require.NoError(t, err)
+	assert.Equal(t, "https://share.example.com:8443", baseURL)
+	assert.Equal(t, "abc", fileId)
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The browser format: one AES-GCM message with a random 96 bit IV prepended
+// to the ciphertext and tag. The key travels base64url encoded, without
+// padding, in the fragment of the download link.
+const (
+	KeyLength = 32
+	IVLength  = 12
+)
+
+// ErrDecryption is returned for a wrong key or tampered ciphertext
+var ErrDecryption = errors.New("decryption failed: wrong key or corrupted data")
+
+// Key is a raw AES key
+type Key []byte
+
+// NewKey generates a random key of the length the web client uses
+func NewKey() (Key, error) {
+	key := make(Key, KeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	return key, nil
+}
+
+// ParseKey decodes a key from the fragment of a download link
+func ParseKey(b64 string) (Key, error) {
+	key, err := base64.RawURLEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	return Key(key), nil
+}
+
+// String encodes the key for the fragment of a download link
+func (k Key) String() string {
+	return base64.RawURLEncoding.EncodeToString(k)
+}
+
+// Seal encrypts clearText into the browser format
+func Seal(clearText []byte, key Key) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, IVLength, IVLength+len(clearText)+gcm.Overhead())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("generate iv: %w", err)
+	}
+
+	return gcm.Seal(iv, iv, clearText, nil), nil
+}
+
+// Open decrypts data in the browser format
+func Open(data []byte, key Key) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < IVLength+gcm.Overhead() {
+		return nil, ErrDecryption
+	}
+
+	clearText, err := gcm.Open(nil, data[:IVLength], data[IVLength:], nil)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+
+	return clearText, nil
+}
+
+// Encrypt reads r to the end and writes it encrypted to w. The browser format
+// is a single GCM message, so the content is held in memory.
+func Encrypt(w io.Writer, r io.Reader, key Key) (int64, error) {
+	clearText, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := Seal(clearText, key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// Decrypt reads r to the end and writes the decrypted content to w. Nothing
+// is written unless the whole message authenticates.
+func Decrypt(w io.Writer, r io.Reader, key Key) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	clearText, err := Open(data, key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(clearText)
+	return int64(n), err
+}
+
+// EncodePublicKey encodes the public key of a file request the way the server
+// takes it, as base64 DER
+func EncodePublicKey(pub *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// ParsePublicKey decodes the public key of a file request
+func ParsePublicKey(b64 string) (*rsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("invalid public key: not an RSA key")
+	}
+	return rsaPub, nil
+}
+
+// WrapKey encrypts a key for the public key of a file request with RSA-OAEP
+// and SHA-256, as the web client does
+func WrapKey(pub *rsa.PublicKey, key Key) (string, error) {
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return "", fmt.Errorf("wrap key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+// UnwrapKey decrypts a key wrapped with WrapKey
+func UnwrapKey(priv *rsa.PrivateKey, wrapped string) (Key, error) {
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, data, nil)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return Key(key), nil
+}
+
+func newGCM(key Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
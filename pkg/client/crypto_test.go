@@ -0,0 +1,48 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOpenWebCiphertext decrypts the output of the web client's encrypt for a
+// fixed key and IV
+func TestOpenWebCiphertext(t *testing.T) {
+	key, err := ParseKey("BwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwc")
+	require.NoError(t, err)
+	assert.Equal(t, "BwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwc", key.String())
+
+	data, err := base64.StdEncoding.DecodeString("AQEBAQEBAQEBAQEBEYX5xePXjXy0xReuDlORIGRoLN3HSkigLQ==")
+	require.NoError(t, err)
+
+	clearText, err := Open(data, key)
+	require.NoError(t, err)
+	assert.Equal(t, "gdprshare", string(clearText))
+}
+
+func TestEncryptDecryptStream(t *testing.T) {
+	key, err := NewKey()
+	require.NoError(t, err)
+
+	encrypted := &bytes.Buffer{}
+	_, err = Encrypt(encrypted, strings.NewReader("round trip"), key)
+	require.NoError(t, err)
+	assert.Equal(t, IVLength+len("round trip")+16, encrypted.Len())
+
+	decrypted := &bytes.Buffer{}
+	_, err = Decrypt(decrypted, bytes.NewReader(encrypted.Bytes()), key)
+	require.NoError(t, err)
+	assert.Equal(t, "round trip", decrypted.String())
+
+	other, err := NewKey()
+	require.NoError(t, err)
+	decrypted.Reset()
+	_, err = Decrypt(decrypted, bytes.NewReader(encrypted.Bytes()), other)
+	assert.ErrorIs(t, err, ErrDecryption)
+	assert.Zero(t, decrypted.Len())
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"fmt"
+)
+
+// ErrorCode mirrors the stable error codes of the server. It implements error,
+// so API errors can be matched with errors.Is(err, client.ErrCodeCountExpired).
+type ErrorCode string
+
+const (
+	// upload
+	ErrCodeInvalidUpload    ErrorCode = "invalid_upload"
+	ErrCodeTempFilename     ErrorCode = "temp_filename_failed"
+	ErrCodeFileIDFailed     ErrorCode = "file_id_failed"
+	ErrCodeOwnerTokenFailed ErrorCode = "owner_token_failed"
+	ErrCodeTransactionStart ErrorCode = "transaction_start_failed"
+	ErrCodeStoreFailed      ErrorCode = "store_failed"
+	ErrCodeSaveFailed       ErrorCode = "save_failed"
+
+	// resumable upload
+	ErrCodeUploadNotFound   ErrorCode = "upload_not_found"
+	ErrCodeInvalidChunk     ErrorCode = "invalid_chunk"
+	ErrCodeChunkTooLarge    ErrorCode = "chunk_too_large"
+	ErrCodeUploadTooLarge   ErrorCode = "upload_too_large"
+	ErrCodeUploadIncomplete ErrorCode = "upload_incomplete"
+	ErrCodeUploadFinalizing ErrorCode = "upload_finalizing"
+	ErrCodeChunkInProgress  ErrorCode = "chunk_in_progress"
+
+	// download
+	ErrCodeInvalidFileID     ErrorCode = "invalid_file_id"
+	ErrCodeCountExpired      ErrorCode = "download_count_expired"
+	ErrCodeFileNotFound      ErrorCode = "file_not_found"
+	ErrCodeNotYetDownloadble ErrorCode = "file_not_yet_downloadable"
+	ErrCodeLocationForbidden ErrorCode = "download_location_forbidden"
+	ErrCodeFileGone          ErrorCode = "file_not_found_or_limit_exceeded"
+	ErrCodeRetrievalFailed   ErrorCode = "file_retrieval_failed"
+	ErrCodeDownloadActive    ErrorCode = "download_in_progress"
+	ErrCodeDownloadToken     ErrorCode = "download_token_invalid"
+	ErrCodeFileExpired       ErrorCode = "file_expired"
+
+	// download approval
+	ErrCodeApprovalPending ErrorCode = "approval_pending"
+	ErrCodeApprovalDenied  ErrorCode = "approval_denied"
+	ErrCodeApprovalInvalid ErrorCode = "approval_invalid"
+	ErrCodeApprovalDecided ErrorCode = "approval_decided"
+	ErrCodeApprovalLimit   ErrorCode = "approval_limit"
+
+	// recipient verification
+	ErrCodeCodeRequired ErrorCode = "verification_required"
+	ErrCodeCodeInvalid  ErrorCode = "verification_invalid"
+	ErrCodeCodeLimit    ErrorCode = "verification_limit"
+
+	// file requests
+	ErrCodeRequestNotFound ErrorCode = "request_not_found"
+	ErrCodeRequestExpired  ErrorCode = "request_expired"
+	ErrCodeRequestFull     ErrorCode = "request_full"
+
+	// sender login
+	ErrCodeLoginRequired  ErrorCode = "login_required"
+	ErrCodeLoginFailed    ErrorCode = "login_failed"
+	ErrCodeLoginForbidden ErrorCode = "login_forbidden"
+
+	// API keys
+	ErrCodeAPIKeyInvalid ErrorCode = "api_key_invalid"
+	ErrCodeAPIKeyScope   ErrorCode = "api_key_scope"
+
+	// quotas
+	ErrCodeQuotaBytes   ErrorCode = "quota_bytes_exceeded"
+	ErrCodeQuotaFiles   ErrorCode = "quota_files_exceeded"
+	ErrCodeQuotaUploads ErrorCode = "quota_uploads_exceeded"
+	ErrCodeStorageFull  ErrorCode = "storage_full"
+
+	// transfer records
+	ErrCodeRecordUnavailable ErrorCode = "record_unavailable"
+
+	// deletion
+	ErrCodeOwnerTokenMismatch ErrorCode = "owner_token_mismatch"
+	ErrCodeDeleteFailed       ErrorCode = "file_deletion_failed"
+
+	// shared
+	ErrCodeTLSRequirements ErrorCode = "tls_requirements_not_met"
+	ErrCodeRateLimited     ErrorCode = "rate_limit_exceeded"
+	ErrCodeInvalidRequest  ErrorCode = "invalid_request"
+	ErrCodeStatsFailed     ErrorCode = "stats_store_failed"
+)
+
+func (c ErrorCode) Error() string {
+	return string(c)
+}
+
+// Error is an error response of the server. Code is empty if the response
+// carried none, e.g. from a proxy in front of the server.
+type Error struct {
+	StatusCode int       `json:"-"`
+	Code       ErrorCode `json:"code"`
+	Message    string    `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("server responded with %d", e.StatusCode)
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// Is matches the ErrorCode of the response
+func (e *Error) Is(target error) bool {
+	code, ok := target.(ErrorCode)
+	return ok && code == e.Code
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const RequestPrefix = "/r/"
+
+// RequestOptions are the settings of a file request, zero values leave the
+// server defaults
+type RequestOptions struct {
+	Email       string // notified of each upload
+	Message     string // shown to the uploader
+	Expiry      uint   // days
+	ExpiryHours uint   // takes precedence over Expiry
+	MaxFiles    uint
+	MaxSize     int64 // MiB per file
+	// PublicKey, if set, is what uploaded files are encrypted for, instead
+	// of a key in the link. Download them with the matching
+	// Client.PrivateKey.
+	PublicKey *rsa.PublicKey
+}
+
+// FileRequest is a created file request
+type FileRequest struct {
+	RequestId  string
+	OwnerToken string
+	Key        Key // nil for requests with a public key
+	// Link is the upload link for the uploader, including the key
+	Link string
+}
+
+// FileRequestInfo is the state of a file request, see Client.Request. Email
+// and Files are only set for the requester.
+type FileRequestInfo struct {
+	RequestId  string        `json:"requestId"`
+	Message    string        `json:"message"`
+	ExpiryDate time.Time     `json:"expiryDate"`
+	MaxFiles   uint          `json:"maxFiles"`
+	Remaining  uint          `json:"remaining"`
+	MaxSize    int64         `json:"maxSize"` // bytes per file
+	PublicKey  string        `json:"publicKey"`
+	Closed     bool          `json:"closed"`
+	Email      string        `json:"email"`
+	Files      []RequestFile `json:"files"`
+}
+
+// RequestFile is a file received through a file request. Its owner token is
+// the one of the request.
+type RequestFile struct {
+	FileId     string    `json:"fileId"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploadedAt"`
+	ExpiryDate time.Time `json:"expiryDate"`
+	Count      uint      `json:"count"`
+	Downloads  uint      `json:"downloads"`
+	WrappedKey string    `json:"wrappedKey"`
+}
+
+// ParseRequestLink splits an upload link into server, request id and key. The
+// key is nil for requests with a public key.
+func ParseRequestLink(link string) (baseURL, requestId string, key Key, err error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("invalid link: %w", err)
+	}
+
+	requestId = strings.TrimPrefix(u.Path, RequestPrefix)
+	if u.Scheme == "" || u.Host == "" || requestId == u.Path || requestId == "" {
+		return "", "", nil, errors.New("invalid link: expected https://<server>/r/<request id>[#<key>]")
+	}
+
+	if u.Fragment != "" {
+		if key, err = ParseKey(u.Fragment); err != nil {
+			return "", "", nil, err
+		}
+	}
+
+	return u.Scheme + "://" + u.Host, requestId, key, nil
+}
+
+// CreateRequest creates a file request. Without a public key the files are
+// encrypted with a new key that is part of the link.
+func (c *Client) CreateRequest(ctx context.Context, opts RequestOptions) (*FileRequest, error) {
+	form := url.Values{}
+	for name, v := range map[string]string{"email": opts.Email, "message": opts.Message} {
+		if v != "" {
+			form.Set(name, v)
+		}
+	}
+	for name, v := range map[string]uint{"expiry": opts.Expiry, "expiry-hours": opts.ExpiryHours, "max-files": opts.MaxFiles} {
+		if v > 0 {
+			form.Set(name, strconv.FormatUint(uint64(v), 10))
+		}
+	}
+	if opts.MaxSize > 0 {
+		form.Set("max-size", strconv.FormatInt(opts.MaxSize, 10))
+	}
+
+	var key Key
+	if opts.PublicKey != nil {
+		publicKey, err := EncodePublicKey(opts.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		form.Set("public-key", publicKey)
+	} else {
+		var err error
+		if key, err = NewKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, "/requests", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		RequestId  string `json:"requestId"`
+		OwnerToken string `json:"ownerToken"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		location = RequestPrefix + result.RequestId
+	}
+	link := c.BaseURL + location
+	if key != nil {
+		link += "#" + key.String()
+	}
+
+	return &FileRequest{
+		RequestId:  result.RequestId,
+		OwnerToken: result.OwnerToken,
+		Key:        key,
+		Link:       link,
+	}, nil
+}
+
+// Request returns the state of a file request. With the owner token it
+// includes the received files.
+func (c *Client) Request(ctx context.Context, requestId, ownerToken string) (*FileRequestInfo, error) {
+	path := "/requests/" + url.PathEscape(requestId)
+	if ownerToken != "" {
+		path += "?" + url.Values{"ownerToken": {ownerToken}}.Encode()
+	}
+
+	resp, err := c.get(ctx, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var info FileRequestInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &info, nil
+}
+
+// UploadToRequest encrypts r and filename and uploads them into a file
+// request. key is the one from the link, for requests with a public key it is
+// nil and a new key is wrapped for it. Returns the id of the received file.
+func (c *Client) UploadToRequest(ctx context.Context, requestId string, key Key, r io.Reader, filename string) (string, error) {
+	fields := [][2]string{{"type", "file"}}
+
+	if key == nil {
+		info, err := c.Request(ctx, requestId, "")
+		if err != nil {
+			return "", err
+		}
+		if info.PublicKey == "" {
+			return "", errors.New("no key: the request needs the key from its link")
+		}
+		pub, err := ParsePublicKey(info.PublicKey)
+		if err != nil {
+			return "", err
+		}
+		if key, err = NewKey(); err != nil {
+			return "", err
+		}
+		wrapped, err := WrapKey(pub, key)
+		if err != nil {
+			return "", err
+		}
+		fields = append(fields, [2]string{"wrapped-key", wrapped})
+	}
+
+	var result struct {
+		FileId string `json:"fileId"`
+	}
+	if _, err := c.postFile(ctx, "/requests/"+url.PathEscape(requestId)+"/files", r, filename, key, fields, &result); err != nil {
+		return "", err
+	}
+	return result.FileId, nil
+}
+
+// CloseRequest stops a file request from taking further uploads. Received
+// files stay available.
+func (c *Client) CloseRequest(ctx context.Context, requestId, ownerToken string) error {
+	query := url.Values{"ownerToken": {ownerToken}}
+	req, err := c.newRequest(ctx, http.MethodDelete, "/requests/"+url.PathEscape(requestId)+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
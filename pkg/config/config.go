@@ -3,9 +3,12 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
 	"text/template"
 
 	"github.com/jinzhu/configor"
+
+	"github.com/lixmal/gdprshare/pkg/record"
 )
 
 type Config struct {
@@ -13,11 +16,28 @@ type Config struct {
 	IDLength      int    `default:"20"`
 	StorePath     string `default:"files"`
 	ListenAddr    string `default:":8080"`
+	PublicURL     string // base of links in mails, e.g. https://share.example.com
 	TLS           struct {
 		Use  bool   `default:"false"`
 		Key  string `default:"/etc/ssl/private/ssl-cert-snakeoil.key"`
 		Cert string `default:"/etc/ssl/certs/ssl-cert-snakeoil.pem"`
 	}
+	Storage struct {
+		Backend string `default:"local"`
+		Shred   struct {
+			Enabled bool `default:"false"`
+			Passes  int  `default:"3"`
+		}
+		S3 struct {
+			Endpoint         string
+			Region           string `default:"us-east-1"`
+			Bucket           string
+			Prefix           string
+			AccessKey        string
+			SecretKey        string
+			VirtualHostStyle bool `default:"false"`
+		}
+	}
 	Database struct {
 		Driver string `default:"sqlite3"`
 		Args   string `default:"gdprshare.db"`
@@ -30,8 +50,48 @@ type Config struct {
 		From           string `default:"root@localhost"`
 		Subject        string `default:"File has been accessed: %s"`
 		SubjectReceipt string `default:"File download confirmed: %s"`
+		SubjectUpdate  string `default:"File settings changed: %s"`
+		// has .FileID and .Changes
+		BodyUpdate  string `default:"The sharing settings of file {{.FileID}} were changed: {{.Changes}}.\n"`
+		SubjectCode string `default:"Download code for file %s"` // sent to the recipient
+		// has .FileID, .Code and .Lifetime in minutes
+		BodyCode string `default:"Your code to download file {{.FileID}} is {{.Code}}. It is valid for {{.Lifetime}} minutes and one download.\n\nIf you didn't start this download, someone else has the link to the file and you can ignore this mail.\n"`
+		// sent to the requester for uploads into a file request, additionally
+		// has .RequestID
+		SubjectRequest string `default:"File received: %s"`
+		RequestBody    string `default:"File {{.FileID}} was uploaded to your file request {{.RequestID}} from {{.Addr}}{{with .Location}} ({{.City}}, {{.Country}}){{end}}.\n"`
 		Body           string `default:"File download with id {{.FileID}} has been attempted. {{.Denied}}"`
 		DeniedMsg      string `default:"Download was denied."`
+		// sent for files that need approval, additionally has .ApprovalURL
+		SubjectApproval string `default:"Download approval requested: %s"`
+		ApprovalBody    string `default:"Download of file {{.FileID}} was requested from {{.Addr}}{{with .Location}} ({{.City}}, {{.Country}}){{end}} with {{.DstTLSVersion}} {{.DstTLSCipherSuite}}, user agent {{.UserAgent}}.\n\n{{if .ApprovalURL}}Approve or deny the download: {{.ApprovalURL}}{{else}}Approve or deny the download with gdprshare-cli approvals.{{end}}\n"`
+	}
+	ResumableUpload struct {
+		MaxSize       int64 `default:"1024"` // MiB
+		ChunkSize     int64 `default:"8"`    // MiB
+		SessionExpiry uint  `default:"24"`   // hours
+	}
+	Records struct {
+		SigningKey string // PEM encoded Ed25519 private key
+	}
+	Cleanup struct {
+		Disabled bool `default:"false"`
+		Interval uint `default:"60"` // minutes
+	}
+	Retention struct {
+		Days uint `default:"90"` // days metadata of deleted files is kept
+	}
+	Download struct {
+		ResumeWindow uint `default:"10"` // minutes
+	}
+	Approval struct {
+		Wait        uint `default:"30"` // max seconds a recipient's status request waits for the decision
+		MaxRequests uint `default:"5"`  // requests mailed to the owner per file and hour
+	}
+	Verification struct {
+		Lifetime    uint `default:"10"` // minutes a code mailed to the recipient is valid
+		MaxCodes    uint `default:"5"`  // codes mailed per file and hour
+		MaxAttempts uint `default:"5"`  // wrong codes per file and hour
 	}
 	Header struct {
 		TLSVersion     string `default:"X-TLS-Version"`
@@ -46,13 +106,71 @@ type Config struct {
 		RPS     float64 `default:"10"`
 		Burst   int     `default:"20"`
 	}
+	Pseudonymise struct {
+		Mode     string `default:"none"` // none, truncate, hmac or geo
+		Rotation uint   `default:"24"`   // hours a hmac key is used
+	}
 	TLSValidation struct {
 		Enabled        bool   `default:"true"`
 		MinVersion     string `default:"1.2"`
 		BlockedCiphers []string
 	}
+	// quotas apply to logged in users and API keys, 0 is unlimited
+	Quota struct {
+		Bytes         int64 `default:"0"` // MiB stored per user or API key
+		Files         uint  `default:"0"` // available files per user or API key
+		UploadsPerDay uint  `default:"0"` // uploads per user or API key within 24 hours
+		TotalBytes    int64 `default:"0"` // MiB stored altogether, anonymous uploads included
+		MinFree       int64 `default:"0"` // MiB kept free on the file store path
+	}
+	Auth struct {
+		RequireLogin    bool `default:"false"` // uploads need a logged in user, downloads stay anonymous
+		SessionLifetime uint `default:"24"`    // hours
+		OIDC            struct {
+			Issuer       string // login is enabled if set
+			ClientID     string
+			ClientSecret string // empty for public clients
+			Scopes       string `default:"openid email profile"`
+		}
+		LDAP struct {
+			URL          string // ldap:// or ldaps://, login is enabled if set
+			StartTLS     bool   `default:"false"`
+			BindDN       string // account searching for users, empty for anonymous search
+			BindPassword string
+			BaseDN       string
+			// {username} is replaced with the escaped login name
+			UserFilter     string   `default:"(|(uid={username})(sAMAccountName={username})(userPrincipalName={username}))"`
+			EmailAttribute string   `default:"mail"`
+			NameAttribute  string   `default:"displayName"`
+			GroupAttribute string   `default:"memberOf"`
+			UploadGroups   []string // DNs of the groups allowed to log in, empty for all users
+			// Groups raise the limits of their members, the highest applies
+			Groups []LDAPGroup
+		}
+	}
 }
 
+// LDAPGroup lifts the sharing limits for the members of a directory group
+type LDAPGroup struct {
+	DN        string
+	MaxExpiry uint // days, 0 keeps the default of 14
+	MaxCount  uint // downloads, 0 keeps the default of 15
+}
+
+// upper bounds of the sharing options, see database.StoredFile
+const (
+	MaxExpiry = 365
+	MaxCount  = 1000
+)
+
+// address pseudonymisation modes
+const (
+	PseudonymiseNone     = "none"
+	PseudonymiseTruncate = "truncate"
+	PseudonymiseHMAC     = "hmac"
+	PseudonymiseGeo      = "geo"
+)
+
 // Default returns a Config instance with default values.
 func Default() *Config {
 	return &Config{}
@@ -78,6 +196,72 @@ func New(path string) (*Config, error) {
 
 func (c *Config) validate() error {
 	// try parsing the mail body template
-	_, err := template.New("mailbody").Parse(c.Mail.Body)
-	return err
+	if _, err := template.New("mailbody").Parse(c.Mail.Body); err != nil {
+		return err
+	}
+	if _, err := template.New("approvalbody").Parse(c.Mail.ApprovalBody); err != nil {
+		return err
+	}
+	if _, err := template.New("requestbody").Parse(c.Mail.RequestBody); err != nil {
+		return err
+	}
+	if _, err := template.New("codebody").Parse(c.Mail.BodyCode); err != nil {
+		return err
+	}
+	if _, err := template.New("updatebody").Parse(c.Mail.BodyUpdate); err != nil {
+		return err
+	}
+
+	// records would silently be unavailable otherwise
+	if c.Records.SigningKey != "" {
+		if _, err := record.LoadPrivateKey(c.Records.SigningKey); err != nil {
+			return fmt.Errorf("record signing key: %w", err)
+		}
+	}
+
+	// chunks are sent as single requests
+	if c.ResumableUpload.ChunkSize > c.MaxUploadSize {
+		return fmt.Errorf("resumable upload chunk size %d MiB exceeds max upload size %d MiB", c.ResumableUpload.ChunkSize, c.MaxUploadSize)
+	}
+
+	switch c.Pseudonymise.Mode {
+	case PseudonymiseNone, PseudonymiseTruncate, PseudonymiseHMAC, PseudonymiseGeo:
+	default:
+		return fmt.Errorf("unknown pseudonymisation mode %q", c.Pseudonymise.Mode)
+	}
+
+	// free space is only known for local directories
+	if c.Quota.MinFree > 0 && c.Storage.Backend != "local" && c.Storage.Backend != "" {
+		return fmt.Errorf("quota minfree needs the local storage backend")
+	}
+	// objects can't be overwritten in place
+	if c.Storage.Shred.Enabled && c.Storage.Backend != "local" && c.Storage.Backend != "" {
+		return fmt.Errorf("storage shred needs the local storage backend")
+	}
+
+	if c.Auth.RequireLogin && c.Auth.OIDC.Issuer == "" && c.Auth.LDAP.URL == "" {
+		return fmt.Errorf("login required but neither OIDC nor LDAP configured")
+	}
+	// the redirect URI registered at the provider is based on the public URL
+	if c.Auth.OIDC.Issuer != "" && (c.Auth.OIDC.ClientID == "" || c.PublicURL == "") {
+		return fmt.Errorf("OIDC login needs a client id and the public URL")
+	}
+	if c.Auth.LDAP.URL != "" {
+		if c.Auth.LDAP.BaseDN == "" {
+			return fmt.Errorf("LDAP login needs a base DN")
+		}
+		if !strings.Contains(c.Auth.LDAP.UserFilter, "{username}") {
+			return fmt.Errorf("LDAP user filter %q lacks {username}", c.Auth.LDAP.UserFilter)
+		}
+	}
+	for _, g := range c.Auth.LDAP.Groups {
+		if g.DN == "" {
+			return fmt.Errorf("LDAP group without DN")
+		}
+		if g.MaxExpiry > MaxExpiry || g.MaxCount > MaxCount {
+			return fmt.Errorf("LDAP group %s exceeds the limits of %d days and %d downloads", g.DN, MaxExpiry, MaxCount)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// states of a StoredFile, see StoredFile.State
+const (
+	FileActive    = "active"
+	FileExpired   = "expired"   // past expiry, not cleaned up yet
+	FileExhausted = "exhausted" // contents removed after the last allowed download
+	FileDeleted   = "deleted"   // metadata kept for the retention period
+)
+
+// FileStates lists the states files can be filtered by
+var FileStates = []string{FileActive, FileExpired, FileExhausted, FileDeleted}
+
+// State returns the state of the file at the given time
+func (f *StoredFile) State(now time.Time) string {
+	switch {
+	case f.DeletedAt != nil:
+		return FileDeleted
+	case now.After(f.ExpiresAt()):
+		return FileExpired
+	case f.ContentDeletedAt != nil:
+		return FileExhausted
+	}
+	return FileActive
+}
+
+// FileFilter selects files for the admin tools, zero values match all
+type FileFilter struct {
+	State    string // one of FileStates, deleted files are only listed with FileDeleted
+	UserId   uint
+	APIKeyId uint
+	Email    string // the sender's notification address or the address of the logged in user
+	Limit    int
+}
+
+// listBatch is the number of rows ListFiles reads at a time
+const listBatch = 500
+
+// ListFiles returns the files matching filter, newest first. Whether a file
+// expired depends on its expiry in days or hours, so that part of the state
+// is checked here, reading batches until enough files match.
+func (db *Database) ListFiles(filter FileFilter, now time.Time) ([]StoredFile, error) {
+	query := db.Order("id DESC")
+	switch filter.State {
+	case FileDeleted:
+		query = query.Unscoped().Where("deleted_at IS NOT NULL")
+	case FileActive:
+		query = query.Where("content_deleted_at IS NULL")
+	case FileExhausted:
+		query = query.Where("content_deleted_at IS NOT NULL")
+	}
+	if filter.UserId != 0 {
+		query = query.Where("user_id = ?", filter.UserId)
+	}
+	if filter.APIKeyId != 0 {
+		query = query.Where("api_key_id = ?", filter.APIKeyId)
+	}
+	if filter.Email != "" {
+		users := db.Table("users").Select("id").Where("email = ?", filter.Email).SubQuery()
+		query = query.Where("email = ? OR user_id IN (?)", filter.Email, users)
+	}
+
+	batch := listBatch
+	if filter.Limit > 0 && filter.Limit < batch {
+		batch = filter.Limit
+	}
+
+	var matching []StoredFile
+	var lastId uint
+	for {
+		page := query
+		if lastId != 0 {
+			page = page.Where("id < ?", lastId)
+		}
+
+		var files []StoredFile
+		if err := page.Limit(batch).Find(&files).Error; err != nil {
+			return nil, fmt.Errorf("list files: %w", err)
+		}
+
+		for _, f := range files {
+			if filter.State != "" && f.State(now) != filter.State {
+				continue
+			}
+			matching = append(matching, f)
+			if filter.Limit > 0 && len(matching) == filter.Limit {
+				return matching, nil
+			}
+		}
+		if len(files) < batch {
+			return matching, nil
+		}
+		lastId = files[len(files)-1].ID
+	}
+}
+
+// FindFile returns the file with fileId, deleted ones included, with its
+// clients and approval requests
+func (db *Database) FindFile(fileId string) (*StoredFile, error) {
+	tx := db.Unscoped()
+
+	var f StoredFile
+	if err := tx.Where("file_id = ?", fileId).First(&f).Error; err != nil {
+		return nil, err
+	}
+
+	var src Client
+	err := tx.Where("stored_file_id = ?", f.ID).First(&src).Error
+	if err != nil && !db.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("fetch src client of file with id %s: %w", fileId, err)
+	}
+	if err == nil {
+		f.SrcClient = &src
+	}
+
+	if err := tx.Where("stored_file_id = ?", f.ID).Order("created_at").Find(&f.DstClients).Error; err != nil {
+		return nil, fmt.Errorf("fetch dst clients of file with id %s: %w", fileId, err)
+	}
+	if err := tx.Where("stored_file_id = ?", f.ID).Order("created_at").Find(&f.DeniedClients).Error; err != nil {
+		return nil, fmt.Errorf("fetch denied clients of file with id %s: %w", fileId, err)
+	}
+	if err := tx.Where("stored_file_id = ?", f.ID).Order("created_at").Find(&f.ApprovalRequests).Error; err != nil {
+		return nil, fmt.Errorf("fetch approval requests of file with id %s: %w", fileId, err)
+	}
+
+	return &f, nil
+}
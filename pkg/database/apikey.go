@@ -0,0 +1,124 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// scopes of an APIKey
+const (
+	ScopeUpload = "upload" // uploads and file requests
+	ScopeDelete = "delete" // deleting files uploaded with the key
+	ScopeStatus = "status" // status of files uploaded with the key
+	ScopeAdmin  = "admin"  // admin API: listing, inspecting and deleting all files
+)
+
+// Scopes lists all scopes an APIKey can have
+var Scopes = []string{ScopeUpload, ScopeDelete, ScopeStatus, ScopeAdmin}
+
+const (
+	// APIKeyPrefix starts every key, so leaked keys are easy to search for
+	APIKeyPrefix = "gdps_"
+	apiKeyLen    = 32
+	// characters of a key kept to recognise it
+	apiKeyShownLen = len(APIKeyPrefix) + 6
+)
+
+var ErrUnknownScope = errors.New("unknown scope")
+
+// APIKey authenticates a machine sender. Only the SHA-256 of the key is
+// stored. Revoked keys are soft deleted, so files keep referring to them.
+type APIKey struct {
+	gorm.Model
+	Name       string `gorm:"not null"`
+	Prefix     string `gorm:"not null"` // start of the key, to recognise it
+	KeyHash    string `gorm:"not null;unique_index"`
+	Scopes     string `gorm:"not null"` // comma separated
+	ExpiresAt  *time.Time
+	RateLimit  float64 // requests per second, 0 for the configured default
+	Burst      int
+	LastUsedAt *time.Time
+	// quotas, 0 for the configured default
+	QuotaBytes         int64 // MiB
+	QuotaFiles         uint
+	QuotaUploadsPerDay uint
+}
+
+// HasScope reports whether the key may be used for scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range strings.Split(k.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the key is past its expiry
+func (k *APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && now.After(*k.ExpiresAt)
+}
+
+// HashAPIKey returns the hex SHA-256 a key is stored as. Keys are random, a
+// slow hash would add nothing.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey generates a key with the given settings. The returned key is
+// shown once, only its hash is kept.
+func (db *Database) CreateAPIKey(k *APIKey) (string, error) {
+	scopes := strings.Split(k.Scopes, ",")
+	for _, scope := range scopes {
+		valid := false
+		for _, s := range Scopes {
+			valid = valid || s == scope
+		}
+		if !valid {
+			return "", fmt.Errorf("%w %q", ErrUnknownScope, scope)
+		}
+	}
+
+	buf := make([]byte, apiKeyLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate API key: %w", err)
+	}
+	key := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	k.Prefix = key[:apiKeyShownLen]
+	k.KeyHash = HashAPIKey(key)
+	if err := db.Create(k).Error; err != nil {
+		return "", fmt.Errorf("create API key: %w", err)
+	}
+	return key, nil
+}
+
+// FindAPIKey returns the unrevoked key, expired or not
+func (db *Database) FindAPIKey(key string) (*APIKey, error) {
+	var k APIKey
+	if err := db.Where("key_hash = ?", HashAPIKey(key)).First(&k).Error; err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// RevokeAPIKey revokes the key with the given id
+func (db *Database) RevokeAPIKey(id uint) error {
+	res := db.Where("id = ?", id).Delete(&APIKey{})
+	if res.Error != nil {
+		return fmt.Errorf("revoke API key %d: %w", id, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("revoke API key %d: %w", id, gorm.ErrRecordNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// audit events
+const (
+	AuditUpload       = "upload"
+	AuditDownload     = "download"
+	AuditDenied       = "denied"
+	AuditApproval     = "approval"
+	AuditCode         = "code"
+	AuditRequest      = "request"
+	AuditReceipt      = "receipt"
+	AuditOwnerDelete  = "owner_delete"
+	AuditUpdate       = "update"
+	AuditExpiryDelete = "expiry_delete"
+	AuditTLSRejected  = "tls_rejected"
+	AuditLogin        = "login"
+	AuditLogout       = "logout"
+	AuditAdminDelete  = "admin_delete"
+)
+
+// auditAppendRetries bounds the attempts to append when other instances
+// append concurrently
+const auditAppendRetries = 5
+
+var ErrAuditChain = errors.New("audit chain broken")
+
+// AuditEntry is an event of the append-only audit log. Each entry holds the
+// hash of its predecessor, so changing, removing or reordering entries breaks
+// the chain. Entries are never updated or deleted, so they hold no personal
+// data: the client's address and user agent go to an AuditClient.
+type AuditEntry struct {
+	ID     uint   `gorm:"primary_key"`
+	Seq    uint64 `gorm:"not null;unique_index"`
+	Time   time.Time
+	Event  string `gorm:"not null"`
+	FileId string `gorm:"index"`
+	// Addr and UserAgent are only set in entries of earlier versions, they
+	// stay part of the hash so those still verify
+	Addr           string
+	UserAgent      string
+	TLSVersion     string
+	TLSCipherSuite string
+	Country        string
+	Detail         string `gorm:"type:text"`
+	PrevHash       string
+	Hash           string `gorm:"not null"`
+
+	Client *AuditClient `gorm:"-"` // saved along with the entry if set
+}
+
+// AuditClient is the address and user agent of the client of an audit
+// entry. It is not part of the chain and is removed with the other client
+// data of the file, or after the retention period for entries without one.
+type AuditClient struct {
+	ID           uint      `gorm:"primary_key"`
+	CreatedAt    time.Time `gorm:"index"`
+	AuditEntryId uint      `gorm:"not null;index"`
+	FileId       string    `gorm:"index"`
+	Addr         string
+	UserAgent    string
+}
+
+// ComputeHash returns the hex SHA-256 over the entry, including the hash of
+// its predecessor.
+func (e *AuditEntry) ComputeHash() string {
+	payload, _ := json.Marshal(struct {
+		Seq            uint64
+		Time           string
+		Event          string
+		FileId         string
+		Addr           string
+		UserAgent      string
+		TLSVersion     string
+		TLSCipherSuite string
+		Country        string
+		Detail         string
+		PrevHash       string
+	}{
+		e.Seq,
+		e.Time.UTC().Format(time.RFC3339),
+		e.Event,
+		e.FileId,
+		e.Addr,
+		e.UserAgent,
+		e.TLSVersion,
+		e.TLSCipherSuite,
+		e.Country,
+		e.Detail,
+		e.PrevHash,
+	})
+
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// AppendAudit adds an entry to the end of the audit chain. Times are kept
+// with second precision, as not all databases store more.
+func (db *Database) AppendAudit(entry *AuditEntry) error {
+	entry.Time = time.Now().UTC().Truncate(time.Second)
+
+	var err error
+	for i := 0; i < auditAppendRetries; i++ {
+		// a concurrent append takes the same sequence number and fails on the index
+		if err = db.appendAudit(entry); err == nil {
+			return nil
+		}
+		entry.ID = 0
+	}
+
+	return fmt.Errorf("append %s audit entry: %w", entry.Event, err)
+}
+
+func (db *Database) appendAudit(entry *AuditEntry) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	var last AuditEntry
+	if err := tx.Order("seq desc").First(&last).Error; err != nil && !db.IsRecordNotFoundError(err) {
+		tx.Rollback()
+		return err
+	}
+
+	entry.Seq = last.Seq + 1
+	entry.PrevHash = last.Hash
+	entry.Hash = entry.ComputeHash()
+
+	if err := tx.Create(entry).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if entry.Client != nil {
+		entry.Client.ID = 0
+		entry.Client.AuditEntryId = entry.ID
+		entry.Client.FileId = entry.FileId
+		if err := tx.Create(entry.Client).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// VerifyAudit checks the whole audit chain and returns the number of entries
+// and the hash of the last one. Keeping that hash elsewhere also makes
+// removing entries from the end detectable.
+func (db *Database) VerifyAudit() (uint64, string, error) {
+	rows, err := db.Model(&AuditEntry{}).Order("seq").Rows()
+	if err != nil {
+		return 0, "", fmt.Errorf("read audit log: %w", err)
+	}
+	defer rows.Close()
+
+	var count uint64
+	var prevHash string
+	for rows.Next() {
+		var entry AuditEntry
+		if err := db.ScanRows(rows, &entry); err != nil {
+			return count, prevHash, fmt.Errorf("read audit entry: %w", err)
+		}
+
+		switch {
+		case entry.Seq != count+1:
+			return count, prevHash, fmt.Errorf("%w: entry %d follows entry %d", ErrAuditChain, entry.Seq, count)
+		case entry.PrevHash != prevHash:
+			return count, prevHash, fmt.Errorf("%w: entry %d doesn't link to its predecessor", ErrAuditChain, entry.Seq)
+		case entry.Hash != entry.ComputeHash():
+			return count, prevHash, fmt.Errorf("%w: entry %d was modified", ErrAuditChain, entry.Seq)
+		}
+
+		count = entry.Seq
+		prevHash = entry.Hash
+	}
+	if err := rows.Err(); err != nil {
+		return count, prevHash, fmt.Errorf("read audit log: %w", err)
+	}
+
+	return count, prevHash, nil
+}
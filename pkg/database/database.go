@@ -30,6 +30,22 @@ func New(config *config.Config) (*Database, error) {
 		return nil, fmt.Errorf("migrate schema dst client: %w", err)
 	}
 
+	if err = db.AutoMigrate(&DeniedClient{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema denied client: %w", err)
+	}
+
+	if err = db.AutoMigrate(&ApprovalRequest{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema approval request: %w", err)
+	}
+
+	if err = db.AutoMigrate(&VerificationCode{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema verification code: %w", err)
+	}
+
+	if err = db.AutoMigrate(&FileRequest{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema file request: %w", err)
+	}
+
 	if err = db.AutoMigrate(&StoredFile{}).Error; err != nil {
 		return nil, fmt.Errorf("migrate schema stored file: %w", err)
 	}
@@ -38,6 +54,50 @@ func New(config *config.Config) (*Database, error) {
 		return nil, fmt.Errorf("migrate schema stats: %w", err)
 	}
 
+	if err = db.AutoMigrate(&UploadSession{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema upload session: %w", err)
+	}
+
+	if err = db.AutoMigrate(&UploadChunk{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema upload chunk: %w", err)
+	}
+
+	if err = db.AutoMigrate(&DownloadToken{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema download token: %w", err)
+	}
+
+	if err = db.AutoMigrate(&Lease{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema lease: %w", err)
+	}
+
+	if err = db.AutoMigrate(&AuditEntry{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema audit entry: %w", err)
+	}
+
+	if err = db.AutoMigrate(&AuditClient{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema audit client: %w", err)
+	}
+
+	if err = db.AutoMigrate(&User{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema user: %w", err)
+	}
+
+	if err = db.AutoMigrate(&Session{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema session: %w", err)
+	}
+
+	if err = db.AutoMigrate(&LoginState{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema login state: %w", err)
+	}
+
+	if err = db.AutoMigrate(&APIKey{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema api key: %w", err)
+	}
+
+	if err = db.AutoMigrate(&PseudonymKey{}).Error; err != nil {
+		return nil, fmt.Errorf("migrate schema pseudonym key: %w", err)
+	}
+
 	return &Database{db}, nil
 }
 
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// Lease is a named lock with an expiry, shared by all instances using the
+// same database. A holder that dies loses it once it expires.
+type Lease struct {
+	Name      string `gorm:"primary_key"`
+	Holder    string `gorm:"not null"`
+	ExpiresAt time.Time
+}
+
+// AcquireLease takes or renews the named lease for ttl. It reports false if
+// another holder owns an unexpired lease.
+func (db *Database) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	lease := Lease{Name: name, Holder: holder, ExpiresAt: now.Add(ttl)}
+
+	res := db.Model(&Lease{}).
+		Where("name = ? AND (holder = ? OR expires_at < ?)", name, holder, now).
+		Updates(map[string]interface{}{"holder": holder, "expires_at": lease.ExpiresAt})
+	if res.Error != nil {
+		return false, fmt.Errorf("renew lease %s: %w", name, res.Error)
+	}
+	if res.RowsAffected > 0 {
+		return true, nil
+	}
+
+	var count int
+	if err := db.Model(&Lease{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("look up lease %s: %w", name, err)
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	// first use, a concurrent insert by another instance fails on the key
+	if err := db.Create(&lease).Error; err != nil {
+		if db.Model(&Lease{}).Where("name = ?", name).Count(&count).Error == nil && count > 0 {
+			return false, nil
+		}
+		return false, fmt.Errorf("create lease %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// ReleaseLease gives up the named lease if held by holder.
+func (db *Database) ReleaseLease(name, holder string) error {
+	err := db.Where("name = ? AND holder = ?", name, holder).Delete(&Lease{}).Error
+	if err != nil {
+		return fmt.Errorf("release lease %s: %w", name, err)
+	}
+	return nil
+}
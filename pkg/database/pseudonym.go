@@ -0,0 +1,49 @@
+package database
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// PseudonymKeyLen is the length of the secrets addresses are hashed with
+const PseudonymKeyLen = 32
+
+// PseudonymKey is the secret client addresses are hashed with during one
+// period, shared by all instances using the same database. Keys of past
+// periods are deleted, so their pseudonyms can't be recomputed anymore.
+type PseudonymKey struct {
+	Period int64  `gorm:"primary_key;auto_increment:false"`
+	Key    []byte `gorm:"not null"`
+}
+
+// PseudonymKey returns the key of the given period, creating it on first use.
+func (db *Database) PseudonymKey(period int64) ([]byte, error) {
+	var key PseudonymKey
+	err := db.Where("period = ?", period).First(&key).Error
+	if err == nil {
+		return key.Key, nil
+	}
+	if !db.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("look up pseudonym key: %w", err)
+	}
+
+	key = PseudonymKey{Period: period, Key: make([]byte, PseudonymKeyLen)}
+	if _, err := rand.Read(key.Key); err != nil {
+		return nil, fmt.Errorf("generate pseudonym key: %w", err)
+	}
+
+	// a concurrent insert by another instance fails on the key
+	if err := db.Create(&key).Error; err != nil {
+		var existing PseudonymKey
+		if db.Where("period = ?", period).First(&existing).Error == nil {
+			return existing.Key, nil
+		}
+		return nil, fmt.Errorf("create pseudonym key: %w", err)
+	}
+
+	if err := db.Where("period < ?", period).Delete(&PseudonymKey{}).Error; err != nil {
+		return nil, fmt.Errorf("delete past pseudonym keys: %w", err)
+	}
+
+	return key.Key, nil
+}
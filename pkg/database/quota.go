@@ -0,0 +1,77 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// Usage is what a user or API key currently has stored. Files whose contents
+// are gone, by expiry, download count or deletion, no longer count.
+type Usage struct {
+	Files   uint  `json:"files"`   // available files
+	Bytes   int64 `json:"bytes"`   // size of available files and unfinished resumable uploads
+	Uploads uint  `json:"uploads"` // uploads since the given time, deleted files included
+}
+
+// UserUsage returns the usage of the user with id, counting uploads since
+// the given time
+func (db *Database) UserUsage(id uint, since time.Time) (*Usage, error) {
+	return db.usage("user_id", id, since)
+}
+
+// APIKeyUsage returns the usage of the API key with id, counting uploads
+// since the given time
+func (db *Database) APIKeyUsage(id uint, since time.Time) (*Usage, error) {
+	return db.usage("api_key_id", id, since)
+}
+
+func (db *Database) usage(column string, id uint, since time.Time) (*Usage, error) {
+	var u Usage
+	err := db.Model(&StoredFile{}).
+		Select("COUNT(*) AS files, COALESCE(SUM(size), 0) AS bytes").
+		Where(column+" = ? AND content_deleted_at IS NULL", id).
+		Scan(&u).Error
+	if err != nil {
+		return nil, fmt.Errorf("sum files by %s %d: %w", column, id, err)
+	}
+
+	// unfinished uploads have their size reserved
+	var reserved struct{ Bytes int64 }
+	err = db.Model(&UploadSession{}).
+		Select("COALESCE(SUM(size), 0) AS bytes").
+		Where(column+" = ?", id).
+		Scan(&reserved).Error
+	if err != nil {
+		return nil, fmt.Errorf("sum uploads by %s %d: %w", column, id, err)
+	}
+	u.Bytes += reserved.Bytes
+
+	err = db.Unscoped().Model(&StoredFile{}).
+		Where(column+" = ? AND created_at > ?", id, since).
+		Count(&u.Uploads).Error
+	if err != nil {
+		return nil, fmt.Errorf("count uploads by %s %d: %w", column, id, err)
+	}
+
+	return &u, nil
+}
+
+// StoredBytes returns the size of all available files and unfinished
+// resumable uploads
+func (db *Database) StoredBytes() (int64, error) {
+	var files, uploads struct{ Bytes int64 }
+	err := db.Model(&StoredFile{}).
+		Select("COALESCE(SUM(size), 0) AS bytes").
+		Where("content_deleted_at IS NULL").
+		Scan(&files).Error
+	if err != nil {
+		return 0, fmt.Errorf("sum stored files: %w", err)
+	}
+	err = db.Model(&UploadSession{}).
+		Select("COALESCE(SUM(size), 0) AS bytes").
+		Scan(&uploads).Error
+	if err != nil {
+		return 0, fmt.Errorf("sum unfinished uploads: %w", err)
+	}
+	return files.Bytes + uploads.Bytes, nil
+}
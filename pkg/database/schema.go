@@ -2,6 +2,7 @@ package database
 
 import (
 	"mime/multipart"
+	"time"
 
 	"github.com/jinzhu/gorm"
 
@@ -15,11 +16,58 @@ type Client struct {
 	UserAgent      string
 	TLSVersion     string
 	TLSCipherSuite string
+	Country        string
+	City           string
 	Location       *geoip.Location `gorm:"-"`
 }
 
 type DstClient Client
 
+// reasons of a DeniedClient
+const (
+	DenialDelay     = "not yet downloadable"
+	DenialLocation  = "location"
+	DenialUserAgent = "user agent"
+	DenialApproval  = "not approved"
+	DenialCode      = "wrong code"
+)
+
+// DeniedClient is a download attempt that was refused, e.g. from a location
+// outside the allowed countries.
+type DeniedClient struct {
+	Client
+	Reason string
+}
+
+// states of an ApprovalRequest
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalDenied   = "denied"
+)
+
+// ApprovalRequest is a download attempt of a file that needs the owner's
+// approval. The recipient refers to it by RequestId, DecisionToken authorises
+// the approval link mailed to the owner. An approval allows one download.
+type ApprovalRequest struct {
+	Client
+	RequestId     string `gorm:"not null;unique_index"`
+	DecisionToken string `gorm:"not null"`
+	State         string `gorm:"not null"`
+	DecidedAt     *time.Time
+	UsedAt        *time.Time
+}
+
+// VerificationCode is a one-time code mailed to the recipient of a file. It
+// allows one download until ExpiresAt.
+type VerificationCode struct {
+	gorm.Model
+	StoredFileId uint   `gorm:"not null"`
+	Code         string `gorm:"not null"`
+	ExpiresAt    time.Time
+	UsedAt       *time.Time
+}
+
 type StoredFile struct {
 	gorm.Model
 	Type             string                `form:"type"                                     binding:"omitempty,printascii,min=1,max=255"`
@@ -29,15 +77,152 @@ type StoredFile struct {
 	Filename         string                `form:"filename"       gorm:"type:varchar(1024)" binding:"omitempty,max=1024"`
 	Name             string                `form:"-"              gorm:"not null"`
 	Email            string                `form:"email"                                    binding:"omitempty,email,min=4,max=255"`
-	Expiry           uint                  `form:"expiry"         gorm:"default:14"         binding:"omitempty,min=1,max=14"`
-	Count            uint                  `form:"count"          gorm:"default:1"          binding:"omitempty,min=1,max=15"`
+	RecipientEmail   string                `form:"recipient-email"                          binding:"omitempty,email,min=4,max=255"` // downloads need a code mailed here
+	Expiry           uint                  `form:"expiry"         gorm:"default:14"         binding:"omitempty,min=1,max=365"`       // limited per user, see User
+	ExpiryHours      uint                  `form:"expiry-hours"                             binding:"omitempty,min=1,max=8760"`      // limited per user, see User
+	Count            uint                  `form:"count"          gorm:"default:1"          binding:"omitempty,min=1,max=1000"`      // limited per user, see User
 	OnlyEEA          bool                  `form:"only-eea"`
 	IncludeOther     bool                  `form:"include-other"`
 	AllowedCountries string                `form:"allowed-countries" gorm:"type:text"    binding:"omitempty,max=2000"`
 	Delay            uint                  `form:"delay"                                    binding:"omitempty,min=0,max=1440"`
 	Ephemeral        uint                  `form:"ephemeral"          gorm:"default:0"      binding:"omitempty,min=0,max=300"`
+	Approval         bool                  `form:"approval"`                        // every download needs the owner's approval
+	Downloads        uint                  `form:"-"              gorm:"default:0"` // completed downloads
+	Size             int64                 `form:"-"`
+	Hash             string                `form:"-"` // hex SHA-256 of the ciphertext
+	DeletionMethod   string                `form:"-"`
+	ContentDeletedAt *time.Time            `form:"-"`
+	PseudonymisedAt  *time.Time            `form:"-"`
+	FileRequestId    uint                  `form:"-"`                               // set for uploads into a FileRequest
+	WrappedKey       string                `form:"-"              gorm:"type:text"` // key wrapped for the request's public key
+	UserId           uint                  `form:"-"`                               // uploader if logged in, see User
+	APIKeyId         uint                  `form:"-"`                               // set for uploads with an APIKey
 	SrcClient        *Client               `form:"-"`
 	DstClients       []*DstClient          `form:"-"`
+	DeniedClients    []*DeniedClient       `form:"-"`
+	ApprovalRequests []*ApprovalRequest    `form:"-"`
+}
+
+// ExpiresAt returns when the file expires. ExpiryHours, if set, takes
+// precedence over Expiry in days.
+func (f *StoredFile) ExpiresAt() time.Time {
+	if f.ExpiryHours > 0 {
+		return f.CreatedAt.Add(time.Duration(f.ExpiryHours) * time.Hour)
+	}
+	return f.CreatedAt.AddDate(0, 0, int(f.Expiry))
+}
+
+// FileRequest asks an external party to upload files to the requester. The
+// files are encrypted with the key in the request link, or with a key of their
+// own that is wrapped for PublicKey.
+type FileRequest struct {
+	gorm.Model
+	RequestId   string        `form:"-"            gorm:"not null;unique_index"`
+	OwnerToken  string        `form:"-"`
+	Email       string        `form:"email"                          binding:"omitempty,email,min=4,max=255"`
+	Message     string        `form:"message"      gorm:"type:text"  binding:"omitempty,max=2000"` // shown to the uploader
+	Expiry      uint          `form:"expiry"       gorm:"default:14" binding:"omitempty,min=1,max=14"`
+	ExpiryHours uint          `form:"expiry-hours"                   binding:"omitempty,min=1,max=336"`
+	MaxFiles    uint          `form:"max-files"    gorm:"default:1"  binding:"omitempty,min=1,max=100"`
+	MaxSize     int64         `form:"max-size"                       binding:"omitempty,min=1"`    // MiB per file
+	PublicKey   string        `form:"public-key"   gorm:"type:text"  binding:"omitempty,max=2048"` // base64 DER of an RSA public key
+	Uploads     uint          `form:"-"            gorm:"default:0"`
+	ClosedAt    *time.Time    `form:"-"`
+	UserId      uint          `form:"-"` // requester if logged in
+	Files       []*StoredFile `form:"-"`
+}
+
+// ExpiresAt returns when the request stops taking uploads, see
+// StoredFile.ExpiresAt
+func (r *FileRequest) ExpiresAt() time.Time {
+	if r.ExpiryHours > 0 {
+		return r.CreatedAt.Add(time.Duration(r.ExpiryHours) * time.Hour)
+	}
+	return r.CreatedAt.AddDate(0, 0, int(r.Expiry))
+}
+
+// UploadSession is a resumable upload in progress. Options holds the form
+// encoded sharing settings, applied to the StoredFile once the upload is
+// finalized.
+type UploadSession struct {
+	gorm.Model
+	UploadId   string `gorm:"not null;unique_index"`
+	Name       string `gorm:"not null"`
+	Options    string `gorm:"type:text"`
+	Size       int64
+	ChunkSize  int64
+	Tus        bool
+	ExpiresAt  time.Time
+	Finalizing bool
+	UserId     uint
+	APIKeyId   uint
+	Chunks     []*UploadChunk
+}
+
+// ReceivedChunks returns the chunks whose blob is complete
+func (u *UploadSession) ReceivedChunks() []*UploadChunk {
+	chunks := make([]*UploadChunk, 0, len(u.Chunks))
+	for _, chunk := range u.Chunks {
+		if !chunk.Pending {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// UploadChunk is a received part of an UploadSession, stored as its own blob.
+// A request claims the index by creating the row before writing the blob.
+type UploadChunk struct {
+	gorm.Model
+	UploadSessionId uint `gorm:"not null;unique_index:idx_upload_chunk"`
+	Index           uint `gorm:"unique_index:idx_upload_chunk"`
+	Size            int64
+	Pending         bool // the blob is still being written
+}
+
+// DownloadToken ties the requests of one download together, so an interrupted
+// transfer can be resumed with Range requests until ExpiresAt. The download
+// only counts once it completed.
+type DownloadToken struct {
+	gorm.Model
+	Token        string `gorm:"not null;unique_index"`
+	StoredFileId uint   `gorm:"not null"`
+	ExpiresAt    time.Time
+	Completed    bool
+}
+
+// User is a sender logged in with OpenID Connect or LDAP, identified by
+// issuer and subject, for LDAP the directory URL and the DN. Email, Name and
+// the limits are updated at each login.
+type User struct {
+	gorm.Model
+	Issuer      string `gorm:"not null;unique_index:idx_user_issuer_subject"`
+	Subject     string `gorm:"not null;unique_index:idx_user_issuer_subject"`
+	Email       string
+	Name        string
+	MaxExpiry   uint // days, raised by LDAP groups, 0 for the default
+	MaxCount    uint // downloads, raised by LDAP groups, 0 for the default
+	LastLoginAt *time.Time
+}
+
+// Session is a login of a User. The cookie holds the token, only its SHA-256
+// is stored.
+type Session struct {
+	gorm.Model
+	TokenHash string `gorm:"not null;unique_index"`
+	UserId    uint   `gorm:"not null"`
+	ExpiresAt time.Time
+}
+
+// LoginState is a login in progress, between the redirect to the provider and
+// its callback. It holds the PKCE verifier and nonce for the login with State.
+type LoginState struct {
+	gorm.Model
+	State     string `gorm:"not null;unique_index"`
+	Nonce     string `gorm:"not null"`
+	Verifier  string `gorm:"not null"`
+	ReturnTo  string
+	ExpiresAt time.Time
 }
 
 type Stats struct {
@@ -0,0 +1,156 @@
+// Package ldap authenticates users against an LDAP directory or Active
+// Directory: the user is searched with a service account, then bound with
+// the given password. Groups are taken from an attribute of the user entry,
+// memberOf by default.
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// UsernamePlaceholder is replaced with the escaped username in Directory.UserFilter
+const UsernamePlaceholder = "{username}"
+
+// Timeout applies to connecting and to each request
+var Timeout = 10 * time.Second
+
+// ErrInvalidCredentials is returned for unknown users and wrong passwords
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Directory is an LDAP server users log in with
+type Directory struct {
+	URL      string // ldap:// or ldaps://
+	StartTLS bool
+	// BindDN and BindPassword are the account searching for users, empty for
+	// an anonymous search
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string // contains UsernamePlaceholder
+	EmailAttribute string
+	NameAttribute  string
+	GroupAttribute string
+	TLSConfig      *tls.Config // for ldaps:// and StartTLS, nil for the defaults
+}
+
+// Entry is an authenticated user
+type Entry struct {
+	DN     string
+	Email  string
+	Name   string
+	Groups []string // DNs
+}
+
+// Authenticate checks the password of username and returns its entry
+func (d *Directory) Authenticate(username, password string) (*Entry, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if d.BindDN != "" {
+		if err := conn.Bind(d.BindDN, d.BindPassword); err != nil {
+			return nil, fmt.Errorf("bind as %s: %w", d.BindDN, err)
+		}
+	}
+
+	filter := strings.ReplaceAll(d.UserFilter, UsernamePlaceholder, goldap.EscapeFilter(username))
+	attributes := []string{d.EmailAttribute, d.NameAttribute, d.GroupAttribute}
+	// two results are enough to tell the username is ambiguous
+	result, err := conn.Search(goldap.NewSearchRequest(
+		d.BaseDN, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 2, int(Timeout/time.Second), false,
+		filter, attributes, nil,
+	))
+	if err != nil && !goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("search user: %w", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("bind as user: %w", err)
+	}
+
+	return &Entry{
+		DN:     entry.DN,
+		Email:  entry.GetEqualFoldAttributeValue(d.EmailAttribute),
+		Name:   entry.GetEqualFoldAttributeValue(d.NameAttribute),
+		Groups: entry.GetEqualFoldAttributeValues(d.GroupAttribute),
+	}, nil
+}
+
+func (d *Directory) dial() (*goldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: Timeout}
+	opts := []goldap.DialOpt{goldap.DialWithDialer(dialer)}
+	if d.TLSConfig != nil {
+		opts = append(opts, goldap.DialWithTLSConfig(d.TLSConfig))
+	}
+
+	conn, err := goldap.DialURL(d.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", d.URL, err)
+	}
+	conn.SetTimeout(Timeout)
+
+	if d.StartTLS {
+		config := d.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = hostname(d.URL)
+		}
+		if err := conn.StartTLS(config); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("start TLS: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// IsMember reports whether the entry is in the group with the given DN. DNs
+// are compared case insensitively and regardless of spacing.
+func (e *Entry) IsMember(group string) bool {
+	want, err := goldap.ParseDN(group)
+	for _, g := range e.Groups {
+		if err != nil {
+			if strings.EqualFold(g, group) {
+				return true
+			}
+			continue
+		}
+		if dn, err := goldap.ParseDN(g); err == nil && want.EqualFold(dn) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostname(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,119 @@
+package ldap_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/ldap"
+	"github.com/lixmal/gdprshare/pkg/ldap/ldaptest"
+)
+
+const (
+	hrGroup      = "cn=hr,ou=groups," + ldaptest.BaseDN
+	payrollGroup = "cn=payroll,ou=groups," + ldaptest.BaseDN
+)
+
+func setupDirectory(t *testing.T) (*ldaptest.Server, *ldap.Directory) {
+	t.Helper()
+
+	srv := ldaptest.New(
+		ldaptest.Entry{
+			DN:       "uid=alice,ou=people," + ldaptest.BaseDN,
+			Password: "alice-secret",
+			Attributes: map[string][]string{
+				"uid":         {"alice"},
+				"mail":        {"alice@example.com"},
+				"displayName": {"Alice"},
+				"memberOf":    {hrGroup, payrollGroup},
+			},
+		},
+		ldaptest.Entry{
+			DN:         "uid=bob,ou=people," + ldaptest.BaseDN,
+			Password:   "bob-secret",
+			Attributes: map[string][]string{"uid": {"bob"}},
+		},
+		// two entries share a username in different branches
+		ldaptest.Entry{DN: "uid=carol,ou=people," + ldaptest.BaseDN, Password: "x", Attributes: map[string][]string{"uid": {"carol"}}},
+		ldaptest.Entry{DN: "uid=carol,ou=partners," + ldaptest.BaseDN, Password: "x", Attributes: map[string][]string{"uid": {"carol"}}},
+	)
+	t.Cleanup(srv.Close)
+
+	return srv, &ldap.Directory{
+		URL:            srv.URL(),
+		BindDN:         ldaptest.BindDN,
+		BindPassword:   ldaptest.BindPassword,
+		BaseDN:         ldaptest.BaseDN,
+		UserFilter:     "(&(uid={username})(!(disabled=TRUE)))",
+		EmailAttribute: "mail",
+		NameAttribute:  "displayName",
+		GroupAttribute: "memberOf",
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	_, dir := setupDirectory(t)
+
+	entry, err := dir.Authenticate("alice", "alice-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "uid=alice,ou=people,"+ldaptest.BaseDN, entry.DN)
+	assert.Equal(t, "alice@example.com", entry.Email)
+	assert.Equal(t, "Alice", entry.Name)
+	assert.Equal(t, []string{hrGroup, payrollGroup}, entry.Groups)
+
+	assert.True(t, entry.IsMember("CN=HR, OU=Groups, DC=example, DC=com"))
+	assert.False(t, entry.IsMember("cn=sales,ou=groups,"+ldaptest.BaseDN))
+
+	entry, err = dir.Authenticate("bob", "bob-secret")
+	require.NoError(t, err)
+	assert.Empty(t, entry.Email)
+	assert.Empty(t, entry.Groups)
+}
+
+func TestAuthenticateRejected(t *testing.T) {
+	_, dir := setupDirectory(t)
+
+	for name, creds := range map[string][2]string{
+		"wrong password": {"alice", "bob-secret"},
+		"empty password": {"alice", ""},
+		"unknown user":   {"mallory", "secret"},
+		"wildcard":       {"*", "alice-secret"},
+		"injection":      {"alice)(uid=*", "alice-secret"},
+		"ambiguous":      {"carol", "x"},
+		"service":        {"gdprshare", ldaptest.BindPassword},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := dir.Authenticate(creds[0], creds[1])
+			assert.ErrorIs(t, err, ldap.ErrInvalidCredentials)
+		})
+	}
+}
+
+func TestAuthenticateServiceAccount(t *testing.T) {
+	srv, dir := setupDirectory(t)
+
+	dir.BindPassword = "wrong"
+	_, err := dir.Authenticate("alice", "alice-secret")
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ldap.ErrInvalidCredentials), "a broken setup is not the user's fault")
+
+	dir.BindDN, dir.BindPassword = "", ""
+	_, err = dir.Authenticate("alice", "alice-secret")
+	require.Error(t, err)
+
+	srv.AllowAnonymous(true)
+	entry, err := dir.Authenticate("alice", "alice-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "Alice", entry.Name)
+}
+
+func TestAuthenticateUnreachable(t *testing.T) {
+	srv, dir := setupDirectory(t)
+	srv.Close()
+
+	_, err := dir.Authenticate("alice", "alice-secret")
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ldap.ErrInvalidCredentials))
+}
@@ -0,0 +1,297 @@
+// Package ldaptest provides an in-process LDAP server for tests. It supports
+// simple binds, subtree searches with and, or, not, equality and presence
+// filters, and nothing else.
+package ldaptest
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+const (
+	BaseDN       = "dc=example,dc=com"
+	BindDN       = "cn=gdprshare,ou=services," + BaseDN
+	BindPassword = "service-secret"
+)
+
+// Entry is an entry of the directory
+type Entry struct {
+	DN         string
+	Password   string // empty for entries that can't bind
+	Attributes map[string][]string
+}
+
+// Server is an LDAP server listening on localhost
+type Server struct {
+	listener  net.Listener
+	mu        sync.Mutex
+	entries   []Entry
+	anonymous bool
+	wg        sync.WaitGroup
+}
+
+// New starts a server with the service account BindDN and the given entries
+func New(entries ...Entry) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("ldaptest: listen: " + err.Error())
+	}
+
+	s := &Server{
+		listener: listener,
+		entries:  append([]Entry{{DN: BindDN, Password: BindPassword}}, entries...),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// URL returns the ldap:// URL of the server
+func (s *Server) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+// Add adds an entry to the directory
+func (s *Server) Add(e Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, e)
+}
+
+// AllowAnonymous sets whether searches work without a bind
+func (s *Server) AllowAnonymous(allow bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.anonymous = allow
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(r)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case goldap.ApplicationBindRequest:
+			code := s.bind(op)
+			bound = ""
+			if code == goldap.LDAPResultSuccess {
+				bound = stringValue(op.Children[1])
+			}
+			responses = append(responses, result(goldap.ApplicationBindResponse, code))
+		case goldap.ApplicationSearchRequest:
+			responses = s.search(op, bound)
+		case goldap.ApplicationUnbindRequest:
+			return
+		case goldap.ApplicationExtendedRequest:
+			// StartTLS among others
+			responses = append(responses, result(goldap.ApplicationExtendedResponse, goldap.LDAPResultProtocolError))
+		default:
+			return
+		}
+
+		for _, response := range responses {
+			message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+			message.AppendChild(response)
+			if _, err := conn.Write(message.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// bind checks a simple bind, anonymous binds succeed
+func (s *Server) bind(op *ber.Packet) uint16 {
+	if len(op.Children) < 3 {
+		return goldap.LDAPResultProtocolError
+	}
+	dn, password := stringValue(op.Children[1]), stringValue(op.Children[2])
+	if dn == "" && password == "" {
+		return goldap.LDAPResultSuccess
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if strings.EqualFold(e.DN, dn) && e.Password != "" && e.Password == password {
+			return goldap.LDAPResultSuccess
+		}
+	}
+	return goldap.LDAPResultInvalidCredentials
+}
+
+func (s *Server) search(op *ber.Packet, bound string) []*ber.Packet {
+	if len(op.Children) < 8 {
+		return []*ber.Packet{result(goldap.ApplicationSearchResultDone, goldap.LDAPResultProtocolError)}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if bound == "" && !s.anonymous {
+		return []*ber.Packet{result(goldap.ApplicationSearchResultDone, goldap.LDAPResultInsufficientAccessRights)}
+	}
+
+	base := strings.ToLower(stringValue(op.Children[0]))
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	var attributes []string
+	for _, a := range op.Children[7].Children {
+		attributes = append(attributes, stringValue(a))
+	}
+
+	var responses []*ber.Packet
+	for _, e := range s.entries {
+		if !strings.HasSuffix(strings.ToLower(e.DN), base) {
+			continue
+		}
+		ok, err := matches(filter, e)
+		if err != nil {
+			return []*ber.Packet{result(goldap.ApplicationSearchResultDone, goldap.LDAPResultUnwillingToPerform)}
+		}
+		if !ok {
+			continue
+		}
+		if sizeLimit > 0 && int64(len(responses)) == sizeLimit {
+			return append(responses, result(goldap.ApplicationSearchResultDone, goldap.LDAPResultSizeLimitExceeded))
+		}
+		responses = append(responses, searchEntry(e, attributes))
+	}
+
+	return append(responses, result(goldap.ApplicationSearchResultDone, goldap.LDAPResultSuccess))
+}
+
+var errUnsupportedFilter = errors.New("unsupported filter")
+
+// matches evaluates filter for e, attribute names and values are case
+// insensitive
+func matches(filter *ber.Packet, e Entry) (bool, error) {
+	switch filter.Tag {
+	case goldap.FilterAnd, goldap.FilterOr:
+		and := filter.Tag == goldap.FilterAnd
+		for _, child := range filter.Children {
+			ok, err := matches(child, e)
+			if err != nil {
+				return false, err
+			}
+			if ok != and {
+				return ok, nil
+			}
+		}
+		return and, nil
+	case goldap.FilterNot:
+		if len(filter.Children) != 1 {
+			return false, errUnsupportedFilter
+		}
+		ok, err := matches(filter.Children[0], e)
+		return !ok, err
+	case goldap.FilterEqualityMatch:
+		if len(filter.Children) != 2 {
+			return false, errUnsupportedFilter
+		}
+		for _, v := range values(e, stringValue(filter.Children[0])) {
+			if strings.EqualFold(v, stringValue(filter.Children[1])) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case goldap.FilterPresent:
+		attr := filter.Data.String()
+		return strings.EqualFold(attr, "objectClass") || len(values(e, attr)) > 0, nil
+	}
+	return false, errUnsupportedFilter
+}
+
+func values(e Entry, attr string) []string {
+	for name, v := range e.Attributes {
+		if strings.EqualFold(name, attr) {
+			return v
+		}
+	}
+	return nil
+}
+
+func searchEntry(e Entry, attributes []string) *ber.Packet {
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "Object Name"))
+
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, vals := range e.Attributes {
+		wanted := len(attributes) == 0
+		for _, a := range attributes {
+			wanted = wanted || strings.EqualFold(a, name)
+		}
+		if !wanted {
+			continue
+		}
+
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range vals {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	entry.AppendChild(attrs)
+
+	return entry
+}
+
+func result(tag ber.Tag, code uint16) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return packet
+}
+
+// stringValue returns the content of an octet string, also context specific
+// ones like the simple bind password
+func stringValue(p *ber.Packet) string {
+	if p.Data == nil {
+		return ""
+	}
+	return p.Data.String()
+}
@@ -3,13 +3,17 @@ package misc
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"math/big"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lixmal/gdprshare/pkg/config"
 	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/storage"
 )
 
 // GenToken generates a cryptographically secure random token of the specified length.
@@ -26,40 +30,331 @@ func GenToken(length int) (string, error) {
 	return token, nil
 }
 
-// DeleteStoredFile removes a stored file from both the filesystem and database.
-func DeleteStoredFile(f *database.StoredFile, db *database.Database, config *config.Config) []error {
-	var errors []error
+// GenCode generates a cryptographically secure random code of the specified
+// number of decimal digits, to be typed in by people.
+func GenCode(digits int) (string, error) {
+	code := make([]byte, digits)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code[i] = byte('0' + n.Int64())
+	}
+
+	return string(code), nil
+}
+
+// RemoveBlob removes the contents of a stored file from the storage backend,
+// shredding them if configured, and records the deletion method on the file.
+// The database entry is kept.
+func RemoveBlob(f *database.StoredFile, db *database.Database, store storage.Backend, config *config.Config) error {
+	var passes int
+	if config.Storage.Shred.Enabled {
+		passes = config.Storage.Shred.Passes
+	}
+
+	method, err := storage.Remove(store, f.Name, passes)
+	if err != nil {
+		return fmt.Errorf("delete file with id %s from storage: %w", f.FileId, err)
+	}
+
+	now := time.Now()
+	f.DeletionMethod = method
+	f.ContentDeletedAt = &now
+	err = db.Model(f).Updates(map[string]interface{}{
+		"deletion_method":    method,
+		"content_deleted_at": now,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("record deletion method of file with id %s: %w", f.FileId, err)
+	}
 
-	path := filepath.Join(config.StorePath, f.Name)
-	if err := os.Remove(path); err != nil {
-		errors = append(errors, fmt.Errorf("delete file with id %s from storage: %w", f.FileId, err))
+	return nil
+}
+
+// DeleteStoredFile removes a stored file from both the storage backend and database.
+func DeleteStoredFile(f *database.StoredFile, db *database.Database, store storage.Backend, config *config.Config) []error {
+	var errs []error
+
+	// contents are already gone if the download count was used up
+	if f.DeletionMethod == "" {
+		if err := RemoveBlob(f, db, store, config); err != nil {
+			errs = append(errs, err)
+		}
 	}
 	if err := db.Delete(&f).Error; err != nil {
-		errors = append(errors, fmt.Errorf("delete file with id %s from database: %w", f.FileId, err))
+		return append(errs, fmt.Errorf("delete file with id %s from database: %w", f.FileId, err))
+	}
+	if err := PseudonymiseStoredFile(f, db); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// isDeleted reports whether the row of f is deleted
+func isDeleted(db *database.Database, f *database.StoredFile) bool {
+	var count int
+	if err := db.Model(&database.StoredFile{}).Where("id = ?", f.ID).Count(&count).Error; err != nil {
+		return false
+	}
+	return count == 0
+}
+
+// deletionDetail is the audit detail of a deletion that failed in part
+func deletionDetail(method string, errs []error) string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	detail := "failed: " + strings.Join(msgs, "; ")
+	if method != "" {
+		detail = method + ", " + detail
+	}
+	return detail
+}
+
+// PseudonymiseStoredFile strips the metadata of a deleted file down to what
+// its transfer record needs: times, TLS parameters and countries are kept,
+// addresses, user agents, cities, the email addresses and file name removed.
+func PseudonymiseStoredFile(f *database.StoredFile, db *database.Database) error {
+	clientFields := map[string]interface{}{"addr": "", "user_agent": "", "city": ""}
+	now := time.Now()
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return fmt.Errorf("pseudonymise file with id %s: %w", f.FileId, tx.Error)
+	}
+
+	for _, model := range []interface{}{&database.Client{}, &database.DstClient{}, &database.DeniedClient{}, &database.ApprovalRequest{}} {
+		if err := tx.Unscoped().Model(model).Where("stored_file_id = ?", f.ID).Updates(clientFields).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("pseudonymise clients of file with id %s: %w", f.FileId, err)
+		}
+	}
+	// audit clients hold nothing but the address and user agent
+	if err := tx.Where("file_id = ?", f.FileId).Delete(&database.AuditClient{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("pseudonymise audit clients of file with id %s: %w", f.FileId, err)
+	}
+
+	err := tx.Unscoped().Model(&database.StoredFile{}).Where("id = ?", f.ID).Updates(map[string]interface{}{
+		"email":            "",
+		"recipient_email":  "",
+		"filename":         "",
+		"pseudonymised_at": now,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("pseudonymise file with id %s: %w", f.FileId, err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("pseudonymise file with id %s: %w", f.FileId, err)
 	}
 
-	return errors
+	f.Email, f.RecipientEmail, f.Filename, f.PseudonymisedAt = "", "", "", &now
+	return nil
 }
 
-// Cleanup removes expired files from the database and filesystem.
-func Cleanup(db *database.Database, config *config.Config) []error {
+// PurgeStoredFile removes a deleted file and everything referring to it from
+// the database for good.
+func PurgeStoredFile(f *database.StoredFile, db *database.Database) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return fmt.Errorf("purge file with id %s: %w", f.FileId, tx.Error)
+	}
+
+	for _, model := range []interface{}{&database.Client{}, &database.DstClient{}, &database.DeniedClient{}, &database.ApprovalRequest{}, &database.VerificationCode{}, &database.DownloadToken{}} {
+		if err := tx.Unscoped().Where("stored_file_id = ?", f.ID).Delete(model).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("purge metadata of file with id %s: %w", f.FileId, err)
+		}
+	}
+	if err := tx.Where("file_id = ?", f.FileId).Delete(&database.AuditClient{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("purge audit clients of file with id %s: %w", f.FileId, err)
+	}
+	if err := tx.Unscoped().Delete(f).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("purge file with id %s: %w", f.FileId, err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("purge file with id %s: %w", f.FileId, err)
+	}
+	return nil
+}
+
+// Cleanup removes expired files from the database and storage backend.
+func Cleanup(db *database.Database, store storage.Backend, config *config.Config) []error {
 	now := time.Now()
-	var errors []error
+	var errs []error
 
 	var files []database.StoredFile
 	if err := db.Find(&files).Error; err != nil && !db.IsRecordNotFoundError(err) {
-		return append(errors, fmt.Errorf("fetch files from database: %w", err))
+		return append(errs, fmt.Errorf("fetch files from database: %w", err))
 	}
 
 	for _, f := range files {
-		expiryTime := f.CreatedAt.AddDate(0, 0, int(f.Expiry))
-
-		if now.After(expiryTime) {
-			if errs := DeleteStoredFile(&f, db, config); len(errs) > 0 {
-				errors = append(errors, errs...)
+		if now.After(f.ExpiresAt()) {
+			derrs := DeleteStoredFile(&f, db, store, config)
+			detail := f.DeletionMethod
+			if len(derrs) > 0 {
+				errs = append(errs, derrs...)
+				// later runs won't see a deleted row, so this is the only
+				// chance to record it
+				if !isDeleted(db, &f) {
+					continue
+				}
+				detail = deletionDetail(f.DeletionMethod, derrs)
+			}
+			err := db.AppendAudit(&database.AuditEntry{
+				Event:  database.AuditExpiryDelete,
+				FileId: f.FileId,
+				Detail: detail,
+			})
+			if err != nil {
+				errs = append(errs, err)
 			}
 		}
 	}
 
-	return errors
+	errs = append(errs, enforceRetention(db, config, now)...)
+	errs = append(errs, expireFileRequests(db, config, now)...)
+
+	var sessions []*database.UploadSession
+	if err := db.Where("expires_at < ?", now).Preload("Chunks").Find(&sessions).Error; err != nil && !db.IsRecordNotFoundError(err) {
+		return append(errs, fmt.Errorf("fetch upload sessions from database: %w", err))
+	}
+
+	for _, session := range sessions {
+		if derrs := DeleteUploadSession(session, db, store); len(derrs) > 0 {
+			errs = append(errs, derrs...)
+		}
+	}
+
+	if err := db.Unscoped().Where("expires_at < ?", now).Delete(&database.DownloadToken{}).Error; err != nil {
+		errs = append(errs, fmt.Errorf("delete expired download tokens: %w", err))
+	}
+
+	if err := db.Unscoped().Where("expires_at < ?", now).Delete(&database.Session{}).Error; err != nil {
+		errs = append(errs, fmt.Errorf("delete expired sessions: %w", err))
+	}
+
+	if err := db.Unscoped().Where("expires_at < ?", now).Delete(&database.LoginState{}).Error; err != nil {
+		errs = append(errs, fmt.Errorf("delete expired login states: %w", err))
+	}
+
+	return errs
+}
+
+// expireFileRequests removes the address and message of requests that stopped
+// taking uploads, and the requests themselves once the retention period is
+// over. Files uploaded into a request expire on their own.
+func expireFileRequests(db *database.Database, config *config.Config, now time.Time) []error {
+	var errs []error
+
+	var requests []database.FileRequest
+	if err := db.Find(&requests).Error; err != nil && !db.IsRecordNotFoundError(err) {
+		return append(errs, fmt.Errorf("fetch file requests from database: %w", err))
+	}
+	for i := range requests {
+		r := &requests[i]
+		if r.ClosedAt == nil && now.Before(r.ExpiresAt()) {
+			continue
+		}
+
+		if err := db.Model(r).Updates(map[string]interface{}{"email": "", "message": ""}).Error; err != nil {
+			errs = append(errs, fmt.Errorf("pseudonymise file request %s: %w", r.RequestId, err))
+			continue
+		}
+		if err := db.Delete(r).Error; err != nil {
+			errs = append(errs, fmt.Errorf("delete file request %s: %w", r.RequestId, err))
+		}
+	}
+
+	err := db.Unscoped().
+		Where("deleted_at < ?", now.AddDate(0, 0, -int(config.Retention.Days))).
+		Delete(&database.FileRequest{}).Error
+	if err != nil {
+		errs = append(errs, fmt.Errorf("purge file requests: %w", err))
+	}
+
+	return errs
+}
+
+// enforceRetention pseudonymises the metadata of deleted files not handled yet
+// and purges it once the retention period is over.
+func enforceRetention(db *database.Database, config *config.Config, now time.Time) []error {
+	var errs []error
+
+	var deleted []database.StoredFile
+	err := db.Unscoped().Where("deleted_at IS NOT NULL AND pseudonymised_at IS NULL").Find(&deleted).Error
+	if err != nil && !db.IsRecordNotFoundError(err) {
+		return append(errs, fmt.Errorf("fetch deleted files from database: %w", err))
+	}
+	for i := range deleted {
+		if err := PseudonymiseStoredFile(&deleted[i], db); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var expired []database.StoredFile
+	err = db.Unscoped().Where("deleted_at < ?", now.AddDate(0, 0, -int(config.Retention.Days))).Find(&expired).Error
+	if err != nil && !db.IsRecordNotFoundError(err) {
+		return append(errs, fmt.Errorf("fetch files past retention from database: %w", err))
+	}
+	for i := range expired {
+		if err := PurgeStoredFile(&expired[i], db); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// clients left behind by files removed by other means
+	for _, model := range []interface{}{&database.Client{}, &database.DstClient{}, &database.DeniedClient{}, &database.ApprovalRequest{}, &database.VerificationCode{}} {
+		err := db.Unscoped().
+			Where("stored_file_id NOT IN (?)", db.Unscoped().Table("stored_files").Select("id").SubQuery()).
+			Delete(model).Error
+		if err != nil {
+			errs = append(errs, fmt.Errorf("purge orphaned clients: %w", err))
+		}
+	}
+
+	// audit clients of logins, requests and other events without a stored file
+	err = db.Where("created_at < ?", now.AddDate(0, 0, -int(config.Retention.Days))).
+		Where("file_id NOT IN (?)", db.Unscoped().Table("stored_files").Select("file_id").SubQuery()).
+		Delete(&database.AuditClient{}).Error
+	if err != nil {
+		errs = append(errs, fmt.Errorf("purge audit clients: %w", err))
+	}
+
+	return errs
+}
+
+// ChunkName returns the blob name of a chunk of an upload session.
+func ChunkName(sessionName string, index uint) string {
+	return sessionName + "." + strconv.FormatUint(uint64(index), 10)
+}
+
+// DeleteUploadSession removes an upload session with all its chunks from the
+// storage backend and database.
+func DeleteUploadSession(session *database.UploadSession, db *database.Database, store storage.Backend) []error {
+	var errs []error
+
+	for _, chunk := range session.Chunks {
+		name := ChunkName(session.Name, chunk.Index)
+		if err := store.Delete(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("delete chunk %s of upload %s from storage: %w", name, session.UploadId, err))
+		}
+	}
+	if err := db.Unscoped().Where("upload_session_id = ?", session.ID).Delete(&database.UploadChunk{}).Error; err != nil {
+		errs = append(errs, fmt.Errorf("delete chunks of upload %s from database: %w", session.UploadId, err))
+	}
+	if err := db.Unscoped().Delete(session).Error; err != nil {
+		errs = append(errs, fmt.Errorf("delete upload %s from database: %w", session.UploadId, err))
+	}
+
+	return errs
 }
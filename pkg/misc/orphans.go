@@ -0,0 +1,138 @@
+package misc
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/lixmal/gdprshare/pkg/config"
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/storage"
+)
+
+// OrphanGrace is the age a blob or file needs to count as orphaned. Uploads
+// write their blob before the database row, so younger ones may be in
+// progress.
+const OrphanGrace = time.Hour
+
+// Orphans are blobs no available file refers to and files whose blob is gone
+type Orphans struct {
+	Blobs []*storage.Info
+	Files []database.StoredFile
+}
+
+// FindOrphans compares the blobs of the storage backend with the database.
+// Blobs of deleted files and of files whose contents were removed are
+// orphans as well, chunks of upload sessions are not. Names starting with a
+// dot are never blobs, except for the leftovers of an interrupted shred.
+func FindOrphans(db *database.Database, store storage.Backend, now time.Time) (*Orphans, error) {
+	// the rows first: blobs are written before them, so every blob of a
+	// listed file is in the listing
+	var files []database.StoredFile
+	if err := db.Where("content_deleted_at IS NULL").Order("id").Find(&files).Error; err != nil {
+		return nil, fmt.Errorf("fetch files from database: %w", err)
+	}
+	var sessions []database.UploadSession
+	if err := db.Find(&sessions).Error; err != nil {
+		return nil, fmt.Errorf("fetch upload sessions from database: %w", err)
+	}
+
+	blobs, err := store.List()
+	if err != nil {
+		return nil, fmt.Errorf("list blobs: %w", err)
+	}
+
+	referenced := map[string]bool{}
+	for _, f := range files {
+		referenced[f.Name] = true
+	}
+	sessionNames := map[string]bool{}
+	for _, session := range sessions {
+		sessionNames[session.Name] = true
+	}
+
+	o := &Orphans{}
+	present := map[string]bool{}
+	for _, b := range blobs {
+		present[b.Name] = true
+		if strings.HasPrefix(b.Name, ".") && !storage.IsShredLeftover(b.Name) || referenced[b.Name] || now.Sub(b.ModTime) < OrphanGrace {
+			continue
+		}
+		// see ChunkName
+		if i := strings.LastIndexByte(b.Name, '.'); i > 0 && sessionNames[b.Name[:i]] {
+			continue
+		}
+		o.Blobs = append(o.Blobs, b)
+	}
+	for _, f := range files {
+		if !present[f.Name] && now.Sub(f.CreatedAt) >= OrphanGrace {
+			o.Files = append(o.Files, f)
+		}
+	}
+
+	return o, nil
+}
+
+// RepairOrphans removes the orphaned blobs and deletes the files whose blob
+// is gone, recording them in the audit log.
+func RepairOrphans(o *Orphans, db *database.Database, store storage.Backend, config *config.Config) []error {
+	var errs []error
+
+	var passes int
+	if config.Storage.Shred.Enabled {
+		passes = config.Storage.Shred.Passes
+	}
+	for _, b := range o.Blobs {
+		if _, err := storage.Remove(store, b.Name, passes); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("delete orphaned blob %s: %w", b.Name, err))
+		}
+	}
+
+	for i := range o.Files {
+		f := &o.Files[i]
+		// the blob may have shown up since the orphans were found
+		if _, err := store.Stat(f.Name); !errors.Is(err, fs.ErrNotExist) {
+			if err != nil {
+				errs = append(errs, fmt.Errorf("check blob of file with id %s: %w", f.FileId, err))
+			}
+			continue
+		}
+		if derrs := ForceDeleteStoredFile(f, db, store, config); len(derrs) > 0 {
+			errs = append(errs, derrs...)
+			continue
+		}
+		err := db.AppendAudit(&database.AuditEntry{
+			Event:  database.AuditAdminDelete,
+			FileId: f.FileId,
+			Detail: f.DeletionMethod,
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// ForceDeleteStoredFile deletes a file like DeleteStoredFile, but records a
+// blob that is already gone as missing instead of failing.
+func ForceDeleteStoredFile(f *database.StoredFile, db *database.Database, store storage.Backend, config *config.Config) []error {
+	if f.DeletionMethod == "" {
+		if _, err := store.Stat(f.Name); errors.Is(err, fs.ErrNotExist) {
+			now := time.Now()
+			f.DeletionMethod = storage.MethodMissing
+			f.ContentDeletedAt = &now
+			err := db.Model(f).Updates(map[string]interface{}{
+				"deletion_method":    f.DeletionMethod,
+				"content_deleted_at": now,
+			}).Error
+			if err != nil {
+				return []error{fmt.Errorf("record missing blob of file with id %s: %w", f.FileId, err)}
+			}
+		}
+	}
+
+	return DeleteStoredFile(f, db, store, config)
+}
@@ -0,0 +1,498 @@
+// Package oidc implements the parts of OpenID Connect a web application
+// login needs: discovery, the authorization code flow with PKCE and the
+// verification of ID tokens against the provider's published keys.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	_ "crypto/sha512" // SHA-384 and SHA-512 of the RS, PS and ES algorithms
+)
+
+// Leeway is the clock skew tolerated between provider and server
+const Leeway = time.Minute
+
+var ErrInvalidToken = errors.New("invalid ID token")
+
+// replaced in tests
+var timeNow = time.Now
+
+// Metadata is the part of the provider's discovery document used here
+type Metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Claims are the verified claims of an ID token
+type Claims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     *bool    `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// audience is a single string or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Provider is an OpenID provider the application is registered at. The
+// discovery document and keys are fetched on first use and kept, keys are
+// refetched when a token is signed with an unknown one.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for public clients
+	RedirectURL  string
+	Scopes       []string
+	HTTPClient   *http.Client
+
+	mu       sync.Mutex
+	metadata *Metadata
+	keys     map[string]crypto.PublicKey
+}
+
+// New creates a provider for issuer, e.g. https://accounts.example.com
+func New(issuer, clientID, clientSecret, redirectURL string, scopes []string) *Provider {
+	return &Provider{
+		Issuer:       strings.TrimRight(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+		HTTPClient:   http.DefaultClient,
+	}
+}
+
+// NewVerifier generates a PKCE code verifier
+func NewVerifier() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Challenge returns the S256 code challenge of a verifier
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Discover fetches the discovery document, once
+func (p *Provider) Discover(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var m Metadata
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &m); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimRight(m.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q doesn't match %q", m.Issuer, p.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, errors.New("discovery: endpoints missing")
+	}
+
+	p.metadata = &m
+	return p.metadata, nil
+}
+
+// AuthCodeURL returns the URL to send the user to for login
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	m, err := p.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return m.AuthorizationEndpoint + sep + query.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified claims of
+// the ID token issued with it
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	m, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+	// client_secret_basic is the default of the spec, post if it's all the
+	// provider takes
+	postSecret := len(m.TokenAuthMethods) > 0 && !contains(m.TokenAuthMethods, "client_secret_basic") && contains(m.TokenAuthMethods, "client_secret_post")
+	if p.ClientSecret != "" && postSecret {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" && !postSecret {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return nil, fmt.Errorf("token response: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return nil, fmt.Errorf("token request: %s: %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token response without ID token")
+	}
+
+	return p.Verify(ctx, token.IDToken, nonce)
+}
+
+// Verify checks signature, issuer, audience, expiry and nonce of an ID token
+// and returns its claims
+func (p *Provider) Verify(ctx context.Context, rawToken, nonce string) (*Claims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %s", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %s", ErrInvalidToken, err)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %s", ErrInvalidToken, err)
+	}
+
+	now := timeNow()
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.Issuer:
+		return nil, fmt.Errorf("%w: issuer %q", ErrInvalidToken, claims.Issuer)
+	case !contains(claims.Audience, p.ClientID):
+		return nil, fmt.Errorf("%w: not issued for this client", ErrInvalidToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID:
+		return nil, fmt.Errorf("%w: authorized party %q", ErrInvalidToken, claims.AuthorizedParty)
+	case now.After(time.Unix(claims.Expiry, 0).Add(Leeway)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(Leeway)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: subject missing", ErrInvalidToken)
+	}
+
+	return &claims, nil
+}
+
+// key returns the signing key with the given id, refetching the key set
+// once if it's unknown, e.g. after a key rotation
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	m, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for refreshed := false; ; refreshed = true {
+		if key, ok := p.keys[kid]; ok {
+			return key, nil
+		}
+		// tokens without key id are fine if there's only one key
+		if kid == "" && len(p.keys) == 1 {
+			for _, key := range p.keys {
+				return key, nil
+			}
+		}
+		if refreshed {
+			return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+		}
+
+		keys, err := p.fetchKeys(ctx, m.JWKSURI)
+		if err != nil {
+			return nil, err
+		}
+		p.keys = keys
+	}
+}
+
+func (p *Provider) fetchKeys(ctx context.Context, jwksURI string) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("fetch keys: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// keys of unsupported types are skipped, others may still be usable
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// jwk is a public key of the provider's key set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verifySignature checks a JWS signature. The algorithm has to fit the key,
+// so a token can't pick a weaker one.
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch {
+	case strings.HasSuffix(alg, "256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	}
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signed, signature) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %q doesn't fit the key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+
+	case strings.HasPrefix(alg, "PS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %q doesn't fit the key", alg)
+		}
+		return rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+
+	case strings.HasPrefix(alg, "ES"):
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature)%2 != 0 {
+			return fmt.Errorf("algorithm %q doesn't fit the key", alg)
+		}
+		// JWS signatures are r and s concatenated, not ASN.1
+		r := new(big.Int).SetBytes(signature[:len(signature)/2])
+		s := new(big.Int).SetBytes(signature[len(signature)/2:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func decodeInt(b64 string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(b64)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/oidc/oidctest"
+)
+
+// login walks through the authorization code flow of the test provider and
+// returns the code and state it redirects back with
+func login(t *testing.T, p *Provider, nonce, verifier string) (code, state string) {
+	t.Helper()
+
+	authURL, err := p.AuthCodeURL(context.Background(), "some-state", nonce, verifier)
+	require.NoError(t, err)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/callback", location.Path)
+
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	idp := oidctest.New(oidctest.User{Subject: "alice", Email: "alice@example.com", Name: "Alice"})
+	defer idp.Close()
+
+	p := New(idp.Issuer()+"/", oidctest.ClientID, oidctest.ClientSecret, "http://gdprshare.test/callback", []string{"openid", "email"})
+
+	verifier, err := NewVerifier()
+	require.NoError(t, err)
+
+	code, state := login(t, p, "some-nonce", verifier)
+	assert.Equal(t, "some-state", state)
+
+	claims, err := p.Exchange(context.Background(), code, verifier, "some-nonce")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+	assert.Equal(t, "alice@example.com", claims.Email)
+	assert.Equal(t, "Alice", claims.Name)
+
+	t.Run("code used twice", func(t *testing.T) {
+		_, err := p.Exchange(context.Background(), code, verifier, "some-nonce")
+		assert.ErrorContains(t, err, "invalid_grant")
+	})
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		code, _ := login(t, p, "some-nonce", verifier)
+		other, err := NewVerifier()
+		require.NoError(t, err)
+
+		_, err = p.Exchange(context.Background(), code, other, "some-nonce")
+		assert.ErrorContains(t, err, "PKCE")
+	})
+
+	t.Run("wrong nonce", func(t *testing.T) {
+		code, _ := login(t, p, "some-nonce", verifier)
+		_, err := p.Exchange(context.Background(), code, verifier, "other-nonce")
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		p := New(idp.Issuer(), oidctest.ClientID, "wrong", "http://gdprshare.test/callback", nil)
+		code, _ := login(t, p, "some-nonce", verifier)
+		_, err := p.Exchange(context.Background(), code, verifier, "some-nonce")
+		assert.ErrorContains(t, err, "invalid_client")
+	})
+}
+
+func TestVerify(t *testing.T) {
+	idp := oidctest.New(oidctest.User{})
+	defer idp.Close()
+
+	p := New(idp.Issuer(), oidctest.ClientID, "", "", nil)
+	ctx := context.Background()
+	now := time.Now()
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   idp.Issuer(),
+			"sub":   "bob",
+			"aud":   oidctest.ClientID,
+			"exp":   now.Add(time.Minute).Unix(),
+			"iat":   now.Unix(),
+			"nonce": "n",
+		}
+		for name, v := range overrides {
+			c[name] = v
+		}
+		return c
+	}
+
+	verified, err := p.Verify(ctx, idp.Sign(claims(nil)), "n")
+	require.NoError(t, err)
+	assert.Equal(t, "bob", verified.Subject)
+
+	_, err = p.Verify(ctx, idp.Sign(claims(map[string]interface{}{
+		"aud": []string{"other", oidctest.ClientID},
+		"azp": oidctest.ClientID,
+	})), "n")
+	assert.NoError(t, err, "audience list with authorized party")
+
+	for name, overrides := range map[string]map[string]interface{}{
+		"issuer":         {"iss": "https://evil.example.com"},
+		"audience":       {"aud": "other"},
+		"authorized":     {"aud": []string{"other", oidctest.ClientID}},
+		"expired":        {"exp": now.Add(-2 * Leeway).Unix()},
+		"issued later":   {"iat": now.Add(2 * Leeway).Unix()},
+		"nonce":          {"nonce": "replayed"},
+		"subject":        {"sub": ""},
+		"iat wrong type": {"iat": "yesterday"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := p.Verify(ctx, idp.Sign(claims(overrides)), "n")
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		token := idp.Sign(claims(nil))
+		other := idp.Sign(claims(map[string]interface{}{"sub": "mallory"}))
+		// claims of one token with the signature of the other
+		tampered := other[:strings.LastIndex(other, ".")] + token[strings.LastIndex(token, "."):]
+
+		_, err := p.Verify(ctx, tampered, "n")
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("alg none", func(t *testing.T) {
+		token := idp.Sign(claims(nil))
+		// {"alg":"none","kid":"test-key"}
+		unsigned := "eyJhbGciOiJub25lIiwia2lkIjoidGVzdC1rZXkifQ" + token[strings.Index(token, "."):strings.LastIndex(token, ".")] + "."
+
+		_, err := p.Verify(ctx, unsigned, "n")
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("clock skew", func(t *testing.T) {
+		defer func() { timeNow = time.Now }()
+		timeNow = func() time.Time { return now.Add(time.Minute + Leeway/2) }
+
+		_, err := p.Verify(ctx, idp.Sign(claims(nil)), "n")
+		assert.NoError(t, err)
+	})
+}
+
+func TestChallenge(t *testing.T) {
+	// RFC 7636, appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+}
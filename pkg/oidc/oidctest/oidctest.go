@@ -0,0 +1,233 @@
+// Package oidctest provides an OpenID provider for tests. It logs in the
+// configured user without asking and issues ID tokens signed with a
+// generated RSA key.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	ClientID     = "gdprshare-test"
+	ClientSecret = "test-secret"
+	KeyID        = "test-key"
+)
+
+// User is who the provider logs in
+type User struct {
+	Subject string
+	Email   string
+	Name    string
+}
+
+type grant struct {
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	user        User
+}
+
+// Provider is a running test provider
+type Provider struct {
+	*httptest.Server
+	Key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	user  User
+	codes map[string]grant
+	// Claims are merged into every issued ID token, e.g. to issue one with
+	// a wrong audience
+	Claims map[string]interface{}
+}
+
+// New starts a provider that logs in user
+func New(user User) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	p := &Provider{
+		Key:    key,
+		user:   user,
+		codes:  make(map[string]grant),
+		Claims: make(map[string]interface{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+
+	return p
+}
+
+// Issuer is the issuer URL to configure
+func (p *Provider) Issuer() string {
+	return p.URL
+}
+
+// SetUser changes who the next login is for
+func (p *Provider) SetUser(user User) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.user = user
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := p.Key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": KeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize redirects back right away, as if the user had logged in
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("client_id") != ClientID || query.Get("response_type") != "code" ||
+		query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randString()
+	p.mu.Lock()
+	p.codes[code] = grant{
+		clientID:    ClientID,
+		redirectURI: query.Get("redirect_uri"),
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+		user:        p.user,
+	}
+	p.mu.Unlock()
+
+	values := redirectURI.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirectURI.RawQuery = values.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != ClientID || secret != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	code := r.PostFormValue("code")
+	p.mu.Lock()
+	g, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	switch {
+	case r.PostFormValue("grant_type") != "authorization_code" || !ok:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	case r.PostFormValue("redirect_uri") != g.redirectURI:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "redirect_uri mismatch"})
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   p.URL,
+		"sub":   g.user.Subject,
+		"aud":   g.clientID,
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"iat":   now.Unix(),
+		"nonce": g.nonce,
+	}
+	if g.user.Email != "" {
+		claims["email"] = g.user.Email
+		claims["email_verified"] = true
+	}
+	if g.user.Name != "" {
+		claims["name"] = g.user.Name
+	}
+	p.mu.Lock()
+	for name, v := range p.Claims {
+		claims[name] = v
+	}
+	p.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     p.Sign(claims),
+	})
+}
+
+// Sign returns an RS256 signed JWT with the given claims
+func (p *Provider) Sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": KeyID})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		panic(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func randString() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,176 @@
+package record
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+const receiptTimeFormat = "2006-01-02 15:04:05 UTC"
+
+// receiptColumn is a table column of the receipt, widths are in mm
+type receiptColumn struct {
+	title string
+	width float64
+}
+
+var (
+	transferColumns = []receiptColumn{
+		{"Time", 38},
+		{"TLS version", 20},
+		{"Cipher suite", 80},
+		{"Location", 52},
+	}
+	denialColumns = []receiptColumn{
+		{"Time", 38},
+		{"Reason", 32},
+		{"TLS version", 20},
+		{"Cipher suite", 62},
+		{"Location", 38},
+	}
+)
+
+// WriteReceipt renders the record as a PDF document for filing
+func (r *Record) WriteReceipt(w io.Writer) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.SetTitle("gdprshare transfer receipt "+r.FileId, true)
+	pdf.SetProducer("gdprshare", false)
+	pdf.SetCreationDate(r.IssuedAt)
+	pdf.SetModificationDate(r.IssuedAt)
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-15)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.CellFormat(0, 10, fmt.Sprintf("File %s, issued %s, page %d/{nb}", r.FileId, formatTime(r.IssuedAt), pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 10, "Transfer receipt", "", 1, "L", false, 0, "")
+	pdf.Ln(2)
+
+	contentDeleted := "not yet deleted"
+	if r.ContentDeletedAt != nil {
+		contentDeleted = formatTime(*r.ContentDeletedAt)
+		if r.DeletionMethod != "" {
+			contentDeleted += " (" + r.DeletionMethod + ")"
+		}
+	}
+	recordDeleted := "not yet deleted"
+	if r.DeletedAt != nil {
+		recordDeleted = formatTime(*r.DeletedAt)
+	}
+
+	for _, field := range [][2]string{
+		{"File ID", r.FileId},
+		{"Ciphertext SHA-256", r.CiphertextSHA256},
+		{"Size", fmt.Sprintf("%d bytes", r.Size)},
+		{"Uploaded", formatTime(r.Upload.Time)},
+		{"Upload TLS", TLSVersionName(r.Upload.TLSVersion) + ", " + CipherSuiteName(r.Upload.TLSCipherSuite)},
+		{"Upload location", formatLocation(r.Upload)},
+		{"Expiry", formatTime(r.ExpiresAt)},
+		{"Contents deleted", contentDeleted},
+		{"File deleted", recordDeleted},
+	} {
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.CellFormat(45, 6, tr(field[0]), "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.CellFormat(0, 6, tr(field[1]), "", 1, "L", false, 0, "")
+	}
+
+	var transfers [][]string
+	for _, t := range r.Transfers {
+		transfers = append(transfers, []string{
+			formatTime(t.Dst.Time),
+			TLSVersionName(t.Dst.TLSVersion),
+			CipherSuiteName(t.Dst.TLSCipherSuite),
+			formatLocation(t.Dst),
+		})
+	}
+	receiptTable(pdf, tr, fmt.Sprintf("Downloads (%d)", len(transfers)), transferColumns, transfers)
+
+	var denials [][]string
+	for _, d := range r.Denied {
+		denials = append(denials, []string{
+			formatTime(d.Time),
+			d.Reason,
+			TLSVersionName(d.TLSVersion),
+			CipherSuiteName(d.TLSCipherSuite),
+			formatLocation(d.Client),
+		})
+	}
+	receiptTable(pdf, tr, fmt.Sprintf("Denied attempts (%d)", len(denials)), denialColumns, denials)
+
+	return pdf.Output(w)
+}
+
+func receiptTable(pdf *fpdf.Fpdf, tr func(string) string, title string, columns []receiptColumn, rows [][]string) {
+	pdf.Ln(6)
+	pdf.SetFont("Helvetica", "B", 12)
+	pdf.CellFormat(0, 8, tr(title), "", 1, "L", false, 0, "")
+
+	if len(rows) == 0 {
+		pdf.SetFont("Helvetica", "I", 9)
+		pdf.CellFormat(0, 6, "none", "", 1, "L", false, 0, "")
+		return
+	}
+
+	pdf.SetFont("Helvetica", "B", 8)
+	pdf.SetFillColor(230, 230, 230)
+	for _, col := range columns {
+		pdf.CellFormat(col.width, 6, col.title, "1", 0, "L", true, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Helvetica", "", 8)
+	for _, row := range rows {
+		for i, col := range columns {
+			pdf.CellFormat(col.width, 6, tr(row[i]), "1", 0, "L", false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+}
+
+// TLSVersionName returns the name of a TLS version as stored for a client,
+// either the numeric protocol version or the name set by a reverse proxy.
+func TLSVersionName(version string) string {
+	if v, err := strconv.ParseUint(version, 10, 16); err == nil {
+		return tls.VersionName(uint16(v))
+	}
+	if version == "" {
+		return "unknown"
+	}
+	return version
+}
+
+// CipherSuiteName returns the name of a cipher suite as stored for a client
+func CipherSuiteName(suite string) string {
+	if id, err := strconv.ParseUint(suite, 10, 16); err == nil {
+		return tls.CipherSuiteName(uint16(id))
+	}
+	if suite == "" {
+		return "unknown"
+	}
+	return suite
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(receiptTimeFormat)
+}
+
+func formatLocation(c Client) string {
+	switch {
+	case c.City != "" && c.Country != "":
+		return c.City + ", " + c.Country
+	case c.Country != "":
+		return c.Country
+	default:
+		return "unknown"
+	}
+}
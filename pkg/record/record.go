@@ -0,0 +1,178 @@
+// Package record creates and verifies signed transfer records: the evidence
+// of what was uploaded, how and where it was downloaded and when it was
+// deleted, signed by the server with Ed25519.
+package record
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const Version = 1
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Client is one side of a transfer
+type Client struct {
+	Time           time.Time `json:"time"`
+	TLSVersion     string    `json:"tlsVersion"`
+	TLSCipherSuite string    `json:"tlsCipherSuite"`
+	Country        string    `json:"country,omitempty"`
+	City           string    `json:"city,omitempty"`
+}
+
+// Transfer is a download of the uploaded file
+type Transfer struct {
+	Src Client `json:"src"`
+	Dst Client `json:"dst"`
+}
+
+// Denial is a refused download attempt
+type Denial struct {
+	Client
+	Reason string `json:"reason"`
+}
+
+type Record struct {
+	Version          int        `json:"version"`
+	FileId           string     `json:"fileId"`
+	CiphertextSHA256 string     `json:"ciphertextSha256"`
+	Size             int64      `json:"size"`
+	Upload           Client     `json:"upload"`
+	Transfers        []Transfer `json:"transfers"`
+	Denied           []Denial   `json:"denied,omitempty"`
+	ExpiresAt        time.Time  `json:"expiresAt"`
+	ContentDeletedAt *time.Time `json:"contentDeletedAt,omitempty"`
+	DeletionMethod   string     `json:"deletionMethod,omitempty"`
+	DeletedAt        *time.Time `json:"deletedAt,omitempty"`
+	IssuedAt         time.Time  `json:"issuedAt"`
+}
+
+// Signed is a record with the signature over its compact JSON encoding
+type Signed struct {
+	Record    json.RawMessage `json:"record"`
+	KeyId     string          `json:"keyId"`
+	Signature []byte          `json:"signature"`
+}
+
+// Sign encodes and signs the record
+func Sign(r *Record, key ed25519.PrivateKey) (*Signed, error) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("encode record: %w", err)
+	}
+
+	return &Signed{
+		Record:    payload,
+		KeyId:     KeyId(key.Public().(ed25519.PublicKey)),
+		Signature: ed25519.Sign(key, payload),
+	}, nil
+}
+
+// Verify checks a signed record as produced by Sign and returns its contents.
+// Reformatting the JSON, e.g. pretty printing, doesn't break the signature.
+func Verify(data []byte, pub ed25519.PublicKey) (*Record, error) {
+	var signed Signed
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("decode signed record: %w", err)
+	}
+
+	payload := &bytes.Buffer{}
+	if err := json.Compact(payload, signed.Record); err != nil {
+		return nil, fmt.Errorf("decode record: %w", err)
+	}
+
+	if signed.KeyId != KeyId(pub) {
+		return nil, fmt.Errorf("%w: signed with key %s, not %s", ErrInvalidSignature, signed.KeyId, KeyId(pub))
+	}
+	if !ed25519.Verify(pub, payload.Bytes(), signed.Signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	var r Record
+	if err := json.Unmarshal(payload.Bytes(), &r); err != nil {
+		return nil, fmt.Errorf("decode record: %w", err)
+	}
+	if r.Version != Version {
+		return nil, fmt.Errorf("unsupported record version %d", r.Version)
+	}
+
+	return &r, nil
+}
+
+// KeyId is the hex SHA-256 fingerprint of a public key
+func KeyId(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadPrivateKey reads a PKCS#8 PEM encoded Ed25519 key, as created by
+// "openssl genpkey -algorithm ed25519".
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key %s: %w", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key %s is not an Ed25519 key", path)
+	}
+
+	return priv, nil
+}
+
+// LoadPublicKey reads a PEM encoded Ed25519 public key, or derives it from a
+// private key.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "PRIVATE KEY" {
+		priv, err := LoadPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		return priv.Public().(ed25519.PublicKey), nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key %s: %w", path, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %s is not an Ed25519 key", path)
+	}
+
+	return pub, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s is not PEM encoded", path)
+	}
+
+	return block, nil
+}
@@ -0,0 +1,129 @@
+package record
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRecord() *Record {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return &Record{
+		Version:          Version,
+		FileId:           "abc",
+		CiphertextSHA256: "00ff",
+		Size:             42,
+		Upload:           Client{Time: now, TLSVersion: "TLS 1.3", Country: "DE"},
+		Transfers: []Transfer{{
+			Src: Client{Time: now, TLSVersion: "TLS 1.3", Country: "DE"},
+			Dst: Client{Time: now.Add(time.Hour), TLSVersion: "TLS 1.2", Country: "AT"},
+		}},
+		ExpiresAt: now.Add(24 * time.Hour),
+		IssuedAt:  now.Add(2 * time.Hour),
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signed, err := Sign(testRecord(), priv)
+	require.NoError(t, err)
+	assert.Equal(t, KeyId(pub), signed.KeyId)
+
+	data, err := json.Marshal(signed)
+	require.NoError(t, err)
+
+	r, err := Verify(data, pub)
+	require.NoError(t, err)
+	assert.Equal(t, testRecord(), r)
+
+	t.Run("pretty printed", func(t *testing.T) {
+		pretty := &bytes.Buffer{}
+		require.NoError(t, json.Indent(pretty, data, "", "  "))
+
+		_, err := Verify(pretty.Bytes(), pub)
+		assert.NoError(t, err)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := bytes.Replace(data, []byte(`"AT"`), []byte(`"US"`), 1)
+		require.NotEqual(t, data, tampered)
+
+		_, err := Verify(tampered, pub)
+		assert.ErrorIs(t, err, ErrInvalidSignature)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		other, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		_, err = Verify(data, other)
+		assert.ErrorIs(t, err, ErrInvalidSignature)
+	})
+}
+
+func TestLoadKeys(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	privPath := filepath.Join(dir, "record.key")
+	require.NoError(t, os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	der, err = x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	pubPath := filepath.Join(dir, "record.pub")
+	require.NoError(t, os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	loaded, err := LoadPrivateKey(privPath)
+	require.NoError(t, err)
+	assert.True(t, priv.Equal(loaded))
+
+	loadedPub, err := LoadPublicKey(pubPath)
+	require.NoError(t, err)
+	assert.True(t, pub.Equal(loadedPub))
+
+	loadedPub, err = LoadPublicKey(privPath)
+	require.NoError(t, err)
+	assert.True(t, pub.Equal(loadedPub), "public key is derived from the private key")
+
+	_, err = LoadPrivateKey(pubPath)
+	assert.Error(t, err)
+}
+
+func TestWriteReceipt(t *testing.T) {
+	r := testRecord()
+	deleted := r.IssuedAt.Add(-time.Minute)
+	r.ContentDeletedAt = &deleted
+	r.DeletionMethod = "shred:3"
+	r.Denied = []Denial{{
+		Client: Client{Time: r.IssuedAt, TLSVersion: "771", City: "Zürich", Country: "CH"},
+		Reason: "location",
+	}}
+
+	out := &bytes.Buffer{}
+	require.NoError(t, r.WriteReceipt(out))
+	assert.True(t, bytes.HasPrefix(out.Bytes(), []byte("%PDF-")))
+}
+
+func TestTLSNames(t *testing.T) {
+	assert.Equal(t, "TLS 1.2", TLSVersionName("771"))
+	assert.Equal(t, "TLSv1.3", TLSVersionName("TLSv1.3"))
+	assert.Equal(t, "unknown", TLSVersionName(""))
+	assert.Equal(t, "TLS_AES_128_GCM_SHA256", CipherSuiteName("4865"))
+	assert.Equal(t, "ECDHE-RSA-AES128-GCM-SHA256", CipherSuiteName("ECDHE-RSA-AES128-GCM-SHA256"))
+}
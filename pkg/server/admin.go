@@ -0,0 +1,263 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+	"github.com/lixmal/gdprshare/pkg/record"
+)
+
+// AdminListLimit is the number of files listed if the query sets no limit
+const AdminListLimit = 100
+
+// AdminFileQuery filters the files listed by the admin API
+type AdminFileQuery struct {
+	State    string `form:"state"   binding:"omitempty,oneof=active expired exhausted deleted"`
+	UserId   uint   `form:"user"`
+	APIKeyId uint   `form:"api-key"`
+	Email    string `form:"email"   binding:"omitempty,max=255"`
+	Limit    int    `form:"limit"   binding:"omitempty,min=1,max=10000"`
+}
+
+// AdminFile is a file as listed by the admin API
+type AdminFile struct {
+	FileId         string    `json:"fileId"`
+	State          string    `json:"state"`
+	Size           int64     `json:"size"`
+	Count          uint      `json:"count"`
+	Downloads      uint      `json:"downloads"`
+	Email          string    `json:"email,omitempty"`
+	UserId         uint      `json:"userId,omitempty"`
+	APIKeyId       uint      `json:"apiKeyId,omitempty"`
+	FileRequestId  uint      `json:"fileRequestId,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+	DeletionMethod string    `json:"deletionMethod,omitempty"`
+}
+
+// AdminFileDetails is a file with its sharing settings and transfer metadata
+type AdminFileDetails struct {
+	AdminFile
+	Filename         string         `json:"filename,omitempty"`
+	Type             string         `json:"type,omitempty"`
+	RecipientEmail   string         `json:"recipientEmail,omitempty"`
+	AllowedCountries string         `json:"allowedCountries,omitempty"`
+	OnlyEEA          bool           `json:"onlyEEA,omitempty"`
+	Delay            uint           `json:"delay,omitempty"`
+	Approval         bool           `json:"approval,omitempty"`
+	BlobPresent      bool           `json:"blobPresent"`
+	Approvals        []Approval     `json:"approvals,omitempty"`
+	Record           *record.Record `json:"record"`
+}
+
+// OrphanBlob is a blob no available file refers to
+type OrphanBlob struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// requireAdmin refuses requests without an API key with the admin scope
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := currentAPIKey(c)
+		if key == nil {
+			apiErrorAborted(c, http.StatusUnauthorized, ErrCodeAPIKeyInvalid, "admin API needs an API key")
+			return
+		}
+		if !key.HasScope(database.ScopeAdmin) {
+			apiErrorAborted(c, http.StatusForbidden, ErrCodeAPIKeyScope, "API key lacks scope "+database.ScopeAdmin)
+			return
+		}
+		c.Next()
+	}
+}
+
+func adminFile(f *database.StoredFile, now time.Time) AdminFile {
+	return AdminFile{
+		FileId:         f.FileId,
+		State:          f.State(now),
+		Size:           f.Size,
+		Count:          f.Count,
+		Downloads:      f.Downloads,
+		Email:          f.Email,
+		UserId:         f.UserId,
+		APIKeyId:       f.APIKeyId,
+		FileRequestId:  f.FileRequestId,
+		CreatedAt:      f.CreatedAt,
+		ExpiresAt:      f.ExpiresAt(),
+		DeletionMethod: f.DeletionMethod,
+	}
+}
+
+// adminListFiles lists files, newest first, filtered by state and sender
+func (s *Server) adminListFiles(c *gin.Context) {
+	var q AdminFileQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if q.Limit == 0 {
+		q.Limit = AdminListLimit
+	}
+
+	now := time.Now()
+	files, err := s.db.ListFiles(database.FileFilter{
+		State:    q.State,
+		UserId:   q.UserId,
+		APIKeyId: q.APIKeyId,
+		Email:    q.Email,
+		Limit:    q.Limit,
+	}, now)
+	if err != nil {
+		log.Printf("Failed to list files: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "failed to list files")
+		return
+	}
+
+	list := make([]AdminFile, 0, len(files))
+	for i := range files {
+		list = append(list, adminFile(&files[i], now))
+	}
+	c.JSON(http.StatusOK, gin.H{"files": list})
+}
+
+// adminGetFile returns a file with its transfers, deleted files included
+func (s *Server) adminGetFile(c *gin.Context) {
+	fileId, err := bindFileID(c)
+	if err != nil {
+		return
+	}
+
+	f, err := s.db.FindFile(fileId)
+	if err != nil {
+		if !s.db.IsRecordNotFoundError(err) {
+			log.Printf("Failed to find file with id %s in database: %s\n", fileId, err)
+		}
+		apiError(c, http.StatusNotFound, ErrCodeFileNotFound, "file not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, s.adminFileDetails(f, time.Now()))
+}
+
+func (s *Server) adminFileDetails(f *database.StoredFile, now time.Time) *AdminFileDetails {
+	if f.SrcClient == nil {
+		f.SrcClient = &database.Client{}
+	}
+
+	details := &AdminFileDetails{
+		AdminFile:        adminFile(f, now),
+		Filename:         f.Filename,
+		Type:             f.Type,
+		RecipientEmail:   f.RecipientEmail,
+		AllowedCountries: f.AllowedCountries,
+		OnlyEEA:          f.OnlyEEA,
+		Delay:            f.Delay,
+		Approval:         f.Approval,
+		Record:           transferRecord(f, now),
+	}
+	if f.ContentDeletedAt == nil {
+		_, err := s.store.Stat(f.Name)
+		details.BlobPresent = err == nil
+	}
+	for _, req := range f.ApprovalRequests {
+		details.Approvals = append(details.Approvals, approvalInfo(req))
+	}
+
+	return details
+}
+
+// adminDeleteFile deletes a file regardless of its owner, also if its blob
+// is gone already
+func (s *Server) adminDeleteFile(c *gin.Context) {
+	fileId, err := bindFileID(c)
+	if err != nil {
+		return
+	}
+
+	var storedFile database.StoredFile
+	if err := s.db.Where(&database.StoredFile{FileId: fileId}).First(&storedFile).Error; err != nil {
+		if !s.db.IsRecordNotFoundError(err) {
+			log.Printf("Failed to find file with id %s in database: %s\n", fileId, err)
+		}
+		apiError(c, http.StatusNotFound, ErrCodeFileNotFound, "file not found")
+		return
+	}
+
+	if errs := misc.ForceDeleteStoredFile(&storedFile, s.db, s.store, s.config); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("%s\n", err)
+		}
+		apiError(c, http.StatusInternalServerError, ErrCodeDeleteFailed, "file deletion failed")
+		return
+	}
+	detail := fmt.Sprintf("api key %d, %s", currentAPIKeyId(c), storedFile.DeletionMethod)
+	s.audit(database.AuditAdminDelete, fileId, s.clientInfo(c), detail)
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"message":        "file deleted",
+			"deletionMethod": storedFile.DeletionMethod,
+		},
+	)
+}
+
+// adminOrphans returns the blobs without file and the files without blob
+func (s *Server) adminOrphans(c *gin.Context) {
+	o, ok := s.findOrphans(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, orphansResponse(o, time.Now()))
+}
+
+// adminRepairOrphans removes the blobs without file and deletes the files
+// without blob. It responds with what it found.
+func (s *Server) adminRepairOrphans(c *gin.Context) {
+	o, ok := s.findOrphans(c)
+	if !ok {
+		return
+	}
+
+	if errs := misc.RepairOrphans(o, s.db, s.store, s.config); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("%s\n", err)
+		}
+		apiError(c, http.StatusInternalServerError, ErrCodeDeleteFailed, fmt.Sprintf("%d orphans could not be repaired", len(errs)))
+		return
+	}
+	c.JSON(http.StatusOK, orphansResponse(o, time.Now()))
+}
+
+func (s *Server) findOrphans(c *gin.Context) (*misc.Orphans, bool) {
+	o, err := misc.FindOrphans(s.db, s.store, time.Now())
+	if err != nil {
+		log.Printf("Failed to find orphans: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "failed to find orphans")
+		return nil, false
+	}
+	return o, true
+}
+
+func orphansResponse(o *misc.Orphans, now time.Time) gin.H {
+	blobs := make([]OrphanBlob, 0, len(o.Blobs))
+	for _, b := range o.Blobs {
+		blobs = append(blobs, OrphanBlob{Name: b.Name, Size: b.Size, ModTime: b.ModTime})
+	}
+	files := make([]AdminFile, 0, len(o.Files))
+	for i := range o.Files {
+		files = append(files, adminFile(&o.Files[i], now))
+	}
+	return gin.H{
+		"blobs": blobs,
+		"files": files,
+	}
+}
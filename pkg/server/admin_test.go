@@ -0,0 +1,255 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+	"github.com/lixmal/gdprshare/pkg/storage"
+)
+
+func adminRequest(srv *Server, method, path, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/v1/admin"+path, nil)
+	if key != "" {
+		withAPIKey(req, key)
+	}
+	return serveWithSession(srv, req, nil)
+}
+
+func listAdminFiles(t *testing.T, srv *Server, key, query string) []string {
+	t.Helper()
+
+	w := adminRequest(srv, http.MethodGet, "/files?"+query, key)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		Files []AdminFile `json:"files"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+	ids := []string{}
+	for _, f := range resp.Files {
+		ids = append(ids, f.FileId)
+	}
+	return ids
+}
+
+func decodeOrphans(t *testing.T, w *httptest.ResponseRecorder) ([]OrphanBlob, []AdminFile) {
+	t.Helper()
+
+	var resp struct {
+		Blobs []OrphanBlob `json:"blobs"`
+		Files []AdminFile  `json:"files"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+	return resp.Blobs, resp.Files
+}
+
+func TestAdminAuth(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	w := adminRequest(srv, http.MethodGet, "/files", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, string(ErrCodeAPIKeyInvalid), decodeError(t, w).Code)
+
+	_, uploadKey := createTestAPIKey(t, srv, database.APIKey{Scopes: "upload,delete"})
+	w = adminRequest(srv, http.MethodGet, "/files", uploadKey)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, string(ErrCodeAPIKeyScope), decodeError(t, w).Code)
+
+	_, adminKey := createTestAPIKey(t, srv, database.APIKey{Name: "ops", Scopes: "admin"})
+	w = adminRequest(srv, http.MethodGet, "/files", adminKey)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = serveWithSession(srv, withAPIKey(newUploadRequest(t, "payslip.pdf"), adminKey), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code, "the admin scope does not include uploads")
+}
+
+func TestAdminListFiles(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	_, adminKey := createTestAPIKey(t, srv, database.APIKey{Name: "ops", Scopes: "admin"})
+	k, key := createTestAPIKey(t, srv, database.APIKey{Scopes: "upload"})
+
+	w := serveWithSession(srv, withAPIKey(newUploadRequest(t, "payslip.pdf"), key), nil)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	byKey := decodeUploaded(t, w)
+
+	byEmail := uploadTestFile(t, srv, map[string]string{"email": "owner@example.com"})
+
+	expired := uploadTestFile(t, srv, map[string]string{"expiry": "1"})
+	require.NoError(t, srv.db.Model(&database.StoredFile{}).
+		Where("file_id = ?", expired).
+		Update("created_at", time.Now().AddDate(0, 0, -2)).Error)
+
+	exhausted := uploadTestFile(t, srv, nil)
+	require.NoError(t, srv.db.Model(&database.StoredFile{}).
+		Where("file_id = ?", exhausted).
+		Update("content_deleted_at", time.Now()).Error)
+
+	deleted := uploadTestFile(t, srv, nil)
+	require.NoError(t, srv.db.Where("file_id = ?", deleted).Delete(&database.StoredFile{}).Error)
+
+	assert.Equal(t, []string{exhausted, expired, byEmail, byKey}, listAdminFiles(t, srv, adminKey, ""))
+	assert.Equal(t, []string{byEmail, byKey}, listAdminFiles(t, srv, adminKey, "state=active"))
+	assert.Equal(t, []string{expired}, listAdminFiles(t, srv, adminKey, "state=expired"))
+	assert.Equal(t, []string{exhausted}, listAdminFiles(t, srv, adminKey, "state=exhausted"))
+	assert.Equal(t, []string{deleted}, listAdminFiles(t, srv, adminKey, "state=deleted"))
+	assert.Equal(t, []string{byKey}, listAdminFiles(t, srv, adminKey, "api-key="+strconv.Itoa(int(k.ID))))
+	assert.Equal(t, []string{byEmail}, listAdminFiles(t, srv, adminKey, "email=owner@example.com"))
+	assert.Equal(t, []string{exhausted}, listAdminFiles(t, srv, adminKey, "limit=1"))
+	// read in batches of the limit until enough files match
+	assert.Equal(t, []string{expired}, listAdminFiles(t, srv, adminKey, "state=expired&limit=1"))
+	assert.Equal(t, []string{byEmail}, listAdminFiles(t, srv, adminKey, "state=active&limit=1"))
+	assert.Equal(t, []string{byKey}, listAdminFiles(t, srv, adminKey, "state=active&limit=1&api-key="+strconv.Itoa(int(k.ID))))
+
+	w = adminRequest(srv, http.MethodGet, "/files?state=lost", adminKey)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, string(ErrCodeInvalidRequest), decodeError(t, w).Code)
+}
+
+func TestAdminGetFile(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	_, adminKey := createTestAPIKey(t, srv, database.APIKey{Name: "ops", Scopes: "admin"})
+	fileId := uploadTestFile(t, srv, map[string]string{"count": "2"})
+	require.Equal(t, http.StatusOK, rangeDownload(srv, fileId, "", "").Code)
+
+	w := adminRequest(srv, http.MethodGet, "/files/"+fileId, adminKey)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var details AdminFileDetails
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&details))
+	assert.Equal(t, fileId, details.FileId)
+	assert.Equal(t, database.FileActive, details.State)
+	assert.Equal(t, uint(1), details.Downloads)
+	assert.True(t, details.BlobPresent)
+	require.NotNil(t, details.Record)
+	assert.Len(t, details.Record.Transfers, 1)
+
+	w = adminRequest(srv, http.MethodGet, "/files/doesnotexistdoesnotex", adminKey)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, string(ErrCodeFileNotFound), decodeError(t, w).Code)
+}
+
+func TestAdminDeleteFile(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	k, adminKey := createTestAPIKey(t, srv, database.APIKey{Name: "ops", Scopes: "admin"})
+	fileId := uploadTestFile(t, srv, nil)
+
+	w := adminRequest(srv, http.MethodDelete, "/files/"+fileId, adminKey)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusNotFound, rangeDownload(srv, fileId, "", "").Code)
+
+	var entry database.AuditEntry
+	require.NoError(t, srv.db.Where("event = ? AND file_id = ?", database.AuditAdminDelete, fileId).First(&entry).Error)
+	assert.Equal(t, "api key "+strconv.Itoa(int(k.ID))+", "+storage.MethodDelete, entry.Detail)
+
+	w = adminRequest(srv, http.MethodGet, "/files/"+fileId, adminKey)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var details AdminFileDetails
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&details))
+	assert.Equal(t, database.FileDeleted, details.State)
+
+	w = adminRequest(srv, http.MethodDelete, "/files/"+fileId, adminKey)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	t.Run("missing blob", func(t *testing.T) {
+		fileId := uploadTestFile(t, srv, nil)
+		require.NoError(t, os.Remove(filepath.Join(srv.config.StorePath, getTestStoredFile(t, srv, fileId).Name)))
+
+		w := adminRequest(srv, http.MethodDelete, "/files/"+fileId, adminKey)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp struct {
+			DeletionMethod string `json:"deletionMethod"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, storage.MethodMissing, resp.DeletionMethod)
+	})
+}
+
+func TestAdminOrphans(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	_, adminKey := createTestAPIKey(t, srv, database.APIKey{Name: "ops", Scopes: "admin"})
+
+	old := time.Now().Add(-2 * time.Hour)
+	stray := filepath.Join(srv.config.StorePath, "strayblob")
+	require.NoError(t, os.WriteFile(stray, []byte("stray"), 0o600))
+	require.NoError(t, os.Chtimes(stray, old, old))
+	// too young, may belong to an upload in progress
+	require.NoError(t, os.WriteFile(filepath.Join(srv.config.StorePath, "freshblob"), []byte("fresh"), 0o600))
+	hidden := filepath.Join(srv.config.StorePath, ".gitignore")
+	require.NoError(t, os.WriteFile(hidden, []byte("*"), 0o600))
+	require.NoError(t, os.Chtimes(hidden, old, old))
+	// left behind by an interrupted shred
+	leftover := filepath.Join(srv.config.StorePath, ".0123456789abcdef0123456789abcdef")
+	require.NoError(t, os.WriteFile(leftover, nil, 0o600))
+	require.NoError(t, os.Chtimes(leftover, old, old))
+
+	intact := uploadTestFile(t, srv, nil)
+	lost := uploadTestFile(t, srv, nil)
+	require.NoError(t, os.Remove(filepath.Join(srv.config.StorePath, getTestStoredFile(t, srv, lost).Name)))
+	require.NoError(t, srv.db.Model(&database.StoredFile{}).
+		Where("file_id = ?", lost).
+		Update("created_at", old).Error)
+	// too young, its blob may not be listed yet
+	young := uploadTestFile(t, srv, nil)
+	require.NoError(t, os.Remove(filepath.Join(srv.config.StorePath, getTestStoredFile(t, srv, young).Name)))
+
+	w := adminRequest(srv, http.MethodGet, "/orphans", adminKey)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	blobs, files := decodeOrphans(t, w)
+	require.Len(t, blobs, 2)
+	assert.ElementsMatch(t, []string{"strayblob", ".0123456789abcdef0123456789abcdef"}, []string{blobs[0].Name, blobs[1].Name})
+	require.Len(t, files, 1)
+	assert.Equal(t, lost, files[0].FileId)
+
+	w = adminRequest(srv, http.MethodPost, "/orphans/repair", adminKey)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	assert.NoFileExists(t, stray)
+	assert.NoFileExists(t, leftover)
+	assert.FileExists(t, hidden)
+	lostFile := getTestStoredFile(t, srv, lost)
+	assert.Equal(t, database.FileDeleted, lostFile.State(time.Now()))
+	assert.Equal(t, storage.MethodMissing, lostFile.DeletionMethod)
+	intactFile := getTestStoredFile(t, srv, intact)
+	assert.Equal(t, database.FileActive, intactFile.State(time.Now()))
+
+	var entry database.AuditEntry
+	require.NoError(t, srv.db.Where("event = ? AND file_id = ?", database.AuditAdminDelete, lost).First(&entry).Error)
+
+	w = adminRequest(srv, http.MethodGet, "/orphans", adminKey)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	blobs, files = decodeOrphans(t, w)
+	assert.Empty(t, blobs)
+	assert.Empty(t, files)
+
+	t.Run("blob appeared", func(t *testing.T) {
+		// found missing, but written before the repair
+		o := &misc.Orphans{Files: []database.StoredFile{getTestStoredFile(t, srv, intact)}}
+		require.Empty(t, misc.RepairOrphans(o, srv.db, srv.store, srv.config))
+
+		intactFile := getTestStoredFile(t, srv, intact)
+		assert.Equal(t, database.FileActive, intactFile.State(time.Now()))
+	})
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+const (
+	// apiKeyTouchInterval limits the writes keeping LastUsedAt up to date
+	apiKeyTouchInterval = time.Minute
+
+	// gin context key of the API key a request was authenticated with
+	apiKeyKey = "apiKey"
+	// gin context key of the reason the request's API key was refused
+	apiKeyErrorKey = "apiKeyError"
+)
+
+// authenticateKey loads the API key of a Bearer authorization header. Other
+// schemes, like the Basic auth of a reverse proxy, are ignored. Unlike a
+// session cookie, a key that is given has to be valid, which rejectInvalidKey
+// enforces after the rate limit.
+func (s *Server) authenticateKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			c.Next()
+			return
+		}
+
+		key, err := s.db.FindAPIKey(token)
+		if err != nil {
+			if !s.db.IsRecordNotFoundError(err) {
+				log.Printf("Failed to fetch API key: %s\n", err)
+			}
+			c.Set(apiKeyErrorKey, "invalid API key")
+			c.Next()
+			return
+		}
+		now := time.Now()
+		if key.Expired(now) {
+			c.Set(apiKeyErrorKey, "API key expired")
+			c.Next()
+			return
+		}
+
+		if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval {
+			if err := s.db.Model(key).UpdateColumn("last_used_at", now).Error; err != nil {
+				log.Printf("Failed to update API key %d: %s\n", key.ID, err)
+			}
+		}
+
+		c.Set(apiKeyKey, key)
+		c.Next()
+	}
+}
+
+// rejectInvalidKey refuses requests whose API key authenticateKey didn't
+// accept. Those are rate limited by address like requests without a key.
+func rejectInvalidKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if reason := c.GetString(apiKeyErrorKey); reason != "" {
+			apiErrorAborted(c, http.StatusUnauthorized, ErrCodeAPIKeyInvalid, reason)
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireScope refuses requests with an API key lacking scope. Requests
+// without a key are left to the handler.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := currentAPIKey(c); key != nil && !key.HasScope(scope) {
+			apiErrorAborted(c, http.StatusForbidden, ErrCodeAPIKeyScope, "API key lacks scope "+scope)
+			return
+		}
+		c.Next()
+	}
+}
+
+// currentAPIKey returns the API key of the request, nil if there is none
+func currentAPIKey(c *gin.Context) *database.APIKey {
+	key, _ := c.Get(apiKeyKey)
+	k, _ := key.(*database.APIKey)
+	return k
+}
+
+// currentAPIKeyId returns the id of the request's API key, 0 if there is none
+func currentAPIKeyId(c *gin.Context) uint {
+	if key := currentAPIKey(c); key != nil {
+		return key.ID
+	}
+	return 0
+}
+
+// isOwner reports whether the request may manage storedFile, with its owner
+// token or the API key it was uploaded with
+func isOwner(c *gin.Context, storedFile *database.StoredFile, ownerToken string) bool {
+	if key := currentAPIKey(c); key != nil && storedFile.APIKeyId == key.ID {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(ownerToken), []byte(storedFile.OwnerToken)) == 1
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+func createTestAPIKey(t *testing.T, srv *Server, k database.APIKey) (*database.APIKey, string) {
+	t.Helper()
+
+	if k.Name == "" {
+		k.Name = "payroll"
+	}
+	key, err := srv.db.CreateAPIKey(&k)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(key, database.APIKeyPrefix))
+
+	return &k, key
+}
+
+func withAPIKey(req *http.Request, key string) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+key)
+	return req
+}
+
+func TestAPIKeyUpload(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	k, key := createTestAPIKey(t, srv, database.APIKey{Scopes: "upload,status"})
+
+	var stored database.APIKey
+	require.NoError(t, srv.db.First(&stored, k.ID).Error)
+	assert.Equal(t, database.HashAPIKey(key), stored.KeyHash)
+	assert.NotContains(t, stored.KeyHash, key, "only the hash is stored")
+	assert.True(t, strings.HasPrefix(key, stored.Prefix))
+
+	req := newUploadRequest(t, "payslip.pdf")
+	w := serveWithSession(srv, withAPIKey(req, key), nil)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	fileId := decodeUploaded(t, w)
+	assert.Equal(t, k.ID, getTestStoredFile(t, srv, fileId).APIKeyId)
+
+	var entry database.AuditEntry
+	require.NoError(t, srv.db.Where("event = ? AND file_id = ?", database.AuditUpload, fileId).First(&entry).Error)
+	assert.Equal(t, "api key 1", entry.Detail)
+
+	require.NoError(t, srv.db.First(&stored, k.ID).Error)
+	assert.NotNil(t, stored.LastUsedAt)
+
+	t.Run("status without owner token", func(t *testing.T) {
+		anonymous := uploadTestFile(t, srv, nil)
+		body := `[{"fileId": "` + fileId + `"}, {"fileId": "` + anonymous + `"}]`
+		req := withAPIKey(httptest.NewRequest(http.MethodPost, "/api/v1/files/status", strings.NewReader(body)), key)
+		req.Header.Set("Content-Type", "application/json")
+		w := serveWithSession(srv, req, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp struct {
+			Files map[string]FileStatus `json:"files"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Empty(t, resp.Files[fileId].Code)
+		assert.Empty(t, resp.Files[fileId].Error)
+		assert.Equal(t, ErrCodeOwnerTokenMismatch, resp.Files[anonymous].Code, "other files still need their owner token")
+	})
+
+	t.Run("delete needs scope", func(t *testing.T) {
+		req := withAPIKey(httptest.NewRequest(http.MethodDelete, "/api/v1/files/"+fileId, nil), key)
+		w := serveWithSession(srv, req, nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, string(ErrCodeAPIKeyScope), decodeError(t, w).Code)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, srv.db.Model(k).Update("scopes", "upload,delete").Error)
+
+		anonymous := uploadTestFile(t, srv, nil)
+		req := withAPIKey(httptest.NewRequest(http.MethodDelete, "/api/v1/files/"+anonymous, nil), key)
+		w := serveWithSession(srv, req, nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		req = withAPIKey(httptest.NewRequest(http.MethodDelete, "/api/v1/files/"+fileId, nil), key)
+		w = serveWithSession(srv, req, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+}
+
+// TestAPIKeyManage verifies a key can change its files and read their
+// records, receipts and approvals without owner tokens
+func TestAPIKeyManage(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	srv.signingKey = priv
+
+	k, key := createTestAPIKey(t, srv, database.APIKey{Scopes: "upload"})
+	w := serveWithSession(srv, withAPIKey(newUploadRequest(t, "payslip.pdf"), key), nil)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	fileId := decodeUploaded(t, w)
+	anonymous := uploadTestFile(t, srv, nil)
+
+	patch := func(fileId, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/"+fileId, strings.NewReader("count=3"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serveWithSession(srv, withAPIKey(req, key), nil)
+	}
+	get := func(path, key string) *httptest.ResponseRecorder {
+		return serveWithSession(srv, withAPIKey(httptest.NewRequest(http.MethodGet, path, nil), key), nil)
+	}
+
+	t.Run("update", func(t *testing.T) {
+		w := patch(fileId, key)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, uint(3), getTestStoredFile(t, srv, fileId).Count)
+
+		w = patch(anonymous, key)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, string(ErrCodeOwnerTokenMismatch), decodeError(t, w).Code)
+	})
+
+	for _, path := range []string{"record", "receipt", "approvals"} {
+		t.Run(path+" needs scope", func(t *testing.T) {
+			w := get("/api/v1/files/"+fileId+"/"+path, key)
+			assert.Equal(t, http.StatusForbidden, w.Code)
+			assert.Equal(t, string(ErrCodeAPIKeyScope), decodeError(t, w).Code)
+		})
+	}
+
+	require.NoError(t, srv.db.Model(k).Update("scopes", "status").Error)
+
+	t.Run("update needs scope", func(t *testing.T) {
+		w := patch(fileId, key)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, string(ErrCodeAPIKeyScope), decodeError(t, w).Code)
+	})
+
+	for _, path := range []string{"record", "receipt", "approvals"} {
+		t.Run(path, func(t *testing.T) {
+			w := get("/api/v1/files/"+fileId+"/"+path, key)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			w = get("/api/v1/files/"+anonymous+"/"+path, key)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Equal(t, string(ErrCodeOwnerTokenMismatch), decodeError(t, w).Code)
+		})
+	}
+}
+
+func TestAPIKeyRejected(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	_, statusOnly := createTestAPIKey(t, srv, database.APIKey{Scopes: "status"})
+	expiresAt := time.Now().Add(-time.Minute)
+	_, expired := createTestAPIKey(t, srv, database.APIKey{Scopes: "upload", ExpiresAt: &expiresAt})
+	revokedKey, revoked := createTestAPIKey(t, srv, database.APIKey{Scopes: "upload"})
+	require.NoError(t, srv.db.RevokeAPIKey(revokedKey.ID))
+
+	for name, tc := range map[string]struct {
+		header string
+		status int
+		code   ErrorCode
+	}{
+		"unknown": {"Bearer " + database.APIKeyPrefix + "unknown", http.StatusUnauthorized, ErrCodeAPIKeyInvalid},
+		"empty":   {"Bearer ", http.StatusUnauthorized, ErrCodeAPIKeyInvalid},
+		"expired": {"Bearer " + expired, http.StatusUnauthorized, ErrCodeAPIKeyInvalid},
+		"revoked": {"Bearer " + revoked, http.StatusUnauthorized, ErrCodeAPIKeyInvalid},
+		"scope":   {"Bearer " + statusOnly, http.StatusForbidden, ErrCodeAPIKeyScope},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := newUploadRequest(t, "payslip.pdf")
+			req.Header.Set("Authorization", tc.header)
+			w := serveWithSession(srv, req, nil)
+			assert.Equal(t, tc.status, w.Code)
+			assert.Equal(t, string(tc.code), decodeError(t, w).Code)
+		})
+	}
+
+	// e.g. the Basic auth of a reverse proxy, resent by browsers
+	t.Run("other scheme", func(t *testing.T) {
+		req := newUploadRequest(t, "payslip.pdf")
+		req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		w := serveWithSession(srv, req, nil)
+		assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	})
+
+	_, err := srv.db.CreateAPIKey(&database.APIKey{Name: "typo", Scopes: "upload,uplaod"})
+	assert.ErrorIs(t, err, database.ErrUnknownScope)
+}
+
+// TestAPIKeyGuessRateLimit checks invalid keys count against the rate limit
+// of their address
+func TestAPIKeyGuessRateLimit(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+	srv.config.RateLimit.Enabled = true
+	srv.config.RateLimit.RPS = 0.01
+	srv.config.RateLimit.Burst = 2
+	srv = New(srv.db, srv.store, srv.config)
+
+	guess := func() int {
+		req := withAPIKey(httptest.NewRequest(http.MethodGet, "/api/v1/usage", nil), database.APIKeyPrefix+"guess")
+		return serveWithSession(srv, req, nil).Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, guess())
+	assert.Equal(t, http.StatusUnauthorized, guess())
+	assert.Equal(t, http.StatusTooManyRequests, guess())
+}
+
+func TestAPIKeyRateLimit(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	_, limited := createTestAPIKey(t, srv, database.APIKey{Scopes: "status", RateLimit: 0.01, Burst: 2})
+	_, other := createTestAPIKey(t, srv, database.APIKey{Scopes: "status"})
+
+	status := func(key string) int {
+		req := withAPIKey(httptest.NewRequest(http.MethodPost, "/api/v1/files/status", strings.NewReader("[]")), key)
+		req.Header.Set("Content-Type", "application/json")
+		return serveWithSession(srv, req, nil).Code
+	}
+
+	assert.Equal(t, http.StatusOK, status(limited))
+	assert.Equal(t, http.StatusOK, status(limited))
+	assert.Equal(t, http.StatusTooManyRequests, status(limited))
+
+	// limits are per key, not per address
+	assert.Equal(t, http.StatusOK, status(other))
+}
+
+func TestAPIKeyCountsAsLogin(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+	srv.config.Auth.RequireLogin = true
+
+	w := uploadWithSession(t, srv, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, string(ErrCodeLoginRequired), decodeError(t, w).Code)
+
+	_, key := createTestAPIKey(t, srv, database.APIKey{Scopes: "upload"})
+	w = serveWithSession(srv, withAPIKey(newUploadRequest(t, "contract.pdf"), key), nil)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+}
@@ -0,0 +1,396 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+)
+
+const (
+	ApprovalRequestIdLen = 20
+	DecisionTokenLen     = 32
+	// ApprovalCookie holds the request a browser started for a file, so
+	// reloading the download page doesn't start another one
+	ApprovalCookie = "gdprshare_approval"
+	// approvalLimitWindow is the period the per file limit of requests
+	// applies to
+	approvalLimitWindow = time.Hour
+)
+
+// approvalPollInterval is how often a waiting status request looks for a
+// decision. Decisions may come in through another instance, so the database
+// is the only place to look.
+var approvalPollInterval = 500 * time.Millisecond
+
+// Approval is an approval request as shown to the owner. The recipient only
+// sees the id and state.
+type Approval struct {
+	RequestId      string     `json:"requestId"`
+	State          string     `json:"state"`
+	Time           *time.Time `json:"time,omitempty"`
+	DecidedAt      *time.Time `json:"decidedAt,omitempty"`
+	Used           bool       `json:"used,omitempty"`
+	Addr           string     `json:"addr,omitempty"`
+	UserAgent      string     `json:"userAgent,omitempty"`
+	TLSVersion     string     `json:"tlsVersion,omitempty"`
+	TLSCipherSuite string     `json:"tlsCipherSuite,omitempty"`
+	Country        string     `json:"country,omitempty"`
+	City           string     `json:"city,omitempty"`
+}
+
+type ApprovalRequestId struct {
+	RequestId string `uri:"requestId" binding:"required,printascii,min=3,max=64"`
+}
+
+// ApprovalDecision approves or denies a request, authorised by either the
+// owner token or the decision token of the mailed link
+type ApprovalDecision struct {
+	Decision   string `form:"decision"   binding:"required,oneof=approve deny"`
+	OwnerToken string `form:"ownerToken" binding:"omitempty,printascii,max=64"`
+	Token      string `form:"token"      binding:"omitempty,printascii,max=64"`
+}
+
+// approvalRequestParam returns the approval request a recipient retries a
+// download with, either as X-Approval-Request header or approval query
+// parameter.
+func approvalRequestParam(c *gin.Context) string {
+	if id := c.GetHeader("X-Approval-Request"); id != "" {
+		return id
+	}
+	return c.Query("approval")
+}
+
+// decisionTokenParam returns the decision token of the approval link, either
+// as X-Decision-Token header or token query parameter.
+func decisionTokenParam(c *gin.Context) string {
+	if token := c.GetHeader("X-Decision-Token"); token != "" {
+		return token
+	}
+	return c.Query("token")
+}
+
+// useApproval lets a download of a file that needs approval proceed if it
+// comes with an approved, unused request. Otherwise it starts a request or
+// reports the state of the given one, and writes the response.
+func (s *Server) useApproval(c *gin.Context, storedFile *database.StoredFile, client *database.DstClient) (*database.ApprovalRequest, bool) {
+	id := approvalRequestParam(c)
+	if id == "" {
+		s.requestApproval(c, storedFile, client)
+		return nil, false
+	}
+
+	var req database.ApprovalRequest
+	if err := s.db.Where("request_id = ? AND stored_file_id = ?", id, storedFile.ID).First(&req).Error; err != nil {
+		if !s.db.IsRecordNotFoundError(err) {
+			log.Printf("Failed to find approval request of file with id %s: %s\n", storedFile.FileId, err)
+		}
+		apiError(c, http.StatusGone, ErrCodeApprovalInvalid, "approval request unknown or already used")
+		return nil, false
+	}
+
+	switch req.State {
+	case database.ApprovalPending:
+		approvalPending(c, &req)
+		return nil, false
+	case database.ApprovalDenied:
+		apiError(c, http.StatusForbidden, ErrCodeApprovalDenied, "download denied by the owner")
+		return nil, false
+	}
+
+	// an approval allows a single download
+	res := s.db.Model(&database.ApprovalRequest{}).
+		Where("id = ? AND used_at IS NULL", req.ID).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		log.Printf("Failed to use approval request of file with id %s: %s\n", storedFile.FileId, res.Error)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return nil, false
+	}
+	if res.RowsAffected == 0 {
+		apiError(c, http.StatusGone, ErrCodeApprovalInvalid, "approval request unknown or already used")
+		return nil, false
+	}
+
+	return &req, true
+}
+
+// releaseApproval makes an approval usable again after the download it was
+// used for couldn't start
+func (s *Server) releaseApproval(req *database.ApprovalRequest) {
+	if err := s.db.Model(&database.ApprovalRequest{}).Where("id = ?", req.ID).Update("used_at", gorm.Expr("NULL")).Error; err != nil {
+		log.Printf("Failed to release approval request %s: %s\n", req.RequestId, err)
+	}
+}
+
+// requestApproval starts an approval request for a download attempt and
+// mails the owner a link to decide on it. Repeated attempts of the same
+// browser get the request already pending. Addresses and user agents don't
+// tell recipients apart, they may be shared, truncated or not saved at all.
+func (s *Server) requestApproval(c *gin.Context, storedFile *database.StoredFile, client *database.DstClient) {
+	if id, err := c.Cookie(ApprovalCookie); err == nil && id != "" {
+		var pending database.ApprovalRequest
+		err := s.db.Where(
+			"request_id = ? AND stored_file_id = ? AND state = ?",
+			id, storedFile.ID, database.ApprovalPending,
+		).First(&pending).Error
+		if err == nil {
+			approvalPending(c, &pending)
+			return
+		}
+		if !s.db.IsRecordNotFoundError(err) {
+			log.Printf("Failed to find approval requests of file with id %s: %s\n", storedFile.FileId, err)
+			apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+			return
+		}
+	}
+
+	// each request mails the owner, so anyone with the link could flood them
+	var requested uint
+	err := s.db.Model(&database.ApprovalRequest{}).
+		Where("stored_file_id = ? AND created_at > ?", storedFile.ID, time.Now().Add(-approvalLimitWindow)).
+		Count(&requested).Error
+	if err != nil {
+		log.Printf("Failed to count approval requests of file with id %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return
+	}
+	if requested >= s.config.Approval.MaxRequests {
+		apiError(c, http.StatusTooManyRequests, ErrCodeApprovalLimit, "too many approval requests, try again later")
+		return
+	}
+
+	requestId, err := misc.GenToken(ApprovalRequestIdLen)
+	if err != nil {
+		log.Printf("Failed to generate approval request id: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return
+	}
+	decisionToken, err := misc.GenToken(DecisionTokenLen)
+	if err != nil {
+		log.Printf("Failed to generate decision token: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return
+	}
+
+	req := &database.ApprovalRequest{
+		Client:        database.Client(*client),
+		RequestId:     requestId,
+		DecisionToken: decisionToken,
+		State:         database.ApprovalPending,
+	}
+	req.StoredFileId = storedFile.ID
+	if err := s.db.Create(req).Error; err != nil {
+		log.Printf("Failed to save approval request of file with id %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return
+	}
+	s.audit(database.AuditApproval, storedFile.FileId, &req.Client, "requested "+requestId)
+	s.setCookie(c, ApprovalCookie, requestId, "/api/v1/files/"+storedFile.FileId, int(time.Until(storedFile.ExpiresAt())/time.Second))
+
+	if storedFile.Email != "" {
+		fields := newMailFields(storedFile, client)
+		fields.ApprovalURL = s.approvalURL(storedFile.FileId, req)
+		if err := s.sendTemplateMail(s.config.Mail.SubjectApproval, s.config.Mail.ApprovalBody, storedFile, fields); err != nil {
+			log.Printf("Failed to send approval mail for ID %s: %s\n", storedFile.FileId, err)
+		}
+	}
+
+	approvalPending(c, req)
+}
+
+// approvalURL returns the page the owner decides on a request at. The
+// decision token stays in the fragment, out of server and proxy logs.
+func (s *Server) approvalURL(fileId string, req *database.ApprovalRequest) string {
+	if s.config.PublicURL == "" {
+		return ""
+	}
+	return strings.TrimRight(s.config.PublicURL, "/") + "/approve/" + fileId + "/" + req.RequestId + "#" + req.DecisionToken
+}
+
+func approvalPending(c *gin.Context, req *database.ApprovalRequest) {
+	c.JSON(
+		http.StatusAccepted,
+		gin.H{
+			"code":      ErrCodeApprovalPending,
+			"message":   "download awaits the owner's approval",
+			"requestId": req.RequestId,
+		},
+	)
+}
+
+// getApproval returns the state of an approval request. With wait set, it
+// waits up to that many seconds for a pending request to be decided. Owners
+// also get the details of the attempt.
+func (s *Server) getApproval(c *gin.Context) {
+	storedFile, req, ok := s.bindApprovalRequest(c)
+	if !ok {
+		return
+	}
+
+	wait := time.Duration(s.config.Approval.Wait) * time.Second
+	if w, err := time.ParseDuration(c.DefaultQuery("wait", "0") + "s"); err == nil && w < wait {
+		wait = w
+	}
+
+	deadline := time.Now().Add(wait)
+	for req.State == database.ApprovalPending && time.Now().Before(deadline) {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(approvalPollInterval):
+		}
+
+		if err := s.db.First(req, req.ID).Error; err != nil {
+			log.Printf("Failed to reload approval request %s: %s\n", req.RequestId, err)
+			apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+			return
+		}
+	}
+
+	if approvalAuthorised(storedFile, req, c.Query("ownerToken"), decisionTokenParam(c)) {
+		c.JSON(http.StatusOK, approvalInfo(req))
+		return
+	}
+
+	c.JSON(http.StatusOK, Approval{RequestId: req.RequestId, State: req.State})
+}
+
+// listApprovals returns all approval requests of a file to its owner
+func (s *Server) listApprovals(c *gin.Context) {
+	storedFile, ok := s.getOwnedFile(c, false)
+	if !ok {
+		return
+	}
+
+	var reqs []*database.ApprovalRequest
+	if err := s.db.Where("stored_file_id = ?", storedFile.ID).Order("created_at").Find(&reqs).Error; err != nil {
+		log.Printf("Failed to find approval requests of file with id %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return
+	}
+
+	approvals := []Approval{}
+	for _, req := range reqs {
+		approvals = append(approvals, approvalInfo(req))
+	}
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"approvals": approvals,
+		},
+	)
+}
+
+// decideApproval approves or denies a pending request. A denial is kept like
+// any other refused download.
+func (s *Server) decideApproval(c *gin.Context) {
+	var d ApprovalDecision
+	if err := c.ShouldBind(&d); err != nil {
+		// TODO: get FieldError and return relevant part only
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	storedFile, req, ok := s.bindApprovalRequest(c)
+	if !ok {
+		return
+	}
+
+	if !approvalAuthorised(storedFile, req, d.OwnerToken, d.Token) {
+		apiError(c, http.StatusUnauthorized, ErrCodeOwnerTokenMismatch, "owner token doesn't match")
+		return
+	}
+
+	state := database.ApprovalApproved
+	if d.Decision == "deny" {
+		state = database.ApprovalDenied
+	}
+
+	now := time.Now()
+	res := s.db.Model(&database.ApprovalRequest{}).
+		Where("id = ? AND state = ?", req.ID, database.ApprovalPending).
+		Updates(map[string]interface{}{"state": state, "decided_at": now})
+	if res.Error != nil {
+		log.Printf("Failed to decide approval request %s: %s\n", req.RequestId, res.Error)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to save decision")
+		return
+	}
+	if res.RowsAffected == 0 {
+		apiError(c, http.StatusConflict, ErrCodeApprovalDecided, "approval request already decided")
+		return
+	}
+	req.State, req.DecidedAt = state, &now
+
+	s.audit(database.AuditApproval, storedFile.FileId, s.clientInfo(c), state+" "+req.RequestId)
+	if state == database.ApprovalDenied {
+		client := database.DstClient(req.Client)
+		client.ID, client.CreatedAt = 0, time.Time{}
+		s.saveDeniedClient(storedFile, &client, database.DenialApproval)
+	}
+
+	c.JSON(http.StatusOK, approvalInfo(req))
+}
+
+// bindApprovalRequest looks up the file and approval request of the uri,
+// writing an error response on failure
+func (s *Server) bindApprovalRequest(c *gin.Context) (*database.StoredFile, *database.ApprovalRequest, bool) {
+	fileId, err := bindFileID(c)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	var r ApprovalRequestId
+	if err := c.ShouldBindUri(&r); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeApprovalInvalid, err.Error())
+		return nil, nil, false
+	}
+
+	storedFile, err := s.getStoredFile(fileId, c)
+	if err != nil {
+		log.Printf("Failed to retrieve file with ID %s: %s\n", fileId, err)
+		return nil, nil, false
+	}
+
+	var req database.ApprovalRequest
+	if err := s.db.Where("request_id = ? AND stored_file_id = ?", r.RequestId, storedFile.ID).First(&req).Error; err != nil {
+		if !s.db.IsRecordNotFoundError(err) {
+			log.Printf("Failed to find approval request of file with id %s: %s\n", fileId, err)
+		}
+		apiError(c, http.StatusNotFound, ErrCodeApprovalInvalid, "approval request not found")
+		return nil, nil, false
+	}
+
+	return storedFile, &req, true
+}
+
+// approvalAuthorised reports whether one of the tokens is the owner token of
+// the file or the decision token of the request
+func approvalAuthorised(storedFile *database.StoredFile, req *database.ApprovalRequest, ownerToken, token string) bool {
+	return ownerToken != "" && subtle.ConstantTimeCompare([]byte(ownerToken), []byte(storedFile.OwnerToken)) == 1 ||
+		token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(req.DecisionToken)) == 1
+}
+
+func approvalInfo(req *database.ApprovalRequest) Approval {
+	return Approval{
+		RequestId:      req.RequestId,
+		State:          req.State,
+		Time:           &req.CreatedAt,
+		DecidedAt:      req.DecidedAt,
+		Used:           req.UsedAt != nil,
+		Addr:           req.Addr,
+		UserAgent:      req.UserAgent,
+		TLSVersion:     req.TLSVersion,
+		TLSCipherSuite: req.TLSCipherSuite,
+		Country:        req.Country,
+		City:           req.City,
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+// requestDownload tries a download with the given approval request and user
+// agent
+func requestDownload(t *testing.T, srv *Server, fileId, requestId, userAgent string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	req.Header.Set("User-Agent", userAgent)
+	if requestId != "" {
+		req.Header.Set("X-Approval-Request", requestId)
+	}
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+// approvalCookie returns the cookie a download attempt bound its approval
+// request to the browser with
+func approvalCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == ApprovalCookie {
+			return cookie
+		}
+	}
+	require.Fail(t, "no approval cookie set")
+	return nil
+}
+
+// retryDownload tries a download again from the browser holding cookie
+func retryDownload(srv *Server, fileId string, cookie *http.Cookie, userAgent string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	req.Header.Set("User-Agent", userAgent)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func pendingRequestId(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	var resp struct {
+		Code      string `json:"code"`
+		RequestId string `json:"requestId"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, string(ErrCodeApprovalPending), resp.Code)
+	require.NotEmpty(t, resp.RequestId)
+
+	return resp.RequestId
+}
+
+func decide(t *testing.T, srv *Server, fileId, requestId string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/files/"+fileId+"/approvals/"+requestId, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func getApproval(t *testing.T, srv *Server, fileId, requestId, query string) Approval {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId+"/approvals/"+requestId+"?"+query, nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var approval Approval
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&approval))
+	return approval
+}
+
+func TestApproval(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+	srv.config.Approval.Wait = 5
+	// the owner decides based on the client details of the attempt
+	srv.config.SaveClientInfo = true
+
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, map[string]string{"approval": "true", "count": "3"})
+
+	first := requestDownload(t, srv, fileId, "", "recipient")
+	cookie := approvalCookie(t, first)
+	requestId := pendingRequestId(t, first)
+	assert.Equal(t, requestId, cookie.Value)
+	assert.Equal(t, "/api/v1/files/"+fileId, cookie.Path)
+	assert.True(t, cookie.HttpOnly)
+
+	// retries of the same browser don't pile up requests
+	assert.Equal(t, requestId, pendingRequestId(t, retryDownload(srv, fileId, cookie, "recipient")))
+	assert.Equal(t, requestId, pendingRequestId(t, requestDownload(t, srv, fileId, requestId, "recipient")))
+
+	// the recipient only learns the state
+	approval := getApproval(t, srv, fileId, requestId, "wait=0")
+	assert.Equal(t, database.ApprovalPending, approval.State)
+	assert.Empty(t, approval.UserAgent)
+	assert.Nil(t, approval.Time)
+
+	approval = getApproval(t, srv, fileId, requestId, "ownerToken="+ownerToken)
+	assert.Equal(t, "recipient", approval.UserAgent)
+	assert.NotNil(t, approval.Time)
+
+	w := decide(t, srv, fileId, requestId, url.Values{"decision": {"approve"}, "token": {"wrongtoken"}})
+	require.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+
+	var req database.ApprovalRequest
+	require.NoError(t, srv.db.Where("request_id = ?", requestId).First(&req).Error)
+
+	// the mailed link carries the decision token instead of the owner token
+	w = decide(t, srv, fileId, requestId, url.Values{"decision": {"approve"}, "token": {req.DecisionToken}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = decide(t, srv, fileId, requestId, url.Values{"decision": {"deny"}, "ownerToken": {ownerToken}})
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	assert.Equal(t, string(ErrCodeApprovalDecided), decodeError(t, w).Code)
+
+	assert.Equal(t, database.ApprovalApproved, getApproval(t, srv, fileId, requestId, "").State)
+
+	w = requestDownload(t, srv, fileId, requestId, "recipient")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "test content", w.Body.String())
+
+	// an approval is good for one download only
+	w = requestDownload(t, srv, fileId, requestId, "recipient")
+	require.Equal(t, http.StatusGone, w.Code, w.Body.String())
+	assert.Equal(t, string(ErrCodeApprovalInvalid), decodeError(t, w).Code)
+
+	t.Run("deny", func(t *testing.T) {
+		requestId := pendingRequestId(t, requestDownload(t, srv, fileId, "", "other"))
+
+		w := decide(t, srv, fileId, requestId, url.Values{"decision": {"deny"}, "ownerToken": {ownerToken}})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = requestDownload(t, srv, fileId, requestId, "other")
+		require.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+		assert.Equal(t, string(ErrCodeApprovalDenied), decodeError(t, w).Code)
+
+		storedFile := getTestStoredFile(t, srv, fileId)
+		status, err := srv.ownedFileStatus(&storedFile)
+		require.NoError(t, err)
+		assert.True(t, status.Approval)
+		assert.Equal(t, uint(1), status.Denied)
+		assert.Equal(t, uint(0), status.Pending)
+		assert.Equal(t, uint(1), status.Downloads)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId+"/approvals?ownerToken=wrongtoken", nil)
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+
+		req = httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId+"/approvals?ownerToken="+ownerToken, nil)
+		w = httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp struct {
+			Approvals []Approval `json:"approvals"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Len(t, resp.Approvals, 2)
+		assert.Equal(t, database.ApprovalApproved, resp.Approvals[0].State)
+		assert.True(t, resp.Approvals[0].Used)
+		assert.Equal(t, database.ApprovalDenied, resp.Approvals[1].State)
+	})
+
+	t.Run("long poll", func(t *testing.T) {
+		defer func(interval time.Duration) { approvalPollInterval = interval }(approvalPollInterval)
+		approvalPollInterval = 10 * time.Millisecond
+
+		requestId := pendingRequestId(t, requestDownload(t, srv, fileId, "", "poller"))
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			decide(t, srv, fileId, requestId, url.Values{"decision": {"approve"}, "ownerToken": {ownerToken}})
+		}()
+
+		start := time.Now()
+		assert.Equal(t, database.ApprovalApproved, getApproval(t, srv, fileId, requestId, "wait=5").State)
+		assert.Less(t, time.Since(start), 4*time.Second)
+	})
+
+	t.Run("without approval", func(t *testing.T) {
+		plainId := uploadTestFile(t, srv, nil)
+
+		// an approval header is ignored for files that don't need one
+		w := requestDownload(t, srv, plainId, "unknown", "recipient")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+}
+
+// TestApprovalSeparateClients checks recipients that can't be told apart by
+// address and user agent don't share a request, so approving one doesn't let
+// the other download
+func TestApprovalSeparateClients(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+	srv.config.SaveClientInfo = false
+
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, map[string]string{"approval": "true", "count": "3"})
+
+	first := requestDownload(t, srv, fileId, "", "recipient")
+	cookieA := approvalCookie(t, first)
+	requestA := pendingRequestId(t, first)
+
+	second := requestDownload(t, srv, fileId, "", "recipient")
+	cookieB := approvalCookie(t, second)
+	requestB := pendingRequestId(t, second)
+	assert.NotEqual(t, requestA, requestB)
+
+	w := decide(t, srv, fileId, requestA, url.Values{"decision": {"approve"}, "ownerToken": {ownerToken}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	assert.Equal(t, requestB, pendingRequestId(t, retryDownload(srv, fileId, cookieB, "recipient")))
+	assert.Equal(t, database.ApprovalPending, getApproval(t, srv, fileId, requestB, "").State)
+
+	// a browser without the cookie starts a request of its own
+	assert.NotContains(t, []string{requestA, requestB}, pendingRequestId(t, requestDownload(t, srv, fileId, "", "recipient")))
+
+	w = requestDownload(t, srv, fileId, cookieA.Value, "recipient")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+// TestApprovalLimit checks download attempts can't mail the owner without
+// limit
+func TestApprovalLimit(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+	srv.config.Approval.MaxRequests = 2
+
+	fileId, _ := uploadOwnedTestFile(t, srv, map[string]string{"approval": "true"})
+
+	first := requestDownload(t, srv, fileId, "", "recipient")
+	cookie := approvalCookie(t, first)
+	requestId := pendingRequestId(t, first)
+	pendingRequestId(t, requestDownload(t, srv, fileId, "", "recipient"))
+
+	w := requestDownload(t, srv, fileId, "", "recipient")
+	require.Equal(t, http.StatusTooManyRequests, w.Code, w.Body.String())
+	assert.Equal(t, string(ErrCodeApprovalLimit), decodeError(t, w).Code)
+
+	// pending requests are still handed back
+	assert.Equal(t, requestId, pendingRequestId(t, retryDownload(srv, fileId, cookie, "recipient")))
+	assert.Equal(t, requestId, pendingRequestId(t, requestDownload(t, srv, fileId, requestId, "recipient")))
+
+	require.NoError(t, srv.db.Model(&database.ApprovalRequest{}).
+		Where("1 = 1").
+		UpdateColumn("created_at", time.Now().Add(-approvalLimitWindow)).Error)
+	pendingRequestId(t, requestDownload(t, srv, fileId, "", "recipient"))
+}
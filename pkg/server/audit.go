@@ -0,0 +1,29 @@
+package server
+
+import (
+	"log"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+// audit appends an event to the audit log. Failures are logged only, the
+// request they belong to has already been decided.
+func (s *Server) audit(event, fileId string, client *database.Client, detail string) {
+	entry := &database.AuditEntry{
+		Event:  event,
+		FileId: fileId,
+		Detail: detail,
+	}
+	if client != nil {
+		if client.Addr != "" || client.UserAgent != "" {
+			entry.Client = &database.AuditClient{Addr: client.Addr, UserAgent: client.UserAgent}
+		}
+		entry.TLSVersion = client.TLSVersion
+		entry.TLSCipherSuite = client.TLSCipherSuite
+		entry.Country = client.Country
+	}
+
+	if err := s.db.AppendAudit(entry); err != nil {
+		log.Printf("Failed to write audit log: %s\n", err)
+	}
+}
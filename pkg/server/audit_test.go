@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+)
+
+func auditEvents(t *testing.T, srv *Server) []string {
+	t.Helper()
+
+	var entries []database.AuditEntry
+	require.NoError(t, srv.db.Order("seq").Find(&entries).Error)
+
+	var events []string
+	for _, e := range entries {
+		events = append(events, e.Event)
+	}
+	return events
+}
+
+// TestAuditLog runs through all audited events and verifies the chain
+func TestAuditLog(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	srv.config.TLSValidation.Enabled = true
+	srv.config.TLSValidation.MinVersion = "1.2"
+	srv.config.Header.TLSVersion = "X-TLS-Version"
+
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, map[string]string{"count": "2"})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/files/"+fileId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	req.Header.Set("X-TLS-Version", strconv.Itoa(tls.VersionTLS10))
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	req = httptest.NewRequest(
+		http.MethodDelete,
+		fmt.Sprintf("/api/v1/files/%s?ownerToken=%s", fileId, ownerToken),
+		nil,
+	)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	deniedId := uploadTestFile(t, srv, map[string]string{"allowed-countries": "DE"})
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/files/"+deniedId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	expiredId := uploadTestFile(t, srv, nil)
+	require.NoError(t, srv.db.Model(&database.StoredFile{}).
+		Where("file_id = ?", expiredId).
+		Update("created_at", time.Now().AddDate(0, 0, -30)).Error)
+	require.Empty(t, misc.Cleanup(srv.db, srv.store, srv.config))
+
+	assert.Equal(t, []string{
+		database.AuditUpload,
+		database.AuditDownload,
+		database.AuditReceipt,
+		database.AuditTLSRejected,
+		database.AuditOwnerDelete,
+		database.AuditUpload,
+		database.AuditDenied,
+		database.AuditUpload,
+		database.AuditExpiryDelete,
+	}, auditEvents(t, srv))
+
+	var rejected database.AuditEntry
+	require.NoError(t, srv.db.Where("event = ?", database.AuditTLSRejected).First(&rejected).Error)
+	assert.Equal(t, fileId, rejected.FileId)
+	assert.Equal(t, strconv.Itoa(tls.VersionTLS10), rejected.TLSVersion)
+
+	count, head, err := srv.db.VerifyAudit()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(9), count)
+	assert.NotEmpty(t, head)
+}
+
+func TestAuditTampering(t *testing.T) {
+	for name, tamper := range map[string]func(db *database.Database) error{
+		"modified": func(db *database.Database) error {
+			return db.Model(&database.AuditEntry{}).Where("seq = 2").Update("file_id", "other").Error
+		},
+		"removed": func(db *database.Database) error {
+			return db.Where("seq = 2").Delete(&database.AuditEntry{}).Error
+		},
+		"rehashed": func(db *database.Database) error {
+			var entry database.AuditEntry
+			if err := db.Where("seq = 2").First(&entry).Error; err != nil {
+				return err
+			}
+			entry.Detail = "forged"
+			return db.Model(&entry).Updates(map[string]interface{}{"detail": entry.Detail, "hash": entry.ComputeHash()}).Error
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv, cleanup := setupTestServer(t)
+			defer cleanup()
+
+			for i := 0; i < 3; i++ {
+				srv.audit(database.AuditUpload, fmt.Sprint(i), nil, "")
+			}
+			_, _, err := srv.db.VerifyAudit()
+			require.NoError(t, err)
+
+			require.NoError(t, tamper(srv.db))
+
+			count, _, err := srv.db.VerifyAudit()
+			assert.ErrorIs(t, err, database.ErrAuditChain)
+			assert.Less(t, count, uint64(3))
+		})
+	}
+}
+
+func TestAuditConcurrentAppend(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			srv.audit(database.AuditDownload, fmt.Sprint(i), nil, "")
+		}(i)
+	}
+	wg.Wait()
+
+	count, _, err := srv.db.VerifyAudit()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), count)
+}
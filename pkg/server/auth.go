@@ -0,0 +1,318 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+	"github.com/lixmal/gdprshare/pkg/oidc"
+)
+
+const (
+	SessionCookie = "gdprshare_session"
+	// LoginCookie binds a login in progress to the browser that started it,
+	// so a callback URL can't be used to log in someone else
+	LoginCookie        = "gdprshare_login"
+	SessionTokenLen    = 32
+	LoginStateLifetime = 10 * time.Minute
+	AuthPath           = "/api/v1/auth"
+	CallbackPath       = AuthPath + "/callback"
+
+	// gin context key of the logged in user
+	userKey = "user"
+)
+
+// newOIDCProvider returns the configured provider, nil if login is disabled
+func newOIDCProvider(s *Server) *oidc.Provider {
+	conf := s.config.Auth.OIDC
+	if conf.Issuer == "" {
+		return nil
+	}
+
+	redirectURL := strings.TrimRight(s.config.PublicURL, "/") + CallbackPath
+	return oidc.New(conf.Issuer, conf.ClientID, conf.ClientSecret, redirectURL, strings.Fields(conf.Scopes))
+}
+
+// login sends the browser to the provider. returnTo is where it ends up
+// after the callback, local paths only.
+func (s *Server) login(c *gin.Context) {
+	returnTo := c.Query("returnTo")
+	if !isLocalPath(returnTo) {
+		returnTo = "/"
+	}
+
+	state, err := misc.GenToken(SessionTokenLen)
+	if err != nil {
+		log.Printf("Failed to generate login state: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeLoginFailed, "failed to start login")
+		return
+	}
+	nonce, err := misc.GenToken(SessionTokenLen)
+	if err != nil {
+		log.Printf("Failed to generate nonce: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeLoginFailed, "failed to start login")
+		return
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		log.Printf("Failed to generate PKCE verifier: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeLoginFailed, "failed to start login")
+		return
+	}
+
+	authURL, err := s.oidc.AuthCodeURL(c.Request.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("Failed to reach identity provider: %s\n", err)
+		apiError(c, http.StatusBadGateway, ErrCodeLoginFailed, "identity provider unavailable")
+		return
+	}
+
+	loginState := database.LoginState{
+		State:     state,
+		Nonce:     nonce,
+		Verifier:  verifier,
+		ReturnTo:  returnTo,
+		ExpiresAt: time.Now().Add(LoginStateLifetime),
+	}
+	if err := s.db.Create(&loginState).Error; err != nil {
+		log.Printf("Failed to create login state: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to start login")
+		return
+	}
+
+	s.setCookie(c, LoginCookie, state, AuthPath, int(LoginStateLifetime/time.Second))
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// callback finishes the login the provider redirected back from and starts a
+// session
+func (s *Server) callback(c *gin.Context) {
+	state := c.Query("state")
+	cookie, _ := c.Cookie(LoginCookie)
+	s.setCookie(c, LoginCookie, "", AuthPath, -1)
+
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(cookie)) != 1 {
+		apiError(c, http.StatusBadRequest, ErrCodeLoginFailed, "login state mismatch, start the login again")
+		return
+	}
+
+	var loginState database.LoginState
+	if err := s.db.Where("state = ?", state).First(&loginState).Error; err != nil {
+		if !s.db.IsRecordNotFoundError(err) {
+			log.Printf("Failed to fetch login state: %s\n", err)
+		}
+		apiError(c, http.StatusBadRequest, ErrCodeLoginFailed, "unknown login, start the login again")
+		return
+	}
+	// each login state is used once
+	res := s.db.Unscoped().Where("id = ?", loginState.ID).Delete(&database.LoginState{})
+	if res.Error != nil || res.RowsAffected != 1 || time.Now().After(loginState.ExpiresAt) {
+		if res.Error != nil {
+			log.Printf("Failed to delete login state: %s\n", res.Error)
+		}
+		apiError(c, http.StatusBadRequest, ErrCodeLoginFailed, "login expired, start the login again")
+		return
+	}
+
+	if errCode := c.Query("error"); errCode != "" {
+		apiError(c, http.StatusUnauthorized, ErrCodeLoginFailed, strings.TrimSpace("login failed: "+errCode+" "+c.Query("error_description")))
+		return
+	}
+
+	claims, err := s.oidc.Exchange(c.Request.Context(), c.Query("code"), loginState.Verifier, loginState.Nonce)
+	if err != nil {
+		log.Printf("Failed to log in: %s\n", err)
+		apiError(c, http.StatusUnauthorized, ErrCodeLoginFailed, "login failed")
+		return
+	}
+
+	user, err := s.saveUser(claims)
+	if err != nil {
+		log.Printf("Failed to save user: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to save user")
+		return
+	}
+
+	if s.startSession(c, user) {
+		c.Redirect(http.StatusFound, loginState.ReturnTo)
+	}
+}
+
+// startSession logs in user and sets the session cookie. It reports whether
+// the session was created, having written an error response if not.
+func (s *Server) startSession(c *gin.Context, user *database.User) bool {
+	token, err := misc.GenToken(SessionTokenLen)
+	if err != nil {
+		log.Printf("Failed to generate session token: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeLoginFailed, "failed to create session")
+		return false
+	}
+	lifetime := time.Duration(s.config.Auth.SessionLifetime) * time.Hour
+	session := database.Session{
+		TokenHash: hashToken(token),
+		UserId:    user.ID,
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+	if err := s.db.Create(&session).Error; err != nil {
+		log.Printf("Failed to create session: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to create session")
+		return false
+	}
+	s.audit(database.AuditLogin, "", s.clientInfo(c), fmt.Sprintf("user %d", user.ID))
+
+	s.setCookie(c, SessionCookie, token, "/", int(lifetime/time.Second))
+	return true
+}
+
+// saveUser creates or updates the user the claims are about
+func (s *Server) saveUser(claims *oidc.Claims) (*database.User, error) {
+	var user database.User
+	err := s.db.Where("issuer = ? AND subject = ?", s.oidc.Issuer, claims.Subject).First(&user).Error
+	if err != nil && !s.db.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+
+	now := time.Now()
+	user.Issuer = s.oidc.Issuer
+	user.Subject = claims.Subject
+	user.Email = claims.Email
+	// unverified addresses could be anyone's
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		user.Email = ""
+	}
+	user.Name = claims.Name
+	if user.Name == "" {
+		user.Name = claims.PreferredUsername
+	}
+	user.LastLoginAt = &now
+
+	if err := s.db.Save(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// logout ends the session of the cookie
+func (s *Server) logout(c *gin.Context) {
+	if token, err := c.Cookie(SessionCookie); err == nil && token != "" {
+		if err := s.db.Unscoped().Where("token_hash = ?", hashToken(token)).Delete(&database.Session{}).Error; err != nil {
+			log.Printf("Failed to delete session: %s\n", err)
+			apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to end session")
+			return
+		}
+	}
+	if user := currentUser(c); user != nil {
+		s.audit(database.AuditLogout, "", s.clientInfo(c), fmt.Sprintf("user %d", user.ID))
+	}
+
+	s.setCookie(c, SessionCookie, "", "/", -1)
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"message": "logged out",
+		},
+	)
+}
+
+// getUser returns the logged in user
+func (s *Server) getUser(c *gin.Context) {
+	user := currentUser(c)
+	if user == nil {
+		apiError(c, http.StatusUnauthorized, ErrCodeLoginRequired, "not logged in")
+		return
+	}
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"email": user.Email,
+			"name":  user.Name,
+		},
+	)
+}
+
+// authenticate loads the user of the session cookie, if any. Requests without
+// a valid session continue anonymously.
+func (s *Server) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := c.Cookie(SessionCookie)
+		if err != nil || token == "" {
+			c.Next()
+			return
+		}
+
+		var session database.Session
+		err = s.db.Where("token_hash = ? AND expires_at > ?", hashToken(token), time.Now()).First(&session).Error
+		if err == nil {
+			var user database.User
+			if err = s.db.First(&user, session.UserId).Error; err == nil {
+				c.Set(userKey, &user)
+			}
+		}
+		if err != nil && !s.db.IsRecordNotFoundError(err) {
+			log.Printf("Failed to fetch session: %s\n", err)
+		}
+
+		c.Next()
+	}
+}
+
+// requireLogin refuses anonymous requests if the config says so. An API key
+// counts as login.
+func (s *Server) requireLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.config.Auth.RequireLogin && currentUser(c) == nil && currentAPIKey(c) == nil {
+			apiErrorAborted(c, http.StatusUnauthorized, ErrCodeLoginRequired, "login required")
+			return
+		}
+		c.Next()
+	}
+}
+
+// currentUser returns the logged in user, nil for anonymous requests
+func currentUser(c *gin.Context) *database.User {
+	user, _ := c.Get(userKey)
+	u, _ := user.(*database.User)
+	return u
+}
+
+// currentUserId returns the id of the logged in user, 0 for anonymous
+// requests
+func currentUserId(c *gin.Context) uint {
+	if user := currentUser(c); user != nil {
+		return user.ID
+	}
+	return 0
+}
+
+func (s *Server) setCookie(c *gin.Context, name, value, path string, maxAge int) {
+	secure := s.config.TLS.Use || strings.HasPrefix(s.config.PublicURL, "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(name, value, maxAge, path, "", secure, true)
+}
+
+// hashToken returns the hex SHA-256 a session token is stored as
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// isLocalPath reports whether p is a path on this server, so redirecting to it
+// can't lead elsewhere
+func isLocalPath(p string) bool {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return false
+	}
+	u, err := url.Parse(p)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
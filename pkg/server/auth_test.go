@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/oidc/oidctest"
+)
+
+const testPublicURL = "http://gdprshare.test"
+
+// setupAuthServer creates a test server logging in with idp
+func setupAuthServer(t *testing.T, idp *oidctest.Provider, requireLogin bool) (*Server, func()) {
+	t.Helper()
+
+	srv, cleanup := setupTestServer(t)
+	conf := srv.config
+	conf.PublicURL = testPublicURL
+	conf.Auth.RequireLogin = requireLogin
+	conf.Auth.SessionLifetime = 24
+	conf.Auth.OIDC.Issuer = idp.Issuer()
+	conf.Auth.OIDC.ClientID = oidctest.ClientID
+	conf.Auth.OIDC.ClientSecret = oidctest.ClientSecret
+	conf.Auth.OIDC.Scopes = "openid email profile"
+
+	// routes depend on the config
+	return New(srv.db, srv.store, conf), cleanup
+}
+
+func findCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// startLogin requests the login and follows the redirect to the provider.
+// Returns the login cookie and the callback the provider redirected to.
+func startLogin(t *testing.T, srv *Server, returnTo string) (*http.Cookie, *url.URL) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/auth/login?returnTo="+url.QueryEscape(returnTo), nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+
+	loginCookie := findCookie(w, LoginCookie)
+	require.NotNil(t, loginCookie)
+	assert.True(t, loginCookie.HttpOnly)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(w.Header().Get("Location"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, testPublicURL+CallbackPath, callback.Scheme+"://"+callback.Host+callback.Path)
+
+	return loginCookie, callback
+}
+
+func finishLogin(srv *Server, loginCookie *http.Cookie, callback *url.URL) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	if loginCookie != nil {
+		req.AddCookie(loginCookie)
+	}
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+// login logs in through the provider and returns the session cookie
+func login(t *testing.T, srv *Server) *http.Cookie {
+	t.Helper()
+
+	loginCookie, callback := startLogin(t, srv, "/request")
+	w := finishLogin(srv, loginCookie, callback)
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+	assert.Equal(t, "/request", w.Header().Get("Location"))
+
+	session := findCookie(w, SessionCookie)
+	require.NotNil(t, session)
+	assert.True(t, session.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, session.SameSite)
+
+	return session
+}
+
+func serveWithSession(srv *Server, req *http.Request, session *http.Cookie) *httptest.ResponseRecorder {
+	if session != nil {
+		req.AddCookie(session)
+	}
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func newUploadRequest(t *testing.T, filename string) *http.Request {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	_, err = part.Write([]byte("test content"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/files", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return req
+}
+
+func uploadWithSession(t *testing.T, srv *Server, session *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return serveWithSession(srv, newUploadRequest(t, "test-auth.txt"), session)
+}
+
+func decodeUploaded(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var resp struct {
+		FileId string `json:"fileId"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.NotEmpty(t, resp.FileId)
+
+	return resp.FileId
+}
+
+func TestLogin(t *testing.T) {
+	idp := oidctest.New(oidctest.User{Subject: "alice", Email: "alice@example.com", Name: "Alice"})
+	defer idp.Close()
+	srv, cleanup := setupAuthServer(t, idp, false)
+	defer cleanup()
+
+	session := login(t, srv)
+
+	w := serveWithSession(srv, httptest.NewRequest(http.MethodGet, "/api/v1/auth/user", nil), session)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"email": "alice@example.com", "name": "Alice"}`, w.Body.String())
+
+	var user database.User
+	require.NoError(t, srv.db.Where("subject = ?", "alice").First(&user).Error)
+	assert.Equal(t, idp.Issuer(), user.Issuer)
+	assert.NotNil(t, user.LastLoginAt)
+
+	var stored database.Session
+	require.NoError(t, srv.db.First(&stored).Error)
+	assert.Equal(t, hashToken(session.Value), stored.TokenHash, "only the hash of the token is stored")
+
+	t.Run("upload is linked to the user", func(t *testing.T) {
+		w := uploadWithSession(t, srv, session)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		fileId := decodeUploaded(t, w)
+		assert.Equal(t, user.ID, getTestStoredFile(t, srv, fileId).UserId)
+
+		anonymous := uploadTestFile(t, srv, nil)
+		assert.Zero(t, getTestStoredFile(t, srv, anonymous).UserId)
+	})
+
+	t.Run("file request is linked to the user", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/requests", strings.NewReader("max-files=1"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := serveWithSession(srv, req, session)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		requestId := strings.TrimPrefix(w.Header().Get("Location"), "/r/")
+
+		// the external party uploads anonymously, the file belongs to the
+		// requester
+		w = uploadToTestRequest(t, srv, requestId, []byte("requested"), map[string]string{"type": "file"})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		assert.Equal(t, user.ID, getTestStoredFile(t, srv, decodeUploaded(t, w)).UserId)
+	})
+
+	t.Run("second login updates the user", func(t *testing.T) {
+		idp.SetUser(oidctest.User{Subject: "alice", Email: "alice@example.org", Name: "Alice"})
+		login(t, srv)
+
+		var users []database.User
+		require.NoError(t, srv.db.Find(&users).Error)
+		require.Len(t, users, 1)
+		assert.Equal(t, "alice@example.org", users[0].Email)
+	})
+
+	t.Run("logout", func(t *testing.T) {
+		w := serveWithSession(srv, httptest.NewRequest(http.MethodPost, "/api/v1/auth/logout", nil), session)
+		require.Equal(t, http.StatusOK, w.Code)
+		cleared := findCookie(w, SessionCookie)
+		require.NotNil(t, cleared)
+		assert.Empty(t, cleared.Value)
+
+		w = serveWithSession(srv, httptest.NewRequest(http.MethodGet, "/api/v1/auth/user", nil), session)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, string(ErrCodeLoginRequired), decodeError(t, w).Code)
+	})
+
+	events := auditEvents(t, srv)
+	assert.Contains(t, events, database.AuditLogin)
+	assert.Contains(t, events, database.AuditLogout)
+}
+
+func TestLoginRejected(t *testing.T) {
+	idp := oidctest.New(oidctest.User{Subject: "bob"})
+	defer idp.Close()
+	srv, cleanup := setupAuthServer(t, idp, false)
+	defer cleanup()
+
+	t.Run("without login cookie", func(t *testing.T) {
+		_, callback := startLogin(t, srv, "/")
+		w := finishLogin(srv, nil, callback)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, string(ErrCodeLoginFailed), decodeError(t, w).Code)
+		assert.Nil(t, findCookie(w, SessionCookie))
+	})
+
+	t.Run("callback replayed", func(t *testing.T) {
+		loginCookie, callback := startLogin(t, srv, "/")
+		require.Equal(t, http.StatusFound, finishLogin(srv, loginCookie, callback).Code)
+
+		w := finishLogin(srv, loginCookie, callback)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, string(ErrCodeLoginFailed), decodeError(t, w).Code)
+	})
+
+	t.Run("wrong audience", func(t *testing.T) {
+		idp.Claims["aud"] = "other-client"
+		defer delete(idp.Claims, "aud")
+
+		loginCookie, callback := startLogin(t, srv, "/")
+		w := finishLogin(srv, loginCookie, callback)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, string(ErrCodeLoginFailed), decodeError(t, w).Code)
+	})
+
+	t.Run("provider error", func(t *testing.T) {
+		loginCookie, callback := startLogin(t, srv, "/")
+		query := callback.Query()
+		query.Del("code")
+		query.Set("error", "access_denied")
+		callback.RawQuery = query.Encode()
+
+		w := finishLogin(srv, loginCookie, callback)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, decodeError(t, w).Message, "access_denied")
+	})
+
+	t.Run("foreign return path", func(t *testing.T) {
+		for _, returnTo := range []string{"https://evil.example.com/", "//evil.example.com", "/\\evil.example.com", "javascript:alert(1)"} {
+			loginCookie, callback := startLogin(t, srv, returnTo)
+			w := finishLogin(srv, loginCookie, callback)
+			require.Equal(t, http.StatusFound, w.Code)
+			assert.Equal(t, "/", w.Header().Get("Location"), returnTo)
+		}
+	})
+
+	t.Run("unknown session", func(t *testing.T) {
+		w := uploadWithSession(t, srv, &http.Cookie{Name: SessionCookie, Value: "forged"})
+		require.Equal(t, http.StatusCreated, w.Code, "continues anonymously")
+		assert.Zero(t, getTestStoredFile(t, srv, decodeUploaded(t, w)).UserId)
+	})
+}
+
+func TestRequireLogin(t *testing.T) {
+	idp := oidctest.New(oidctest.User{Subject: "carol"})
+	defer idp.Close()
+	srv, cleanup := setupAuthServer(t, idp, true)
+	defer cleanup()
+
+	w := serveWithSession(srv, httptest.NewRequest(http.MethodGet, "/api/v1/config", nil), nil)
+	assert.Contains(t, w.Body.String(), `"login":true`)
+	assert.Contains(t, w.Body.String(), `"loginRequired":true`)
+
+	anonymous := map[string]*http.Request{
+		"upload":       httptest.NewRequest(http.MethodPost, "/api/v1/files", nil),
+		"resumable":    httptest.NewRequest(http.MethodPost, "/api/v1/uploads", strings.NewReader("size=10")),
+		"tus":          httptest.NewRequest(http.MethodPost, "/api/v1/tus", nil),
+		"file request": httptest.NewRequest(http.MethodPost, "/api/v1/requests", nil),
+	}
+	anonymous["tus"].Header.Set("Tus-Resumable", TusVersion)
+	for name, req := range anonymous {
+		t.Run(name, func(t *testing.T) {
+			w := serveWithSession(srv, req, nil)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Equal(t, string(ErrCodeLoginRequired), decodeError(t, w).Code)
+		})
+	}
+
+	session := login(t, srv)
+	w = uploadWithSession(t, srv, session)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	fileId := decodeUploaded(t, w)
+
+	// downloads stay anonymous
+	w = rangeDownload(srv, fileId, "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "test content", w.Body.String())
+}
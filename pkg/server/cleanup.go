@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/lixmal/gdprshare/pkg/config"
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+	"github.com/lixmal/gdprshare/pkg/storage"
+)
+
+const (
+	// CleanupLease makes sure only one of several instances sharing a
+	// database runs the cleanup per interval.
+	CleanupLease = "cleanup"
+	// CleanupOnceTTL bounds how long a one-off cleanup holds the lease if it
+	// dies before releasing it
+	CleanupOnceTTL = time.Hour
+)
+
+type cleanupScheduler struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	holder string
+}
+
+// startCleanup runs misc.Cleanup now and then every configured interval,
+// until Shutdown.
+func (s *Server) startCleanup() {
+	if s.config.Cleanup.Disabled || s.config.Cleanup.Interval == 0 || s.cleanup != nil {
+		return
+	}
+
+	holder, err := cleanupHolder()
+	if err != nil {
+		log.Printf("Failed to start cleanup scheduler: %s\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cleanup = &cleanupScheduler{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		holder: holder,
+	}
+
+	go s.runCleanupScheduler(ctx, s.cleanup)
+}
+
+func (s *Server) runCleanupScheduler(ctx context.Context, sched *cleanupScheduler) {
+	defer close(sched.done)
+
+	interval := time.Duration(s.config.Cleanup.Interval) * time.Minute
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.runCleanup(sched.holder, interval)
+
+		select {
+		case <-ctx.Done():
+			if err := s.db.ReleaseLease(CleanupLease, sched.holder); err != nil {
+				log.Printf("%s\n", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runCleanup cleans up if no other instance did within the interval. The
+// lease is kept for the whole interval, not just while cleaning up.
+func (s *Server) runCleanup(holder string, interval time.Duration) {
+	ok, err := s.db.AcquireLease(CleanupLease, holder, interval)
+	if err != nil {
+		log.Printf("Failed to acquire cleanup lease: %s\n", err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if errs := misc.Cleanup(s.db, s.store, s.config); len(errs) > 0 {
+		log.Println("File cleanup errors:")
+		for _, err := range errs {
+			log.Printf("%s\n", err)
+		}
+	}
+}
+
+// CleanupOnce runs misc.Cleanup under the lease of the scheduler, for cron
+// jobs next to running servers. It reports false without cleaning up if
+// another instance holds the lease.
+func CleanupOnce(db *database.Database, store storage.Backend, conf *config.Config) (bool, []error) {
+	holder, err := cleanupHolder()
+	if err != nil {
+		return false, []error{err}
+	}
+
+	ok, err := db.AcquireLease(CleanupLease, holder, CleanupOnceTTL)
+	if err != nil {
+		return false, []error{err}
+	}
+	if !ok {
+		return false, nil
+	}
+
+	errs := misc.Cleanup(db, store, conf)
+	if err := db.ReleaseLease(CleanupLease, holder); err != nil {
+		errs = append(errs, err)
+	}
+	return true, errs
+}
+
+// stopCleanup stops the scheduler and waits for a running cleanup to finish
+func (s *Server) stopCleanup(ctx context.Context) error {
+	if s.cleanup == nil {
+		return nil
+	}
+
+	s.cleanup.cancel()
+	select {
+	case <-s.cleanup.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func cleanupHolder() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	id, err := misc.GenToken(8)
+	if err != nil {
+		return "", err
+	}
+
+	return hostname + "-" + id, nil
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+)
+
+// TestCleanupScheduler verifies expired files are removed without an
+// external cron and the scheduler stops with the server
+func TestCleanupScheduler(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+	srv.config.Cleanup.Interval = 60
+
+	fileId := uploadTestFile(t, srv, map[string]string{"expiry": "1"})
+	require.NoError(t, srv.db.Model(&database.StoredFile{}).
+		Where("file_id = ?", fileId).
+		Update("created_at", time.Now().AddDate(0, 0, -2)).Error)
+
+	srv.startCleanup()
+
+	assert.Eventually(t, func() bool {
+		var count int
+		require.NoError(t, srv.db.Model(&database.StoredFile{}).Where("file_id = ?", fileId).Count(&count).Error)
+		return count == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+
+	var leases int
+	require.NoError(t, srv.db.Model(&database.Lease{}).Count(&leases).Error)
+	assert.Equal(t, 0, leases, "lease is released on shutdown")
+}
+
+func TestCleanupSchedulerDisabled(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+	srv.config.Cleanup.Interval = 60
+	srv.config.Cleanup.Disabled = true
+
+	srv.startCleanup()
+	assert.Nil(t, srv.cleanup)
+	require.NoError(t, srv.Shutdown(context.Background()))
+}
+
+// TestLease verifies a lease is exclusive until released or expired
+func TestLease(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ok, err := srv.db.AcquireLease("test", "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = srv.db.AcquireLease("test", "b", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok, "held by a")
+
+	ok, err = srv.db.AcquireLease("test", "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok, "a renews")
+
+	require.NoError(t, srv.db.ReleaseLease("test", "a"))
+	ok, err = srv.db.AcquireLease("test", "b", -time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok, "released")
+
+	ok, err = srv.db.AcquireLease("test", "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok, "expired")
+}
+
+func countUnscoped(t *testing.T, srv *Server, model interface{}) int {
+	t.Helper()
+
+	var count int
+	require.NoError(t, srv.db.Unscoped().Model(model).Count(&count).Error)
+	return count
+}
+
+// TestCleanupOnce verifies a one-off cleanup leaves the files to an instance
+// holding the lease
+func TestCleanupOnce(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	fileId := uploadTestFile(t, srv, map[string]string{"expiry": "1"})
+	require.NoError(t, srv.db.Model(&database.StoredFile{}).
+		Where("file_id = ?", fileId).
+		Update("created_at", time.Now().AddDate(0, 0, -2)).Error)
+
+	ok, err := srv.db.AcquireLease(CleanupLease, "other", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ran, errs := CleanupOnce(srv.db, srv.store, srv.config)
+	assert.False(t, ran)
+	assert.Empty(t, errs)
+	assert.Equal(t, 1, countUnscoped(t, srv, &database.StoredFile{}))
+	assert.Zero(t, countAuditEvents(t, srv, database.AuditExpiryDelete))
+
+	require.NoError(t, srv.db.ReleaseLease(CleanupLease, "other"))
+
+	ran, errs = CleanupOnce(srv.db, srv.store, srv.config)
+	assert.True(t, ran)
+	assert.Empty(t, errs)
+	assert.Equal(t, 1, countAuditEvents(t, srv, database.AuditExpiryDelete))
+	assert.Equal(t, 0, countUnscoped(t, srv, &database.Lease{}), "the lease is released")
+}
+
+// TestCleanupAuditsFailedDeletion checks an expired file whose row was
+// deleted is audited even if removing its blob failed
+func TestCleanupAuditsFailedDeletion(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	fileId := uploadTestFile(t, srv, map[string]string{"expiry": "1"})
+	require.NoError(t, srv.db.Model(&database.StoredFile{}).
+		Where("file_id = ?", fileId).
+		Update("created_at", time.Now().AddDate(0, 0, -2)).Error)
+	require.NoError(t, os.Remove(filepath.Join(srv.config.StorePath, getTestStoredFile(t, srv, fileId).Name)))
+
+	require.NotEmpty(t, misc.Cleanup(srv.db, srv.store, srv.config))
+	assert.NotNil(t, getTestStoredFile(t, srv, fileId).DeletedAt)
+
+	var entry database.AuditEntry
+	require.NoError(t, srv.db.Where("event = ? AND file_id = ?", database.AuditExpiryDelete, fileId).First(&entry).Error)
+	assert.Contains(t, entry.Detail, "failed: delete file with id "+fileId+" from storage")
+
+	require.Empty(t, misc.Cleanup(srv.db, srv.store, srv.config))
+	assert.Equal(t, 1, countAuditEvents(t, srv, database.AuditExpiryDelete))
+}
+
+func countAuditEvents(t *testing.T, srv *Server, event string) int {
+	t.Helper()
+
+	var count int
+	require.NoError(t, srv.db.Model(&database.AuditEntry{}).Where("event = ?", event).Count(&count).Error)
+	return count
+}
+
+// TestRetention checks metadata is pseudonymised on deletion and purged after
+// the retention period
+func TestRetention(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	srv.config.SaveClientInfo = true
+	srv.config.Retention.Days = 30
+
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, map[string]string{"email": "owner@example.com"})
+	srv.config.Mail.SmtpPort = 1 // mails fail fast
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var dst database.DstClient
+	require.NoError(t, srv.db.First(&dst).Error)
+	require.NotEmpty(t, dst.Addr)
+
+	req = httptest.NewRequest(
+		http.MethodDelete,
+		fmt.Sprintf("/api/v1/files/%s?ownerToken=%s", fileId, ownerToken),
+		nil,
+	)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	storedFile := getTestStoredFile(t, srv, fileId)
+	assert.NotNil(t, storedFile.PseudonymisedAt)
+	assert.Empty(t, storedFile.Email)
+	assert.Empty(t, storedFile.Filename)
+
+	var src database.Client
+	require.NoError(t, srv.db.First(&src).Error)
+	require.NoError(t, srv.db.First(&dst).Error)
+	for _, client := range []database.Client{src, database.Client(dst)} {
+		assert.Empty(t, client.Addr)
+		assert.Empty(t, client.UserAgent)
+		assert.False(t, client.CreatedAt.IsZero())
+	}
+
+	// still within retention
+	require.Empty(t, misc.Cleanup(srv.db, srv.store, srv.config))
+	assert.Equal(t, 1, countUnscoped(t, srv, &database.StoredFile{}))
+
+	require.NoError(t, srv.db.Unscoped().Model(&storedFile).
+		Update("deleted_at", time.Now().AddDate(0, 0, -31)).Error)
+	require.Empty(t, misc.Cleanup(srv.db, srv.store, srv.config))
+
+	assert.Equal(t, 0, countUnscoped(t, srv, &database.StoredFile{}))
+	assert.Equal(t, 0, countUnscoped(t, srv, &database.Client{}))
+	assert.Equal(t, 0, countUnscoped(t, srv, &database.DstClient{}))
+	assert.Equal(t, 0, countUnscoped(t, srv, &database.DownloadToken{}))
+}
+
+// TestAuditRetention checks the audit log keeps no addresses or user agents
+// past the retention period while its chain stays intact
+func TestAuditRetention(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	srv.config.SaveClientInfo = true
+	srv.config.Retention.Days = 30
+
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, nil)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	req.Header.Set("User-Agent", "recipient")
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	srv.audit(database.AuditLogin, "", &database.Client{Addr: "192.0.2.7", UserAgent: "sender"}, "user 1")
+
+	assert.Equal(t, 0, countAuditAddrs(t, srv))
+	var clients []database.AuditClient
+	require.NoError(t, srv.db.Where("file_id = ?", fileId).Find(&clients).Error)
+	require.Len(t, clients, 2, "upload and download")
+	assert.NotEmpty(t, clients[1].Addr)
+	assert.Equal(t, "recipient", clients[1].UserAgent)
+
+	req = httptest.NewRequest(
+		http.MethodDelete,
+		fmt.Sprintf("/api/v1/files/%s?ownerToken=%s", fileId, ownerToken),
+		nil,
+	)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// removed with the other client data of the file, the deletion's own
+	// is kept like the file's metadata
+	require.NoError(t, srv.db.Where("file_id = ? AND user_agent = ?", fileId, "recipient").Find(&clients).Error)
+	assert.Empty(t, clients)
+
+	// still within retention
+	require.Empty(t, misc.Cleanup(srv.db, srv.store, srv.config))
+	assert.Equal(t, 2, countUnscoped(t, srv, &database.AuditClient{}))
+
+	require.NoError(t, srv.db.Unscoped().Model(&database.StoredFile{}).
+		Where("file_id = ?", fileId).
+		Update("deleted_at", time.Now().AddDate(0, 0, -31)).Error)
+	require.NoError(t, srv.db.Model(&database.AuditClient{}).
+		Update("created_at", time.Now().AddDate(0, 0, -31)).Error)
+	require.Empty(t, misc.Cleanup(srv.db, srv.store, srv.config))
+	assert.Equal(t, 0, countUnscoped(t, srv, &database.AuditClient{}))
+	assert.Equal(t, 0, countAuditAddrs(t, srv))
+
+	_, _, err := srv.db.VerifyAudit()
+	assert.NoError(t, err)
+}
+
+func countAuditAddrs(t *testing.T, srv *Server) int {
+	t.Helper()
+
+	var count int
+	require.NoError(t, srv.db.Model(&database.AuditEntry{}).
+		Where("addr != '' OR user_agent != ''").
+		Count(&count).Error)
+	return count
+}
+
+// TestRetentionSweep checks files deleted without pseudonymisation are caught
+// up by the cleanup
+func TestRetentionSweep(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	srv.config.SaveClientInfo = true
+	srv.config.Retention.Days = 30
+
+	fileId := uploadTestFile(t, srv, nil)
+	require.NoError(t, srv.db.Where("file_id = ?", fileId).Delete(&database.StoredFile{}).Error)
+
+	require.Empty(t, misc.Cleanup(srv.db, srv.store, srv.config))
+
+	storedFile := getTestStoredFile(t, srv, fileId)
+	assert.NotNil(t, storedFile.PseudonymisedAt)
+
+	var src database.Client
+	require.NoError(t, srv.db.First(&src).Error)
+	assert.Empty(t, src.Addr)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+)
+
+const DownloadTokenLen = 20
+
+// downloadTokenParam returns the download token sent with a resumed download,
+// either as X-Download-Token header or token query parameter.
+func downloadTokenParam(c *gin.Context) string {
+	if token := c.GetHeader("X-Download-Token"); token != "" {
+		return token
+	}
+	return c.Query("token")
+}
+
+// getDownloadToken looks up an unexpired, not yet completed download token of
+// the given file.
+func (s *Server) getDownloadToken(storedFile *database.StoredFile, t string) (*database.DownloadToken, error) {
+	var token database.DownloadToken
+	if err := s.db.Where("token = ? AND stored_file_id = ?", t, storedFile.ID).Find(&token).Error; err != nil {
+		return nil, fmt.Errorf("find download token: %w", err)
+	}
+
+	if token.Completed {
+		return nil, errors.New("download token already used")
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return nil, errors.New("download token expired")
+	}
+
+	return &token, nil
+}
+
+// newDownloadToken starts a download. Every download in progress reserves one
+// of the remaining downloads until it completes or its token expires.
+func (s *Server) newDownloadToken(c *gin.Context, storedFile *database.StoredFile) (*database.DownloadToken, bool) {
+	now := time.Now()
+
+	var active uint
+	err := s.db.Model(&database.DownloadToken{}).
+		Where("stored_file_id = ? AND completed = ? AND expires_at > ?", storedFile.ID, false, now).
+		Count(&active).Error
+	if err != nil {
+		log.Printf("Failed to count downloads of file with id %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return nil, false
+	}
+	if active >= storedFile.Count {
+		apiError(c, http.StatusConflict, ErrCodeDownloadActive, "download already in progress, try again later")
+		return nil, false
+	}
+
+	t, err := misc.GenToken(DownloadTokenLen)
+	if err != nil {
+		log.Printf("Failed to generate download token: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return nil, false
+	}
+
+	token := &database.DownloadToken{
+		Token:        t,
+		StoredFileId: storedFile.ID,
+		ExpiresAt:    now.Add(time.Duration(s.config.Download.ResumeWindow) * time.Minute),
+	}
+	if err := s.db.Create(token).Error; err != nil {
+		log.Printf("Failed to save download token for file with id %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return nil, false
+	}
+
+	return token, true
+}
+
+// completeDownload consumes one download once the last byte of the file was
+// sent, and removes the contents after the last one.
+func (s *Server) completeDownload(storedFile *database.StoredFile, token *database.DownloadToken) error {
+	tx := s.db.Begin()
+	if err := tx.Error; err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+
+	res := tx.Model(&database.DownloadToken{}).
+		Where("id = ? AND completed = ?", token.ID, false).
+		Update("completed", true)
+	if res.Error != nil {
+		tx.Rollback()
+		return fmt.Errorf("mark download token completed: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		// a concurrent request on the same token already counted it
+		tx.Rollback()
+		return nil
+	}
+
+	err := tx.Model(&database.StoredFile{}).
+		Where("id = ? AND count > 0", storedFile.ID).
+		Updates(map[string]interface{}{
+			"count":     gorm.Expr("count - 1"),
+			"downloads": gorm.Expr("downloads + 1"),
+		}).Error
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("decrease count: %w", err)
+	}
+
+	var updated database.StoredFile
+	if err := tx.First(&updated, storedFile.ID).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("reload file: %w", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	if updated.Count < 1 {
+		// Remove actual file only, db entry will be deleted on confirmation
+		return misc.RemoveBlob(&updated, s.db, s.store, s.config)
+	}
+
+	return nil
+}
+
+// transferComplete reports whether the response sent the file up to its last
+// byte, either in full or as the final range of a resumed download.
+func transferComplete(c *gin.Context, size int64) bool {
+	written := int64(c.Writer.Size())
+	if written < 0 {
+		written = 0
+	}
+
+	switch c.Writer.Status() {
+	case http.StatusOK:
+		return written == size
+	case http.StatusPartialContent:
+		var start, end, total int64
+		if _, err := fmt.Sscanf(c.Writer.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil {
+			// multiple ranges
+			return false
+		}
+		return end == size-1 && written == end-start+1
+	}
+
+	return false
+}
+
+// saveDeniedClient keeps a refused download attempt for the transfer receipt
+func (s *Server) saveDeniedClient(storedFile *database.StoredFile, client *database.DstClient, reason string) {
+	denied := &database.DeniedClient{
+		Client: database.Client(*client),
+		Reason: reason,
+	}
+	denied.StoredFileId = storedFile.ID
+
+	if err := s.db.Create(denied).Error; err != nil {
+		log.Printf("Failed to save denied client on file with id %s: %s\n", storedFile.FileId, err)
+	}
+	s.audit(database.AuditDenied, storedFile.FileId, &denied.Client, reason)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+func rangeDownload(srv *Server, fileId, token, byteRange string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	if byteRange != "" {
+		req.Header.Set("Range", "bytes="+byteRange)
+	}
+	if token != "" {
+		req.Header.Set("X-Download-Token", token)
+	}
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+// getTestStoredFile returns the row of a file, deleted ones included
+func getTestStoredFile(t *testing.T, srv *Server, fileId string) database.StoredFile {
+	t.Helper()
+
+	var storedFile database.StoredFile
+	require.NoError(t, srv.db.Unscoped().Where("file_id = ?", fileId).First(&storedFile).Error)
+
+	return storedFile
+}
+
+// TestDownloadResume interrupts a one-shot download and resumes it with the
+// download token, the count is consumed by the completing request only
+func TestDownloadResume(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	fileId := uploadTestFile(t, srv, map[string]string{"count": "1"})
+
+	w := rangeDownload(srv, fileId, "", "0-4")
+	require.Equal(t, http.StatusPartialContent, w.Code, w.Body.String())
+	assert.Equal(t, "test ", w.Body.String())
+	token := w.Header().Get("X-Download-Token")
+	require.NotEmpty(t, token)
+	assert.NotEmpty(t, w.Header().Get("X-Download-Token-Expires"))
+
+	storedFile := getTestStoredFile(t, srv, fileId)
+	assert.Equal(t, uint(1), storedFile.Count)
+	_, err := srv.store.Stat(storedFile.Name)
+	require.NoError(t, err)
+
+	// the remaining download is reserved for the interrupted one
+	w = rangeDownload(srv, fileId, "", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, string(ErrCodeDownloadActive), decodeError(t, w).Code)
+
+	w = rangeDownload(srv, fileId, "invalid", "5-")
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Equal(t, string(ErrCodeDownloadToken), decodeError(t, w).Code)
+
+	w = rangeDownload(srv, fileId, token, "5-")
+	require.Equal(t, http.StatusPartialContent, w.Code, w.Body.String())
+	assert.Equal(t, "content", w.Body.String())
+	assert.Equal(t, token, w.Header().Get("X-Download-Token"))
+
+	storedFile = getTestStoredFile(t, srv, fileId)
+	assert.Equal(t, uint(0), storedFile.Count)
+	assert.Equal(t, "delete", storedFile.DeletionMethod)
+
+	var clients int
+	require.NoError(t, srv.db.Model(&database.DstClient{}).Where("stored_file_id = ?", storedFile.ID).Count(&clients).Error)
+	assert.Equal(t, 1, clients, "a resumed download is recorded once")
+
+	w = rangeDownload(srv, fileId, token, "5-")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestDownloadTokenExpiry verifies an expired token neither resumes nor keeps
+// the download reserved
+func TestDownloadTokenExpiry(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	fileId := uploadTestFile(t, srv, map[string]string{"count": "1"})
+
+	w := rangeDownload(srv, fileId, "", "0-4")
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	token := w.Header().Get("X-Download-Token")
+
+	require.NoError(t, srv.db.Model(&database.DownloadToken{}).
+		Where("token = ?", token).
+		Update("expires_at", time.Now().Add(-time.Minute)).Error)
+
+	w = rangeDownload(srv, fileId, token, "5-")
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Equal(t, string(ErrCodeDownloadToken), decodeError(t, w).Code)
+
+	w = rangeDownload(srv, fileId, "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "test content", w.Body.String())
+	assert.Equal(t, uint(0), getTestStoredFile(t, srv, fileId).Count)
+}
@@ -8,7 +8,8 @@ import (
 // Clients use it to look up a localized message and fall back to the English
 // message field when they don't know the code, so codes must never be renamed
 // or reused for a different meaning once released. Adding a new one only means
-// adding a constant here and a matching entry in the client locale files.
+// adding a constant here, in pkg/client and a matching entry in the client
+// locale files.
 type ErrorCode string
 
 const (
@@ -21,6 +22,15 @@ const (
 	ErrCodeStoreFailed      ErrorCode = "store_failed"
 	ErrCodeSaveFailed       ErrorCode = "save_failed"
 
+	// resumable upload
+	ErrCodeUploadNotFound   ErrorCode = "upload_not_found"
+	ErrCodeInvalidChunk     ErrorCode = "invalid_chunk"
+	ErrCodeChunkTooLarge    ErrorCode = "chunk_too_large"
+	ErrCodeUploadTooLarge   ErrorCode = "upload_too_large"
+	ErrCodeUploadIncomplete ErrorCode = "upload_incomplete"
+	ErrCodeUploadFinalizing ErrorCode = "upload_finalizing"
+	ErrCodeChunkInProgress  ErrorCode = "chunk_in_progress"
+
 	// download
 	ErrCodeInvalidFileID     ErrorCode = "invalid_file_id"
 	ErrCodeCountExpired      ErrorCode = "download_count_expired"
@@ -29,6 +39,44 @@ const (
 	ErrCodeLocationForbidden ErrorCode = "download_location_forbidden"
 	ErrCodeFileGone          ErrorCode = "file_not_found_or_limit_exceeded"
 	ErrCodeRetrievalFailed   ErrorCode = "file_retrieval_failed"
+	ErrCodeDownloadActive    ErrorCode = "download_in_progress"
+	ErrCodeDownloadToken     ErrorCode = "download_token_invalid"
+	ErrCodeFileExpired       ErrorCode = "file_expired"
+
+	// download approval
+	ErrCodeApprovalPending ErrorCode = "approval_pending"
+	ErrCodeApprovalDenied  ErrorCode = "approval_denied"
+	ErrCodeApprovalInvalid ErrorCode = "approval_invalid"
+	ErrCodeApprovalDecided ErrorCode = "approval_decided"
+	ErrCodeApprovalLimit   ErrorCode = "approval_limit"
+
+	// recipient verification
+	ErrCodeCodeRequired ErrorCode = "verification_required"
+	ErrCodeCodeInvalid  ErrorCode = "verification_invalid"
+	ErrCodeCodeLimit    ErrorCode = "verification_limit"
+
+	// file requests
+	ErrCodeRequestNotFound ErrorCode = "request_not_found"
+	ErrCodeRequestExpired  ErrorCode = "request_expired"
+	ErrCodeRequestFull     ErrorCode = "request_full"
+
+	// sender login
+	ErrCodeLoginRequired  ErrorCode = "login_required"
+	ErrCodeLoginFailed    ErrorCode = "login_failed"
+	ErrCodeLoginForbidden ErrorCode = "login_forbidden"
+
+	// API keys
+	ErrCodeAPIKeyInvalid ErrorCode = "api_key_invalid"
+	ErrCodeAPIKeyScope   ErrorCode = "api_key_scope"
+
+	// quotas
+	ErrCodeQuotaBytes   ErrorCode = "quota_bytes_exceeded"
+	ErrCodeQuotaFiles   ErrorCode = "quota_files_exceeded"
+	ErrCodeQuotaUploads ErrorCode = "quota_uploads_exceeded"
+	ErrCodeStorageFull  ErrorCode = "storage_full"
+
+	// transfer records
+	ErrCodeRecordUnavailable ErrorCode = "record_unavailable"
 
 	// deletion
 	ErrCodeOwnerTokenMismatch ErrorCode = "owner_token_mismatch"
@@ -123,6 +123,13 @@ func TestErrorCodesAreUnique(t *testing.T) {
 		ErrCodeTransactionStart,
 		ErrCodeStoreFailed,
 		ErrCodeSaveFailed,
+		ErrCodeUploadNotFound,
+		ErrCodeInvalidChunk,
+		ErrCodeChunkTooLarge,
+		ErrCodeUploadTooLarge,
+		ErrCodeUploadIncomplete,
+		ErrCodeUploadFinalizing,
+		ErrCodeChunkInProgress,
 		ErrCodeInvalidFileID,
 		ErrCodeCountExpired,
 		ErrCodeFileNotFound,
@@ -130,6 +137,30 @@ func TestErrorCodesAreUnique(t *testing.T) {
 		ErrCodeLocationForbidden,
 		ErrCodeFileGone,
 		ErrCodeRetrievalFailed,
+		ErrCodeDownloadActive,
+		ErrCodeDownloadToken,
+		ErrCodeFileExpired,
+		ErrCodeApprovalPending,
+		ErrCodeApprovalDenied,
+		ErrCodeApprovalInvalid,
+		ErrCodeApprovalDecided,
+		ErrCodeApprovalLimit,
+		ErrCodeCodeRequired,
+		ErrCodeCodeInvalid,
+		ErrCodeCodeLimit,
+		ErrCodeRequestNotFound,
+		ErrCodeRequestExpired,
+		ErrCodeRequestFull,
+		ErrCodeLoginRequired,
+		ErrCodeLoginFailed,
+		ErrCodeLoginForbidden,
+		ErrCodeAPIKeyInvalid,
+		ErrCodeAPIKeyScope,
+		ErrCodeQuotaBytes,
+		ErrCodeQuotaFiles,
+		ErrCodeQuotaUploads,
+		ErrCodeStorageFull,
+		ErrCodeRecordUnavailable,
 		ErrCodeOwnerTokenMismatch,
 		ErrCodeDeleteFailed,
 		ErrCodeTLSRequirements,
@@ -151,6 +182,16 @@ func TestErrorCodesAreUnique(t *testing.T) {
 func uploadTestFile(t *testing.T, srv *Server, fields map[string]string) string {
 	t.Helper()
 
+	fileId, _ := uploadOwnedTestFile(t, srv, fields)
+
+	return fileId
+}
+
+// uploadOwnedTestFile uploads a small file with the given extra form fields and
+// returns its id and owner token.
+func uploadOwnedTestFile(t *testing.T, srv *Server, fields map[string]string) (string, string) {
+	t.Helper()
+
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 
@@ -176,6 +217,8 @@ func uploadTestFile(t *testing.T, srv *Server, fields map[string]string) string
 
 	fileId, ok := resp["fileId"].(string)
 	require.True(t, ok, "upload response has no fileId: %v", resp)
+	ownerToken, ok := resp["ownerToken"].(string)
+	require.True(t, ok, "upload response has no ownerToken: %v", resp)
 
-	return fileId
+	return fileId, ownerToken
 }
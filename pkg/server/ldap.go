@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/ldap"
+)
+
+// LDAPLogin is the body of a login with username and password
+type LDAPLogin struct {
+	Username string `json:"username" binding:"required,max=255"`
+	Password string `json:"password" binding:"required,max=1024"`
+}
+
+// newLDAPDirectory returns the configured directory, nil if LDAP login is
+// disabled
+func newLDAPDirectory(s *Server) *ldap.Directory {
+	conf := s.config.Auth.LDAP
+	if conf.URL == "" {
+		return nil
+	}
+
+	return &ldap.Directory{
+		URL:            conf.URL,
+		StartTLS:       conf.StartTLS,
+		BindDN:         conf.BindDN,
+		BindPassword:   conf.BindPassword,
+		BaseDN:         conf.BaseDN,
+		UserFilter:     conf.UserFilter,
+		EmailAttribute: conf.EmailAttribute,
+		NameAttribute:  conf.NameAttribute,
+		GroupAttribute: conf.GroupAttribute,
+	}
+}
+
+// ldapLogin checks username and password against the directory and starts a
+// session. Only JSON is accepted: a cross-site form can't send it, so nobody
+// can be logged in to someone else's account.
+func (s *Server) ldapLogin(c *gin.Context) {
+	if c.ContentType() != gin.MIMEJSON {
+		apiError(c, http.StatusUnsupportedMediaType, ErrCodeInvalidRequest, "login expects a JSON body")
+		return
+	}
+	var l LDAPLogin
+	if err := c.ShouldBindJSON(&l); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	entry, err := s.ldap.Authenticate(l.Username, l.Password)
+	if errors.Is(err, ldap.ErrInvalidCredentials) {
+		apiError(c, http.StatusUnauthorized, ErrCodeLoginFailed, "invalid username or password")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to authenticate against LDAP: %s\n", err)
+		apiError(c, http.StatusBadGateway, ErrCodeLoginFailed, "directory unavailable")
+		return
+	}
+
+	if !s.mayUpload(entry) {
+		apiError(c, http.StatusForbidden, ErrCodeLoginForbidden, "not a member of a group allowed to upload")
+		return
+	}
+
+	user, err := s.saveLDAPUser(entry, l.Username)
+	if err != nil {
+		log.Printf("Failed to save user: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to save user")
+		return
+	}
+
+	if !s.startSession(c, user) {
+		return
+	}
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"email": user.Email,
+			"name":  user.Name,
+		},
+	)
+}
+
+// mayUpload reports whether entry is in one of the upload groups, if any are
+// configured
+func (s *Server) mayUpload(entry *ldap.Entry) bool {
+	groups := s.config.Auth.LDAP.UploadGroups
+	if len(groups) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		if entry.IsMember(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// saveLDAPUser creates or updates the user of entry, with the highest limits
+// of its groups
+func (s *Server) saveLDAPUser(entry *ldap.Entry, username string) (*database.User, error) {
+	var user database.User
+	err := s.db.Where("issuer = ? AND subject = ?", s.ldap.URL, entry.DN).First(&user).Error
+	if err != nil && !s.db.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+
+	now := time.Now()
+	user.Issuer = s.ldap.URL
+	user.Subject = entry.DN
+	user.Email = entry.Email
+	user.Name = entry.Name
+	if user.Name == "" {
+		user.Name = username
+	}
+	// group memberships may have been revoked since the last login
+	user.MaxExpiry, user.MaxCount = 0, 0
+	for _, group := range s.config.Auth.LDAP.Groups {
+		if !entry.IsMember(group.DN) {
+			continue
+		}
+		if group.MaxExpiry > user.MaxExpiry {
+			user.MaxExpiry = group.MaxExpiry
+		}
+		if group.MaxCount > user.MaxCount {
+			user.MaxCount = group.MaxCount
+		}
+	}
+	user.LastLoginAt = &now
+
+	if err := s.db.Save(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
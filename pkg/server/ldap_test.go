@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/config"
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/ldap/ldaptest"
+)
+
+const (
+	staffGroup = "cn=staff,ou=groups," + ldaptest.BaseDN
+	legalGroup = "cn=legal,ou=groups," + ldaptest.BaseDN
+	aliceDN    = "uid=alice,ou=people," + ldaptest.BaseDN
+)
+
+// setupLDAPServer creates a test server logging in with a directory of
+// alice in staff and legal, bob in staff and eve in no group. Staff may
+// upload, legal has longer expiry and more downloads.
+func setupLDAPServer(t *testing.T, requireLogin bool) (*Server, *ldaptest.Server, func()) {
+	t.Helper()
+
+	dir := ldaptest.New(
+		ldaptest.Entry{
+			DN:       aliceDN,
+			Password: "alice-secret",
+			Attributes: map[string][]string{
+				"uid":         {"alice"},
+				"mail":        {"alice@example.com"},
+				"displayName": {"Alice"},
+				"memberOf":    {staffGroup, legalGroup},
+			},
+		},
+		ldaptest.Entry{
+			DN:         "uid=bob,ou=people," + ldaptest.BaseDN,
+			Password:   "bob-secret",
+			Attributes: map[string][]string{"uid": {"bob"}, "memberOf": {staffGroup}},
+		},
+		ldaptest.Entry{
+			DN:         "uid=eve,ou=people," + ldaptest.BaseDN,
+			Password:   "eve-secret",
+			Attributes: map[string][]string{"uid": {"eve"}},
+		},
+	)
+
+	srv, cleanup := setupTestServer(t)
+	conf := srv.config
+	conf.Auth.RequireLogin = requireLogin
+	conf.Auth.SessionLifetime = 24
+	conf.Auth.LDAP.URL = dir.URL()
+	conf.Auth.LDAP.BindDN = ldaptest.BindDN
+	conf.Auth.LDAP.BindPassword = ldaptest.BindPassword
+	conf.Auth.LDAP.BaseDN = ldaptest.BaseDN
+	conf.Auth.LDAP.UserFilter = "(uid={username})"
+	conf.Auth.LDAP.EmailAttribute = "mail"
+	conf.Auth.LDAP.NameAttribute = "displayName"
+	conf.Auth.LDAP.GroupAttribute = "memberOf"
+	conf.Auth.LDAP.UploadGroups = []string{staffGroup}
+	conf.Auth.LDAP.Groups = []config.LDAPGroup{{DN: legalGroup, MaxExpiry: 90, MaxCount: 100}}
+
+	// routes depend on the config
+	return New(srv.db, srv.store, conf), dir, func() {
+		dir.Close()
+		cleanup()
+	}
+}
+
+func ldapLogin(srv *Server, username, password string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(LDAPLogin{Username: username, Password: password})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/ldap", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return serveWithSession(srv, req, nil)
+}
+
+// loginLDAP logs in with username and password and returns the session
+// cookie
+func loginLDAP(t *testing.T, srv *Server, username, password string) *http.Cookie {
+	t.Helper()
+
+	w := ldapLogin(srv, username, password)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	session := findCookie(w, SessionCookie)
+	require.NotNil(t, session)
+	assert.True(t, session.HttpOnly)
+
+	return session
+}
+
+// uploadWithOptions uploads a file with the given sharing options and
+// returns the response
+func uploadWithOptions(t *testing.T, srv *Server, session *http.Cookie, options map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range options {
+		require.NoError(t, writer.WriteField(k, v))
+	}
+	part, err := writer.CreateFormFile("file", "contract.pdf")
+	require.NoError(t, err)
+	_, err = part.Write([]byte("test content"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/files", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return serveWithSession(srv, req, session)
+}
+
+func TestLDAPLogin(t *testing.T) {
+	srv, dir, cleanup := setupLDAPServer(t, false)
+	defer cleanup()
+
+	w := serveWithSession(srv, httptest.NewRequest(http.MethodGet, "/api/v1/config", nil), nil)
+	assert.Contains(t, w.Body.String(), `"login":true`)
+	assert.Contains(t, w.Body.String(), `"ldapLogin":true`)
+	assert.Contains(t, w.Body.String(), `"oidcLogin":false`)
+	assert.Contains(t, w.Body.String(), `"maxCount":15`)
+
+	// no OIDC routes without an issuer
+	w = serveWithSession(srv, httptest.NewRequest(http.MethodGet, "/api/v1/auth/login", nil), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = ldapLogin(srv, "alice", "alice-secret")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"email":"alice@example.com","name":"Alice"}`, w.Body.String())
+	session := findCookie(w, SessionCookie)
+	require.NotNil(t, session)
+
+	w = serveWithSession(srv, httptest.NewRequest(http.MethodGet, "/api/v1/auth/user", nil), session)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"email":"alice@example.com","name":"Alice"}`, w.Body.String())
+
+	w = serveWithSession(srv, httptest.NewRequest(http.MethodGet, "/api/v1/config", nil), session)
+	assert.Contains(t, w.Body.String(), `"maxExpiry":90`)
+	assert.Contains(t, w.Body.String(), `"maxCount":100`)
+
+	w = uploadWithSession(t, srv, session)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	storedFile := getTestStoredFile(t, srv, decodeUploaded(t, w))
+
+	var user database.User
+	require.NoError(t, srv.db.First(&user, storedFile.UserId).Error)
+	assert.Equal(t, dir.URL(), user.Issuer)
+	assert.Equal(t, aliceDN, user.Subject)
+
+	// a second login updates the same user
+	loginLDAP(t, srv, "alice", "alice-secret")
+	var count int
+	require.NoError(t, srv.db.Model(&database.User{}).Count(&count).Error)
+	assert.Equal(t, 1, count)
+
+	// anonymous uploads keep working
+	w = uploadWithSession(t, srv, nil)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Zero(t, getTestStoredFile(t, srv, decodeUploaded(t, w)).UserId)
+}
+
+func TestLDAPLoginRejected(t *testing.T) {
+	srv, dir, cleanup := setupLDAPServer(t, false)
+	defer cleanup()
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		status   int
+		code     ErrorCode
+	}{
+		{"wrong password", "alice", "bob-secret", http.StatusUnauthorized, ErrCodeLoginFailed},
+		{"unknown user", "mallory", "secret", http.StatusUnauthorized, ErrCodeLoginFailed},
+		{"wildcard", "*", "alice-secret", http.StatusUnauthorized, ErrCodeLoginFailed},
+		{"empty password", "alice", "", http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"no upload group", "eve", "eve-secret", http.StatusForbidden, ErrCodeLoginForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := ldapLogin(srv, tt.username, tt.password)
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, string(tt.code), decodeError(t, w).Code)
+			assert.Nil(t, findCookie(w, SessionCookie))
+		})
+	}
+
+	t.Run("form", func(t *testing.T) {
+		form := url.Values{"username": {"alice"}, "password": {"alice-secret"}}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/ldap", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := serveWithSession(srv, req, nil)
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+		assert.Nil(t, findCookie(w, SessionCookie))
+	})
+
+	t.Run("directory down", func(t *testing.T) {
+		dir.Close()
+		w := ldapLogin(srv, "alice", "alice-secret")
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+		assert.Equal(t, string(ErrCodeLoginFailed), decodeError(t, w).Code)
+	})
+}
+
+func TestLDAPGroupLimits(t *testing.T) {
+	srv, _, cleanup := setupLDAPServer(t, false)
+	defer cleanup()
+	alice := loginLDAP(t, srv, "alice", "alice-secret")
+	bob := loginLDAP(t, srv, "bob", "bob-secret")
+
+	tests := []struct {
+		name    string
+		session *http.Cookie
+		options map[string]string
+		status  int
+	}{
+		{"anonymous default", nil, map[string]string{"count": "15", "expiry": "14"}, http.StatusCreated},
+		{"anonymous count", nil, map[string]string{"count": "16"}, http.StatusBadRequest},
+		{"staff count", bob, map[string]string{"count": "16"}, http.StatusBadRequest},
+		{"staff expiry", bob, map[string]string{"expiry": "15"}, http.StatusBadRequest},
+		{"staff expiry hours", bob, map[string]string{"expiry-hours": "337"}, http.StatusBadRequest},
+		{"legal count", alice, map[string]string{"count": "100"}, http.StatusCreated},
+		{"legal expiry", alice, map[string]string{"expiry": "90"}, http.StatusCreated},
+		{"legal expiry hours", alice, map[string]string{"expiry-hours": "2160"}, http.StatusCreated},
+		{"legal above limit", alice, map[string]string{"count": "101"}, http.StatusBadRequest},
+		{"above ceiling", alice, map[string]string{"count": "1001"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := uploadWithOptions(t, srv, tt.session, tt.options)
+			require.Equal(t, tt.status, w.Code, w.Body.String())
+			if tt.status != http.StatusCreated {
+				assert.Equal(t, string(ErrCodeInvalidUpload), decodeError(t, w).Code)
+			}
+		})
+	}
+
+	t.Run("update", func(t *testing.T) {
+		for session, status := range map[*http.Cookie]int{alice: http.StatusOK, bob: http.StatusBadRequest} {
+			w := uploadWithOptions(t, srv, session, nil)
+			require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+			var uploaded struct {
+				FileId     string `json:"fileId"`
+				OwnerToken string `json:"ownerToken"`
+			}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&uploaded))
+
+			w = patchFile(t, srv, uploaded.FileId, url.Values{"ownerToken": {uploaded.OwnerToken}, "count": {"50"}})
+			assert.Equal(t, status, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("resumable", func(t *testing.T) {
+		srv.config.ResumableUpload.MaxSize = 10
+		srv.config.ResumableUpload.ChunkSize = 1
+		form := url.Values{"size": {"10"}, "count": {"50"}}
+		for session, status := range map[*http.Cookie]int{alice: http.StatusCreated, bob: http.StatusBadRequest} {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/uploads", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := serveWithSession(srv, req, session)
+			assert.Equal(t, status, w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestLDAPLimitsRevoked(t *testing.T) {
+	srv, _, cleanup := setupLDAPServer(t, false)
+	defer cleanup()
+	srv.config.ResumableUpload.MaxSize = 10
+	srv.config.ResumableUpload.ChunkSize = 1
+	srv.config.ResumableUpload.SessionExpiry = 1
+	session := loginLDAP(t, srv, "alice", "alice-secret")
+
+	form := url.Values{"size": {"1"}, "count": {"50"}}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/uploads", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := serveWithSession(srv, req, session)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var info UploadSessionInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+	require.Equal(t, http.StatusOK, putTestChunk(srv, info.UploadId, 0, []byte("x")).Code)
+
+	// the group membership ended before the upload was finished
+	require.NoError(t, srv.db.Model(&database.User{}).Where("subject = ?", aliceDN).
+		Updates(map[string]interface{}{"max_expiry": 0, "max_count": 0}).Error)
+
+	w = serveWithSession(srv, httptest.NewRequest(http.MethodPost, "/api/v1/uploads/"+info.UploadId, nil), session)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, string(ErrCodeInvalidUpload), decodeError(t, w).Code)
+}
+
+func TestLDAPRequireLogin(t *testing.T) {
+	srv, _, cleanup := setupLDAPServer(t, true)
+	defer cleanup()
+
+	w := uploadWithSession(t, srv, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, string(ErrCodeLoginRequired), decodeError(t, w).Code)
+
+	session := loginLDAP(t, srv, "bob", "bob-secret")
+	w = uploadWithSession(t, srv, session)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+}
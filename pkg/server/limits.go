@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+// sharing limits of anonymous uploads and users without a privileged group
+const (
+	DefaultMaxExpiry = 14 // days
+	DefaultMaxCount  = 15
+)
+
+// Limits bound the sharing options of an uploader's files
+type Limits struct {
+	MaxExpiry uint `json:"maxExpiry"` // days
+	MaxCount  uint `json:"maxCount"`
+}
+
+// userLimits returns the limits of user, which is nil for anonymous uploads
+func userLimits(user *database.User) Limits {
+	limits := Limits{MaxExpiry: DefaultMaxExpiry, MaxCount: DefaultMaxCount}
+	if user == nil {
+		return limits
+	}
+	if user.MaxExpiry > limits.MaxExpiry {
+		limits.MaxExpiry = user.MaxExpiry
+	}
+	if user.MaxCount > limits.MaxCount {
+		limits.MaxCount = user.MaxCount
+	}
+	return limits
+}
+
+// uploaderLimits returns the limits of the user with the given id, 0 for
+// anonymous uploads. Users are read again, their groups may have changed
+// since the upload started.
+func (s *Server) uploaderLimits(c *gin.Context, userId uint) (Limits, bool) {
+	if userId == 0 {
+		return userLimits(nil), true
+	}
+
+	var user database.User
+	if err := s.db.First(&user, userId).Error; err != nil {
+		log.Printf("Failed to fetch user %d: %s\n", userId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "failed to check limits")
+		return Limits{}, false
+	}
+	return userLimits(&user), true
+}
+
+// checkLimits writes an error response with code if the given options, 0 if
+// unset, exceed limits
+func checkLimits(c *gin.Context, limits Limits, expiry, expiryHours, count uint, code ErrorCode) bool {
+	switch {
+	case expiry > limits.MaxExpiry:
+		apiError(c, http.StatusBadRequest, code, fmt.Sprintf("expiry exceeds the limit of %d days", limits.MaxExpiry))
+	case expiryHours > limits.MaxExpiry*24:
+		apiError(c, http.StatusBadRequest, code, fmt.Sprintf("expiry exceeds the limit of %d hours", limits.MaxExpiry*24))
+	case count > limits.MaxCount:
+		apiError(c, http.StatusBadRequest, code, fmt.Sprintf("count exceeds the limit of %d downloads", limits.MaxCount))
+	default:
+		return true
+	}
+	return false
+}
+
+// checkFileLimits writes an error response if the options of a new file
+// exceed the limits of its uploader
+func (s *Server) checkFileLimits(c *gin.Context, f *database.StoredFile) bool {
+	limits, ok := s.uploaderLimits(c, f.UserId)
+	if !ok {
+		return false
+	}
+	return checkLimits(c, limits, f.Expiry, f.ExpiryHours, f.Count, ErrCodeInvalidUpload)
+}
+
+// derefUint returns the value of an optional field, 0 if unset
+func derefUint(v *uint) uint {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lixmal/gdprshare/pkg/config"
+)
+
+// address prefixes kept by the truncate mode
+const (
+	TruncateBitsIPv4 = 24
+	TruncateBitsIPv6 = 48
+)
+
+// pseudonymKey caches the hmac key of the current period
+type pseudonymKey struct {
+	mu     sync.Mutex
+	period int64
+	key    []byte
+}
+
+// pseudonymiseAddr applies the configured pseudonymisation to a client
+// address before it is stored, mailed or audited. The geo mode keeps nothing,
+// the location is looked up before.
+func (s *Server) pseudonymiseAddr(addr string) (string, error) {
+	switch s.config.Pseudonymise.Mode {
+	case config.PseudonymiseTruncate:
+		return truncateAddr(addr), nil
+	case config.PseudonymiseHMAC:
+		key, err := s.currentPseudonymKey(time.Now())
+		if err != nil {
+			return "", err
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(addr))
+		return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+	case config.PseudonymiseGeo:
+		return "", nil
+	default:
+		return addr, nil
+	}
+}
+
+// currentPseudonymKey returns the hmac key of the rotation period t falls in
+func (s *Server) currentPseudonymKey(t time.Time) ([]byte, error) {
+	rotation := time.Duration(s.config.Pseudonymise.Rotation) * time.Hour
+	if rotation <= 0 {
+		rotation = 24 * time.Hour
+	}
+	period := t.Unix() / int64(rotation.Seconds())
+
+	s.pseudonymKey.mu.Lock()
+	defer s.pseudonymKey.mu.Unlock()
+
+	if s.pseudonymKey.key != nil && s.pseudonymKey.period == period {
+		return s.pseudonymKey.key, nil
+	}
+
+	key, err := s.db.PseudonymKey(period)
+	if err != nil {
+		return nil, fmt.Errorf("get pseudonym key: %w", err)
+	}
+	s.pseudonymKey.period, s.pseudonymKey.key = period, key
+
+	return key, nil
+}
+
+// truncateAddr keeps the network part of an address, /24 for IPv4 and /48
+// for IPv6
+func truncateAddr(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(TruncateBitsIPv4, 32)), Mask: net.CIDRMask(TruncateBitsIPv4, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(TruncateBitsIPv6, 128)), Mask: net.CIDRMask(TruncateBitsIPv6, 128)}).String()
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/config"
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+func TestTruncateAddr(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.123":          "192.0.2.0/24",
+		"::ffff:192.0.2.123":   "192.0.2.0/24",
+		"2001:db8:abcd:12::1":  "2001:db8:abcd::/48",
+		"2001:db8:abcd:ffff::": "2001:db8:abcd::/48",
+		"not an address":       "",
+	}
+
+	for addr, expected := range tests {
+		assert.Equal(t, expected, truncateAddr(addr), addr)
+	}
+}
+
+func TestPseudonymiseHMAC(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	srv.config.Pseudonymise.Mode = config.PseudonymiseHMAC
+	srv.config.Pseudonymise.Rotation = 1
+
+	first, err := srv.pseudonymiseAddr("192.0.2.1")
+	require.NoError(t, err)
+	assert.Len(t, first, 32)
+	assert.NotContains(t, first, "192.0.2.1")
+
+	again, err := srv.pseudonymiseAddr("192.0.2.1")
+	require.NoError(t, err)
+	assert.Equal(t, first, again, "same address, same period")
+
+	other, err := srv.pseudonymiseAddr("192.0.2.2")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, other)
+
+	// the next period uses a new key and the past one is gone
+	now := time.Now()
+	current, err := srv.currentPseudonymKey(now)
+	require.NoError(t, err)
+	next, err := srv.currentPseudonymKey(now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.NotEqual(t, current, next)
+
+	var count int
+	require.NoError(t, srv.db.Model(&database.PseudonymKey{}).Count(&count).Error)
+	assert.Equal(t, 1, count)
+}
+
+// TestPseudonymisedClient checks the stored and audited address of a download
+func TestPseudonymisedClient(t *testing.T) {
+	for mode, expected := range map[string]string{
+		config.PseudonymiseNone:     "192.0.2.1",
+		config.PseudonymiseTruncate: "192.0.2.0/24",
+		config.PseudonymiseGeo:      "",
+	} {
+		t.Run(mode, func(t *testing.T) {
+			srv, cleanup := setupTestServer(t)
+			defer cleanup()
+
+			srv.config.SaveClientInfo = true
+			srv.config.Pseudonymise.Mode = mode
+
+			fileId := uploadTestFile(t, srv, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+			req.RemoteAddr = "192.0.2.1:40000"
+			req.Header.Set("User-Agent", "recipient")
+			w := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var dst database.DstClient
+			require.NoError(t, srv.db.First(&dst).Error)
+			assert.Equal(t, expected, dst.Addr)
+
+			var entry database.AuditEntry
+			require.NoError(t, srv.db.Where("event = ?", database.AuditDownload).First(&entry).Error)
+			assert.Empty(t, entry.Addr)
+
+			var client database.AuditClient
+			require.NoError(t, srv.db.Where("audit_entry_id = ?", entry.ID).First(&client).Error)
+			assert.Equal(t, expected, client.Addr)
+		})
+	}
+}
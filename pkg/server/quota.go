@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/storage"
+)
+
+const (
+	// QuotaWindow is the time uploads per day are counted over
+	QuotaWindow = 24 * time.Hour
+
+	mib = 1024 * 1024
+)
+
+// Quota limits what a user or API key stores, zero values are unlimited
+type Quota struct {
+	Bytes         int64 `json:"bytes"`
+	Files         uint  `json:"files"`
+	UploadsPerDay uint  `json:"uploadsPerDay"`
+}
+
+// userQuota returns the quota of logged in users
+func (s *Server) userQuota() Quota {
+	conf := s.config.Quota
+	return Quota{
+		Bytes:         conf.Bytes * mib,
+		Files:         conf.Files,
+		UploadsPerDay: conf.UploadsPerDay,
+	}
+}
+
+// apiKeyQuota returns the quota of key, its own limits replacing the
+// configured ones
+func (s *Server) apiKeyQuota(key *database.APIKey) Quota {
+	quota := s.userQuota()
+	if key.QuotaBytes > 0 {
+		quota.Bytes = key.QuotaBytes * mib
+	}
+	if key.QuotaFiles > 0 {
+		quota.Files = key.QuotaFiles
+	}
+	if key.QuotaUploadsPerDay > 0 {
+		quota.UploadsPerDay = key.QuotaUploadsPerDay
+	}
+	return quota
+}
+
+// checkQuota writes an error response if an upload of size bytes by the
+// given user or API key, 0 for none, would exceed their quota or the space
+// of the server. reserved means an unfinished upload already accounts for
+// the bytes.
+func (s *Server) checkQuota(c *gin.Context, userId, apiKeyId uint, size int64, reserved bool) bool {
+	if !s.checkSpace(c, size, reserved) {
+		return false
+	}
+
+	since := time.Now().Add(-QuotaWindow)
+	if userId != 0 {
+		usage, err := s.db.UserUsage(userId, since)
+		if err != nil {
+			log.Printf("Failed to get usage of user %d: %s\n", userId, err)
+			apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to check quota")
+			return false
+		}
+		if !withinQuota(c, usage, s.userQuota(), size, reserved) {
+			return false
+		}
+	}
+
+	if apiKeyId != 0 {
+		// the key may have been revoked since the upload started
+		var key database.APIKey
+		if err := s.db.Unscoped().First(&key, apiKeyId).Error; err != nil {
+			log.Printf("Failed to fetch API key %d: %s\n", apiKeyId, err)
+			apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to check quota")
+			return false
+		}
+		usage, err := s.db.APIKeyUsage(apiKeyId, since)
+		if err != nil {
+			log.Printf("Failed to get usage of API key %d: %s\n", apiKeyId, err)
+			apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to check quota")
+			return false
+		}
+		if !withinQuota(c, usage, s.apiKeyQuota(&key), size, reserved) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkFileQuota writes an error response if the user has as many files as
+// their quota allows
+func (s *Server) checkFileQuota(c *gin.Context, userId uint) bool {
+	quota := s.userQuota()
+	if quota.Files == 0 {
+		return true
+	}
+
+	usage, err := s.db.UserUsage(userId, time.Now().Add(-QuotaWindow))
+	if err != nil {
+		log.Printf("Failed to get usage of user %d: %s\n", userId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to check quota")
+		return false
+	}
+	if usage.Files >= quota.Files {
+		apiError(c, http.StatusForbidden, ErrCodeQuotaFiles, fmt.Sprintf("quota of %d files reached", quota.Files))
+		return false
+	}
+	return true
+}
+
+func withinQuota(c *gin.Context, usage *database.Usage, quota Quota, size int64, reserved bool) bool {
+	if reserved {
+		size = 0
+	}
+
+	switch {
+	case quota.Files > 0 && usage.Files >= quota.Files:
+		apiError(c, http.StatusForbidden, ErrCodeQuotaFiles, fmt.Sprintf("quota of %d files reached", quota.Files))
+	case quota.Bytes > 0 && usage.Bytes+size > quota.Bytes:
+		apiError(c, http.StatusForbidden, ErrCodeQuotaBytes, fmt.Sprintf("upload exceeds the storage quota of %d MiB", quota.Bytes/mib))
+	case quota.UploadsPerDay > 0 && usage.Uploads >= quota.UploadsPerDay:
+		apiError(c, http.StatusTooManyRequests, ErrCodeQuotaUploads, fmt.Sprintf("quota of %d uploads per day reached", quota.UploadsPerDay))
+	default:
+		return true
+	}
+	return false
+}
+
+// checkSpace writes an error response if an upload of size bytes would
+// exceed the total storage or leave too little free space. It applies to
+// anonymous uploads as well.
+func (s *Server) checkSpace(c *gin.Context, size int64, reserved bool) bool {
+	conf := s.config.Quota
+
+	if conf.TotalBytes > 0 {
+		stored, err := s.db.StoredBytes()
+		if err != nil {
+			log.Printf("Failed to get stored bytes: %s\n", err)
+			apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to check quota")
+			return false
+		}
+		if !reserved {
+			stored += size
+		}
+		if stored > conf.TotalBytes*mib {
+			apiError(c, http.StatusInsufficientStorage, ErrCodeStorageFull, "server storage is full")
+			return false
+		}
+	}
+
+	if fs, ok := s.store.(storage.FreeSpacer); ok && conf.MinFree > 0 {
+		free, err := fs.Free()
+		if err != nil {
+			// uploads still work if the space can't be determined
+			log.Printf("Failed to get free space: %s\n", err)
+			return true
+		}
+		// the blob is written next to the chunks of a resumable upload
+		if free-size < conf.MinFree*mib {
+			apiError(c, http.StatusInsufficientStorage, ErrCodeStorageFull, "server storage is full")
+			return false
+		}
+	}
+
+	return true
+}
+
+// getUsage returns the usage and quota of the logged in user or the API key
+func (s *Server) getUsage(c *gin.Context) {
+	since := time.Now().Add(-QuotaWindow)
+
+	var usage *database.Usage
+	var quota Quota
+	var err error
+	if key := currentAPIKey(c); key != nil {
+		usage, err = s.db.APIKeyUsage(key.ID, since)
+		quota = s.apiKeyQuota(key)
+	} else if user := currentUser(c); user != nil {
+		usage, err = s.db.UserUsage(user.ID, since)
+		quota = s.userQuota()
+	} else {
+		apiError(c, http.StatusUnauthorized, ErrCodeLoginRequired, "usage is only tracked for logged in users and API keys")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get usage: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "failed to get usage")
+		return
+	}
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"usage": usage,
+			"quota": quota,
+		},
+	)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/oidc/oidctest"
+)
+
+func uploadWithKey(t *testing.T, srv *Server, key string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return serveWithSession(srv, withAPIKey(newUploadRequest(t, "payslip.pdf"), key), nil)
+}
+
+func createUploadWithKey(srv *Server, key string, size int) *httptest.ResponseRecorder {
+	form := url.Values{"size": {fmt.Sprint(size)}}
+	req := withAPIKey(httptest.NewRequest(http.MethodPost, "/api/v1/uploads", strings.NewReader(form.Encode())), key)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serveWithSession(srv, req, nil)
+}
+
+func getUsage(t *testing.T, srv *Server, key string) (Quota, database.Usage) {
+	t.Helper()
+
+	w := serveWithSession(srv, withAPIKey(httptest.NewRequest(http.MethodGet, "/api/v1/usage", nil), key), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		Usage database.Usage `json:"usage"`
+		Quota Quota          `json:"quota"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	return resp.Quota, resp.Usage
+}
+
+func TestAPIKeyQuota(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+	srv.config.Quota.UploadsPerDay = 3
+
+	_, key := createTestAPIKey(t, srv, database.APIKey{Scopes: "upload,delete,status", QuotaFiles: 1, QuotaBytes: 2})
+
+	w := uploadWithKey(t, srv, key)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	fileId := decodeUploaded(t, w)
+
+	quota, usage := getUsage(t, srv, key)
+	assert.Equal(t, Quota{Bytes: 2 * mib, Files: 1, UploadsPerDay: 3}, quota)
+	assert.Equal(t, database.Usage{Files: 1, Bytes: int64(len("test content")), Uploads: 1}, usage)
+
+	w = uploadWithKey(t, srv, key)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, string(ErrCodeQuotaFiles), decodeError(t, w).Code)
+
+	// deleted files free their place, but still count as upload
+	w = serveWithSession(srv, withAPIKey(httptest.NewRequest(http.MethodDelete, "/api/v1/files/"+fileId, nil), key), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = uploadWithKey(t, srv, key)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	_, usage = getUsage(t, srv, key)
+	assert.Equal(t, database.Usage{Files: 1, Bytes: int64(len("test content")), Uploads: 2}, usage)
+
+	// anonymous uploads have no quota
+	uploadTestFile(t, srv, nil)
+	uploadTestFile(t, srv, nil)
+}
+
+func TestAPIKeyQuotaResumable(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	k, key := createTestAPIKey(t, srv, database.APIKey{Scopes: "upload,status", QuotaBytes: 2, QuotaUploadsPerDay: 1})
+
+	w := createUploadWithKey(srv, key, 2*mib+1)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, string(ErrCodeQuotaBytes), decodeError(t, w).Code)
+
+	// unfinished uploads reserve their size
+	w = createUploadWithKey(srv, key, mib)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var info UploadSessionInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+	_, usage := getUsage(t, srv, key)
+	assert.Equal(t, int64(mib), usage.Bytes)
+
+	w = createUploadWithKey(srv, key, mib+1)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, string(ErrCodeQuotaBytes), decodeError(t, w).Code)
+
+	// the session's upload counts on finalization, the reservation doesn't
+	// count twice
+	require.Equal(t, http.StatusOK, putTestChunk(srv, info.UploadId, 0, make([]byte, mib)).Code)
+	w = uploadWithKey(t, srv, key)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = serveWithSession(srv, httptest.NewRequest(http.MethodPost, "/api/v1/uploads/"+info.UploadId, nil), nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, string(ErrCodeQuotaUploads), decodeError(t, w).Code)
+
+	require.NoError(t, srv.db.Model(k).Update("quota_uploads_per_day", 2).Error)
+	w = serveWithSession(srv, httptest.NewRequest(http.MethodPost, "/api/v1/uploads/"+info.UploadId, nil), nil)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	_, usage = getUsage(t, srv, key)
+	assert.Equal(t, database.Usage{Files: 2, Bytes: mib + int64(len("test content")), Uploads: 2}, usage)
+}
+
+func TestUserQuota(t *testing.T) {
+	idp := oidctest.New(oidctest.User{Subject: "alice"})
+	defer idp.Close()
+	srv, cleanup := setupAuthServer(t, idp, false)
+	defer cleanup()
+	srv.config.Quota.Files = 1
+
+	w := serveWithSession(srv, httptest.NewRequest(http.MethodGet, "/api/v1/usage", nil), nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, string(ErrCodeLoginRequired), decodeError(t, w).Code)
+
+	session := login(t, srv)
+	require.Equal(t, http.StatusCreated, uploadWithSession(t, srv, session).Code)
+
+	w = uploadWithSession(t, srv, session)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, string(ErrCodeQuotaFiles), decodeError(t, w).Code)
+
+	w = serveWithSession(srv, httptest.NewRequest(http.MethodGet, "/api/v1/usage", nil), session)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Usage database.Usage `json:"usage"`
+		Quota Quota          `json:"quota"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, uint(1), resp.Usage.Files)
+	assert.Equal(t, uint(1), resp.Quota.Files)
+}
+
+// TestRequestQuota verifies files received through a request are checked
+// against the requester's quota
+func TestRequestQuota(t *testing.T) {
+	idp := oidctest.New(oidctest.User{Subject: "alice"})
+	defer idp.Close()
+	srv, cleanup := setupAuthServer(t, idp, false)
+	defer cleanup()
+	srv.config.Quota.Files = 1
+
+	session := login(t, srv)
+	createRequest := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/requests", strings.NewReader("max-files=3"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serveWithSession(srv, req, session)
+	}
+
+	w := createRequest()
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var resp struct {
+		RequestId string `json:"requestId"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+	w = uploadToTestRequest(t, srv, resp.RequestId, []byte("first"), nil)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = uploadToTestRequest(t, srv, resp.RequestId, []byte("second"), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, string(ErrCodeQuotaFiles), decodeError(t, w).Code)
+
+	w = createRequest()
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, string(ErrCodeQuotaFiles), decodeError(t, w).Code)
+}
+
+func TestStorageFull(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	t.Run("total", func(t *testing.T) {
+		srv.config.Quota.TotalBytes = 1
+		defer func() { srv.config.Quota.TotalBytes = 0 }()
+
+		_, key := createTestAPIKey(t, srv, database.APIKey{Scopes: "upload"})
+		require.Equal(t, http.StatusCreated, createUploadWithKey(srv, key, mib-20).Code)
+
+		uploadTestFile(t, srv, nil)
+		for _, w := range []*httptest.ResponseRecorder{
+			createUploadWithKey(srv, key, 100),
+			uploadWithKey(t, srv, key),
+			uploadWithSession(t, srv, nil),
+		} {
+			assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+			assert.Equal(t, string(ErrCodeStorageFull), decodeError(t, w).Code)
+		}
+	})
+
+	t.Run("free space", func(t *testing.T) {
+		srv.config.Quota.MinFree = 1 << 40
+		defer func() { srv.config.Quota.MinFree = 0 }()
+
+		w := uploadWithSession(t, srv, nil)
+		assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+		assert.Equal(t, string(ErrCodeStorageFull), decodeError(t, w).Code)
+
+		requestId, _ := createTestRequest(t, srv, url.Values{})
+		w = uploadToTestRequest(t, srv, requestId, []byte("contract"), nil)
+		assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+	})
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -48,23 +49,39 @@ func (rl *rateLimiter) cleanupVisitors() {
 }
 
 func (rl *rateLimiter) getVisitor(ip string) *rate.Limiter {
+	return rl.getLimiter(ip, rl.rate, rl.burst)
+}
+
+// getLimiter returns the limiter of id, adjusted to limit and burst in case
+// they changed
+func (rl *rateLimiter) getLimiter(id string, limit rate.Limit, burst int) *rate.Limiter {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	v, exists := rl.visitors[ip]
+	v, exists := rl.visitors[id]
 	if !exists {
-		limiter := rate.NewLimiter(rl.rate, rl.burst)
-		rl.visitors[ip] = &visitor{limiter, time.Now()}
+		limiter := rate.NewLimiter(limit, burst)
+		rl.visitors[id] = &visitor{limiter, time.Now()}
 		return limiter
 	}
 
+	if v.limiter.Limit() != limit || v.limiter.Burst() != burst {
+		v.limiter.SetLimit(limit)
+		v.limiter.SetBurst(burst)
+	}
 	v.lastSeen = time.Now()
 	return v.limiter
 }
 
 // RateLimitMiddleware returns a gin middleware that rate limits requests by IP address.
+// Requests with an API key are limited by keyMiddleware instead.
 func (rl *rateLimiter) middleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if currentAPIKey(c) != nil {
+			c.Next()
+			return
+		}
+
 		limiter := rl.getVisitor(c.ClientIP())
 		if !limiter.Allow() {
 			apiErrorAborted(c, http.StatusTooManyRequests, ErrCodeRateLimited, "rate limit exceeded")
@@ -73,3 +90,30 @@ func (rl *rateLimiter) middleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// keyMiddleware rate limits requests with an API key by key, so several
+// senders behind one address don't share a limit. Keys without a limit of
+// their own get the default one, or none if defaults is false.
+func (rl *rateLimiter) keyMiddleware(defaults bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := currentAPIKey(c)
+		if key == nil || key.RateLimit <= 0 && !defaults {
+			c.Next()
+			return
+		}
+
+		limit, burst := rl.rate, rl.burst
+		if key.RateLimit > 0 {
+			limit, burst = rate.Limit(key.RateLimit), key.Burst
+			if burst < 1 {
+				burst = 1
+			}
+		}
+
+		if !rl.getLimiter("key "+strconv.FormatUint(uint64(key.ID), 10), limit, burst).Allow() {
+			apiErrorAborted(c, http.StatusTooManyRequests, ErrCodeRateLimited, "rate limit of API key exceeded")
+			return
+		}
+		c.Next()
+	}
+}
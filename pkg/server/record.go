@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/record"
+)
+
+// getRecord returns the signed transfer record of a file to its owner. It is
+// available after deletion as long as the database row is retained.
+func (s *Server) getRecord(c *gin.Context) {
+	storedFile, ok := s.getOwnedFile(c, true)
+	if !ok {
+		return
+	}
+
+	if s.signingKey == nil {
+		apiError(c, http.StatusServiceUnavailable, ErrCodeRecordUnavailable, "transfer records are not enabled")
+		return
+	}
+
+	signed, err := record.Sign(transferRecord(storedFile, time.Now()), s.signingKey)
+	if err != nil {
+		log.Printf("Failed to sign record of file with id %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRecordUnavailable, "failed to create transfer record")
+		return
+	}
+
+	c.Header("Content-Disposition", attachmentDisposition(fmt.Sprintf("gdprshare-record-%s.json", storedFile.FileId)))
+	c.JSON(http.StatusOK, signed)
+}
+
+// getReceipt renders the transfer record of a file into a PDF receipt for
+// its owner. Unlike the signed record it needs no signing key.
+func (s *Server) getReceipt(c *gin.Context) {
+	storedFile, ok := s.getOwnedFile(c, true)
+	if !ok {
+		return
+	}
+
+	receipt := &bytes.Buffer{}
+	if err := transferRecord(storedFile, time.Now()).WriteReceipt(receipt); err != nil {
+		log.Printf("Failed to render receipt of file with id %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRecordUnavailable, "failed to create transfer receipt")
+		return
+	}
+
+	c.Header("Content-Disposition", attachmentDisposition(fmt.Sprintf("gdprshare-receipt-%s.pdf", storedFile.FileId)))
+	c.Data(http.StatusOK, "application/pdf", receipt.Bytes())
+}
+
+// getOwnedFile loads a file with its clients after checking the owner token,
+// or the API key the file was uploaded with.
+// Deleted files are included if withDeleted is set.
+func (s *Server) getOwnedFile(c *gin.Context, withDeleted bool) (*database.StoredFile, bool) {
+	fileId, err := bindFileID(c)
+	if err != nil {
+		return nil, false
+	}
+
+	var o OwnerToken
+	// files uploaded with an API key can be read with the key alone
+	if err := c.ShouldBind(&o); err != nil && currentAPIKey(c) == nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return nil, false
+	}
+
+	db := s.db.DB
+	if withDeleted {
+		db = db.Unscoped()
+	}
+
+	var storedFile database.StoredFile
+	if err := db.Where(&database.StoredFile{FileId: fileId}).Find(&storedFile).Error; err != nil {
+		log.Printf("Failed to find file with id %s in database: %s\n", fileId, err)
+		apiError(c, http.StatusNotFound, ErrCodeFileNotFound, "file not found")
+		return nil, false
+	}
+
+	if !isOwner(c, &storedFile, o.OwnerToken) {
+		apiError(c, http.StatusUnauthorized, ErrCodeOwnerTokenMismatch, "owner token doesn't match")
+		return nil, false
+	}
+
+	var srcclient database.Client
+	if err := db.Model(&storedFile).Related(&srcclient).Error; err != nil {
+		log.Printf("Failed to access src client of file with id %s: %s\n", fileId, err)
+		apiError(c, http.StatusNotFound, ErrCodeRetrievalFailed, "file retrieval error")
+		return nil, false
+	}
+	storedFile.SrcClient = &srcclient
+
+	var dstclients []*database.DstClient
+	if err := db.Model(&storedFile).Order("created_at").Related(&dstclients).Error; err != nil {
+		log.Printf("Failed to access dst clients of file with id %s: %s\n", fileId, err)
+		apiError(c, http.StatusNotFound, ErrCodeRetrievalFailed, "file retrieval error")
+		return nil, false
+	}
+	storedFile.DstClients = dstclients
+
+	var deniedclients []*database.DeniedClient
+	if err := db.Where("stored_file_id = ?", storedFile.ID).Order("created_at").Find(&deniedclients).Error; err != nil {
+		log.Printf("Failed to access denied clients of file with id %s: %s\n", fileId, err)
+		apiError(c, http.StatusNotFound, ErrCodeRetrievalFailed, "file retrieval error")
+		return nil, false
+	}
+	storedFile.DeniedClients = deniedclients
+
+	return &storedFile, true
+}
+
+func transferRecord(storedFile *database.StoredFile, now time.Time) *record.Record {
+	src := recordClient((*database.Client)(storedFile.SrcClient))
+
+	r := &record.Record{
+		Version:          record.Version,
+		FileId:           storedFile.FileId,
+		CiphertextSHA256: storedFile.Hash,
+		Size:             storedFile.Size,
+		Upload:           src,
+		Transfers:        []record.Transfer{},
+		ExpiresAt:        storedFile.ExpiresAt().UTC(),
+		DeletionMethod:   storedFile.DeletionMethod,
+		IssuedAt:         now.UTC(),
+	}
+
+	for _, dst := range storedFile.DstClients {
+		r.Transfers = append(r.Transfers, record.Transfer{
+			Src: src,
+			Dst: recordClient((*database.Client)(dst)),
+		})
+	}
+
+	for _, denied := range storedFile.DeniedClients {
+		r.Denied = append(r.Denied, record.Denial{
+			Client: recordClient(&denied.Client),
+			Reason: denied.Reason,
+		})
+	}
+
+	if storedFile.ContentDeletedAt != nil {
+		t := storedFile.ContentDeletedAt.UTC()
+		r.ContentDeletedAt = &t
+	}
+	if storedFile.DeletedAt != nil {
+		t := storedFile.DeletedAt.UTC()
+		r.DeletedAt = &t
+	}
+
+	return r
+}
+
+func recordClient(client *database.Client) record.Client {
+	return record.Client{
+		Time:           client.CreatedAt.UTC(),
+		TLSVersion:     client.TLSVersion,
+		TLSCipherSuite: client.TLSCipherSuite,
+		Country:        client.Country,
+		City:           client.City,
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/record"
+)
+
+func getTestRecord(srv *Server, fileId, ownerToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("/api/v1/files/%s/record?ownerToken=%s", fileId, ownerToken),
+		nil,
+	)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestRecordUnavailable(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, nil)
+
+	w := getTestRecord(srv, fileId, ownerToken)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, string(ErrCodeRecordUnavailable), decodeError(t, w).Code)
+}
+
+// TestRecord downloads and deletes a file and checks the signed record covers
+// the whole lifecycle
+func TestRecord(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	srv.signingKey = priv
+
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, map[string]string{"count": "2"})
+
+	w := getTestRecord(srv, fileId, "wrongtoken")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	content, err := io.ReadAll(w.Body)
+	require.NoError(t, err)
+
+	req = httptest.NewRequest(
+		http.MethodDelete,
+		fmt.Sprintf("/api/v1/files/%s?ownerToken=%s", fileId, ownerToken),
+		nil,
+	)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = getTestRecord(srv, fileId, ownerToken)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "gdprshare-record-"+fileId+".json")
+
+	r, err := record.Verify(w.Body.Bytes(), pub)
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(content)
+	assert.Equal(t, fileId, r.FileId)
+	assert.Equal(t, hex.EncodeToString(sum[:]), r.CiphertextSHA256)
+	assert.Equal(t, int64(len(content)), r.Size)
+	assert.Len(t, r.Transfers, 1)
+	assert.Equal(t, "delete", r.DeletionMethod)
+	assert.NotNil(t, r.ContentDeletedAt)
+	assert.NotNil(t, r.DeletedAt)
+}
+
+// TestReceipt checks denied attempts are kept and the receipt is still
+// available after deletion
+func TestReceipt(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	// without geoip the location is unknown and the download denied
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, map[string]string{"allowed-countries": "DE"})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	req = httptest.NewRequest(
+		http.MethodDelete,
+		fmt.Sprintf("/api/v1/files/%s?ownerToken=%s", fileId, ownerToken),
+		nil,
+	)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/files/%s/receipt?ownerToken=wrongtoken", fileId), nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/files/%s/receipt?ownerToken=%s", fileId, ownerToken), nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "gdprshare-receipt-"+fileId+".pdf")
+	assert.True(t, bytes.HasPrefix(w.Body.Bytes(), []byte("%PDF-")))
+
+	storedFile, ok := func() (*database.StoredFile, bool) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/?ownerToken="+ownerToken, nil)
+		c.Params = gin.Params{{Key: "fileId", Value: fileId}}
+		return srv.getOwnedFile(c, true)
+	}()
+	require.True(t, ok)
+
+	r := transferRecord(storedFile, time.Now())
+	assert.Empty(t, r.Transfers)
+	require.Len(t, r.Denied, 1)
+	assert.Equal(t, database.DenialLocation, r.Denied[0].Reason)
+	assert.NotNil(t, r.DeletedAt)
+}
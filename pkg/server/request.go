@@ -0,0 +1,419 @@
+package server
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+)
+
+const (
+	FileRequestIdLen = 20
+	// MinPublicKeyBits is the smallest RSA key files are wrapped for
+	MinPublicKeyBits = 2048
+)
+
+type FileRequestId struct {
+	RequestId string `uri:"requestId" binding:"required,printascii,min=3,max=64"`
+}
+
+// RequestUpload is an upload into a file request. The sharing settings are
+// the requester's, so only the file itself is taken.
+type RequestUpload struct {
+	File       *multipart.FileHeader `form:"file"        binding:"required"`
+	Filename   string                `form:"filename"    binding:"omitempty,max=1024"`
+	Type       string                `form:"type"        binding:"omitempty,printascii,min=1,max=255"`
+	WrappedKey string                `form:"wrapped-key" binding:"omitempty,max=1024"`
+}
+
+// FileRequestInfo describes a file request. The uploader sees what is needed
+// to upload, the requester additionally the address and received files.
+type FileRequestInfo struct {
+	RequestId  string        `json:"requestId"`
+	Message    string        `json:"message,omitempty"`
+	ExpiryDate time.Time     `json:"expiryDate"`
+	MaxFiles   uint          `json:"maxFiles"`
+	Remaining  uint          `json:"remaining"`
+	MaxSize    int64         `json:"maxSize"` // bytes per file
+	PublicKey  string        `json:"publicKey,omitempty"`
+	Closed     bool          `json:"closed,omitempty"`
+	Email      string        `json:"email,omitempty"`
+	Files      []RequestFile `json:"files,omitempty"`
+}
+
+// RequestFile is a file received through a file request
+type RequestFile struct {
+	FileId     string    `json:"fileId"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploadedAt"`
+	ExpiryDate time.Time `json:"expiryDate"`
+	Count      uint      `json:"count"`
+	Downloads  uint      `json:"downloads"`
+	WrappedKey string    `json:"wrappedKey,omitempty"`
+}
+
+// createRequest creates a file request. The requester keeps the returned owner
+// token, the uploader gets the request id.
+func (s *Server) createRequest(c *gin.Context) {
+	var fileRequest database.FileRequest
+	if err := c.ShouldBind(&fileRequest); err != nil {
+		// TODO: get FieldError and return relevant part only
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if fileRequest.MaxSize == 0 {
+		fileRequest.MaxSize = s.config.MaxUploadSize
+	}
+	if fileRequest.MaxSize > s.config.MaxUploadSize {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("max-size exceeds the max upload size of %d MiB", s.config.MaxUploadSize))
+		return
+	}
+	if fileRequest.PublicKey != "" {
+		if _, err := parsePublicKey(fileRequest.PublicKey); err != nil {
+			apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	// received files count towards the requester's quota
+	if userId := currentUserId(c); userId != 0 && !s.checkFileQuota(c, userId) {
+		return
+	}
+
+	requestId, err := misc.GenToken(FileRequestIdLen)
+	if err != nil {
+		log.Printf("Failed to generate request ID: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeFileIDFailed, "failed to generate request ID")
+		return
+	}
+	ownerToken, err := misc.GenToken(OwnerTokenLen)
+	if err != nil {
+		log.Printf("Failed to generate owner token: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeOwnerTokenFailed, "failed to generate owner token")
+		return
+	}
+	fileRequest.RequestId = requestId
+	fileRequest.OwnerToken = ownerToken
+	fileRequest.UserId = currentUserId(c)
+
+	if err := s.db.Create(&fileRequest).Error; err != nil {
+		log.Printf("Failed to create file request in database: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to store request in database")
+		return
+	}
+	s.audit(database.AuditRequest, "", s.clientInfo(c), "created "+requestId)
+
+	c.Header("Location", "/r/"+requestId)
+	c.JSON(
+		http.StatusCreated,
+		gin.H{
+			"message":    "request created successfully",
+			"requestId":  requestId,
+			"ownerToken": ownerToken,
+		},
+	)
+}
+
+// getRequest describes a request to the uploader. With the owner token it
+// also lists the received files, after the request closed as well.
+func (s *Server) getRequest(c *gin.Context) {
+	ownerToken := c.Query("ownerToken")
+
+	fileRequest, ok := s.bindFileRequest(c, ownerToken != "")
+	if !ok {
+		return
+	}
+
+	if ownerToken == "" {
+		if requestClosed(fileRequest) {
+			apiError(c, http.StatusGone, ErrCodeRequestExpired, "request expired or closed")
+			return
+		}
+		c.JSON(http.StatusOK, requestInfo(fileRequest))
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(ownerToken), []byte(fileRequest.OwnerToken)) != 1 {
+		apiError(c, http.StatusUnauthorized, ErrCodeOwnerTokenMismatch, "owner token doesn't match")
+		return
+	}
+
+	var files []*database.StoredFile
+	if err := s.db.Where("file_request_id = ?", fileRequest.ID).Order("created_at").Find(&files).Error; err != nil {
+		log.Printf("Failed to find files of request %s: %s\n", fileRequest.RequestId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return
+	}
+
+	info := requestInfo(fileRequest)
+	info.Email = fileRequest.Email
+	info.Files = []RequestFile{}
+	for _, f := range files {
+		info.Files = append(info.Files, RequestFile{
+			FileId:     f.FileId,
+			Type:       f.Type,
+			Size:       f.Size,
+			UploadedAt: f.CreatedAt,
+			ExpiryDate: f.ExpiresAt(),
+			Count:      f.Count,
+			Downloads:  f.Downloads,
+			WrappedKey: f.WrappedKey,
+		})
+	}
+
+	c.JSON(http.StatusOK, info)
+}
+
+// uploadToRequest stores a file uploaded into a request and notifies the
+// requester. The file belongs to the requester: it has the request's owner
+// token and address.
+func (s *Server) uploadToRequest(c *gin.Context) {
+	fileRequest, ok := s.bindFileRequest(c, false)
+	if !ok {
+		return
+	}
+
+	var upload RequestUpload
+	if err := c.ShouldBind(&upload); err != nil {
+		// file too large: middleware has already written to response body
+		if c.Writer.Status() == http.StatusRequestEntityTooLarge {
+			return
+		}
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidUpload, err.Error())
+		return
+	}
+
+	if requestClosed(fileRequest) {
+		apiError(c, http.StatusGone, ErrCodeRequestExpired, "request expired or closed")
+		return
+	}
+	if upload.File.Size > fileRequest.MaxSize*1024*1024 {
+		apiError(c, http.StatusRequestEntityTooLarge, ErrCodeUploadTooLarge, "upload exceeds maximum size of the request")
+		return
+	}
+	if err := checkWrappedKey(fileRequest, upload.WrappedKey); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidUpload, err.Error())
+		return
+	}
+	// received files count towards the requester's quota
+	if !s.checkQuota(c, fileRequest.UserId, 0, upload.File.Size, false) {
+		return
+	}
+
+	// reserve one of the uploads, concurrent uploads can't exceed the limit
+	res := s.db.Model(&database.FileRequest{}).
+		Where("id = ? AND uploads < max_files", fileRequest.ID).
+		Update("uploads", gorm.Expr("uploads + 1"))
+	if res.Error != nil {
+		log.Printf("Failed to reserve upload of request %s: %s\n", fileRequest.RequestId, res.Error)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to store file in database")
+		return
+	}
+	if res.RowsAffected == 0 {
+		apiError(c, http.StatusConflict, ErrCodeRequestFull, "request takes no more files")
+		return
+	}
+
+	src, err := upload.File.Open()
+	if err != nil {
+		log.Printf("Failed to open uploaded file: %s\n", err)
+		s.releaseRequestUpload(fileRequest)
+		apiError(c, http.StatusInternalServerError, ErrCodeSaveFailed, "failed to save file")
+		return
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			log.Printf("Failed to close uploaded file: %s\n", err)
+		}
+	}()
+
+	storedFile := &database.StoredFile{
+		Type:          upload.Type,
+		Filename:      upload.Filename,
+		File:          upload.File,
+		OwnerToken:    fileRequest.OwnerToken,
+		Email:         fileRequest.Email,
+		FileRequestId: fileRequest.ID,
+		WrappedKey:    upload.WrappedKey,
+		UserId:        fileRequest.UserId,
+	}
+	sanitizeStoredFile(storedFile)
+
+	if !s.createStoredFile(c, storedFile, src, upload.File.Size) {
+		s.releaseRequestUpload(fileRequest)
+		return
+	}
+
+	if storedFile.Email != "" {
+		fields := newMailFields(storedFile, (*database.DstClient)(storedFile.SrcClient))
+		fields.RequestID = fileRequest.RequestId
+		if err := s.sendTemplateMail(s.config.Mail.SubjectRequest, s.config.Mail.RequestBody, storedFile, fields); err != nil {
+			log.Printf("Failed to send request mail for ID %s: %s\n", storedFile.FileId, err)
+		}
+	}
+
+	c.JSON(
+		http.StatusCreated,
+		gin.H{
+			"message": "file uploaded successfully",
+			"fileId":  storedFile.FileId,
+		},
+	)
+}
+
+// closeRequest stops a request from taking more uploads. Received files stay
+// available.
+func (s *Server) closeRequest(c *gin.Context) {
+	fileRequest, ok := s.bindFileRequest(c, false)
+	if !ok {
+		return
+	}
+
+	var o OwnerToken
+	if err := c.ShouldBind(&o); err != nil {
+		// TODO: get FieldError and return relevant part only
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(o.OwnerToken), []byte(fileRequest.OwnerToken)) != 1 {
+		apiError(c, http.StatusUnauthorized, ErrCodeOwnerTokenMismatch, "owner token doesn't match")
+		return
+	}
+
+	if fileRequest.ClosedAt == nil {
+		if err := s.db.Model(fileRequest).Update("closed_at", time.Now()).Error; err != nil {
+			log.Printf("Failed to close request %s: %s\n", fileRequest.RequestId, err)
+			apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to close request")
+			return
+		}
+		s.audit(database.AuditRequest, "", s.clientInfo(c), "closed "+fileRequest.RequestId)
+	}
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"message": "request closed",
+		},
+	)
+}
+
+// releaseRequestUpload gives back an upload reserved for a file that couldn't
+// be stored
+func (s *Server) releaseRequestUpload(fileRequest *database.FileRequest) {
+	err := s.db.Model(&database.FileRequest{}).
+		Where("id = ? AND uploads > 0", fileRequest.ID).
+		Update("uploads", gorm.Expr("uploads - 1")).Error
+	if err != nil {
+		log.Printf("Failed to release upload of request %s: %s\n", fileRequest.RequestId, err)
+	}
+}
+
+// bindFileRequest looks up the request of the uri, writing an error response
+// on failure. Requests removed after they expired are only found withDeleted.
+func (s *Server) bindFileRequest(c *gin.Context, withDeleted bool) (*database.FileRequest, bool) {
+	var r FileRequestId
+	if err := c.ShouldBindUri(&r); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeRequestNotFound, err.Error())
+		return nil, false
+	}
+
+	db := s.db.DB
+	if withDeleted {
+		db = db.Unscoped()
+	}
+
+	var fileRequest database.FileRequest
+	if err := db.Where("request_id = ?", r.RequestId).First(&fileRequest).Error; err != nil {
+		if !s.db.IsRecordNotFoundError(err) {
+			log.Printf("Failed to find request %s in database: %s\n", r.RequestId, err)
+		}
+		apiError(c, http.StatusNotFound, ErrCodeRequestNotFound, "request not found")
+		return nil, false
+	}
+
+	return &fileRequest, true
+}
+
+func requestClosed(fileRequest *database.FileRequest) bool {
+	return fileRequest.ClosedAt != nil || fileRequest.DeletedAt != nil || time.Now().After(fileRequest.ExpiresAt())
+}
+
+func requestInfo(fileRequest *database.FileRequest) FileRequestInfo {
+	var remaining uint
+	if fileRequest.Uploads < fileRequest.MaxFiles {
+		remaining = fileRequest.MaxFiles - fileRequest.Uploads
+	}
+
+	return FileRequestInfo{
+		RequestId:  fileRequest.RequestId,
+		Message:    fileRequest.Message,
+		ExpiryDate: fileRequest.ExpiresAt(),
+		MaxFiles:   fileRequest.MaxFiles,
+		Remaining:  remaining,
+		MaxSize:    fileRequest.MaxSize * 1024 * 1024,
+		PublicKey:  fileRequest.PublicKey,
+		Closed:     requestClosed(fileRequest),
+	}
+}
+
+// parsePublicKey decodes the base64 DER public key of a request, files are
+// wrapped for it with RSA-OAEP and SHA-256
+func parsePublicKey(b64 string) (*rsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("public-key is not base64: %w", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("public-key is not a DER encoded public key: %w", err)
+	}
+
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public-key is not an RSA key")
+	}
+	if rsaPub.N.BitLen() < MinPublicKeyBits {
+		return nil, fmt.Errorf("public-key has less than %d bits", MinPublicKeyBits)
+	}
+
+	return rsaPub, nil
+}
+
+// checkWrappedKey requires a key wrapped for the public key of the request, if
+// it has one. The server can't tell if it was wrapped correctly, only its size.
+func checkWrappedKey(fileRequest *database.FileRequest, wrappedKey string) error {
+	if fileRequest.PublicKey == "" {
+		if wrappedKey != "" {
+			return errors.New("wrapped-key given for a request without public key")
+		}
+		return nil
+	}
+
+	pub, err := parsePublicKey(fileRequest.PublicKey)
+	if err != nil {
+		return err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return fmt.Errorf("wrapped-key is not base64: %w", err)
+	}
+	if len(wrapped) != pub.Size() {
+		return errors.New("wrapped-key missing or not wrapped for the public key of the request")
+	}
+
+	return nil
+}
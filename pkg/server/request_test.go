@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+)
+
+func createTestRequest(t *testing.T, srv *Server, form url.Values) (string, string) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/requests", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var resp struct {
+		RequestId  string `json:"requestId"`
+		OwnerToken string `json:"ownerToken"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.NotEmpty(t, resp.RequestId)
+	require.NotEmpty(t, resp.OwnerToken)
+	assert.Equal(t, "/r/"+resp.RequestId, w.Header().Get("Location"))
+
+	return resp.RequestId, resp.OwnerToken
+}
+
+func uploadToTestRequest(t *testing.T, srv *Server, requestId string, content []byte, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", "requested.txt")
+	require.NoError(t, err)
+	_, err = part.Write(content)
+	require.NoError(t, err)
+	for name, value := range fields {
+		require.NoError(t, writer.WriteField(name, value))
+	}
+	require.NoError(t, writer.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/requests/"+requestId+"/files", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func getTestRequest(t *testing.T, srv *Server, requestId, query string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/requests/"+requestId+"?"+query, nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestFileRequest(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+	srv.config.Mail.SubjectRequest = "File received: %s"
+	srv.config.Mail.RequestBody = "File {{.FileID}} was uploaded to your file request {{.RequestID}}.\n"
+	mails := captureMails(t)
+
+	requestId, ownerToken := createTestRequest(t, srv, url.Values{
+		"email":     {"requester@example.com"},
+		"message":   {"Please send your signed contract"},
+		"max-files": {"2"},
+		"max-size":  {"1"},
+	})
+
+	// the uploader learns the limits, not the requester's address
+	w := getTestRequest(t, srv, requestId, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var info FileRequestInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+	assert.Equal(t, "Please send your signed contract", info.Message)
+	assert.Equal(t, uint(2), info.Remaining)
+	assert.Equal(t, int64(1024*1024), info.MaxSize)
+	assert.Empty(t, info.Email)
+	assert.Empty(t, info.Files)
+
+	w = uploadToTestRequest(t, srv, requestId, make([]byte, 2*1024*1024), nil)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+	assert.Equal(t, string(ErrCodeUploadTooLarge), decodeError(t, w).Code)
+
+	// sharing settings are the requester's
+	w = uploadToTestRequest(t, srv, requestId, []byte("contract"), map[string]string{"count": "15", "email": "uploader@example.com"})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var uploaded struct {
+		FileId string `json:"fileId"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&uploaded))
+
+	require.Len(t, mails(), 1)
+	assert.Equal(t, "requester@example.com", mails()[0].To)
+	assert.Contains(t, mails()[0].Body, requestId)
+
+	w = uploadToTestRequest(t, srv, requestId, []byte("appendix"), nil)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = uploadToTestRequest(t, srv, requestId, []byte("one too many"), nil)
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	assert.Equal(t, string(ErrCodeRequestFull), decodeError(t, w).Code)
+
+	w = getTestRequest(t, srv, requestId, "ownerToken=wrongtoken")
+	require.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+
+	w = getTestRequest(t, srv, requestId, "ownerToken="+ownerToken)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	info = FileRequestInfo{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+	assert.Equal(t, "requester@example.com", info.Email)
+	assert.Zero(t, info.Remaining)
+	require.Len(t, info.Files, 2)
+	assert.Equal(t, uploaded.FileId, info.Files[0].FileId)
+	assert.Equal(t, uint(1), info.Files[0].Count)
+
+	// received files are owned by the requester
+	var storedFile database.StoredFile
+	require.NoError(t, srv.db.Where("file_id = ?", uploaded.FileId).First(&storedFile).Error)
+	assert.Equal(t, ownerToken, storedFile.OwnerToken)
+	assert.Equal(t, "requester@example.com", storedFile.Email)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+uploaded.FileId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "contract", w.Body.String())
+	assert.Empty(t, w.Header().Get("X-Wrapped-Key"))
+
+	t.Run("public key", func(t *testing.T) {
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+		require.NoError(t, err)
+		publicKey := base64.StdEncoding.EncodeToString(der)
+
+		small, err := rsa.GenerateKey(rand.Reader, 1024)
+		require.NoError(t, err)
+		smallDer, err := x509.MarshalPKIXPublicKey(&small.PublicKey)
+		require.NoError(t, err)
+
+		for _, invalid := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("garbage")), base64.StdEncoding.EncodeToString(smallDer)} {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/requests", strings.NewReader(url.Values{"public-key": {invalid}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(w, req)
+			require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		}
+
+		keyRequestId, _ := createTestRequest(t, srv, url.Values{"public-key": {publicKey}})
+
+		w := getTestRequest(t, srv, keyRequestId, "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var info FileRequestInfo
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+		assert.Equal(t, publicKey, info.PublicKey)
+
+		w = uploadToTestRequest(t, srv, keyRequestId, []byte("secret"), nil)
+		require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+		key := make([]byte, 32)
+		_, err = rand.Read(key)
+		require.NoError(t, err)
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &priv.PublicKey, key, nil)
+		require.NoError(t, err)
+		wrappedKey := base64.StdEncoding.EncodeToString(wrapped)
+
+		w = uploadToTestRequest(t, srv, keyRequestId, []byte("secret"), map[string]string{"wrapped-key": wrappedKey})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var uploaded struct {
+			FileId string `json:"fileId"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&uploaded))
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+uploaded.FileId, nil)
+		w = httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, wrappedKey, w.Header().Get("X-Wrapped-Key"))
+
+		// the rejected upload didn't take a slot
+		var fileRequest database.FileRequest
+		require.NoError(t, srv.db.Where("request_id = ?", keyRequestId).First(&fileRequest).Error)
+		assert.Equal(t, uint(1), fileRequest.Uploads)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		closedId, closedToken := createTestRequest(t, srv, url.Values{"email": {"requester@example.com"}})
+
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/requests/"+closedId+"?ownerToken=wrongtoken", nil)
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+
+		req = httptest.NewRequest(http.MethodDelete, "/api/v1/requests/"+closedId+"?ownerToken="+closedToken, nil)
+		w = httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = getTestRequest(t, srv, closedId, "")
+		require.Equal(t, http.StatusGone, w.Code, w.Body.String())
+		assert.Equal(t, string(ErrCodeRequestExpired), decodeError(t, w).Code)
+
+		w = uploadToTestRequest(t, srv, closedId, []byte("late"), nil)
+		require.Equal(t, http.StatusGone, w.Code, w.Body.String())
+
+		// the cleanup removes the address, the requester still sees the files
+		require.Empty(t, misc.Cleanup(srv.db, srv.store, srv.config))
+		w = getTestRequest(t, srv, closedId, "ownerToken="+closedToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var info FileRequestInfo
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+		assert.True(t, info.Closed)
+		assert.Empty(t, info.Email)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		expiredId, _ := createTestRequest(t, srv, url.Values{"expiry-hours": {"1"}})
+		require.NoError(t, srv.db.Model(&database.FileRequest{}).Where("request_id = ?", expiredId).
+			Update("created_at", time.Now().Add(-2*time.Hour)).Error)
+
+		w := uploadToTestRequest(t, srv, expiredId, []byte("late"), nil)
+		require.Equal(t, http.StatusGone, w.Code, w.Body.String())
+		assert.Equal(t, string(ErrCodeRequestExpired), decodeError(t, w).Code)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		w := getTestRequest(t, srv, "doesnotexist", "")
+		require.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+		assert.Equal(t, string(ErrCodeRequestNotFound), decodeError(t, w).Code)
+	})
+}
@@ -1,24 +1,28 @@
 package server
 
 import (
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 	uuid "github.com/nu7hatch/gouuid"
 	"gopkg.in/gomail.v2"
 
 	"github.com/lixmal/gdprshare/pkg/database"
 	"github.com/lixmal/gdprshare/pkg/geoip"
 	"github.com/lixmal/gdprshare/pkg/misc"
+	"github.com/lixmal/gdprshare/pkg/storage"
 )
 
 func (s *Server) index(c *gin.Context) {
@@ -26,11 +30,18 @@ func (s *Server) index(c *gin.Context) {
 }
 
 func (s *Server) getConfig(c *gin.Context) {
+	limits := userLimits(currentUser(c))
 	c.JSON(
 		http.StatusOK,
 		gin.H{
 			"maxFileSize":   s.config.MaxUploadSize,
 			"showCountdown": s.config.ShowCountdown,
+			"login":         s.oidc != nil || s.ldap != nil,
+			"oidcLogin":     s.oidc != nil,
+			"ldapLogin":     s.ldap != nil,
+			"loginRequired": s.config.Auth.RequireLogin,
+			"maxExpiry":     limits.MaxExpiry,
+			"maxCount":      limits.MaxCount,
 		},
 	)
 }
@@ -46,22 +57,44 @@ func (s *Server) uploadFile(c *gin.Context) {
 		return
 	}
 
-	storedFile.Filename = sanitizeFilename(storedFile.Filename)
-	storedFile.Type = sanitizeType(storedFile.Type)
-	storedFile.AllowedCountries = sanitizeCountries(storedFile.AllowedCountries)
-	if storedFile.AllowedCountries != "" {
-		storedFile.OnlyEEA = false
-		storedFile.IncludeOther = false
+	sanitizeStoredFile(&storedFile)
+	storedFile.UserId = currentUserId(c)
+	storedFile.APIKeyId = currentAPIKeyId(c)
+
+	if !s.checkFileLimits(c, &storedFile) {
+		return
+	}
+	if !s.checkQuota(c, storedFile.UserId, storedFile.APIKeyId, storedFile.File.Size, false) {
+		return
+	}
+
+	src, err := storedFile.File.Open()
+	if err != nil {
+		log.Printf("Failed to open uploaded file: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeSaveFailed, "failed to save file")
+		return
 	}
-	if storedFile.Type != "image" {
-		storedFile.Ephemeral = 0
+	defer func() {
+		if err := src.Close(); err != nil {
+			log.Printf("Failed to close uploaded file: %s\n", err)
+		}
+	}()
+
+	if s.createStoredFile(c, &storedFile, src, storedFile.File.Size) {
+		respondUploaded(c, &storedFile)
 	}
+}
 
+// createStoredFile assigns id, owner token and blob name to a bound and
+// sanitized file, keeping an owner token already set, then stores size bytes
+// of contents read from src and its record in the database. It reports
+// whether the file was created, having written an error response if not.
+func (s *Server) createStoredFile(c *gin.Context, storedFile *database.StoredFile, src io.Reader, size int64) bool {
 	name, err := uuid.NewV4()
 	if err != nil {
 		log.Printf("Failed to create uuid: %s\n", err)
 		apiError(c, http.StatusInternalServerError, ErrCodeTempFilename, "failed to generate temp filename")
-		return
+		return false
 	}
 	namestr := name.String()
 
@@ -69,21 +102,23 @@ func (s *Server) uploadFile(c *gin.Context) {
 	if err != nil {
 		log.Printf("Failed to generate file ID: %s\n", err)
 		apiError(c, http.StatusInternalServerError, ErrCodeFileIDFailed, "failed to generate file ID")
-		return
+		return false
 	}
 
-	ownerToken, err := misc.GenToken(OwnerTokenLen)
-	if err != nil {
-		log.Printf("Failed to generate file ID: %s\n", err)
-		apiError(c, http.StatusInternalServerError, ErrCodeOwnerTokenFailed, "failed to generate owner token")
-		return
+	ownerToken := storedFile.OwnerToken
+	if ownerToken == "" {
+		if ownerToken, err = misc.GenToken(OwnerTokenLen); err != nil {
+			log.Printf("Failed to generate file ID: %s\n", err)
+			apiError(c, http.StatusInternalServerError, ErrCodeOwnerTokenFailed, "failed to generate owner token")
+			return false
+		}
 	}
 
 	tx := s.db.Begin()
 	if err = tx.Error; err != nil {
 		log.Printf("Failed to begin transaction: %s\n", err)
 		apiError(c, http.StatusInternalServerError, ErrCodeTransactionStart, "failed to start transaction")
-		return
+		return false
 	}
 
 	storedFile.FileId = fileId
@@ -98,45 +133,55 @@ func (s *Server) uploadFile(c *gin.Context) {
 		if !c.IsAborted() {
 			apiError(c, http.StatusForbidden, ErrCodeTLSRequirements, "TLS requirements not met")
 		}
-		return
+		return false
 	}
 
-	if err = tx.Create(&storedFile).Error; err != nil {
+	if err = tx.Create(storedFile).Error; err != nil {
 		log.Printf("Failed to create file in database: %s\n", err)
 		if err = tx.Rollback().Error; err != nil {
 			log.Printf("Failed to rollback: %s\n", err)
 		}
 		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to store file in database")
-		return
+		return false
 	}
 
-	path := filepath.Join(s.config.StorePath, namestr)
-	if err := c.SaveUploadedFile(storedFile.File, path); err != nil {
+	if err := s.saveStoredFile(tx, storedFile, src, size); err != nil {
 		log.Printf("Failed to save file: %s\n", err)
 		if err = tx.Rollback().Error; err != nil {
 			log.Printf("Failed to rollback: %s\n", err)
 		}
 		apiError(c, http.StatusInternalServerError, ErrCodeSaveFailed, "failed to save file")
-		return
+		return false
 	}
 
 	if err = tx.Commit().Error; err != nil {
 		log.Printf("Failed to commit: %s\n", err)
 
-		if err = os.Remove(path); err != nil {
-			log.Printf("Failed to remove file %s: %s\n", path, err)
-		}
+		s.removeBlob(namestr)
 		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to store file in database")
-		return
+		return false
+	}
+
+	var sender []string
+	if storedFile.UserId != 0 {
+		sender = append(sender, fmt.Sprintf("user %d", storedFile.UserId))
 	}
+	if storedFile.APIKeyId != 0 {
+		sender = append(sender, fmt.Sprintf("api key %d", storedFile.APIKeyId))
+	}
+	s.audit(database.AuditUpload, fileId, storedFile.SrcClient, strings.Join(sender, ", "))
+
+	return true
+}
 
-	c.Header("Location", "/d/"+fileId)
+func respondUploaded(c *gin.Context, storedFile *database.StoredFile) {
+	c.Header("Location", "/d/"+storedFile.FileId)
 	c.JSON(
 		http.StatusCreated,
 		gin.H{
 			"message":    "file uploaded successfully",
-			"fileId":     fileId,
-			"ownerToken": ownerToken,
+			"fileId":     storedFile.FileId,
+			"ownerToken": storedFile.OwnerToken,
 		},
 	)
 }
@@ -162,9 +207,14 @@ func (s *Server) validateFiles(c *gin.Context) {
 			fileInfo[fileId] = StoredFileInfo{
 				Error: "Owner token mismatch",
 			}
+		} else if time.Now().After(storedFile.ExpiresAt()) {
+			// gone like a deleted file, the code tells why
+			fileInfo[fileId] = StoredFileInfo{
+				Code: ErrCodeFileExpired,
+			}
 		} else {
 			fileInfo[fileId] = StoredFileInfo{
-				ExpiryDate: storedFile.CreatedAt.AddDate(0, 0, int(storedFile.Expiry)),
+				ExpiryDate: storedFile.ExpiresAt(),
 				Count:      storedFile.Count,
 			}
 		}
@@ -190,20 +240,14 @@ func (s *Server) downloadFile(c *gin.Context) {
 		return
 	}
 
-	path := filepath.Join(s.config.StorePath, storedFile.Name)
-
 	if storedFile.Count < 1 {
 		apiError(c, http.StatusNotFound, ErrCodeCountExpired, "download count expired")
 		return
 	}
 
-	if info, err := os.Stat(path); err != nil || info.IsDir() {
-		if err != nil {
-			log.Printf("Failed to access file with id %s: %s\n", fileId, err)
-		} else {
-			log.Printf("File with id %s is a directory\n", fileId)
-		}
-
+	info, err := s.store.Stat(storedFile.Name)
+	if err != nil {
+		log.Printf("Failed to access file with id %s: %s\n", fileId, err)
 		apiError(c, http.StatusNotFound, ErrCodeFileNotFound, "file not found")
 		return
 	}
@@ -213,22 +257,68 @@ func (s *Server) downloadFile(c *gin.Context) {
 		return
 	}
 
-	allowed := s.isDownloadAllowed(storedFile, client) && !s.isUserAgentDisallowed(client.UserAgent)
+	// a download token resumes an earlier, interrupted download
+	var token *database.DownloadToken
+	if t := downloadTokenParam(c); t != "" {
+		if token, err = s.getDownloadToken(storedFile, t); err != nil {
+			log.Printf("Failed to resume download of file with id %s: %s\n", fileId, err)
+			apiError(c, http.StatusGone, ErrCodeDownloadToken, "download token invalid or expired")
+			return
+		}
+	}
+	resumed := token != nil
+
+	locationAllowed := s.isDownloadAllowed(storedFile, client)
+	userAgentAllowed := !s.isUserAgentDisallowed(client.UserAgent)
+	allowed := locationAllowed && userAgentAllowed
 
 	if time.Now().Before(storedFile.CreatedAt.Add(time.Duration(storedFile.Delay) * time.Minute)) {
+		s.saveDeniedClient(storedFile, client, database.DenialDelay)
 		apiError(c, http.StatusForbidden, ErrCodeNotYetDownloadble, "file not yet downloadable")
 	} else if !allowed {
 		log.Printf("Download from %s forbidden, user agent: %s\n", client.Addr, client.UserAgent)
+		if !userAgentAllowed {
+			s.saveDeniedClient(storedFile, client, database.DenialUserAgent)
+		} else {
+			s.saveDeniedClient(storedFile, client, database.DenialLocation)
+		}
 		apiError(c, http.StatusForbidden, ErrCodeLocationForbidden, "download from this location forbidden")
 	} else {
-		storedFile.DstClients = append(
-			storedFile.DstClients,
-			client,
-		)
-
-		storedFile.Count--
-		if err := s.db.Save(&storedFile).Error; err != nil {
-			log.Printf("Failed to save decreased count on file with id %s: %s\n", fileId, err)
+		if !resumed {
+			var approval *database.ApprovalRequest
+			var code *database.VerificationCode
+			var ok bool
+			if storedFile.Approval {
+				if approval, ok = s.useApproval(c, storedFile, client); !ok {
+					return
+				}
+			}
+			// the code is asked for last, so it doesn't expire while the
+			// owner decides
+			if storedFile.RecipientEmail != "" {
+				if code, ok = s.useCode(c, storedFile, client); !ok {
+					if approval != nil {
+						s.releaseApproval(approval)
+					}
+					return
+				}
+			}
+
+			if token, ok = s.newDownloadToken(c, storedFile); !ok {
+				if approval != nil {
+					s.releaseApproval(approval)
+				}
+				if code != nil {
+					s.releaseCode(code)
+				}
+				return
+			}
+
+			client.StoredFileId = storedFile.ID
+			if err := s.db.Create(client).Error; err != nil {
+				log.Printf("Failed to save client on file with id %s: %s\n", fileId, err)
+			}
+			s.audit(database.AuditDownload, fileId, (*database.Client)(client), "")
 		}
 
 		var filename string
@@ -240,17 +330,22 @@ func (s *Server) downloadFile(c *gin.Context) {
 		c.Header("X-Filename", filename)
 		c.Header("X-Type", storedFile.Type)
 		c.Header("X-Ephemeral", strconv.FormatUint(uint64(storedFile.Ephemeral), 10))
-		c.FileAttachment(path, filename)
-
-		if storedFile.Count < 1 {
-			// Remove actual file only, db entry will be deleted on confirmation
-			if err := os.Remove(path); err != nil {
-				log.Printf("Failed to delete file with id %s from storage: %s\n", fileId, err)
+		c.Header("X-Download-Token", token.Token)
+		c.Header("X-Download-Token-Expires", token.ExpiresAt.UTC().Format(http.TimeFormat))
+		if storedFile.WrappedKey != "" {
+			c.Header("X-Wrapped-Key", storedFile.WrappedKey)
+		}
+		if err := s.serveBlob(c, info, filename); err != nil {
+			log.Printf("Failed to serve file with id %s: %s\n", fileId, err)
+		} else if transferComplete(c, info.Size) {
+			if err := s.completeDownload(storedFile, token); err != nil {
+				log.Printf("Failed to complete download of file with id %s: %s\n", fileId, err)
 			}
 		}
 	}
 
-	if storedFile.Email != "" {
+	// an allowed resumption belongs to an access that was already reported
+	if storedFile.Email != "" && (!resumed || !allowed) {
 		if err := s.sendMail(s.config.Mail.Subject, storedFile, client, allowed); err != nil {
 			log.Printf("Failed to send access mail for ID %s: %s\n", fileId, err)
 		}
@@ -326,12 +421,7 @@ func (s *Server) confirmReceipt(c *gin.Context) {
 		return
 	}
 
-	if storedFile.Count < 1 {
-		// File already deleted from storage by download handler, so we're taking care of the db now
-		if err := s.db.Delete(storedFile).Error; err != nil {
-			log.Printf("Failed to delete file with id %s from database: %s\n", fileId, err)
-		}
-	}
+	s.audit(database.AuditReceipt, fileId, s.clientInfo(c), "")
 
 	if storedFile.Email != "" {
 		client := (*database.DstClient)(s.getClientInfo(c))
@@ -341,6 +431,15 @@ func (s *Server) confirmReceipt(c *gin.Context) {
 			}
 		}
 	}
+
+	if storedFile.Count < 1 {
+		// File already deleted from storage by download handler, so we're taking care of the db now
+		if err := s.db.Delete(storedFile).Error; err != nil {
+			log.Printf("Failed to delete file with id %s from database: %s\n", fileId, err)
+		} else if err := misc.PseudonymiseStoredFile(storedFile, s.db); err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
 }
 
 func (s *Server) deleteFile(c *gin.Context) {
@@ -350,7 +449,8 @@ func (s *Server) deleteFile(c *gin.Context) {
 	}
 
 	var o OwnerToken
-	if err := c.ShouldBind(&o); err != nil {
+	// files uploaded with an API key can be deleted with the key alone
+	if err := c.ShouldBind(&o); err != nil && currentAPIKey(c) == nil {
 		// TODO: get FieldError and return relevant part only
 		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
@@ -364,18 +464,19 @@ func (s *Server) deleteFile(c *gin.Context) {
 	}
 
 	// check if owner token matches the stored one
-	if subtle.ConstantTimeCompare([]byte(o.OwnerToken), []byte(storedFile.OwnerToken)) != 1 {
+	if !isOwner(c, &storedFile, o.OwnerToken) {
 		apiError(c, http.StatusUnauthorized, ErrCodeOwnerTokenMismatch, "owner token doesn't match")
 		return
 	}
 
-	if errs := misc.DeleteStoredFile(&storedFile, s.db, s.config); len(errs) > 0 {
+	if errs := misc.DeleteStoredFile(&storedFile, s.db, s.store, s.config); len(errs) > 0 {
 		for _, err := range errs {
 			log.Printf("%s\n", err)
 		}
 		apiError(c, http.StatusInternalServerError, ErrCodeDeleteFailed, "file deletion failed")
 		return
 	}
+	s.audit(database.AuditOwnerDelete, fileId, s.clientInfo(c), storedFile.DeletionMethod)
 
 	c.JSON(
 		http.StatusOK,
@@ -413,7 +514,23 @@ func (s *Server) setStats(c *gin.Context) {
 	)
 }
 
+// getClientInfo returns the client of the request, or responds with an error
+// and nil if its TLS parameters don't meet the requirements.
 func (s *Server) getClientInfo(c *gin.Context) *database.Client {
+	client := s.clientInfo(c)
+
+	if err := s.validateTLS(client.TLSVersion, client.TLSCipherSuite); err != nil {
+		s.audit(database.AuditTLSRejected, c.Param("fileId"), client, c.Request.Method+" "+c.FullPath()+": "+err.Error())
+		apiError(c, http.StatusForbidden, ErrCodeTLSRequirements, "TLS requirements not met")
+		c.Abort()
+		return nil
+	}
+
+	return client
+}
+
+// clientInfo collects the client of the request without checking it
+func (s *Server) clientInfo(c *gin.Context) *database.Client {
 	var addr, ua, tlsversion, tlscipher string
 	var location *geoip.Location
 	var err error
@@ -428,6 +545,11 @@ func (s *Server) getClientInfo(c *gin.Context) *database.Client {
 				log.Printf("Failed to lookup geo ip: %s\n", err)
 			}
 		}
+
+		// on failure the address is dropped rather than kept in full
+		if addr, err = s.pseudonymiseAddr(addr); err != nil {
+			log.Printf("Failed to pseudonymise client address: %s\n", err)
+		}
 	} else {
 		ua = "none"
 	}
@@ -440,76 +562,104 @@ func (s *Server) getClientInfo(c *gin.Context) *database.Client {
 		tlscipher = c.Request.Header.Get(s.config.Header.TLSCipherSuite)
 	}
 
-	if err := s.validateTLS(tlsversion, tlscipher); err != nil {
-		apiError(c, http.StatusForbidden, ErrCodeTLSRequirements, "TLS requirements not met")
-		c.Abort()
-		return nil
-	}
-
-	return &database.Client{
+	client := &database.Client{
 		Addr:           addr,
 		UserAgent:      ua,
 		TLSVersion:     tlsversion,
 		TLSCipherSuite: tlscipher,
 		Location:       location,
 	}
+	if location != nil {
+		client.Country = location.CountryCode
+		client.City = location.City
+	}
+
+	return client
+}
+
+// mailFields are the variables available in the mail body templates
+type mailFields struct {
+	FileID            string
+	Addr              string
+	UserAgent         string
+	SrcTLSVersion     string
+	SrcTLSCipherSuite string
+	DstTLSVersion     string
+	DstTLSCipherSuite string
+	Location          *geoip.Location
+	DeniedMsg         string
+	ApprovalURL       string
+	RequestID         string
+	Code              string
+	Lifetime          uint
+	Changes           string
+}
+
+func newMailFields(storedFile *database.StoredFile, client *database.DstClient) *mailFields {
+	return &mailFields{
+		FileID:            storedFile.FileId,
+		Addr:              client.Addr,
+		UserAgent:         client.UserAgent,
+		SrcTLSVersion:     storedFile.SrcClient.TLSVersion,
+		SrcTLSCipherSuite: storedFile.SrcClient.TLSCipherSuite,
+		DstTLSVersion:     client.TLSVersion,
+		DstTLSCipherSuite: client.TLSCipherSuite,
+		Location:          client.Location,
+	}
 }
 
 func (s *Server) sendMail(subject string, storedFile *database.StoredFile, client *database.DstClient, allowedDownload bool) error {
-	templ, err := template.New("mailbody").Parse(s.config.Mail.Body)
+	fields := newMailFields(storedFile, client)
+	if !allowedDownload {
+		fields.DeniedMsg = s.config.Mail.DeniedMsg
+	}
+
+	return s.sendTemplateMail(subject, s.config.Mail.Body, storedFile, fields)
+}
+
+// sendTemplateMail renders the body template with the given fields and mails
+// it to the owner of the file
+func (s *Server) sendTemplateMail(subject, bodyTemplate string, storedFile *database.StoredFile, fields *mailFields) error {
+	body, err := renderMailBody(bodyTemplate, fields)
 	if err != nil {
-		return fmt.Errorf("parse mail body template: %w", err)
+		return err
 	}
 
-	var deniedMsg string
+	return s.deliverMail(storedFile.Email, fmt.Sprintf(subject, storedFile.FileId), body)
+}
 
-	if !allowedDownload {
-		deniedMsg = s.config.Mail.DeniedMsg
-	}
-
-	fields := struct {
-		FileID            string
-		Addr              string
-		UserAgent         string
-		SrcTLSVersion     string
-		SrcTLSCipherSuite string
-		DstTLSVersion     string
-		DstTLSCipherSuite string
-		Location          *geoip.Location
-		DeniedMsg         string
-	}{
-		storedFile.FileId,
-		client.Addr,
-		client.UserAgent,
-		storedFile.SrcClient.TLSVersion,
-		storedFile.SrcClient.TLSCipherSuite,
-		client.TLSVersion,
-		client.TLSCipherSuite,
-		client.Location,
-		deniedMsg,
+// renderMailBody executes the body template with the given fields
+func renderMailBody(bodyTemplate string, fields *mailFields) (string, error) {
+	templ, err := template.New("mailbody").Parse(bodyTemplate)
+	if err != nil {
+		return "", fmt.Errorf("parse mail body template: %w", err)
 	}
 
 	var body strings.Builder
 	if err := templ.Execute(&body, fields); err != nil {
-		return fmt.Errorf("execute mail body template: %w", err)
+		return "", fmt.Errorf("execute mail body template: %w", err)
 	}
 
+	return body.String(), nil
+}
+
+// dialAndSend hands a mail to the SMTP server, replaced in tests
+var dialAndSend = func(dialer *gomail.Dialer, msg *gomail.Message) error {
+	return dialer.DialAndSend(msg)
+}
+
+// deliverMail sends a plain text mail through the configured SMTP server
+func (s *Server) deliverMail(to, subject, body string) error {
 	msg := gomail.NewMessage()
 	msg.SetHeader("From", s.config.Mail.From)
-	msg.SetHeader("To", storedFile.Email)
-	msg.SetHeader(
-		"Subject",
-		fmt.Sprintf(
-			subject,
-			storedFile.FileId,
-		),
-	)
-	msg.SetBody("text/plain", body.String())
+	msg.SetHeader("To", to)
+	msg.SetHeader("Subject", subject)
+	msg.SetBody("text/plain", body)
 
 	dialer := gomail.NewDialer(s.config.Mail.SmtpHost, int(s.config.Mail.SmtpPort), s.config.Mail.SmtpUser, s.config.Mail.SmtpPass)
 
-	if err := dialer.DialAndSend(msg); err != nil {
-		return fmt.Errorf("send mail to %s: %w", storedFile.Email, err)
+	if err := dialAndSend(dialer, msg); err != nil {
+		return fmt.Errorf("send mail to %s: %w", to, err)
 	}
 
 	return nil
@@ -523,6 +673,12 @@ func (s *Server) getStoredFile(fileId string, c *gin.Context) (*database.StoredF
 		return nil, fmt.Errorf("find file in database: %w", err)
 	}
 
+	// the cleanup only runs periodically
+	if time.Now().After(storedFile.ExpiresAt()) {
+		apiError(c, http.StatusGone, ErrCodeFileExpired, "file expired")
+		return nil, fmt.Errorf("file expired at %s", storedFile.ExpiresAt())
+	}
+
 	var srcclient database.Client
 	if err := s.db.Model(&storedFile).Related(&srcclient).Error; err != nil {
 		apiError(c, http.StatusNotFound, ErrCodeRetrievalFailed, "file retrieval error")
@@ -549,3 +705,65 @@ func bindFileID(c *gin.Context) (string, error) {
 	}
 	return f.FileId, nil
 }
+
+// saveStoredFile streams the contents into the storage backend and records
+// their size and hash, so transfer records can prove what was sent.
+func (s *Server) saveStoredFile(tx *gorm.DB, storedFile *database.StoredFile, src io.Reader, size int64) error {
+	hash := sha256.New()
+
+	n, err := s.store.Put(storedFile.Name, io.TeeReader(src, hash), size)
+	if err != nil {
+		return fmt.Errorf("store file: %w", err)
+	}
+	if n != size {
+		s.removeBlob(storedFile.Name)
+		return fmt.Errorf("stored %d of %d bytes", n, size)
+	}
+
+	storedFile.Size = n
+	storedFile.Hash = hex.EncodeToString(hash.Sum(nil))
+	err = tx.Model(storedFile).Updates(map[string]interface{}{
+		"size": storedFile.Size,
+		"hash": storedFile.Hash,
+	}).Error
+	if err != nil {
+		s.removeBlob(storedFile.Name)
+		return fmt.Errorf("record size and hash: %w", err)
+	}
+
+	return nil
+}
+
+// removeBlob removes the blob of a file that wasn't created
+func (s *Server) removeBlob(name string) {
+	if err := s.store.Delete(name); err != nil {
+		log.Printf("Failed to remove file %s: %s\n", name, err)
+	}
+}
+
+func (s *Server) serveBlob(c *gin.Context, info *storage.Info, filename string) error {
+	obj, err := s.store.Open(info.Name)
+	if err != nil {
+		apiError(c, http.StatusNotFound, ErrCodeFileNotFound, "file not found")
+		return fmt.Errorf("open blob: %w", err)
+	}
+	defer func() {
+		if err := obj.Close(); err != nil {
+			log.Printf("Failed to close blob %s: %s\n", info.Name, err)
+		}
+	}()
+
+	c.Header("Content-Disposition", attachmentDisposition(filename))
+	http.ServeContent(c.Writer, c.Request, filename, info.ModTime, obj)
+
+	return nil
+}
+
+func attachmentDisposition(filename string) string {
+	for _, r := range filename {
+		if r > 0x7e || r < 0x20 || r == '"' || r == '\\' {
+			return "attachment; filename*=UTF-8''" + url.QueryEscape(filename)
+		}
+	}
+	return `attachment; filename="` + filename + `"`
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"regexp"
 	"strings"
+
+	"github.com/lixmal/gdprshare/pkg/database"
 )
 
 var (
@@ -10,6 +12,21 @@ var (
 	validTypes        = map[string]bool{"file": true, "text": true, "image": true}
 )
 
+// sanitizeStoredFile normalizes the user supplied fields of an upload and
+// drops options that don't apply.
+func sanitizeStoredFile(f *database.StoredFile) {
+	f.Filename = sanitizeFilename(f.Filename)
+	f.Type = sanitizeType(f.Type)
+	f.AllowedCountries = sanitizeCountries(f.AllowedCountries)
+	if f.AllowedCountries != "" {
+		f.OnlyEEA = false
+		f.IncludeOther = false
+	}
+	if f.Type != "image" {
+		f.Ephemeral = 0
+	}
+}
+
 func sanitizeFilename(filename string) string {
 	if filename == "" {
 		return ""
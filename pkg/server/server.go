@@ -1,6 +1,10 @@
 package server
 
 import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log"
 	"net/http"
 	"time"
 
@@ -9,6 +13,10 @@ import (
 
 	"github.com/lixmal/gdprshare/pkg/config"
 	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/ldap"
+	"github.com/lixmal/gdprshare/pkg/oidc"
+	"github.com/lixmal/gdprshare/pkg/record"
+	"github.com/lixmal/gdprshare/pkg/storage"
 )
 
 const (
@@ -21,6 +29,7 @@ type StoredFileInfo struct {
 	ExpiryDate time.Time `json:"expiryDate"`
 	Count      uint      `json:"count"`
 	Error      string    `json:"error"`
+	Code       ErrorCode `json:"code,omitempty"`
 }
 
 type FileId struct {
@@ -38,13 +47,22 @@ type OwnedFile struct {
 
 type Server struct {
 	*http.Server
-	db     *database.Database
-	config *config.Config
+	db      *database.Database
+	store   storage.Backend
+	config  *config.Config
+	cleanup *cleanupScheduler
+	// hmac key of the address pseudonymisation
+	pseudonymKey pseudonymKey
+	// signs transfer records, nil if not configured
+	signingKey ed25519.PrivateKey
+	// sender login, nil if not configured
+	oidc *oidc.Provider
+	ldap *ldap.Directory
 }
 
 func setupRoutes(router *gin.Engine, srv *Server) {
 	// TODO: add json response
-	router.Use(limits.RequestSizeLimiter(srv.config.MaxUploadSize * 1024 * 1024))
+	router.Use(sizeLimiter(srv.config.MaxUploadSize * 1024 * 1024))
 	router.MaxMultipartMemory = MultipartMem
 
 	router.Static("/assets", "public")
@@ -52,46 +70,137 @@ func setupRoutes(router *gin.Engine, srv *Server) {
 	router.GET("/", srv.index)
 	router.GET("/uploaded", srv.index)
 	router.GET("/d/:fileId", srv.index)
+	router.GET("/approve/:fileId/:requestId", srv.index)
+	router.GET("/request", srv.index)
+	router.GET("/r/:requestId", srv.index)
 
 	v1 := router.Group("/api/v1")
 
+	v1.Use(srv.authenticateKey())
+
+	limiter := newRateLimiter(srv.config.RateLimit.RPS, srv.config.RateLimit.Burst)
 	if srv.config.RateLimit.Enabled {
-		limiter := newRateLimiter(srv.config.RateLimit.RPS, srv.config.RateLimit.Burst)
 		v1.Use(limiter.middleware())
 	}
+	v1.Use(limiter.keyMiddleware(srv.config.RateLimit.Enabled))
+	v1.Use(rejectInvalidKey())
+
+	if srv.oidc != nil || srv.ldap != nil {
+		v1.Use(srv.authenticate())
+
+		auth := v1.Group("/auth")
+		if srv.oidc != nil {
+			auth.GET("/login", srv.login)
+			auth.GET("/callback", srv.callback)
+		}
+		if srv.ldap != nil {
+			auth.POST("/ldap", srv.ldapLogin)
+		}
+		auth.POST("/logout", srv.logout)
+		auth.GET("/user", srv.getUser)
+	}
 
 	v1.POST("/stats", srv.setStats)
 	v1.GET("/config", srv.getConfig)
 	v1.GET("/countries", srv.getCountries)
-	v1.POST("/files", srv.uploadFile)
+	v1.GET("/usage", requireScope(database.ScopeStatus), srv.getUsage)
+	v1.POST("/files", requireScope(database.ScopeUpload), srv.requireLogin(), srv.uploadFile)
 	v1.GET("/files/:fileId", srv.downloadFile)
 	v1.POST("/files/:fileId", srv.confirmReceipt)
-	v1.DELETE("/files/:fileId", srv.deleteFile)
+	v1.DELETE("/files/:fileId", requireScope(database.ScopeDelete), srv.deleteFile)
+	v1.PATCH("/files/:fileId", requireScope(database.ScopeUpload), srv.updateFile)
 	v1.POST("/files/validate", srv.validateFiles)
+	v1.POST("/files/status", requireScope(database.ScopeStatus), srv.fileStatus)
+	v1.GET("/files/:fileId/record", requireScope(database.ScopeStatus), srv.getRecord)
+	v1.GET("/files/:fileId/receipt", requireScope(database.ScopeStatus), srv.getReceipt)
+	v1.GET("/files/:fileId/approvals", requireScope(database.ScopeStatus), srv.listApprovals)
+	v1.GET("/files/:fileId/approvals/:requestId", srv.getApproval)
+	v1.POST("/files/:fileId/approvals/:requestId", srv.decideApproval)
+
+	v1.POST("/requests", requireScope(database.ScopeUpload), srv.requireLogin(), srv.createRequest)
+	v1.GET("/requests/:requestId", srv.getRequest)
+	v1.POST("/requests/:requestId/files", srv.uploadToRequest)
+	v1.DELETE("/requests/:requestId", srv.closeRequest)
+
+	v1.POST("/uploads", requireScope(database.ScopeUpload), srv.requireLogin(), srv.createUpload)
+	v1.GET("/uploads/:uploadId", srv.getUpload)
+	v1.PUT("/uploads/:uploadId/chunks/:index", srv.putChunk)
+	v1.POST("/uploads/:uploadId", srv.finalizeUpload)
+	v1.DELETE("/uploads/:uploadId", srv.deleteUpload)
+
+	tus := v1.Group("/tus", tusResumable())
+	tus.OPTIONS("", srv.tusOptions)
+	tus.POST("", requireScope(database.ScopeUpload), srv.requireLogin(), srv.tusCreate)
+	tus.HEAD("/:uploadId", srv.tusHead)
+	tus.PATCH("/:uploadId", srv.tusPatch)
+	tus.DELETE("/:uploadId", srv.tusDelete)
+
+	admin := v1.Group("/admin", requireAdmin())
+	admin.GET("/files", srv.adminListFiles)
+	admin.GET("/files/:fileId", srv.adminGetFile)
+	admin.DELETE("/files/:fileId", srv.adminDeleteFile)
+	admin.GET("/orphans", srv.adminOrphans)
+	admin.POST("/orphans/repair", srv.adminRepairOrphans)
+}
+
+// sizeLimiter limits request bodies to limit bytes, except for resumable
+// upload chunks, which their handlers limit to the chunk or upload size.
+func sizeLimiter(limit int64) gin.HandlerFunc {
+	limiter := limits.RequestSizeLimiter(limit)
+	return func(c *gin.Context) {
+		switch c.Request.Method + " " + c.FullPath() {
+		case http.MethodPut + " /api/v1/uploads/:uploadId/chunks/:index", http.MethodPatch + " /api/v1/tus/:uploadId":
+			c.Next()
+		default:
+			limiter(c)
+		}
+	}
 }
 
-// New creates a new Server instance with the given database and configuration.
-func New(db *database.Database, conf *config.Config) *Server {
+// New creates a new Server instance with the given database, storage backend and configuration.
+func New(db *database.Database, store storage.Backend, conf *config.Config) *Server {
 	router := gin.Default()
 
 	srv := &Server{
-		&http.Server{
+		Server: &http.Server{
 			Addr:    conf.ListenAddr,
 			Handler: router,
 		},
-		db,
-		conf,
+		db:     db,
+		store:  store,
+		config: conf,
 	}
 
+	if conf.Records.SigningKey != "" {
+		key, err := record.LoadPrivateKey(conf.Records.SigningKey)
+		if err != nil {
+			log.Printf("Failed to load record signing key, transfer records are unavailable: %s\n", err)
+		}
+		srv.signingKey = key
+	}
+	srv.oidc = newOIDCProvider(srv)
+	srv.ldap = newLDAPDirectory(srv)
+
 	setupRoutes(router, srv)
 
 	return srv
 }
 
-// Start starts the HTTP or HTTPS server based on the TLS configuration.
+// Start starts the HTTP or HTTPS server based on the TLS configuration, and
+// the cleanup of expired files.
 func (s *Server) Start() error {
+	s.startCleanup()
+
 	if s.config.TLS.Use {
 		return s.ListenAndServeTLS(s.config.TLS.Cert, s.config.TLS.Key)
 	}
 	return s.ListenAndServe()
 }
+
+// Shutdown stops the cleanup scheduler and gracefully shuts down the server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if err := s.stopCleanup(ctx); err != nil {
+		return fmt.Errorf("stop cleanup: %w", err)
+	}
+	return s.Server.Shutdown(ctx)
+}
@@ -13,11 +13,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/lixmal/gdprshare/pkg/config"
 	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+	"github.com/lixmal/gdprshare/pkg/storage"
 )
 
 // setupTestServer creates a test server with an in-memory SQLite database
@@ -34,11 +37,15 @@ func setupTestServer(t *testing.T) (*Server, func()) {
 	conf.SaveClientInfo = false
 	conf.MaxUploadSize = 100
 	conf.IDLength = 20
+	conf.Download.ResumeWindow = 10
+	conf.Approval.MaxRequests = 5
 
 	db, err := database.New(conf)
 	require.NoError(t, err)
+	// every connection to :memory: opens a database of its own
+	db.DB.DB().SetMaxOpenConns(1)
 
-	srv := New(db, conf)
+	srv := New(db, storage.NewLocal(conf.StorePath), conf)
 
 	cleanup := func() {
 		db.Close()
@@ -524,3 +531,156 @@ func TestIndexRoute(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 	assert.Contains(t, w.Body.String(), "Test")
 }
+
+// TestDeleteFileShredded verifies that owner deletion shreds the contents and
+// keeps the method with the deletion record
+func TestDeleteFileShredded(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	srv.config.Storage.Shred.Enabled = true
+	srv.config.Storage.Shred.Passes = 2
+
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, nil)
+
+	deleteReq := httptest.NewRequest(
+		http.MethodDelete,
+		fmt.Sprintf("/api/v1/files/%s?ownerToken=%s", fileId, ownerToken),
+		nil,
+	)
+	deleteW := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(deleteW, deleteReq)
+	require.Equal(t, http.StatusOK, deleteW.Code)
+
+	storedFile := getTestStoredFile(t, srv, fileId)
+	assert.NotNil(t, storedFile.DeletedAt)
+	assert.Equal(t, "shred:2", storedFile.DeletionMethod)
+
+	entries, err := os.ReadDir(srv.config.StorePath)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// TestDownloadExhaustedRecordsDeletion verifies the contents are removed once
+// the last download was served
+func TestDownloadExhaustedRecordsDeletion(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	fileId := uploadTestFile(t, srv, map[string]string{"count": "1"})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	storedFile := getTestStoredFile(t, srv, fileId)
+	assert.Equal(t, "delete", storedFile.DeletionMethod)
+
+	_, err := srv.store.Stat(storedFile.Name)
+	assert.Error(t, err)
+}
+
+// TestExpiredFileIsGone verifies an expired file can't be downloaded, confirmed
+// or validated before the cleanup removed it
+func TestExpiredFileIsGone(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, map[string]string{"expiry": "1"})
+	require.NoError(t, srv.db.Model(&database.StoredFile{}).
+		Where("file_id = ?", fileId).
+		Update("created_at", time.Now().Add(-25*time.Hour)).Error)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Equal(t, string(ErrCodeFileExpired), decodeError(t, w).Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/files/"+fileId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Equal(t, string(ErrCodeFileExpired), decodeError(t, w).Code)
+
+	body, err := json.Marshal([]map[string]string{{"fileId": fileId, "ownerToken": ownerToken}})
+	require.NoError(t, err)
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/files/validate", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		FileInfo map[string]StoredFileInfo `json:"fileInfo"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, StoredFileInfo{Code: ErrCodeFileExpired}, resp.FileInfo[fileId])
+}
+
+// TestExpiryHours verifies the expiry can be given in hours instead of days
+func TestExpiryHours(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	fileId := uploadTestFile(t, srv, map[string]string{"expiry-hours": "2"})
+
+	storedFile := getTestStoredFile(t, srv, fileId)
+	assert.Equal(t, uint(2), storedFile.ExpiryHours)
+	assert.WithinDuration(t, storedFile.CreatedAt.Add(2*time.Hour), storedFile.ExpiresAt(), time.Second)
+
+	require.NoError(t, srv.db.Model(&database.StoredFile{}).
+		Where("file_id = ?", fileId).
+		Update("created_at", time.Now().Add(-3*time.Hour)).Error)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	require.Empty(t, misc.Cleanup(srv.db, srv.store, srv.config))
+	var count int
+	require.NoError(t, srv.db.Model(&database.StoredFile{}).Where("file_id = ?", fileId).Count(&count).Error)
+	assert.Equal(t, 0, count)
+
+	t.Run("out of range", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "hours.txt")
+		require.NoError(t, err)
+		_, err = part.Write([]byte("hours"))
+		require.NoError(t, err)
+		require.NoError(t, writer.WriteField("expiry-hours", "337"))
+		require.NoError(t, writer.Close())
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+// TestCreateStoredFileIncomplete checks contents shorter than announced leave
+// neither a file nor its blob behind
+func TestCreateStoredFileIncomplete(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/files", nil)
+
+	storedFile := database.StoredFile{Filename: "short.txt"}
+	require.False(t, srv.createStoredFile(c, &storedFile, bytes.NewReader([]byte("short")), 10))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, string(ErrCodeSaveFailed), decodeError(t, w).Code)
+
+	var count int
+	require.NoError(t, srv.db.Unscoped().Model(&database.StoredFile{}).Count(&count).Error)
+	assert.Equal(t, 0, count)
+
+	blobs, err := srv.store.List()
+	require.NoError(t, err)
+	assert.Empty(t, blobs)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+// FileStatus is the state of an owned file as shown to its owner
+type FileStatus struct {
+	Filename         string      `json:"filename,omitempty"`
+	Type             string      `json:"type,omitempty"`
+	Count            uint        `json:"count"`
+	ExpiryDate       time.Time   `json:"expiryDate"`
+	AvailableAt      time.Time   `json:"availableAt"`
+	AllowedCountries []string    `json:"allowedCountries,omitempty"`
+	OnlyEEA          bool        `json:"onlyEEA,omitempty"`
+	Approval         bool        `json:"approval,omitempty"`
+	Pending          uint        `json:"pending,omitempty"` // approval requests awaiting a decision
+	Downloads        uint        `json:"downloads"`
+	Denied           uint        `json:"denied"`
+	LastAccess       *FileAccess `json:"lastAccess,omitempty"`
+	Error            string      `json:"error,omitempty"`
+	Code             ErrorCode   `json:"code,omitempty"`
+}
+
+// FileAccess is a download attempt, allowed or not
+type FileAccess struct {
+	Time    time.Time `json:"time"`
+	Country string    `json:"country,omitempty"`
+	City    string    `json:"city,omitempty"`
+	Denied  bool      `json:"denied,omitempty"`
+}
+
+// StatusQuery is a file asked for in a status request. The owner token can be
+// left out for files uploaded with the request's API key.
+type StatusQuery struct {
+	FileId     string `json:"fileId"     binding:"required,printascii,min=3,max=64"`
+	OwnerToken string `json:"ownerToken" binding:"omitempty,printascii,min=3,max=64"`
+}
+
+// fileStatus returns the status of each of the given files, keyed by file id.
+// Files the owner token doesn't match or that are gone only carry a code.
+func (s *Server) fileStatus(c *gin.Context) {
+	var files []StatusQuery
+	if err := c.ShouldBindJSON(&files); err != nil {
+		// TODO: get FieldError and return relevant part only
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	status := map[string]FileStatus{}
+	for _, f := range files {
+		fileId := f.FileId
+
+		var storedFile database.StoredFile
+		if err := s.db.Where(&database.StoredFile{FileId: fileId}).Find(&storedFile).Error; err != nil {
+			if !s.db.IsRecordNotFoundError(err) {
+				log.Printf("Failed to find file with id %s in database: %s\n", fileId, err)
+			}
+			status[fileId] = FileStatus{Code: ErrCodeFileNotFound}
+			continue
+		}
+
+		if !isOwner(c, &storedFile, f.OwnerToken) {
+			status[fileId] = FileStatus{
+				Error: "Owner token mismatch",
+				Code:  ErrCodeOwnerTokenMismatch,
+			}
+			continue
+		}
+
+		fileStatus, err := s.ownedFileStatus(&storedFile)
+		if err != nil {
+			log.Printf("Failed to get status of file with id %s: %s\n", fileId, err)
+			status[fileId] = FileStatus{Code: ErrCodeRetrievalFailed}
+			continue
+		}
+		status[fileId] = *fileStatus
+	}
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"files": status,
+		},
+	)
+}
+
+func (s *Server) ownedFileStatus(storedFile *database.StoredFile) (*FileStatus, error) {
+	status := &FileStatus{
+		Filename:    storedFile.Filename,
+		Type:        storedFile.Type,
+		Count:       storedFile.Count,
+		ExpiryDate:  storedFile.ExpiresAt(),
+		AvailableAt: storedFile.CreatedAt.Add(time.Duration(storedFile.Delay) * time.Minute),
+		OnlyEEA:     storedFile.OnlyEEA,
+		Approval:    storedFile.Approval,
+		Downloads:   storedFile.Downloads,
+	}
+	if storedFile.AllowedCountries != "" {
+		status.AllowedCountries = strings.Split(storedFile.AllowedCountries, ",")
+	}
+	if time.Now().After(status.ExpiryDate) {
+		status.Code = ErrCodeFileExpired
+	}
+
+	if err := s.db.Model(&database.DeniedClient{}).Where("stored_file_id = ?", storedFile.ID).Count(&status.Denied).Error; err != nil {
+		return nil, err
+	}
+	err := s.db.Model(&database.ApprovalRequest{}).
+		Where("stored_file_id = ? AND state = ?", storedFile.ID, database.ApprovalPending).
+		Count(&status.Pending).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var lastDst database.DstClient
+	err = s.db.Where("stored_file_id = ?", storedFile.ID).Order("created_at desc").First(&lastDst).Error
+	if err != nil && !s.db.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	if err == nil {
+		status.LastAccess = &FileAccess{Time: lastDst.CreatedAt, Country: lastDst.Country, City: lastDst.City}
+	}
+
+	var lastDenied database.DeniedClient
+	err = s.db.Where("stored_file_id = ?", storedFile.ID).Order("created_at desc").First(&lastDenied).Error
+	if err != nil && !s.db.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	if err == nil && (status.LastAccess == nil || lastDenied.CreatedAt.After(status.LastAccess.Time)) {
+		status.LastAccess = &FileAccess{Time: lastDenied.CreatedAt, Country: lastDenied.Country, City: lastDenied.City, Denied: true}
+	}
+
+	return status, nil
+}
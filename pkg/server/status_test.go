@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStatus(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, map[string]string{"count": "3", "type": "file", "filename": "report.txt"})
+	deniedId, deniedToken := uploadOwnedTestFile(t, srv, map[string]string{"allowed-countries": "DE,AT", "delay": "5"})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// not yet available
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/files/"+deniedId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	body, err := json.Marshal([]map[string]string{
+		{"fileId": fileId, "ownerToken": ownerToken},
+		{"fileId": deniedId, "ownerToken": deniedToken},
+		{"fileId": "doesnotexist", "ownerToken": "sometoken"},
+		{"fileId": fileId + "x", "ownerToken": ownerToken},
+	})
+	require.NoError(t, err)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/files/status", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		Files map[string]FileStatus `json:"files"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Len(t, resp.Files, 4)
+
+	status := resp.Files[fileId]
+	assert.Equal(t, "report.txt", status.Filename)
+	assert.Equal(t, "file", status.Type)
+	assert.Equal(t, uint(2), status.Count)
+	assert.Equal(t, uint(1), status.Downloads)
+	assert.Equal(t, uint(0), status.Denied)
+	require.NotNil(t, status.LastAccess)
+	assert.False(t, status.LastAccess.Denied)
+	assert.WithinDuration(t, time.Now(), status.LastAccess.Time, time.Minute)
+	assert.Empty(t, status.Code)
+
+	status = resp.Files[deniedId]
+	assert.Equal(t, []string{"DE", "AT"}, status.AllowedCountries)
+	assert.True(t, status.AvailableAt.After(time.Now()))
+	assert.Equal(t, uint(0), status.Downloads)
+	assert.Equal(t, uint(1), status.Denied)
+	require.NotNil(t, status.LastAccess)
+	assert.True(t, status.LastAccess.Denied)
+
+	assert.Equal(t, ErrCodeFileNotFound, resp.Files["doesnotexist"].Code)
+	assert.Equal(t, ErrCodeFileNotFound, resp.Files[fileId+"x"].Code)
+
+	t.Run("wrong owner token", func(t *testing.T) {
+		body, err := json.Marshal([]map[string]string{{"fileId": fileId, "ownerToken": "wrongtoken"}})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/files/status", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			Files map[string]FileStatus `json:"files"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		status := resp.Files[fileId]
+		assert.Equal(t, ErrCodeOwnerTokenMismatch, status.Code)
+		assert.Empty(t, status.Filename)
+		assert.Nil(t, status.LastAccess)
+	})
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/lixmal/gdprshare/pkg/config"
 	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/storage"
 )
 
 func TestTLSVersionParsing(t *testing.T) {
@@ -49,7 +50,7 @@ func TestTLSValidation(t *testing.T) {
 	require.NoError(t, err)
 	defer db.Close()
 
-	srv := New(db, conf)
+	srv := New(db, storage.NewLocal(conf.StorePath), conf)
 
 	err = srv.validateTLS(strconv.Itoa(int(tls.VersionTLS12)), "")
 	assert.NoError(t, err, "TLS 1.2 should be allowed")
@@ -75,7 +76,7 @@ func TestWeakCipherRejection(t *testing.T) {
 	require.NoError(t, err)
 	defer db.Close()
 
-	srv := New(db, conf)
+	srv := New(db, storage.NewLocal(conf.StorePath), conf)
 
 	err = srv.validateTLS(
 		strconv.Itoa(int(tls.VersionTLS12)),
@@ -100,7 +101,7 @@ func TestTLSValidationDisabled(t *testing.T) {
 	require.NoError(t, err)
 	defer db.Close()
 
-	srv := New(db, conf)
+	srv := New(db, storage.NewLocal(conf.StorePath), conf)
 
 	err = srv.validateTLS(strconv.Itoa(int(tls.VersionTLS10)), "")
 	assert.NoError(t, err, "TLS validation should be disabled")
@@ -118,7 +119,7 @@ func TestBlockedCipherFromConfig(t *testing.T) {
 	require.NoError(t, err)
 	defer db.Close()
 
-	srv := New(db, conf)
+	srv := New(db, storage.NewLocal(conf.StorePath), conf)
 
 	err = srv.validateTLS(
 		strconv.Itoa(int(tls.VersionTLS12)),
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+// tus 1.0 resumable upload protocol, see https://tus.io/protocols/resumable-upload
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,expiration,termination"
+	TusBasePath   = "/api/v1/tus/"
+
+	tusOffsetContentType = "application/offset+octet-stream"
+)
+
+// tusMetadataKeys are the Upload-Metadata keys taken over as upload form
+// fields. Others, like the filetype most clients send, are ignored.
+var tusMetadataKeys = map[string]bool{
+	"type":              true,
+	"filename":          true,
+	"email":             true,
+	"expiry":            true,
+	"expiry-hours":      true,
+	"count":             true,
+	"only-eea":          true,
+	"include-other":     true,
+	"allowed-countries": true,
+	"delay":             true,
+	"ephemeral":         true,
+	"approval":          true,
+	"recipient-email":   true,
+}
+
+// tusResumable rejects requests of other protocol versions and adds the
+// protocol header to every response.
+func tusResumable() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", TusVersion)
+
+		if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != TusVersion {
+			c.Header("Tus-Version", TusVersion)
+			apiErrorAborted(c, http.StatusPreconditionFailed, ErrCodeInvalidRequest, "unsupported tus version")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func (s *Server) tusOptions(c *gin.Context) {
+	c.Header("Tus-Version", TusVersion)
+	c.Header("Tus-Extension", TusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(s.config.ResumableUpload.MaxSize*1024*1024, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// tusCreate implements the creation extension. The sharing options are taken
+// from Upload-Metadata.
+func (s *Server) tusCreate(c *gin.Context) {
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidUpload, "deferred upload length not supported")
+		return
+	}
+
+	size, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || size < 1 {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidUpload, "invalid Upload-Length")
+		return
+	}
+
+	options, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidUpload, err.Error())
+		return
+	}
+
+	session, ok := s.newUploadSession(c, options, size, true)
+	if !ok {
+		return
+	}
+
+	c.Header("Location", TusBasePath+session.UploadId)
+	c.Header("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+func (s *Server) tusHead(c *gin.Context) {
+	session, ok := s.getTusSession(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(receivedBytes(session), 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.Size, 10))
+	c.Header("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+// tusPatch appends the request body to the upload. The request completing
+// the upload creates the StoredFile, its id and owner token are returned in
+// the X-File-Id and X-Owner-Token headers.
+func (s *Server) tusPatch(c *gin.Context) {
+	if c.ContentType() != tusOffsetContentType {
+		apiError(c, http.StatusUnsupportedMediaType, ErrCodeInvalidChunk, "content type must be "+tusOffsetContentType)
+		return
+	}
+
+	session, ok := s.getTusSession(c)
+	if !ok {
+		return
+	}
+	if session.Finalizing {
+		apiError(c, http.StatusConflict, ErrCodeUploadFinalizing, "upload is being finalized")
+		return
+	}
+
+	offset := receivedBytes(session)
+	if c.GetHeader("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		apiError(c, http.StatusConflict, ErrCodeInvalidChunk, "Upload-Offset doesn't match")
+		return
+	}
+
+	remaining := session.Size - offset
+	if c.Request.ContentLength > remaining {
+		apiError(c, http.StatusRequestEntityTooLarge, ErrCodeChunkTooLarge, "chunk exceeds Upload-Length")
+		return
+	}
+
+	if c.Request.ContentLength != 0 {
+		// chunks can have any size, so a chunk ends where the body does
+		body := &tusBody{r: http.MaxBytesReader(c.Writer, c.Request.Body, remaining)}
+		if !s.replaceChunk(c, session, uint(len(session.ReceivedChunks())), body, -1) {
+			return
+		}
+		if body.err != nil {
+			log.Printf("Upload %s interrupted: %s\n", session.UploadId, body.err)
+		}
+
+		uploadId := session.UploadId
+		var err error
+		if session, err = s.getUploadSession(uploadId, c); err != nil {
+			log.Printf("Failed to retrieve upload with ID %s: %s\n", uploadId, err)
+			return
+		}
+	}
+
+	offset = receivedBytes(session)
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	if offset == session.Size {
+		storedFile, ok := s.finalizeUploadSession(c, session)
+		if !ok {
+			return
+		}
+		c.Header("Location", "/d/"+storedFile.FileId)
+		c.Header("X-File-Id", storedFile.FileId)
+		c.Header("X-Owner-Token", storedFile.OwnerToken)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// tusBody ends the request body at the first read error, so the bytes
+// received before a connection dropped are kept and the client resumes after
+// them. Exceeding the upload length stays an error.
+type tusBody struct {
+	r   io.Reader
+	err error
+}
+
+func (b *tusBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	var maxErr *http.MaxBytesError
+	if err != nil && err != io.EOF && !errors.As(err, &maxErr) {
+		b.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *Server) tusDelete(c *gin.Context) {
+	session, ok := s.getTusSession(c)
+	if !ok {
+		return
+	}
+
+	if errs := s.deleteUploadSession(session); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("%s\n", err)
+		}
+		apiError(c, http.StatusInternalServerError, ErrCodeDeleteFailed, "upload deletion failed")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) getTusSession(c *gin.Context) (*database.UploadSession, bool) {
+	var u UploadId
+	if err := c.ShouldBindUri(&u); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return nil, false
+	}
+
+	session, err := s.getUploadSession(u.UploadId, c)
+	if err != nil {
+		log.Printf("Failed to retrieve upload with ID %s: %s\n", u.UploadId, err)
+		return nil, false
+	}
+	if !session.Tus {
+		apiError(c, http.StatusNotFound, ErrCodeUploadNotFound, "upload not found")
+		return nil, false
+	}
+
+	return session, true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs of
+// key and base64 encoded value, the value being optional.
+func parseTusMetadata(header string) (url.Values, error) {
+	options := url.Values{}
+	if strings.TrimSpace(header) == "" {
+		return options, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata: empty key")
+		}
+
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, errors.New("invalid Upload-Metadata: value of " + key + " is not base64")
+		}
+
+		if tusMetadataKeys[key] {
+			options.Set(key, string(value))
+		}
+	}
+
+	return options, nil
+}
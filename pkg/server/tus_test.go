@@ -0,0 +1,289 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tusRequest(method, target string, body []byte) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", TusVersion)
+	return req
+}
+
+func tusMetadata(pairs map[string]string) string {
+	var parts []string
+	for k, v := range pairs {
+		parts = append(parts, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	return strings.Join(parts, ",")
+}
+
+func createTusUpload(t *testing.T, srv *Server, size int, metadata map[string]string) string {
+	t.Helper()
+
+	req := tusRequest(http.MethodPost, "/api/v1/tus", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(size))
+	req.Header.Set("Upload-Metadata", tusMetadata(metadata))
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal(t, TusVersion, w.Header().Get("Tus-Resumable"))
+	assert.NotEmpty(t, w.Header().Get("Upload-Expires"))
+
+	location := w.Header().Get("Location")
+	require.True(t, strings.HasPrefix(location, TusBasePath), location)
+
+	return location
+}
+
+func patchTus(srv *Server, location string, offset int, data []byte) *httptest.ResponseRecorder {
+	req := tusRequest(http.MethodPatch, location, data)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestTusOptions(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/v1/tus", nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, TusVersion, w.Header().Get("Tus-Version"))
+	assert.Equal(t, "creation,expiration,termination", w.Header().Get("Tus-Extension"))
+	assert.Equal(t, strconv.Itoa(10*1024*1024), w.Header().Get("Tus-Max-Size"))
+}
+
+func TestTusRequiresVersion(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/tus", nil)
+	req.Header.Set("Upload-Length", "10")
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, TusVersion, w.Header().Get("Tus-Version"))
+}
+
+// TestTusUploadFlow uploads in two PATCH requests, resuming after a HEAD, and
+// checks the result is a regular stored file
+func TestTusUploadFlow(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	content := []byte("tus resumable upload content")
+	location := createTusUpload(t, srv, len(content), map[string]string{
+		"filename": "tus.txt",
+		"filetype": "text/plain",
+		"count":    "3",
+		"expiry":   "2",
+	})
+
+	w := patchTus(srv, location, 0, content[:10])
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	assert.Equal(t, "10", w.Header().Get("Upload-Offset"))
+	assert.Empty(t, w.Header().Get("X-File-Id"))
+
+	// a stale offset is rejected
+	w = patchTus(srv, location, 0, content[:10])
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	req := tusRequest(http.MethodHead, location, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Upload-Offset"))
+	assert.Equal(t, strconv.Itoa(len(content)), w.Header().Get("Upload-Length"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	w = patchTus(srv, location, 10, content[10:])
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	assert.Equal(t, strconv.Itoa(len(content)), w.Header().Get("Upload-Offset"))
+
+	fileId := w.Header().Get("X-File-Id")
+	require.NotEmpty(t, fileId)
+	require.NotEmpty(t, w.Header().Get("X-Owner-Token"))
+
+	storedFile := getTestStoredFile(t, srv, fileId)
+	assert.Equal(t, "tus.txt", storedFile.Filename)
+	assert.Equal(t, uint(3), storedFile.Count)
+	assert.Equal(t, uint(2), storedFile.Expiry)
+	assert.Equal(t, w.Header().Get("X-Owner-Token"), storedFile.OwnerToken)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	downloaded, err := io.ReadAll(w.Body)
+	require.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+
+	// upload is gone after completion
+	req = tusRequest(http.MethodHead, location, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestTusSinglePatch sends a whole upload larger than the regular upload
+// limit in one PATCH, as tus clients do by default
+func TestTusSinglePatch(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+	srv.config.MaxUploadSize = 1
+	srv = New(srv.db, srv.store, srv.config)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 2*1024*1024/16)
+	location := createTusUpload(t, srv, len(content), nil)
+
+	w := patchTus(srv, location, 0, content)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	assert.Equal(t, strconv.Itoa(len(content)), w.Header().Get("Upload-Offset"))
+	assert.NotEmpty(t, w.Header().Get("X-File-Id"))
+}
+
+// failingReader returns data and then fails like a dropped connection
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// TestTusInterruptedPatch checks the bytes of an interrupted PATCH are kept,
+// so the client resumes after them
+func TestTusInterruptedPatch(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	content := []byte("tus resumable upload content")
+	location := createTusUpload(t, srv, len(content), nil)
+
+	req := httptest.NewRequest(http.MethodPatch, location, &failingReader{data: content[:12]})
+	req.ContentLength = int64(len(content))
+	req.Header.Set("Tus-Resumable", TusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	srv.Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = tusRequest(http.MethodHead, location, nil)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "12", w.Header().Get("Upload-Offset"))
+
+	w = patchTus(srv, location, 12, content[12:])
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	fileId := w.Header().Get("X-File-Id")
+	require.NotEmpty(t, fileId)
+
+	w = rangeDownload(srv, fileId, "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, content, w.Body.Bytes())
+}
+
+func TestTusRejects(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	t.Run("invalid metadata", func(t *testing.T) {
+		req := tusRequest(http.MethodPost, "/api/v1/tus", nil)
+		req.Header.Set("Upload-Length", "10")
+		req.Header.Set("Upload-Metadata", "count "+base64.StdEncoding.EncodeToString([]byte("100")))
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("deferred length", func(t *testing.T) {
+		req := tusRequest(http.MethodPost, "/api/v1/tus", nil)
+		req.Header.Set("Upload-Defer-Length", "1")
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	location := createTusUpload(t, srv, 10, nil)
+
+	t.Run("wrong content type", func(t *testing.T) {
+		req := tusRequest(http.MethodPatch, location, []byte("0123456789"))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+
+	t.Run("beyond length", func(t *testing.T) {
+		w := patchTus(srv, location, 0, []byte("more than ten bytes"))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("chunked upload endpoint", func(t *testing.T) {
+		uploadId := strings.TrimPrefix(location, TusBasePath)
+		w := putTestChunk(srv, uploadId, 0, []byte("0123456789"))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestTusTermination(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	location := createTusUpload(t, srv, 10, nil)
+	w := patchTus(srv, location, 0, []byte("01234"))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	req := tusRequest(http.MethodDelete, location, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	req = tusRequest(http.MethodHead, location, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	blobs, err := srv.store.List()
+	require.NoError(t, err)
+	assert.Empty(t, blobs)
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	options, err := parseTusMetadata("filename dGVzdC50eHQ=,only-eea,unknown dmFsdWU=")
+	require.NoError(t, err)
+	assert.Equal(t, "test.txt", options.Get("filename"))
+	assert.True(t, options.Has("only-eea"))
+	assert.False(t, options.Has("unknown"))
+
+	_, err = parseTusMetadata("filename not-base64!")
+	assert.Error(t, err)
+}
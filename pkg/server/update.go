@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+// FileUpdate holds the sharing constraints an owner can change after upload.
+// Unset fields are left as they are, the limits are those of the uploader.
+type FileUpdate struct {
+	Count            *uint   `form:"count"             binding:"omitempty,min=1,max=1000"`
+	Expiry           *uint   `form:"expiry"            binding:"omitempty,min=1,max=365"`
+	ExpiryHours      *uint   `form:"expiry-hours"      binding:"omitempty,min=1,max=8760"`
+	AllowedCountries *string `form:"allowed-countries" binding:"omitempty,max=2000"`
+	OnlyEEA          *bool   `form:"only-eea"`
+	IncludeOther     *bool   `form:"include-other"`
+	Delay            *uint   `form:"delay"             binding:"omitempty,max=1440"`
+	Approval         *bool   `form:"approval"`
+}
+
+// updateFile changes the sharing constraints of a file. Expiry and delay stay
+// relative to the upload time. The change is audited and mailed to the owner.
+func (s *Server) updateFile(c *gin.Context) {
+	fileId, err := bindFileID(c)
+	if err != nil {
+		return
+	}
+
+	var u FileUpdate
+	if err := c.ShouldBind(&u); err != nil {
+		// TODO: get FieldError and return relevant part only
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	var o OwnerToken
+	// files uploaded with an API key can be changed with the key alone
+	if err := c.ShouldBind(&o); err != nil && currentAPIKey(c) == nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if u.Expiry != nil && u.ExpiryHours != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "expiry and expiry-hours are exclusive")
+		return
+	}
+
+	var storedFile database.StoredFile
+	if err := s.db.Where(&database.StoredFile{FileId: fileId}).Find(&storedFile).Error; err != nil {
+		log.Printf("Failed to find file with id %s in database: %s\n", fileId, err)
+		apiError(c, http.StatusNotFound, ErrCodeFileNotFound, "file not found")
+		return
+	}
+
+	if !isOwner(c, &storedFile, o.OwnerToken) {
+		apiError(c, http.StatusUnauthorized, ErrCodeOwnerTokenMismatch, "owner token doesn't match")
+		return
+	}
+
+	limits, ok := s.uploaderLimits(c, storedFile.UserId)
+	if !ok {
+		return
+	}
+	if !checkLimits(c, limits, derefUint(u.Expiry), derefUint(u.ExpiryHours), derefUint(u.Count), ErrCodeInvalidRequest) {
+		return
+	}
+
+	if time.Now().After(storedFile.ExpiresAt()) {
+		apiError(c, http.StatusGone, ErrCodeFileExpired, "file expired")
+		return
+	}
+	if storedFile.ContentDeletedAt != nil {
+		apiError(c, http.StatusGone, ErrCodeFileGone, "file not found or download limit exceeded")
+		return
+	}
+
+	updated := storedFile
+	u.apply(&updated)
+	changes := fileChanges(&storedFile, &updated)
+	if len(changes) == 0 {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, "nothing to change")
+		return
+	}
+
+	err = s.db.Model(&storedFile).Updates(map[string]interface{}{
+		"count":             updated.Count,
+		"expiry":            updated.Expiry,
+		"expiry_hours":      updated.ExpiryHours,
+		"allowed_countries": updated.AllowedCountries,
+		"only_eea":          updated.OnlyEEA,
+		"include_other":     updated.IncludeOther,
+		"delay":             updated.Delay,
+		"approval":          updated.Approval,
+	}).Error
+	if err != nil {
+		log.Printf("Failed to update file with id %s: %s\n", fileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to update file")
+		return
+	}
+
+	detail := strings.Join(changes, ", ")
+	s.audit(database.AuditUpdate, fileId, s.clientInfo(c), detail)
+
+	if storedFile.Email != "" {
+		fields := &mailFields{FileID: fileId, Changes: detail}
+		if err := s.sendTemplateMail(s.config.Mail.SubjectUpdate, s.config.Mail.BodyUpdate, &storedFile, fields); err != nil {
+			log.Printf("Failed to send update mail for ID %s: %s\n", fileId, err)
+		}
+	}
+
+	status, err := s.ownedFileStatus(&storedFile)
+	if err != nil {
+		log.Printf("Failed to get status of file with id %s: %s\n", fileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// apply sets the given fields on the file, sanitized like on upload
+func (u *FileUpdate) apply(f *database.StoredFile) {
+	if u.Count != nil {
+		f.Count = *u.Count
+	}
+	if u.Expiry != nil {
+		f.Expiry = *u.Expiry
+		f.ExpiryHours = 0
+	}
+	if u.ExpiryHours != nil {
+		f.ExpiryHours = *u.ExpiryHours
+	}
+	if u.AllowedCountries != nil {
+		f.AllowedCountries = sanitizeCountries(*u.AllowedCountries)
+	}
+	if u.OnlyEEA != nil {
+		f.OnlyEEA = *u.OnlyEEA
+	}
+	if u.IncludeOther != nil {
+		f.IncludeOther = *u.IncludeOther
+	}
+	if u.Delay != nil {
+		f.Delay = *u.Delay
+	}
+	if u.Approval != nil {
+		f.Approval = *u.Approval
+	}
+
+	if f.AllowedCountries != "" {
+		f.OnlyEEA = false
+		f.IncludeOther = false
+	}
+}
+
+// fileChanges describes the differences in sharing constraints for the audit
+// log and notification
+func fileChanges(old, updated *database.StoredFile) []string {
+	var changes []string
+	change := func(name string, from, to interface{}) {
+		if from != to {
+			changes = append(changes, fmt.Sprintf("%s %v -> %v", name, from, to))
+		}
+	}
+
+	change("count", old.Count, updated.Count)
+	change("expiry", old.ExpiresAt().UTC().Format(time.RFC3339), updated.ExpiresAt().UTC().Format(time.RFC3339))
+	change("allowed countries", quoteEmpty(old.AllowedCountries), quoteEmpty(updated.AllowedCountries))
+	change("only EEA", old.OnlyEEA, updated.OnlyEEA)
+	change("include other", old.IncludeOther, updated.IncludeOther)
+	change("delay", fmt.Sprintf("%dm", old.Delay), fmt.Sprintf("%dm", updated.Delay))
+	change("approval", old.Approval, updated.Approval)
+
+	return changes
+}
+
+func quoteEmpty(s string) string {
+	if s == "" {
+		return `""`
+	}
+	return s
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+func patchFile(t *testing.T, srv *Server, fileId string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/v1/files/"+fileId, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestUpdateFile(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	fileId, ownerToken := uploadOwnedTestFile(t, srv, map[string]string{"expiry": "2", "only-eea": "true"})
+
+	w := patchFile(t, srv, fileId, url.Values{
+		"ownerToken":   {ownerToken},
+		"expiry-hours": {"120"},
+		"count":        {"4"},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var status FileStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(t, uint(4), status.Count)
+	assert.True(t, status.OnlyEEA)
+	assert.WithinDuration(t, time.Now().Add(120*time.Hour), status.ExpiryDate, time.Minute)
+
+	// restricting to countries drops the EEA restriction
+	w = patchFile(t, srv, fileId, url.Values{
+		"ownerToken":        {ownerToken},
+		"allowed-countries": {"de, at"},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	storedFile := getTestStoredFile(t, srv, fileId)
+	assert.Equal(t, "DE,AT", storedFile.AllowedCountries)
+	assert.False(t, storedFile.OnlyEEA)
+	assert.Equal(t, uint(120), storedFile.ExpiryHours)
+
+	// expiry in days replaces the hours
+	w = patchFile(t, srv, fileId, url.Values{
+		"ownerToken": {ownerToken},
+		"expiry":     {"1"},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, srv.db.Where("file_id = ?", fileId).First(&storedFile).Error)
+	assert.Equal(t, uint(1), storedFile.Expiry)
+	assert.Zero(t, storedFile.ExpiryHours)
+
+	var entries []database.AuditEntry
+	require.NoError(t, srv.db.Where("event = ?", database.AuditUpdate).Order("seq").Find(&entries).Error)
+	require.Len(t, entries, 3)
+	assert.Contains(t, entries[0].Detail, "count 1 -> 4")
+	assert.Contains(t, entries[1].Detail, `allowed countries "" -> DE,AT`)
+	assert.Contains(t, entries[1].Detail, "only EEA true -> false")
+	assert.Contains(t, entries[2].Detail, "expiry ")
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			fileId string
+			form   url.Values
+			status int
+			code   ErrorCode
+		}{
+			{"wrong owner token", fileId, url.Values{"ownerToken": {"wrongtoken"}, "count": {"2"}}, http.StatusUnauthorized, ErrCodeOwnerTokenMismatch},
+			{"missing owner token", fileId, url.Values{"count": {"2"}}, http.StatusBadRequest, ErrCodeInvalidRequest},
+			{"unknown file", "doesnotexist", url.Values{"ownerToken": {ownerToken}, "count": {"2"}}, http.StatusNotFound, ErrCodeFileNotFound},
+			{"count above limit", fileId, url.Values{"ownerToken": {ownerToken}, "count": {"16"}}, http.StatusBadRequest, ErrCodeInvalidRequest},
+			{"expiry above limit", fileId, url.Values{"ownerToken": {ownerToken}, "expiry": {"15"}}, http.StatusBadRequest, ErrCodeInvalidRequest},
+			{"both expiries", fileId, url.Values{"ownerToken": {ownerToken}, "expiry": {"2"}, "expiry-hours": {"2"}}, http.StatusBadRequest, ErrCodeInvalidRequest},
+			{"nothing changed", fileId, url.Values{"ownerToken": {ownerToken}, "count": {"4"}}, http.StatusBadRequest, ErrCodeInvalidRequest},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				w := patchFile(t, srv, tt.fileId, tt.form)
+				require.Equal(t, tt.status, w.Code, w.Body.String())
+				assert.Equal(t, string(tt.code), decodeError(t, w).Code)
+			})
+		}
+	})
+
+	t.Run("gone", func(t *testing.T) {
+		goneId, goneToken := uploadOwnedTestFile(t, srv, nil)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+goneId, nil)
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		// the last download removed the contents, more downloads can't help
+		w = patchFile(t, srv, goneId, url.Values{"ownerToken": {goneToken}, "count": {"3"}})
+		require.Equal(t, http.StatusGone, w.Code, w.Body.String())
+		assert.Equal(t, string(ErrCodeFileGone), decodeError(t, w).Code)
+	})
+
+	t.Run("mail", func(t *testing.T) {
+		srv.config.Mail.SubjectUpdate = "File settings changed: %s"
+		srv.config.Mail.BodyUpdate = "Changed {{.FileID}}: {{.Changes}}\n"
+		mails := captureMails(t)
+
+		mailId, mailToken := uploadOwnedTestFile(t, srv, map[string]string{"email": "owner@example.com"})
+		w := patchFile(t, srv, mailId, url.Values{"ownerToken": {mailToken}, "count": {"2"}})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		require.Len(t, mails(), 1)
+		assert.Equal(t, "owner@example.com", mails()[0].To)
+		assert.Contains(t, mails()[0].Body, "Changed "+mailId+": count 1 -> 2")
+	})
+}
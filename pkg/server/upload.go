@@ -0,0 +1,600 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	uuid "github.com/nu7hatch/gouuid"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+	"github.com/lixmal/gdprshare/pkg/storage"
+)
+
+const (
+	UploadIdLen = 20
+)
+
+type UploadId struct {
+	UploadId string `uri:"uploadId" binding:"required,printascii,min=3,max=64"`
+}
+
+type ChunkIndex struct {
+	UploadId
+	Index uint `uri:"index"`
+}
+
+type UploadSessionInfo struct {
+	UploadId  string    `json:"uploadId"`
+	Size      int64     `json:"size"`
+	ChunkSize int64     `json:"chunkSize"`
+	Received  int64     `json:"received"`
+	Chunks    []uint    `json:"chunks"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// createUpload starts a chunked upload. It takes the same form fields as
+// uploadFile, except for the file itself, plus the total size in bytes.
+func (s *Server) createUpload(c *gin.Context) {
+	var req struct {
+		Size int64 `form:"size" binding:"required,min=1"`
+	}
+	if err := c.ShouldBind(&req); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidUpload, err.Error())
+		return
+	}
+
+	session, ok := s.newUploadSession(c, c.Request.PostForm, req.Size, false)
+	if !ok {
+		return
+	}
+
+	c.Header("Location", "/api/v1/uploads/"+session.UploadId)
+	c.JSON(http.StatusCreated, uploadSessionInfo(session))
+}
+
+// newUploadSession validates the sharing options and creates a session for
+// an upload of size bytes, writing an error response on failure. tus sessions
+// take chunks of any size in order instead of fixed size chunks.
+func (s *Server) newUploadSession(c *gin.Context, options url.Values, size int64, tus bool) (*database.UploadSession, bool) {
+	if size > s.config.ResumableUpload.MaxSize*1024*1024 {
+		apiError(c, http.StatusRequestEntityTooLarge, ErrCodeUploadTooLarge, "upload exceeds maximum size")
+		return nil, false
+	}
+
+	// fail early, options are applied again on finalization
+	f := database.StoredFile{UserId: currentUserId(c)}
+	if err := bindFileOptions(options, &f); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidUpload, err.Error())
+		return nil, false
+	}
+	if !s.checkFileLimits(c, &f) {
+		return nil, false
+	}
+
+	// the session reserves the space until it is finalized or expires
+	if !s.checkQuota(c, currentUserId(c), currentAPIKeyId(c), size, false) {
+		return nil, false
+	}
+
+	name, err := uuid.NewV4()
+	if err != nil {
+		log.Printf("Failed to create uuid: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeTempFilename, "failed to generate temp filename")
+		return nil, false
+	}
+
+	uploadId, err := misc.GenToken(UploadIdLen)
+	if err != nil {
+		log.Printf("Failed to generate upload ID: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeFileIDFailed, "failed to generate upload ID")
+		return nil, false
+	}
+
+	session := database.UploadSession{
+		UploadId:  uploadId,
+		Name:      name.String(),
+		Options:   options.Encode(),
+		Size:      size,
+		Tus:       tus,
+		UserId:    currentUserId(c),
+		APIKeyId:  currentAPIKeyId(c),
+		ExpiresAt: time.Now().Add(time.Duration(s.config.ResumableUpload.SessionExpiry) * time.Hour),
+	}
+	if !tus {
+		session.ChunkSize = s.config.ResumableUpload.ChunkSize * 1024 * 1024
+	}
+	if err := s.db.Create(&session).Error; err != nil {
+		log.Printf("Failed to create upload session: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to create upload")
+		return nil, false
+	}
+
+	return &session, true
+}
+
+// bindFileOptions maps form encoded sharing options onto a StoredFile and
+// validates them, leaving out the file itself.
+func bindFileOptions(options url.Values, f *database.StoredFile) error {
+	if err := binding.MapFormWithTag(f, options, "form"); err != nil {
+		return err
+	}
+
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return errors.New("unsupported validator")
+	}
+	return v.StructExcept(f, "File")
+}
+
+func (s *Server) getUpload(c *gin.Context) {
+	var u UploadId
+	if err := c.ShouldBindUri(&u); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	session, err := s.getUploadSession(u.UploadId, c)
+	if err != nil {
+		log.Printf("Failed to retrieve upload with ID %s: %s\n", u.UploadId, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, uploadSessionInfo(session))
+}
+
+// putChunk stores one chunk of a chunked upload. Every chunk except the last
+// has exactly the session's chunk size. Sending a chunk again replaces it.
+func (s *Server) putChunk(c *gin.Context) {
+	var ci ChunkIndex
+	if err := c.ShouldBindUri(&ci); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidChunk, err.Error())
+		return
+	}
+
+	session, err := s.getUploadSession(ci.UploadId.UploadId, c)
+	if err != nil {
+		log.Printf("Failed to retrieve upload with ID %s: %s\n", ci.UploadId.UploadId, err)
+		return
+	}
+	if session.Tus {
+		apiError(c, http.StatusNotFound, ErrCodeUploadNotFound, "upload not found")
+		return
+	}
+	if session.Finalizing {
+		apiError(c, http.StatusConflict, ErrCodeUploadFinalizing, "upload is being finalized")
+		return
+	}
+
+	offset := int64(ci.Index) * session.ChunkSize
+	if offset >= session.Size {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidChunk, "chunk index out of range")
+		return
+	}
+	expected := min(session.ChunkSize, session.Size-offset)
+
+	if c.Request.ContentLength > expected {
+		apiError(c, http.StatusRequestEntityTooLarge, ErrCodeChunkTooLarge, "chunk too large")
+		return
+	}
+	if c.Request.ContentLength >= 0 && c.Request.ContentLength != expected {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidChunk, fmt.Sprintf("chunk %d must be %d bytes", ci.Index, expected))
+		return
+	}
+
+	if !s.replaceChunk(c, session, ci.Index, http.MaxBytesReader(c.Writer, c.Request.Body, expected), expected) {
+		return
+	}
+
+	session, err = s.getUploadSession(ci.UploadId.UploadId, c)
+	if err != nil {
+		log.Printf("Failed to retrieve upload with ID %s: %s\n", ci.UploadId.UploadId, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, uploadSessionInfo(session))
+}
+
+// ChunkClaimTimeout is how long a chunk being written blocks other requests
+// for its index. Older claims are left over from failed requests.
+const ChunkClaimTimeout = 15 * time.Minute
+
+// replaceChunk stores r as chunk index of the session, replacing an earlier
+// chunk with the same index. The index is claimed in the database before the
+// blob is written, so concurrent requests for it don't write the same blob.
+// The chunk must be exactly size bytes, unless size is negative.
+func (s *Server) replaceChunk(c *gin.Context, session *database.UploadSession, index uint, r io.Reader, size int64) bool {
+	chunk, ok := s.claimChunk(c, session, index)
+	if !ok {
+		return false
+	}
+
+	name := chunkName(session, index)
+	n, err := s.store.Put(name, r, size)
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("received %d of %d bytes", n, size)
+	}
+	if err != nil {
+		log.Printf("Failed to save chunk %d of upload %s: %s\n", index, session.UploadId, err)
+		s.releaseChunk(session, chunk)
+		var maxErr *http.MaxBytesError
+		switch {
+		case c.Writer.Status() == http.StatusRequestEntityTooLarge:
+			// request size limiter has already written the response
+		case errors.As(err, &maxErr):
+			apiError(c, http.StatusRequestEntityTooLarge, ErrCodeChunkTooLarge, "chunk too large")
+		case size >= 0 && n != size:
+			apiError(c, http.StatusBadRequest, ErrCodeInvalidChunk, "incomplete chunk")
+		default:
+			apiError(c, http.StatusInternalServerError, ErrCodeSaveFailed, "failed to save chunk")
+		}
+		return false
+	}
+
+	res := s.db.Model(&database.UploadChunk{}).
+		Where("id = ? AND pending = ?", chunk.ID, true).
+		Updates(map[string]interface{}{"size": n, "pending": false})
+	if res.Error != nil {
+		log.Printf("Failed to record chunk %d of upload %s: %s\n", index, session.UploadId, res.Error)
+		s.releaseChunk(session, chunk)
+		apiError(c, http.StatusInternalServerError, ErrCodeSaveFailed, "failed to save chunk")
+		return false
+	}
+	if res.RowsAffected == 0 {
+		// the claim timed out and was taken over, the blob is theirs now
+		apiError(c, http.StatusConflict, ErrCodeChunkInProgress, "chunk is being uploaded by another request")
+		return false
+	}
+
+	return true
+}
+
+// claimChunk records chunk index of the session as pending, replacing a
+// received chunk or a timed out claim and removing its blob. It writes an
+// error response if another request holds the index.
+func (s *Server) claimChunk(c *gin.Context, session *database.UploadSession, index uint) (*database.UploadChunk, bool) {
+	where := map[string]interface{}{"upload_session_id": session.ID, "index": index}
+
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		log.Printf("Failed to start transaction: %s\n", tx.Error)
+		apiError(c, http.StatusInternalServerError, ErrCodeTransactionStart, "failed to save chunk")
+		return nil, false
+	}
+
+	// finalizeUploadSession reads the chunks only after setting finalizing
+	res := tx.Model(&database.UploadSession{}).
+		Where("id = ? AND finalizing = ?", session.ID, false).
+		UpdateColumn("updated_at", time.Now())
+	if res.Error != nil || res.RowsAffected != 1 {
+		tx.Rollback()
+		if res.Error != nil {
+			log.Printf("Failed to lock upload %s: %s\n", session.UploadId, res.Error)
+		}
+		apiError(c, http.StatusConflict, ErrCodeUploadFinalizing, "upload is being finalized")
+		return nil, false
+	}
+
+	var existing database.UploadChunk
+	err := tx.Where(where).First(&existing).Error
+	if err != nil && !s.db.IsRecordNotFoundError(err) {
+		tx.Rollback()
+		log.Printf("Failed to find chunk %d of upload %s: %s\n", index, session.UploadId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeSaveFailed, "failed to save chunk")
+		return nil, false
+	}
+	replaced := err == nil
+	if replaced {
+		res := tx.Unscoped().
+			Where("id = ? AND (pending = ? OR updated_at < ?)", existing.ID, false, time.Now().Add(-ChunkClaimTimeout)).
+			Delete(&database.UploadChunk{})
+		if res.Error != nil || res.RowsAffected == 0 {
+			tx.Rollback()
+			if res.Error != nil {
+				log.Printf("Failed to replace chunk %d of upload %s: %s\n", index, session.UploadId, res.Error)
+			}
+			apiError(c, http.StatusConflict, ErrCodeChunkInProgress, "chunk is being uploaded by another request")
+			return nil, false
+		}
+	}
+
+	chunk := &database.UploadChunk{
+		UploadSessionId: session.ID,
+		Index:           index,
+		Pending:         true,
+	}
+	// a concurrent claim fails on the unique index
+	if err := tx.Create(chunk).Error; err != nil {
+		tx.Rollback()
+		log.Printf("Failed to claim chunk %d of upload %s: %s\n", index, session.UploadId, err)
+		apiError(c, http.StatusConflict, ErrCodeChunkInProgress, "chunk is being uploaded by another request")
+		return nil, false
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Failed to claim chunk %d of upload %s: %s\n", index, session.UploadId, err)
+		apiError(c, http.StatusConflict, ErrCodeChunkInProgress, "chunk is being uploaded by another request")
+		return nil, false
+	}
+
+	if replaced {
+		name := chunkName(session, index)
+		if err := s.store.Delete(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to replace chunk %d of upload %s: %s\n", index, session.UploadId, err)
+			s.releaseChunk(session, chunk)
+			apiError(c, http.StatusInternalServerError, ErrCodeSaveFailed, "failed to save chunk")
+			return nil, false
+		}
+	}
+
+	return chunk, true
+}
+
+// releaseChunk gives up a claim that wasn't completed, with whatever was
+// written of its blob
+func (s *Server) releaseChunk(session *database.UploadSession, chunk *database.UploadChunk) {
+	name := chunkName(session, chunk.Index)
+	if err := s.store.Delete(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Failed to remove incomplete chunk %s: %s\n", name, err)
+	}
+	if err := s.db.Unscoped().Delete(chunk).Error; err != nil {
+		log.Printf("Failed to release chunk %d of upload %s: %s\n", chunk.Index, session.UploadId, err)
+	}
+}
+
+// finalizeUpload assembles the received chunks into a StoredFile and responds
+// like uploadFile.
+func (s *Server) finalizeUpload(c *gin.Context) {
+	var u UploadId
+	if err := c.ShouldBindUri(&u); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	session, err := s.getUploadSession(u.UploadId, c)
+	if err != nil {
+		log.Printf("Failed to retrieve upload with ID %s: %s\n", u.UploadId, err)
+		return
+	}
+
+	if session.Tus {
+		apiError(c, http.StatusNotFound, ErrCodeUploadNotFound, "upload not found")
+		return
+	}
+
+	if storedFile, ok := s.finalizeUploadSession(c, session); ok {
+		respondUploaded(c, storedFile)
+	}
+}
+
+// finalizeUploadSession turns a complete session into a StoredFile, writing
+// an error response on failure. The session is removed on success.
+func (s *Server) finalizeUploadSession(c *gin.Context, session *database.UploadSession) (*database.StoredFile, bool) {
+	if received := receivedBytes(session); received != session.Size {
+		apiError(c, http.StatusConflict, ErrCodeUploadIncomplete, fmt.Sprintf("received %d of %d bytes", received, session.Size))
+		return nil, false
+	}
+
+	options, err := url.ParseQuery(session.Options)
+	if err != nil {
+		log.Printf("Failed to parse options of upload %s: %s\n", session.UploadId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to read upload options")
+		return nil, false
+	}
+
+	var storedFile database.StoredFile
+	if err := bindFileOptions(options, &storedFile); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidUpload, err.Error())
+		return nil, false
+	}
+	sanitizeStoredFile(&storedFile)
+	storedFile.UserId = session.UserId
+	storedFile.APIKeyId = session.APIKeyId
+
+	if !s.checkFileLimits(c, &storedFile) {
+		return nil, false
+	}
+	// files and uploads per day may have changed since the session started
+	if !s.checkQuota(c, session.UserId, session.APIKeyId, session.Size, true) {
+		return nil, false
+	}
+
+	// claim the session, so concurrent requests don't create the file twice
+	res := s.db.Model(&database.UploadSession{}).
+		Where("id = ? AND finalizing = ?", session.ID, false).
+		Update("finalizing", true)
+	if res.Error != nil || res.RowsAffected != 1 {
+		if res.Error != nil {
+			log.Printf("Failed to claim upload %s: %s\n", session.UploadId, res.Error)
+		}
+		apiError(c, http.StatusConflict, ErrCodeUploadFinalizing, "upload is being finalized")
+		return nil, false
+	}
+
+	// chunks claimed before the session was may have changed since
+	if err := s.db.Model(session).Related(&session.Chunks, "Chunks").Error; err != nil {
+		log.Printf("Failed to retrieve chunks of upload %s: %s\n", session.UploadId, err)
+		s.releaseUploadSession(session)
+		apiError(c, http.StatusInternalServerError, ErrCodeStoreFailed, "failed to read upload")
+		return nil, false
+	}
+	if len(session.ReceivedChunks()) != len(session.Chunks) {
+		s.releaseUploadSession(session)
+		apiError(c, http.StatusConflict, ErrCodeChunkInProgress, "chunk is being uploaded by another request")
+		return nil, false
+	}
+	if received := receivedBytes(session); received != session.Size {
+		s.releaseUploadSession(session)
+		apiError(c, http.StatusConflict, ErrCodeUploadIncomplete, fmt.Sprintf("received %d of %d bytes", received, session.Size))
+		return nil, false
+	}
+
+	r := newChunkReader(s.store, session)
+	ok := s.createStoredFile(c, &storedFile, r, session.Size)
+	r.Close()
+	if !ok {
+		s.releaseUploadSession(session)
+		return nil, false
+	}
+
+	for _, err := range s.deleteUploadSession(session) {
+		log.Printf("%s\n", err)
+	}
+
+	return &storedFile, true
+}
+
+// releaseUploadSession lets chunks be sent again after finalizing failed
+func (s *Server) releaseUploadSession(session *database.UploadSession) {
+	if err := s.db.Model(session).Update("finalizing", false).Error; err != nil {
+		log.Printf("Failed to release upload %s: %s\n", session.UploadId, err)
+	}
+}
+
+func (s *Server) deleteUpload(c *gin.Context) {
+	var u UploadId
+	if err := c.ShouldBindUri(&u); err != nil {
+		apiError(c, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	session, err := s.getUploadSession(u.UploadId, c)
+	if err != nil {
+		log.Printf("Failed to retrieve upload with ID %s: %s\n", u.UploadId, err)
+		return
+	}
+
+	if errs := s.deleteUploadSession(session); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("%s\n", err)
+		}
+		apiError(c, http.StatusInternalServerError, ErrCodeDeleteFailed, "upload deletion failed")
+		return
+	}
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"message": "upload deleted",
+		},
+	)
+}
+
+func (s *Server) deleteUploadSession(session *database.UploadSession) []error {
+	return misc.DeleteUploadSession(session, s.db, s.store)
+}
+
+// getUploadSession looks up an unexpired session with its chunks, writing an
+// error response if there is none.
+func (s *Server) getUploadSession(uploadId string, c *gin.Context) (*database.UploadSession, error) {
+	var session database.UploadSession
+
+	if err := s.db.Where(&database.UploadSession{UploadId: uploadId}).Preload("Chunks").Find(&session).Error; err != nil {
+		apiError(c, http.StatusNotFound, ErrCodeUploadNotFound, "upload not found")
+		return nil, fmt.Errorf("find upload in database: %w", err)
+	}
+
+	if time.Now().After(session.ExpiresAt) {
+		apiError(c, http.StatusNotFound, ErrCodeUploadNotFound, "upload not found")
+		return nil, errors.New("upload expired")
+	}
+
+	return &session, nil
+}
+
+func uploadSessionInfo(session *database.UploadSession) UploadSessionInfo {
+	received := session.ReceivedChunks()
+	chunks := make([]uint, 0, len(received))
+	for _, chunk := range received {
+		chunks = append(chunks, chunk.Index)
+	}
+
+	return UploadSessionInfo{
+		UploadId:  session.UploadId,
+		Size:      session.Size,
+		ChunkSize: session.ChunkSize,
+		Received:  receivedBytes(session),
+		Chunks:    chunks,
+		ExpiresAt: session.ExpiresAt,
+	}
+}
+
+func receivedBytes(session *database.UploadSession) int64 {
+	var received int64
+	for _, chunk := range session.ReceivedChunks() {
+		received += chunk.Size
+	}
+	return received
+}
+
+func chunkName(session *database.UploadSession, index uint) string {
+	return misc.ChunkName(session.Name, index)
+}
+
+// chunkReader reads the chunks of a session in order, opening one blob at a
+// time.
+type chunkReader struct {
+	store storage.Backend
+	names []string
+	cur   storage.Object
+}
+
+func newChunkReader(store storage.Backend, session *database.UploadSession) *chunkReader {
+	chunks := session.ReceivedChunks()
+	names := make([]string, len(chunks))
+	for _, chunk := range chunks {
+		if int(chunk.Index) < len(names) {
+			names[chunk.Index] = chunkName(session, chunk.Index)
+		}
+	}
+	return &chunkReader{store: store, names: names}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.names) == 0 {
+				return 0, io.EOF
+			}
+			if r.names[0] == "" {
+				return 0, errors.New("missing chunk")
+			}
+			obj, err := r.store.Open(r.names[0])
+			if err != nil {
+				return 0, fmt.Errorf("open chunk: %w", err)
+			}
+			r.cur = obj
+			r.names = r.names[1:]
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			if cerr := r.cur.Close(); cerr != nil {
+				log.Printf("Failed to close chunk: %s\n", cerr)
+			}
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() {
+	if r.cur != nil {
+		if err := r.cur.Close(); err != nil {
+			log.Printf("Failed to close chunk: %s\n", err)
+		}
+		r.cur = nil
+	}
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+)
+
+// setupChunkedServer creates a test server with 1 MiB chunks
+func setupChunkedServer(t *testing.T) (*Server, func()) {
+	t.Helper()
+
+	srv, cleanup := setupTestServer(t)
+	srv.config.ResumableUpload.MaxSize = 10
+	srv.config.ResumableUpload.ChunkSize = 1
+	srv.config.ResumableUpload.SessionExpiry = 1
+
+	return srv, cleanup
+}
+
+func createTestUpload(t *testing.T, srv *Server, size int, fields url.Values) UploadSessionInfo {
+	t.Helper()
+
+	if fields == nil {
+		fields = url.Values{}
+	}
+	fields.Set("size", fmt.Sprint(size))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/uploads", strings.NewReader(fields.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var info UploadSessionInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+
+	return info
+}
+
+func putTestChunk(srv *Server, uploadId string, index int, data []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(
+		http.MethodPut,
+		fmt.Sprintf("/api/v1/uploads/%s/chunks/%d", uploadId, index),
+		bytes.NewReader(data),
+	)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+// TestChunkedUploadFlow uploads a file in chunks, out of order and with one
+// chunk resent, and downloads it again
+func TestChunkedUploadFlow(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	chunkSize := 1 << 20
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*chunkSize+100)/16)
+	content = append(content, []byte("tail")...)
+
+	info := createTestUpload(t, srv, len(content), url.Values{
+		"filename": {"chunked.bin"},
+		"count":    {"2"},
+	})
+	assert.Equal(t, int64(chunkSize), info.ChunkSize)
+	assert.Equal(t, int64(len(content)), info.Size)
+
+	w := putTestChunk(srv, info.UploadId, 2, content[2*chunkSize:])
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = putTestChunk(srv, info.UploadId, 0, content[:chunkSize])
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	// resend replaces the earlier chunk
+	w = putTestChunk(srv, info.UploadId, 0, content[:chunkSize])
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// finalizing with a missing chunk fails
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/uploads/"+info.UploadId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, string(ErrCodeUploadIncomplete), decodeError(t, w).Code)
+
+	w = putTestChunk(srv, info.UploadId, 1, content[chunkSize:2*chunkSize])
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/uploads/"+info.UploadId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var status UploadSessionInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(t, int64(len(content)), status.Received)
+	assert.ElementsMatch(t, []uint{0, 1, 2}, status.Chunks)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/uploads/"+info.UploadId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var resp map[string]interface{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	fileId := resp["fileId"].(string)
+	require.NotEmpty(t, fileId)
+	require.NotEmpty(t, resp["ownerToken"])
+
+	// session and chunks are gone
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/uploads/"+info.UploadId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	blobs, err := srv.store.List()
+	require.NoError(t, err)
+	assert.Len(t, blobs, 1, "only the assembled file is left")
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	downloaded, err := io.ReadAll(w.Body)
+	require.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	assert.Equal(t, "chunked.bin", w.Header().Get("X-Filename"))
+
+	storedFile := getTestStoredFile(t, srv, fileId)
+	assert.Equal(t, uint(1), storedFile.Count, "options are applied on finalization")
+}
+
+func TestChunkedUploadRejects(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	t.Run("too large", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/uploads", strings.NewReader("size=20000000"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Equal(t, string(ErrCodeUploadTooLarge), decodeError(t, w).Code)
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/uploads", strings.NewReader("size=10&count=100"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, string(ErrCodeInvalidUpload), decodeError(t, w).Code)
+	})
+
+	info := createTestUpload(t, srv, 10, nil)
+
+	t.Run("wrong chunk size", func(t *testing.T) {
+		w := putTestChunk(srv, info.UploadId, 0, []byte("short"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, string(ErrCodeInvalidChunk), decodeError(t, w).Code)
+	})
+
+	t.Run("chunk too large", func(t *testing.T) {
+		w := putTestChunk(srv, info.UploadId, 0, []byte("more than ten bytes"))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Equal(t, string(ErrCodeChunkTooLarge), decodeError(t, w).Code)
+	})
+
+	t.Run("index out of range", func(t *testing.T) {
+		w := putTestChunk(srv, info.UploadId, 1, []byte("0123456789"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, string(ErrCodeInvalidChunk), decodeError(t, w).Code)
+	})
+
+	t.Run("unknown upload", func(t *testing.T) {
+		w := putTestChunk(srv, "doesnotexist", 0, []byte("0123456789"))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, string(ErrCodeUploadNotFound), decodeError(t, w).Code)
+	})
+}
+
+// TestConcurrentChunkUpload sends the same chunk index from several requests
+// at once and checks only one of them is recorded at a time
+func TestConcurrentChunkUpload(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	info := createTestUpload(t, srv, 10, nil)
+
+	codes := make([]int, 10)
+	errCodes := make([]string, 10)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := putTestChunk(srv, info.UploadId, 0, []byte(fmt.Sprintf("012345678%d", i)))
+			codes[i] = w.Code
+			if w.Code != http.StatusOK {
+				errCodes[i] = decodeError(t, w).Code
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Contains(t, codes, http.StatusOK)
+	for i, code := range codes {
+		if code != http.StatusOK {
+			assert.Equal(t, http.StatusConflict, code)
+			assert.Equal(t, string(ErrCodeChunkInProgress), errCodes[i])
+		}
+	}
+
+	var chunks []database.UploadChunk
+	require.NoError(t, srv.db.Unscoped().Find(&chunks).Error)
+	require.Len(t, chunks, 1)
+	assert.False(t, chunks[0].Pending)
+	assert.Equal(t, int64(10), chunks[0].Size)
+
+	blobs, err := srv.store.List()
+	require.NoError(t, err)
+	assert.Len(t, blobs, 1)
+
+	t.Run("pending claim", func(t *testing.T) {
+		info := createTestUpload(t, srv, 10, nil)
+		var session database.UploadSession
+		require.NoError(t, srv.db.Where("upload_id = ?", info.UploadId).First(&session).Error)
+		claim := database.UploadChunk{UploadSessionId: session.ID, Index: 0, Pending: true}
+		require.NoError(t, srv.db.Create(&claim).Error)
+
+		w := putTestChunk(srv, info.UploadId, 0, []byte("0123456789"))
+		require.Equal(t, http.StatusConflict, w.Code)
+		assert.Equal(t, string(ErrCodeChunkInProgress), decodeError(t, w).Code)
+
+		// a claim left over by a failed request is taken over
+		require.NoError(t, srv.db.Model(&claim).UpdateColumn("updated_at", time.Now().Add(-ChunkClaimTimeout-time.Minute)).Error)
+		w = putTestChunk(srv, info.UploadId, 0, []byte("0123456789"))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/uploads/"+info.UploadId, nil)
+		w = httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	})
+}
+
+// TestChunkDuringFinalize checks a chunk request that read the session before
+// it was finalized can't replace a chunk being assembled
+func TestChunkDuringFinalize(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	info := createTestUpload(t, srv, 10, nil)
+	require.Equal(t, http.StatusOK, putTestChunk(srv, info.UploadId, 0, []byte("0123456789")).Code)
+
+	stale := &database.UploadSession{}
+	require.NoError(t, srv.db.Where("upload_id = ?", info.UploadId).First(stale).Error)
+	require.NoError(t, srv.db.Model(stale).UpdateColumn("finalizing", true).Error)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	_, ok := srv.claimChunk(c, stale, 0)
+	require.False(t, ok)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, string(ErrCodeUploadFinalizing), decodeError(t, w).Code)
+
+	blobs, err := srv.store.List()
+	require.NoError(t, err)
+	assert.Len(t, blobs, 1, "the received chunk is kept")
+
+	t.Run("pending chunk", func(t *testing.T) {
+		require.NoError(t, srv.db.Model(stale).UpdateColumn("finalizing", false).Error)
+		require.NoError(t, srv.db.Model(&database.UploadChunk{}).
+			Where("upload_session_id = ?", stale.ID).
+			UpdateColumn("pending", true).Error)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/uploads/"+info.UploadId, nil)
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+		assert.Equal(t, string(ErrCodeUploadIncomplete), decodeError(t, w).Code)
+	})
+}
+
+// TestChunkedUploadExpiry verifies abandoned sessions are unreachable and
+// removed by the cleanup
+func TestChunkedUploadExpiry(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	info := createTestUpload(t, srv, 10, nil)
+	w := putTestChunk(srv, info.UploadId, 0, []byte("0123456789"))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	require.NoError(t, srv.db.Model(&database.UploadSession{}).
+		Where("upload_id = ?", info.UploadId).
+		Update("expires_at", time.Now().Add(-time.Minute)).Error)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/uploads/"+info.UploadId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	errs := misc.Cleanup(srv.db, srv.store, srv.config)
+	require.Empty(t, errs)
+
+	var count int
+	require.NoError(t, srv.db.Unscoped().Model(&database.UploadSession{}).Count(&count).Error)
+	assert.Equal(t, 0, count)
+	require.NoError(t, srv.db.Unscoped().Model(&database.UploadChunk{}).Count(&count).Error)
+	assert.Equal(t, 0, count)
+
+	blobs, err := srv.store.List()
+	require.NoError(t, err)
+	assert.Empty(t, blobs)
+}
+
+func TestDeleteUpload(t *testing.T) {
+	srv, cleanup := setupChunkedServer(t)
+	defer cleanup()
+
+	info := createTestUpload(t, srv, 10, nil)
+	w := putTestChunk(srv, info.UploadId, 0, []byte("0123456789"))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/uploads/"+info.UploadId, nil)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	blobs, err := srv.store.List()
+	require.NoError(t, err)
+	assert.Empty(t, blobs)
+}
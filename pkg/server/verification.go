@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+	"github.com/lixmal/gdprshare/pkg/misc"
+)
+
+const VerificationCodeLen = 6
+
+// codeLimitWindow is the period the per file limits of mailed and wrong codes
+// apply to
+const codeLimitWindow = time.Hour
+
+// codeParam returns the code a recipient retries a download with, either as
+// X-Verification-Code header or code query parameter.
+func codeParam(c *gin.Context) string {
+	if code := c.GetHeader("X-Verification-Code"); code != "" {
+		return code
+	}
+	return c.Query("code")
+}
+
+// useCode lets a download of a file bound to a recipient proceed if it comes
+// with a valid, unused code mailed to them. Without a code it mails one, a
+// wrong one is kept as denied download. Otherwise writes the response.
+func (s *Server) useCode(c *gin.Context, storedFile *database.StoredFile, client *database.DstClient) (*database.VerificationCode, bool) {
+	code := codeParam(c)
+	if code == "" {
+		s.sendCode(c, storedFile, client)
+		return nil, false
+	}
+
+	now := time.Now()
+
+	// bounds guessing, wrong codes count whichever code they were meant for
+	var failed uint
+	err := s.db.Model(&database.DeniedClient{}).
+		Where("stored_file_id = ? AND reason = ? AND created_at > ?", storedFile.ID, database.DenialCode, now.Add(-codeLimitWindow)).
+		Count(&failed).Error
+	if err != nil {
+		log.Printf("Failed to count wrong codes of file with id %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return nil, false
+	}
+	if failed >= s.config.Verification.MaxAttempts {
+		apiError(c, http.StatusTooManyRequests, ErrCodeCodeLimit, "too many wrong codes, try again later")
+		return nil, false
+	}
+
+	var vc database.VerificationCode
+	err = s.db.Where(
+		"stored_file_id = ? AND code = ? AND used_at IS NULL AND expires_at > ?",
+		storedFile.ID, code, now,
+	).First(&vc).Error
+	if err != nil {
+		if !s.db.IsRecordNotFoundError(err) {
+			log.Printf("Failed to find code of file with id %s: %s\n", storedFile.FileId, err)
+			apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+			return nil, false
+		}
+		s.saveDeniedClient(storedFile, client, database.DenialCode)
+		apiError(c, http.StatusForbidden, ErrCodeCodeInvalid, "code wrong, expired or already used")
+		return nil, false
+	}
+
+	// a code allows a single download
+	res := s.db.Model(&database.VerificationCode{}).
+		Where("id = ? AND used_at IS NULL", vc.ID).
+		Update("used_at", now)
+	if res.Error != nil {
+		log.Printf("Failed to use code of file with id %s: %s\n", storedFile.FileId, res.Error)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return nil, false
+	}
+	if res.RowsAffected == 0 {
+		apiError(c, http.StatusForbidden, ErrCodeCodeInvalid, "code wrong, expired or already used")
+		return nil, false
+	}
+
+	return &vc, true
+}
+
+// releaseCode makes a code usable again after the download it was used for
+// couldn't start
+func (s *Server) releaseCode(vc *database.VerificationCode) {
+	if err := s.db.Model(&database.VerificationCode{}).Where("id = ?", vc.ID).Update("used_at", gorm.Expr("NULL")).Error; err != nil {
+		log.Printf("Failed to release code %d: %s\n", vc.ID, err)
+	}
+}
+
+// sendCode mails a new code to the recipient of a file, unless the file had
+// too many codes mailed recently
+func (s *Server) sendCode(c *gin.Context, storedFile *database.StoredFile, client *database.DstClient) {
+	now := time.Now()
+
+	var sent uint
+	err := s.db.Model(&database.VerificationCode{}).
+		Where("stored_file_id = ? AND created_at > ?", storedFile.ID, now.Add(-codeLimitWindow)).
+		Count(&sent).Error
+	if err != nil {
+		log.Printf("Failed to count codes of file with id %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return
+	}
+	if sent >= s.config.Verification.MaxCodes {
+		apiError(c, http.StatusTooManyRequests, ErrCodeCodeLimit, "too many codes sent, try again later")
+		return
+	}
+
+	code, err := misc.GenCode(VerificationCodeLen)
+	if err != nil {
+		log.Printf("Failed to generate code: %s\n", err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return
+	}
+
+	lifetime := time.Duration(s.config.Verification.Lifetime) * time.Minute
+	vc := &database.VerificationCode{
+		StoredFileId: storedFile.ID,
+		Code:         code,
+		ExpiresAt:    now.Add(lifetime),
+	}
+	// counts towards the limit even if the mail fails, so a broken mail
+	// server isn't hammered
+	if err := s.db.Create(vc).Error; err != nil {
+		log.Printf("Failed to save code of file with id %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "file retrieval error")
+		return
+	}
+
+	body, err := renderMailBody(s.config.Mail.BodyCode, &mailFields{
+		FileID:   storedFile.FileId,
+		Code:     code,
+		Lifetime: s.config.Verification.Lifetime,
+	})
+	if err != nil {
+		log.Printf("Failed to render code mail for ID %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "failed to send code")
+		return
+	}
+	if err := s.deliverMail(storedFile.RecipientEmail, fmt.Sprintf(s.config.Mail.SubjectCode, storedFile.FileId), body); err != nil {
+		log.Printf("Failed to send code mail for ID %s: %s\n", storedFile.FileId, err)
+		apiError(c, http.StatusInternalServerError, ErrCodeRetrievalFailed, "failed to send code")
+		return
+	}
+	s.audit(database.AuditCode, storedFile.FileId, (*database.Client)(client), "sent")
+
+	apiError(c, http.StatusUnauthorized, ErrCodeCodeRequired, "code sent to the recipient's email address")
+}
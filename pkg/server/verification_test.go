@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gomail.v2"
+
+	"github.com/lixmal/gdprshare/pkg/database"
+)
+
+type sentMail struct {
+	To   string
+	Body string
+}
+
+// captureMails replaces the SMTP server for the test and returns the mails
+// sent so far on each call
+func captureMails(t *testing.T) func() []sentMail {
+	t.Helper()
+
+	var mu sync.Mutex
+	var mails []sentMail
+
+	orig := dialAndSend
+	t.Cleanup(func() { dialAndSend = orig })
+	dialAndSend = func(_ *gomail.Dialer, msg *gomail.Message) error {
+		var raw bytes.Buffer
+		if _, err := msg.WriteTo(&raw); err != nil {
+			return err
+		}
+		parsed, err := mail.ReadMessage(&raw)
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		mails = append(mails, sentMail{To: msg.GetHeader("To")[0], Body: string(body)})
+		return nil
+	}
+
+	return func() []sentMail {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]sentMail(nil), mails...)
+	}
+}
+
+var mailedCode = regexp.MustCompile(`code to download file \S+ is (\d+)`)
+
+// lastCode returns the code of the latest mail
+func lastCode(t *testing.T, mails []sentMail) string {
+	t.Helper()
+
+	require.NotEmpty(t, mails)
+	m := mailedCode.FindStringSubmatch(mails[len(mails)-1].Body)
+	require.NotNil(t, m, "no code in mail: %s", mails[len(mails)-1].Body)
+	return m[1]
+}
+
+func downloadWithCode(t *testing.T, srv *Server, fileId, code string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/files/"+fileId, nil)
+	for name := range header {
+		req.Header.Set(name, header.Get(name))
+	}
+	if code != "" {
+		req.Header.Set("X-Verification-Code", code)
+	}
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestVerificationCode(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+	srv.config.Mail.SubjectCode = "Download code for file %s"
+	srv.config.Mail.BodyCode = "Your code to download file {{.FileID}} is {{.Code}}. It is valid for {{.Lifetime}} minutes.\n"
+	srv.config.Verification.Lifetime = 10
+	srv.config.Verification.MaxCodes = 3
+	srv.config.Verification.MaxAttempts = 3
+	mails := captureMails(t)
+
+	fileId := uploadTestFile(t, srv, map[string]string{"recipient-email": "recipient@example.com", "count": "2"})
+
+	w := downloadWithCode(t, srv, fileId, "", nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+	assert.Equal(t, string(ErrCodeCodeRequired), decodeError(t, w).Code)
+
+	require.Len(t, mails(), 1)
+	assert.Equal(t, "recipient@example.com", mails()[0].To)
+	code := lastCode(t, mails())
+	assert.Len(t, code, VerificationCodeLen)
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	w = downloadWithCode(t, srv, fileId, wrong, nil)
+	require.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	assert.Equal(t, string(ErrCodeCodeInvalid), decodeError(t, w).Code)
+
+	w = downloadWithCode(t, srv, fileId, code, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "test content", w.Body.String())
+
+	// a code is good for one download
+	w = downloadWithCode(t, srv, fileId, code, nil)
+	require.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+
+	var denied []database.DeniedClient
+	require.NoError(t, srv.db.Where("reason = ?", database.DenialCode).Find(&denied).Error)
+	assert.Len(t, denied, 2)
+	assert.Contains(t, auditEvents(t, srv), database.AuditCode)
+
+	// guessing stops after the allowed wrong codes, even with the right one
+	w = downloadWithCode(t, srv, fileId, wrong, nil)
+	require.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+
+	w = downloadWithCode(t, srv, fileId, "", nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+	w = downloadWithCode(t, srv, fileId, lastCode(t, mails()), nil)
+	require.Equal(t, http.StatusTooManyRequests, w.Code, w.Body.String())
+	assert.Equal(t, string(ErrCodeCodeLimit), decodeError(t, w).Code)
+
+	t.Run("mail limit", func(t *testing.T) {
+		limitedId := uploadTestFile(t, srv, map[string]string{"recipient-email": "recipient@example.com"})
+
+		for i := 0; i < 3; i++ {
+			w := downloadWithCode(t, srv, limitedId, "", nil)
+			require.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+		}
+		sent := len(mails())
+
+		w := downloadWithCode(t, srv, limitedId, "", nil)
+		require.Equal(t, http.StatusTooManyRequests, w.Code, w.Body.String())
+		assert.Equal(t, string(ErrCodeCodeLimit), decodeError(t, w).Code)
+		assert.Len(t, mails(), sent)
+
+		// earlier codes stay valid
+		w = downloadWithCode(t, srv, limitedId, lastCode(t, mails()), nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("with approval", func(t *testing.T) {
+		srv.config.SaveClientInfo = true
+		defer func() { srv.config.SaveClientInfo = false }()
+
+		approvalId, ownerToken := uploadOwnedTestFile(t, srv, map[string]string{"recipient-email": "recipient@example.com", "approval": "true"})
+
+		requestId := pendingRequestId(t, downloadWithCode(t, srv, approvalId, "", nil))
+		w := decide(t, srv, approvalId, requestId, url.Values{"decision": {"approve"}, "ownerToken": {ownerToken}})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		// the code is asked for once approved, the approval stays usable
+		header := http.Header{"X-Approval-Request": {requestId}}
+		w = downloadWithCode(t, srv, approvalId, "", header)
+		require.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+
+		w = downloadWithCode(t, srv, approvalId, lastCode(t, mails()), header)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Free returns the bytes available to unprivileged users on the filesystem
+// of the directory.
+func (l *Local) Free() (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(l.dir, &st); err != nil {
+		return 0, fmt.Errorf("statfs %s: %w", l.dir, err)
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Local stores blobs as plain files in a single directory.
+type Local struct {
+	dir string
+}
+
+// NewLocal creates a local directory backend rooted at dir.
+func NewLocal(dir string) *Local {
+	return &Local{dir: dir}
+}
+
+func newLocalDir(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create file store path: %w", err)
+	}
+	return NewLocal(dir), nil
+}
+
+// Path returns the filesystem path of the blob with the given name.
+func (l *Local) Path(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid blob name %q", name)
+	}
+	return filepath.Join(l.dir, name), nil
+}
+
+func (l *Local) Put(name string, r io.Reader, _ int64) (int64, error) {
+	path, err := l.Path(name)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("create %s: %w", name, err)
+	}
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	} else if cerr := f.Close(); cerr != nil {
+		log.Printf("Failed to close %s: %s\n", path, cerr)
+	}
+
+	if err != nil {
+		if rerr := os.Remove(path); rerr != nil {
+			log.Printf("Failed to remove partial file %s: %s\n", path, rerr)
+		}
+		return n, fmt.Errorf("write %s: %w", name, err)
+	}
+
+	return n, nil
+}
+
+func (l *Local) Open(name string) (Object, error) {
+	path, err := l.Path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (l *Local) Stat(name string) (*Info, error) {
+	path, err := l.Path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory: %w", name, fs.ErrNotExist)
+	}
+
+	return &Info{
+		Name:    name,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+func (l *Local) Delete(name string) error {
+	path, err := l.Path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (l *Local) List() ([]*Info, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, fmt.Errorf("read store path: %w", err)
+	}
+
+	var infos []*Info
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			// removed in the meantime
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("stat %s: %w", e.Name(), err)
+		}
+
+		infos = append(infos, &Info{
+			Name:    e.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return infos, nil
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalRoundTrip(t *testing.T) {
+	store := NewLocal(t.TempDir())
+
+	content := []byte("encrypted content")
+	n, err := store.Put("blob", bytes.NewReader(content), int64(len(content)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+
+	info, err := store.Stat("blob")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+
+	obj, err := store.Open("blob")
+	require.NoError(t, err)
+	data, err := io.ReadAll(obj)
+	require.NoError(t, err)
+	require.NoError(t, obj.Close())
+	assert.Equal(t, content, data)
+
+	infos, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "blob", infos[0].Name)
+
+	require.NoError(t, store.Delete("blob"))
+
+	_, err = store.Stat("blob")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "stat after delete: %v", err)
+}
+
+func TestLocalRejectsPathNames(t *testing.T) {
+	store := NewLocal(t.TempDir())
+
+	for _, name := range []string{"", ".", "..", "../escape", "sub/blob"} {
+		_, err := store.Put(name, bytes.NewReader(nil), 0)
+		assert.Error(t, err, "name %q", name)
+	}
+}
+
+func TestLocalPutDoesNotOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocal(dir)
+
+	_, err := store.Put("blob", bytes.NewReader([]byte("first")), 5)
+	require.NoError(t, err)
+
+	_, err = store.Put("blob", bytes.NewReader([]byte("second")), 6)
+	assert.Error(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "blob"))
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+}
+
+func TestLocalStatDirectory(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0700))
+
+	_, err := NewLocal(dir).Stat("sub")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "stat directory: %v", err)
+}
+
+func TestLocalShred(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocal(dir)
+
+	_, err := store.Put("blob", bytes.NewReader([]byte("secret content")), 14)
+	require.NoError(t, err)
+
+	method, err := Remove(store, "blob", 3)
+	require.NoError(t, err)
+	assert.Equal(t, "shred:3", method)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "no renamed leftovers")
+
+	assert.True(t, IsShredLeftover(".0123456789abcdef0123456789abcdef"))
+	assert.False(t, IsShredLeftover(".gitignore"))
+	assert.False(t, IsShredLeftover("0123456789abcdef0123456789abcdef0"))
+}
+
+func TestRemoveWithoutShredding(t *testing.T) {
+	store := NewLocal(t.TempDir())
+
+	_, err := store.Put("blob", bytes.NewReader([]byte("content")), 7)
+	require.NoError(t, err)
+
+	method, err := Remove(store, "blob", 0)
+	require.NoError(t, err)
+	assert.Equal(t, MethodDelete, method)
+
+	_, err = Remove(store, "blob", 0)
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "remove missing blob: %v", err)
+}
@@ -0,0 +1,577 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BackendS3 = "s3"
+
+	// s3PartSize is the part size of multipart uploads, used when the content
+	// length is unknown or too large for a single PUT. At most one part is
+	// held in memory per upload.
+	s3PartSize = 16 << 20 // 16M
+	// s3MaxPutSize is the largest object S3 accepts in a single PUT.
+	s3MaxPutSize = 5 << 30 // 5G
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	amzDateFormat   = "20060102T150405Z"
+)
+
+// S3Config holds the connection settings of an S3 compatible object store.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// VirtualHostStyle addresses the bucket as subdomain of the endpoint
+	// instead of as first path element.
+	VirtualHostStyle bool
+}
+
+// S3 stores blobs as objects in an S3 compatible bucket (AWS S3, MinIO, Ceph RGW).
+// Requests are signed with AWS signature version 4.
+type S3 struct {
+	endpoint *url.URL
+	conf     S3Config
+	client   *http.Client
+	partSize int
+	now      func() time.Time
+}
+
+// NewS3 creates an S3 backend from the given settings.
+func NewS3(conf S3Config) (*S3, error) {
+	if conf.Endpoint == "" {
+		return nil, errors.New("s3 endpoint not set")
+	}
+	if conf.Bucket == "" {
+		return nil, errors.New("s3 bucket not set")
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse s3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("s3 endpoint %s: scheme must be http or https", conf.Endpoint)
+	}
+
+	return &S3{
+		endpoint: endpoint,
+		conf:     conf,
+		client:   &http.Client{},
+		partSize: s3PartSize,
+		now:      time.Now,
+	}, nil
+}
+
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.Status)
+	}
+	return fmt.Sprintf("s3: status %d: %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Unwrap maps missing objects to fs.ErrNotExist.
+func (e *s3Error) Unwrap() error {
+	if e.Status == http.StatusNotFound || e.Code == "NoSuchKey" {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+func (s *S3) key(name string) (string, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid blob name %q", name)
+	}
+	return s.conf.Prefix + name, nil
+}
+
+func (s *S3) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+
+	if !s.conf.VirtualHostStyle {
+		u.Path = base + "/" + s.conf.Bucket + "/" + key
+	} else {
+		u.Host = s.conf.Bucket + "." + u.Host
+		u.Path = base + "/" + key
+	}
+	// send the path exactly as it is signed
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return &u
+}
+
+// do signs and sends a request, returning the response if its status is 2xx.
+func (s *S3) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := s.url(key, query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	if body != nil && size >= 0 {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	s.sign(req, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, key, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer closeBody(resp.Body)
+
+		serr := &s3Error{Status: resp.StatusCode}
+		if method != http.MethodHead {
+			data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+			_ = xml.Unmarshal(data, serr)
+		}
+		return nil, fmt.Errorf("%s %s: %w", method, key, serr)
+	}
+
+	return resp, nil
+}
+
+// sign adds the AWS signature version 4 headers to req. The payload is not
+// part of the signature, so bodies can be streamed.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(amzDateFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" || lk == "content-type" || lk == "content-md5" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := date + "/" + s.conf.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.conf.SecretKey), date)
+	key = hmacSHA256(key, s.conf.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set(
+		"Authorization",
+		"AWS4-HMAC-SHA256 Credential="+s.conf.AccessKey+"/"+scope+
+			", SignedHeaders="+signedHeaders+
+			", Signature="+signature,
+	)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode encodes s as required by signature version 4.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func closeBody(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, body)
+	if err := body.Close(); err != nil {
+		log.Printf("Failed to close s3 response body: %s\n", err)
+	}
+}
+
+func (s *S3) Put(name string, r io.Reader, size int64) (int64, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if size < 0 || size > s3MaxPutSize {
+		return s.putMultipart(key, r)
+	}
+
+	counter := &countingReader{r: io.LimitReader(r, size)}
+	resp, err := s.do(http.MethodPut, key, nil, nil, counter, size)
+	if err != nil {
+		return counter.n, err
+	}
+	closeBody(resp.Body)
+
+	return counter.n, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *S3) putMultipart(key string, r io.Reader) (int64, error) {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return 0, fmt.Errorf("create multipart upload: %w", err)
+	}
+
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	closeBody(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("decode multipart upload: %w", err)
+	}
+
+	written, err := s.uploadParts(key, initiated.UploadId, r)
+	if err != nil {
+		abort := url.Values{"uploadId": {initiated.UploadId}}
+		if resp, aerr := s.do(http.MethodDelete, key, abort, nil, nil, 0); aerr != nil {
+			log.Printf("Failed to abort multipart upload of %s: %s\n", key, aerr)
+		} else {
+			closeBody(resp.Body)
+		}
+		return written, err
+	}
+
+	return written, nil
+}
+
+func (s *S3) uploadParts(key, uploadId string, r io.Reader) (int64, error) {
+	var written int64
+	var parts []completedPart
+	buf := make([]byte, s.partSize)
+
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && number > 1 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return written, fmt.Errorf("read part %d: %w", number, err)
+		}
+
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {uploadId},
+		}
+		resp, perr := s.do(http.MethodPut, key, query, nil, bytes.NewReader(buf[:n]), int64(n))
+		if perr != nil {
+			return written, fmt.Errorf("upload part %d: %w", number, perr)
+		}
+		etag := resp.Header.Get("ETag")
+		closeBody(resp.Body)
+
+		written += int64(n)
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+
+		if err != nil {
+			// short read: this was the last part
+			break
+		}
+	}
+
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return written, fmt.Errorf("encode multipart completion: %w", err)
+	}
+
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadId}}, nil, bytes.NewReader(complete), int64(len(complete)))
+	if err != nil {
+		return written, fmt.Errorf("complete multipart upload: %w", err)
+	}
+
+	// errors after the 200 status line are reported in the body
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	closeBody(resp.Body)
+	var serr s3Error
+	if xml.Unmarshal(data, &serr) == nil && serr.Code != "" {
+		serr.Status = resp.StatusCode
+		return written, fmt.Errorf("complete multipart upload: %w", &serr)
+	}
+
+	return written, nil
+}
+
+func (s *S3) Open(name string) (Object, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Object{s3: s, key: key, size: info.Size}, nil
+}
+
+func (s *S3) Stat(name string) (*Info, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	closeBody(resp.Body)
+
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		modTime = time.Time{}
+	}
+
+	return &Info{
+		Name:    name,
+		Size:    resp.ContentLength,
+		ModTime: modTime,
+	}, nil
+}
+
+func (s *S3) Delete(name string) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	closeBody(resp.Body)
+
+	return nil
+}
+
+func (s *S3) List() ([]*Info, error) {
+	var infos []*Info
+	var token string
+
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if s.conf.Prefix != "" {
+			query.Set("prefix", s.conf.Prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, fmt.Errorf("list objects: %w", err)
+		}
+
+		var result struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		closeBody(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("decode object list: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, s.conf.Prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			infos = append(infos, &Info{
+				Name:    name,
+				Size:    obj.Size,
+				ModTime: obj.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return infos, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// s3Object reads an object lazily with ranged GET requests, so seeking
+// doesn't transfer anything until the next read.
+type s3Object struct {
+	s3   *S3
+	key  string
+	size int64
+	off  int64
+	body io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.off)}}
+		resp, err := o.s3.do(http.MethodGet, o.key, nil, header, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	if err == io.EOF && o.off < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var off int64
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = o.off + offset
+	case io.SeekEnd:
+		off = o.size + offset
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if off < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+
+	if off != o.off && o.body != nil {
+		// don't drain, the rest of the object may be large
+		if err := o.body.Close(); err != nil {
+			log.Printf("Failed to close s3 response body: %s\n", err)
+		}
+		o.body = nil
+	}
+	o.off = off
+
+	return off, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// MethodDelete is recorded for blobs that were removed without overwriting.
+	MethodDelete = "delete"
+	// MethodShred is recorded, together with the number of passes, for blobs
+	// that were overwritten before removal.
+	MethodShred = "shred"
+	// MethodMissing is recorded for blobs that were gone before their
+	// deletion, found by the admin tools.
+	MethodMissing = "missing"
+)
+
+// shredNameLen is the number of random bytes in the hex name Shred renames
+// blobs to before unlinking them
+const shredNameLen = 16
+
+// Shredder is implemented by backends that can overwrite a blob before removing it.
+type Shredder interface {
+	// Shred overwrites the blob passes times with random data and removes it.
+	Shred(name string, passes int) error
+}
+
+// Remove deletes a blob, shredding it first if passes is positive and the
+// backend supports it. It returns the deletion method used, suitable for
+// accountability records.
+func Remove(b Backend, name string, passes int) (string, error) {
+	if shredder, ok := b.(Shredder); ok && passes > 0 {
+		if err := shredder.Shred(name, passes); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s:%d", MethodShred, passes), nil
+	}
+
+	if err := b.Delete(name); err != nil {
+		return "", err
+	}
+	return MethodDelete, nil
+}
+
+// Shred overwrites the file passes times with random data, syncing after each
+// pass, truncates it, renames it to a random name to scrub the directory entry
+// and finally unlinks it.
+func (l *Local) Shred(name string, passes int) error {
+	path, err := l.Path(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := overwrite(f, passes); err != nil {
+		if cerr := f.Close(); cerr != nil {
+			log.Printf("Failed to close %s: %s\n", path, cerr)
+		}
+		return fmt.Errorf("shred %s: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", name, err)
+	}
+
+	random := make([]byte, shredNameLen)
+	if _, err := rand.Read(random); err != nil {
+		return fmt.Errorf("generate random name: %w", err)
+	}
+	renamed := filepath.Join(l.dir, "."+hex.EncodeToString(random))
+	if err := os.Rename(path, renamed); err != nil {
+		return fmt.Errorf("rename %s: %w", name, err)
+	}
+	syncDir(l.dir)
+
+	if err := os.Remove(renamed); err != nil {
+		return fmt.Errorf("remove %s: %w", name, err)
+	}
+	syncDir(l.dir)
+
+	return nil
+}
+
+// IsShredLeftover reports whether name is the random name Shred renames a
+// blob to. Such a blob is left behind, emptied, if Shred is interrupted before
+// unlinking it.
+func IsShredLeftover(name string) bool {
+	if len(name) != 1+2*shredNameLen || name[0] != '.' {
+		return false
+	}
+	_, err := hex.DecodeString(name[1:])
+	return err == nil
+}
+
+func overwrite(f *os.File, passes int) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	for pass := 0; pass < passes; pass++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(f, rand.Reader, size); err != nil {
+			return fmt.Errorf("pass %d: %w", pass+1, err)
+		}
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("sync pass %d: %w", pass+1, err)
+		}
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	return f.Sync()
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		log.Printf("Failed to open %s for sync: %s\n", dir, err)
+		return
+	}
+	if err := d.Sync(); err != nil {
+		log.Printf("Failed to sync %s: %s\n", dir, err)
+	}
+	if err := d.Close(); err != nil {
+		log.Printf("Failed to close %s: %s\n", dir, err)
+	}
+}
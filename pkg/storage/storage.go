@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lixmal/gdprshare/pkg/config"
+)
+
+const (
+	BackendLocal = "local"
+)
+
+// Info describes a stored blob.
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Object is an opened blob. It is seekable so it can be served with range support.
+type Object interface {
+	io.ReadSeekCloser
+}
+
+// Backend stores the encrypted blobs referenced by StoredFile.Name.
+// Implementations must return errors wrapping fs.ErrNotExist for missing blobs.
+type Backend interface {
+	// Put stores the content of r under name. size is the content length if known, or -1.
+	// It returns the number of bytes written.
+	Put(name string, r io.Reader, size int64) (int64, error)
+	// Open opens the blob with the given name for reading.
+	Open(name string) (Object, error)
+	// Stat returns information about the blob with the given name.
+	Stat(name string) (*Info, error)
+	// Delete removes the blob with the given name.
+	Delete(name string) error
+	// List returns information about all stored blobs.
+	List() ([]*Info, error)
+}
+
+// FreeSpacer is implemented by backends that know how much space is left.
+type FreeSpacer interface {
+	// Free returns the bytes available for new blobs.
+	Free() (int64, error)
+}
+
+// New creates the storage backend selected in the configuration.
+func New(conf *config.Config) (Backend, error) {
+	switch conf.Storage.Backend {
+	case BackendLocal, "":
+		return newLocalDir(conf.StorePath)
+	case BackendS3:
+		s3 := conf.Storage.S3
+		return NewS3(S3Config{
+			Endpoint:         s3.Endpoint,
+			Region:           s3.Region,
+			Bucket:           s3.Bucket,
+			Prefix:           s3.Prefix,
+			AccessKey:        s3.AccessKey,
+			SecretKey:        s3.SecretKey,
+			VirtualHostStyle: s3.VirtualHostStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", conf.Storage.Backend)
+	}
+}
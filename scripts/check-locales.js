@@ -21,6 +21,7 @@ const sharedWithEnglish = {
     'download.title': ['de', 'it', 'pt-BR'],
     'download.submit': ['nl'],
     'download.password': ['it'],
+    'requestUpload.file': ['it'],
     'alert.errorLabel': ['es'],
 }
 
@@ -0,0 +1,130 @@
+import React from 'react'
+import { Link } from 'react-router-dom'
+import Classnames from 'classnames'
+import Alert from './Alert'
+import Success from './Success'
+
+// Opened from the approval mail. The decision token is in the fragment, so it
+// never shows up in server or proxy logs.
+export default class Approve extends React.Component {
+    constructor() {
+        super()
+        this.handleDecision = this.handleDecision.bind(this)
+
+        this.state = {
+            error: null,
+            mask: false,
+            approval: null,
+        }
+    }
+
+    async componentDidMount() {
+        const parts = window.location.pathname.split('/')
+        this.requestId = parts.pop()
+        this.fileId = parts.pop()
+        this.token = window.location.hash.substring(1)
+        this.url = gdprshare.config.apiUrl + '/' + this.fileId + '/approvals/' + this.requestId
+
+        try {
+            const response = await window.fetch(this.url, {
+                headers: {
+                    'X-Decision-Token': this.token,
+                },
+            })
+            const fetchData = await response.json()
+            if (!response.ok)
+                return gdprshare.displayErr.call(this, fetchData.message)
+
+            this.setState({ approval: fetchData })
+        } catch (error) {
+            gdprshare.displayErr.call(this, error)
+        }
+    }
+
+    async handleDecision(event) {
+        event.preventDefault()
+
+        var formData = new FormData()
+        formData.append('decision', event.currentTarget.value)
+        formData.append('token', this.token)
+
+        this.setState({
+            error: null,
+            mask: true,
+        })
+
+        try {
+            const response = await window.fetch(this.url, {
+                method: 'POST',
+                body: formData,
+            })
+            const fetchData = await response.json()
+            if (!response.ok)
+                return gdprshare.displayErr.call(this, fetchData.message)
+
+            this.setState({
+                approval: fetchData,
+                mask: false,
+            })
+        } catch (error) {
+            gdprshare.displayErr.call(this, error)
+        }
+    }
+
+    render() {
+        const approval = this.state.approval
+
+        var details = null
+        if (approval) {
+            const location = [approval.city, approval.country].filter(Boolean).join(', ')
+            details = (
+                <dl className="row">
+                    <dt className="col-sm-4">Requested</dt>
+                    <dd className="col-sm-8">{new Date(approval.time).toLocaleString()}</dd>
+                    <dt className="col-sm-4">Address</dt>
+                    <dd className="col-sm-8">{approval.addr || '<none>'}</dd>
+                    <dt className="col-sm-4">Location</dt>
+                    <dd className="col-sm-8">{location || '<unknown>'}</dd>
+                    <dt className="col-sm-4">TLS</dt>
+                    <dd className="col-sm-8">{[approval.tlsVersion, approval.tlsCipherSuite].filter(Boolean).join(' ') || '<none>'}</dd>
+                    <dt className="col-sm-4">User agent</dt>
+                    <dd className="col-sm-8">{approval.userAgent || '<none>'}</dd>
+                </dl>
+            )
+        }
+
+        return (
+            <div className="container-fluid col-sm-4">
+                <div className={Classnames({ 'app-outer': true, 'loading-mask': this.state.mask })}>
+                    <h4 className="text-center">Download request</h4>
+                    {details}
+
+                    {approval && approval.state === 'pending' && (
+                        <div className="text-center col-sm-12">
+                            <button className="btn btn-primary me-2" id="approve" value="approve"
+                                    onClick={this.handleDecision}>
+                                Approve
+                            </button>
+                            <button className="btn btn-danger" id="deny" value="deny"
+                                    onClick={this.handleDecision}>
+                                Deny
+                            </button>
+                        </div>
+                    )}
+                    {approval && approval.state === 'approved' && (
+                        <Success message="The download was approved." />
+                    )}
+                    {approval && approval.state === 'denied' && (
+                        <Alert error="The download was denied." />
+                    )}
+                    <Alert error={this.state.error} />
+
+                    <br />
+                    <div className="text-center col-sm-12">
+                        <Link to="/">Upload a file</Link>
+                    </div>
+                </div>
+            </div>
+        )
+    }
+}
@@ -16,6 +16,8 @@ export class Download extends React.Component {
         this.handleViewImage = this.handleViewImage.bind(this)
         this.handleImageZoom = this.handleImageZoom.bind(this)
         this.handleVisibilityChange = this.handleVisibilityChange.bind(this)
+        this.handleCode = this.handleCode.bind(this)
+        this.handleResendCode = this.handleResendCode.bind(this)
 
         this.state = {
             error: null,
@@ -32,8 +34,11 @@ export class Download extends React.Component {
             countdown: 0,
             phase: null,
             progress: null,
+            codeRequired: false,
         }
         this.countdownTimer = null
+        // approval and code of the recipient, sent again on retries
+        this.retryHeaders = {}
     }
 
     componentWillUnmount() {
@@ -181,18 +186,35 @@ export class Download extends React.Component {
     // Reads the response body in chunks so the visitor sees the transfer move.
     // Falls back to a plain buffer read when the browser has no streaming
     // support, in which case there is nothing to report but the phase.
-    async readWithProgress(response) {
+    // When the connection drops, resume(received) is asked for a response
+    // carrying the rest of the file, so a flaky network doesn't use up the
+    // download.
+    async readWithProgress(response, resume) {
         const total = parseInt(response.headers.get('Content-Length') || '0', 10)
 
         if (!response.body || !response.body.getReader)
             return response.arrayBuffer()
 
-        const reader = response.body.getReader()
+        var reader = response.body.getReader()
         const chunks = []
         var received = 0
+        var retries = 3
 
         for (;;) {
-            const step = await reader.read()
+            var step
+            try {
+                step = await reader.read()
+            } catch (error) {
+                if (!resume || retries-- < 1)
+                    throw error
+
+                const rest = await resume(received)
+                if (!rest.ok || rest.status !== 206 || !rest.body)
+                    throw error
+
+                reader = rest.body.getReader()
+                continue
+            }
             if (step.done)
                 break
 
@@ -216,6 +238,47 @@ export class Download extends React.Component {
         return body.buffer
     }
 
+    // Holds the download until the sender decided on it. The server keeps
+    // each status request open until a decision or its timeout, so this
+    // doesn't poll in a tight loop. The file is then requested again with the
+    // request id, which the server refuses if the download was denied.
+    async awaitApproval(url, requestId) {
+        this.setState({ phase: 'awaitingApproval', progress: null })
+
+        for (;;) {
+            const response = await window.fetch(url + '/approvals/' + encodeURIComponent(requestId) + '?wait=30')
+            if (!response.ok)
+                return response
+
+            const approval = await response.json()
+            if (approval.state !== 'pending')
+                break
+        }
+
+        this.setState({ phase: 'downloading' })
+
+        return window.fetch(url, {
+            method: 'GET',
+            headers: {
+                'X-Approval-Request': requestId,
+            },
+        })
+    }
+
+    // The sender bound the file to an email address, the server mailed a code
+    // there and gets the same download again with it.
+    handleCode(event) {
+        event.preventDefault()
+
+        this.retryHeaders['X-Verification-Code'] = this.refs.code.value.trim()
+        this.handleDownload(null, this.key)
+    }
+
+    handleResendCode() {
+        delete this.retryHeaders['X-Verification-Code']
+        this.handleDownload(null, this.key)
+    }
+
     async handleDownload(event, key) {
         if (event)
             event.preventDefault()
@@ -237,10 +300,33 @@ export class Download extends React.Component {
         let fileId = window.location.pathname.split('/').pop()
 
         try {
-            const response = await window.fetch(gdprshare.config.apiUrl + '/' + fileId, {
+            const url = gdprshare.config.apiUrl + '/' + fileId
+            let response = await window.fetch(url, {
                 method: 'GET',
+                headers: this.retryHeaders,
             })
 
+            // the sender approves each download of this file
+            if (response.status === 202) {
+                const pending = await response.json()
+                this.retryHeaders['X-Approval-Request'] = pending.requestId
+                response = await this.awaitApproval(url, pending.requestId)
+            }
+
+            // a code was mailed to the recipient, ask for it and retry
+            if (response.status === 401) {
+                const fetchData = await response.clone().json().catch(() => ({}))
+                if (fetchData.code === 'verification_required') {
+                    this.key = key
+                    return this.setState({
+                        codeRequired: true,
+                        disableForm: true,
+                        mask: false,
+                        phase: null,
+                    })
+                }
+            }
+
             if (!response.ok) {
                 let fetchData
                 try {
@@ -256,7 +342,18 @@ export class Download extends React.Component {
 
             var filename = Buffer.from(response.headers.get('X-Filename'), 'base64')
 
-            const file = await this.readWithProgress(response)
+            // the download token lets the rest be fetched with a Range request
+            // without counting as another download
+            const token = response.headers.get('X-Download-Token')
+            const resume = token ? (received) => window.fetch(url, {
+                method: 'GET',
+                headers: {
+                    'Range': 'bytes=' + received + '-',
+                    'X-Download-Token': token,
+                },
+            }) : null
+
+            const file = await this.readWithProgress(response, resume)
 
             this.setState({ phase: 'decrypting', progress: null })
 
@@ -269,6 +366,7 @@ export class Download extends React.Component {
                     mask: false,
                     phase: null,
                     disableForm: true,
+                    codeRequired: false,
                 })
 
                 gdprshare.confirmReceipt(fileId)
@@ -285,6 +383,7 @@ export class Download extends React.Component {
                     mask: false,
                     phase: null,
                     disableForm: true,
+                    codeRequired: false,
                 })
 
                 gdprshare.confirmReceipt(fileId)
@@ -301,6 +400,7 @@ export class Download extends React.Component {
                         mask: false,
                         phase: null,
                         disableForm: true,
+                        codeRequired: false,
                     })
                     gdprshare.confirmReceipt(fileId)
                 }
@@ -334,6 +434,25 @@ export class Download extends React.Component {
             </form>
         )
 
+        var codeForm = (
+            <form className="app-inner" onSubmit={this.handleCode}>
+                <p className="text-center">{t('download.code.hint')}</p>
+                <div className="form-group row">
+                    <label htmlFor="code" className="col-sm-3 col-form-label">{t('download.code.label')}</label>
+                    <div className="col-sm-9">
+                        <input className="form-control" id="code" type="text" ref="code" inputMode="numeric"
+                               autoComplete="one-time-code" maxLength="12" autoFocus required />
+                    </div>
+                </div>
+                <div className="text-center col-sm-12">
+                    <input type="submit" className="btn btn-primary" value={t('download.submit')} />
+                    <button type="button" className="btn btn-link" id="resend-code" onClick={this.handleResendCode}>
+                        {t('download.code.resend')}
+                    </button>
+                </div>
+            </form>
+        )
+
         // shown over the loading mask so the visitor knows the wait is doing
         // something, and roughly how much of it is left
         var status = this.state.mask && this.state.phase ? (
@@ -365,6 +484,7 @@ export class Download extends React.Component {
                     {status}
                     <h4 className="text-center">{t('download.title')}</h4>
                     {this.state.disableForm ? null : form}
+                    {this.state.codeRequired && codeForm}
 
                     <br />
                     {this.state.successful && <Success message={t('download.success')} />}
@@ -0,0 +1,117 @@
+import React from 'react'
+
+// Login state of the sender, shown on the upload pages if the server has a
+// login configured. Logging in with OpenID Connect leaves the page for the
+// identity provider and comes back to the current path. With LDAP, username
+// and password are posted and the page is reloaded for the user's limits.
+export default class Login extends React.Component {
+    constructor() {
+        super()
+        this.handleLogout = this.handleLogout.bind(this)
+        this.handleLDAPLogin = this.handleLDAPLogin.bind(this)
+
+        this.state = {
+            user: null,
+            username: '',
+            password: '',
+            error: null,
+        }
+    }
+
+    async componentDidMount() {
+        if (!gdprshare.config.login)
+            return
+
+        try {
+            const response = await window.fetch(gdprshare.config.apiPrefix + '/auth/user')
+            if (response.ok)
+                this.setState({ user: await response.json() })
+        } catch (error) {
+            console.log(error)
+        }
+    }
+
+    async handleLDAPLogin(event) {
+        event.preventDefault()
+
+        try {
+            const response = await window.fetch(gdprshare.config.apiPrefix + '/auth/ldap', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ username: this.state.username, password: this.state.password }),
+            })
+            if (!response.ok) {
+                const data = await response.json().catch(function () { return null })
+                this.setState({ password: '', error: gdprshare.serverErrorText(data) || 'Login failed' })
+                return
+            }
+        } catch (error) {
+            console.log(error)
+            this.setState({ error: 'Login failed' })
+            return
+        }
+        window.location.reload()
+    }
+
+    async handleLogout(event) {
+        event.preventDefault()
+
+        try {
+            await window.fetch(gdprshare.config.apiPrefix + '/auth/logout', { method: 'POST' })
+        } catch (error) {
+            console.log(error)
+        }
+        this.setState({ user: null })
+    }
+
+    render() {
+        if (!gdprshare.config.login)
+            return null
+
+        const user = this.state.user
+        if (user) {
+            return (
+                <p className="text-center text-muted">
+                    <small>
+                        Logged in as {user.name || user.email}
+                        {user.name && user.email && ' (' + user.email + ')'} &middot; <a href="#" onClick={this.handleLogout}>Log out</a>
+                    </small>
+                </p>
+            )
+        }
+
+        const loginUrl = gdprshare.config.apiPrefix + '/auth/login?returnTo=' +
+            encodeURIComponent(window.location.pathname)
+        return (
+            <div className="text-center">
+                {gdprshare.config.ldapLogin &&
+                    <form className="row g-2 justify-content-center mb-2" onSubmit={this.handleLDAPLogin}>
+                        <div className="col-auto">
+                            <input className="form-control form-control-sm" type="text" placeholder="Username"
+                                   autoComplete="username" aria-label="Username" required
+                                   value={this.state.username}
+                                   onChange={(e) => this.setState({ username: e.target.value })}/>
+                        </div>
+                        <div className="col-auto">
+                            <input className="form-control form-control-sm" type="password" placeholder="Password"
+                                   autoComplete="current-password" aria-label="Password" required
+                                   value={this.state.password}
+                                   onChange={(e) => this.setState({ password: e.target.value })}/>
+                        </div>
+                        <div className="col-auto">
+                            <button className="btn btn-sm btn-outline-primary" type="submit">Log in</button>
+                        </div>
+                        {this.state.error &&
+                            <div className="col-12"><small className="text-danger">{this.state.error}</small></div>}
+                    </form>}
+                <p>
+                    <small>
+                        {gdprshare.config.oidcLogin && <a href={loginUrl}>Log in</a>}
+                        {gdprshare.config.oidcLogin && gdprshare.config.ldapLogin && ' with single sign-on'}
+                        {gdprshare.config.loginRequired && (gdprshare.config.oidcLogin ? ' to upload files' : 'Log in to upload files')}
+                    </small>
+                </p>
+            </div>
+        )
+    }
+}
@@ -0,0 +1,343 @@
+import React from 'react'
+import { Link } from 'react-router-dom'
+import Classnames from 'classnames'
+import Octicon, { Clippy, Trashcan } from '@primer/octicons-react'
+import Alert from './Alert'
+import Login from './Login'
+import { Tooltip } from 'react-tooltip'
+
+// Creates file requests and lists what was received. Requests are kept in
+// localStorage like uploaded files, together with the key of the link, so the
+// received files can be opened with their regular download link.
+export default class Request extends React.Component {
+    constructor() {
+        super()
+
+        this.copyHandler = gdprshare.copyHandler.bind(this)
+        this.handleCreate = this.handleCreate.bind(this)
+        this.handleClose = this.handleClose.bind(this)
+
+        this.state = {
+            error: null,
+            mask: false,
+            copy: null,
+            link: null,
+            requestInfo: {},
+        }
+    }
+
+    componentDidMount() {
+        this.updateRequests()
+    }
+
+    savedRequests() {
+        try {
+            return JSON.parse(window.localStorage.getItem('savedRequests')) || {}
+        } catch (e) {
+            console.log(e)
+            return {}
+        }
+    }
+
+    async updateRequests() {
+        const requests = this.savedRequests()
+        const requestInfo = {}
+
+        for (const requestId in requests) {
+            try {
+                const response = await window.fetch(gdprshare.config.apiPrefix + '/requests/' + requestId +
+                    '?ownerToken=' + encodeURIComponent(requests[requestId].ownerToken))
+                const fetchData = await response.json()
+                requestInfo[requestId] = response.ok ? fetchData : { error: fetchData.message }
+            } catch (error) {
+                console.log(error)
+            }
+        }
+
+        this.setState({ requestInfo: requestInfo })
+    }
+
+    // accepts the PEM output of "openssl pkey -pubout", the server takes the
+    // base64 DER inside
+    publicKey() {
+        return this.refs.publicKey.value
+            .replace(/-----(BEGIN|END) PUBLIC KEY-----/g, '')
+            .replace(/\s+/g, '')
+    }
+
+    async handleCreate(event) {
+        event.preventDefault()
+        if (this.state.mask)
+            return
+
+        this.setState({
+            error: null,
+            mask: true,
+        })
+
+        var formData = new FormData()
+        formData.append('email', this.refs.email.value)
+        formData.append('message', this.refs.message.value)
+        formData.append('max-files', this.refs.maxFiles.value)
+        formData.append('expiry', this.refs.expiry.value)
+        if (this.refs.maxSize.value)
+            formData.append('max-size', this.refs.maxSize.value)
+
+        const publicKey = this.publicKey()
+        let key = null
+        if (publicKey)
+            formData.append('public-key', publicKey)
+        else
+            key = gdprshare.keyToB64(window.crypto.getRandomValues(new Uint8Array(gdprshare.config.keyLength)))
+
+        let response
+        let fetchData
+        try {
+            response = await window.fetch(gdprshare.config.apiPrefix + '/requests', {
+                method: 'POST',
+                body: formData,
+            })
+            fetchData = await response.clone().json()
+        } catch (error) {
+            return gdprshare.displayErr.call(this, error)
+        }
+        if (!response.ok)
+            return gdprshare.displayErr.call(this, fetchData.message)
+
+        let link = location.protocol + '//' + location.host + response.headers.get('Location')
+        if (key)
+            link += '#' + key
+
+        const requests = this.savedRequests()
+        requests[fetchData.requestId] = {
+            ownerToken: fetchData.ownerToken,
+            key: key,
+            link: link,
+            message: this.refs.message.value,
+        }
+        try {
+            window.localStorage.setItem('savedRequests', JSON.stringify(requests))
+        } catch (e) {
+            console.log(e)
+        }
+
+        this.refs.form.reset()
+        this.setState({
+            mask: false,
+            link: link,
+        })
+        this.updateRequests()
+    }
+
+    async handleClose(requestId) {
+        const requests = this.savedRequests()
+
+        this.setState({
+            error: null,
+            mask: true,
+        })
+
+        try {
+            const response = await window.fetch(gdprshare.config.apiPrefix + '/requests/' + requestId +
+                '?ownerToken=' + encodeURIComponent(requests[requestId].ownerToken), {
+                method: 'DELETE',
+            })
+            if (!response.ok && response.status !== 404) {
+                const fetchData = await response.json()
+                return gdprshare.displayErr.call(this, fetchData.message)
+            }
+        } catch (error) {
+            return gdprshare.displayErr.call(this, error)
+        }
+
+        this.setState({ mask: false })
+        this.updateRequests()
+    }
+
+    renderRequest(requestId, saved) {
+        const info = this.state.requestInfo[requestId]
+        if (!info)
+            return null
+
+        let state
+        if (info.error)
+            state = <span className="expiry expiry-error">&lt;error&gt;</span>
+        else if (info.closed || Date.now() > new Date(info.expiryDate))
+            state = <span className="expiry expiry-expired">&lt;closed&gt;</span>
+        else
+            state = <span className="expiry">{info.remaining}/{info.maxFiles} left until {new Date(info.expiryDate).toLocaleString()}</span>
+
+        const files = (info.files || []).map(function (file) {
+            // files for a public key are opened with the private key, see the CLI
+            const name = saved.key
+                ? <a href={'/d/' + file.fileId + '#' + saved.key} target="_blank" rel="noreferrer">{file.fileId}</a>
+                : file.fileId
+            return (
+                <li key={file.fileId} className="long-text">
+                    {name} ({file.count} DL left, expires {new Date(file.expiryDate).toLocaleString()})
+                </li>
+            )
+        })
+
+        return (
+            <div className="card" key={requestId}>
+                <div className="card-header">
+                    <div className="input-group">
+                        <div className="input-group-prepend">
+                            <button className="btn btn-sm" type="button" onClick={this.copyHandler}
+                                    data-for="copy-tip" data-tip>
+                                <Octicon icon={Clippy}/>
+                            </button>
+                            {!info.closed && (
+                                <button className="btn btn-sm" type="button"
+                                        onClick={function () { this.handleClose(requestId) }.bind(this)}
+                                        data-tip data-for="close-tip">
+                                    <Octicon icon={Trashcan}/>
+                                </button>
+                            )}
+                        </div>
+                        <input className="form-control form-control-sm" type="text" readOnly value={saved.link}/>
+                    </div>
+                </div>
+                <div className="card-body long-text">
+                    {saved.message || requestId}
+                    {state}
+                    <ul>{files}</ul>
+                </div>
+            </div>
+        )
+    }
+
+    render() {
+        const requests = this.savedRequests()
+        const cards = []
+        for (const requestId in requests)
+            cards.push(this.renderRequest(requestId, requests[requestId]))
+
+        return (
+            <div className={'container-fluid col-sm-' + (cards.length > 0 ? 8 : 4)}>
+                <div className={Classnames({ 'app-outer': true, 'loading-mask': this.state.mask })}>
+                    <h4 className="text-center">File request</h4>
+                    <div className="row">
+                        <div className="col-sm">
+                            <form ref="form" className="app-inner" onSubmit={this.handleCreate}>
+                                <div className="mb-3 row">
+                                    <label htmlFor="message" className="col-sm-3 col-form-label col-form-label-sm">
+                                        Message
+                                    </label>
+                                    <div className="col-sm-9">
+                                        <textarea className="form-control form-control-sm" id="message" ref="message"
+                                                  rows="2" maxLength="2000" aria-describedby="messageHelp"/>
+                                        <small id="messageHelp" className="form-text text-muted">Shown to the
+                                            uploader, e.g. which documents you need</small>
+                                    </div>
+                                </div>
+                                <div className="mb-3 row">
+                                    <label htmlFor="email" className="col-sm-3 col-form-label col-form-label-sm">
+                                        Notification
+                                    </label>
+                                    <div className="col-sm-9">
+                                        <input className="form-control form-control-sm" id="email" type="email"
+                                               ref="email" placeholder="Enter email (optional)" maxLength="255"
+                                               defaultValue={window.localStorage.getItem('email')} minLength="6"
+                                               aria-describedby="requestEmailHelp"/>
+                                        <small id="requestEmailHelp" className="form-text text-muted">Email to be
+                                            notified of each upload</small>
+                                    </div>
+                                </div>
+                                <div className="mb-3 row">
+                                    <label htmlFor="max-files" className="col-sm-3 col-form-label col-form-label-sm">
+                                        Files
+                                    </label>
+                                    <div className="col-sm-9">
+                                        <input className="form-control form-control-sm" id="max-files" type="number"
+                                               ref="maxFiles" min="1" max="100" defaultValue="1" required/>
+                                    </div>
+                                </div>
+                                <div className="mb-3 row">
+                                    <label htmlFor="max-size" className="col-sm-3 col-form-label col-form-label-sm">
+                                        Size
+                                    </label>
+                                    <div className="col-sm-9">
+                                        <input className="form-control form-control-sm" id="max-size" type="number"
+                                               ref="maxSize" min="1" max={gdprshare.config.maxFileSize}
+                                               placeholder={gdprshare.config.maxFileSize + ' MiB'}
+                                               aria-describedby="maxSizeHelp"/>
+                                        <small id="maxSizeHelp" className="form-text text-muted">Maximum MiB per
+                                            file</small>
+                                    </div>
+                                </div>
+                                <div className="mb-3 row">
+                                    <label htmlFor="expiry" className="col-sm-3 col-form-label col-form-label-sm">
+                                        Expiry
+                                    </label>
+                                    <div className="col-sm-9">
+                                        <input className="form-control form-control-sm" id="expiry" type="number"
+                                               ref="expiry" min="1" max="14" defaultValue="7" required
+                                               aria-describedby="requestExpiryHelp"/>
+                                        <small id="requestExpiryHelp" className="form-text text-muted">Days the link
+                                            takes uploads</small>
+                                    </div>
+                                </div>
+                                <div className="mb-3 row">
+                                    <label htmlFor="public-key" className="col-sm-3 col-form-label col-form-label-sm">
+                                        Public key
+                                    </label>
+                                    <div className="col-sm-9">
+                                        <textarea className="form-control form-control-sm" id="public-key"
+                                                  ref="publicKey" rows="2" placeholder="-----BEGIN PUBLIC KEY----- (optional)"
+                                                  aria-describedby="publicKeyHelp"/>
+                                        <small id="publicKeyHelp" className="form-text text-muted">RSA key to encrypt
+                                            the files for instead of a key in the link. Received files are downloaded
+                                            with the private key and gdprshare-cli.</small>
+                                    </div>
+                                </div>
+
+                                <div className="text-center col-sm-12">
+                                    <input type="submit" className="btn btn-primary" value="Create request"/>
+                                </div>
+                            </form>
+
+                            {this.state.link && (
+                                <div className="mb-3 row">
+                                    <label htmlFor="request-link" className="col-sm-3 col-form-label col-form-label-sm">
+                                        Link
+                                    </label>
+                                    <div className="col-sm-9">
+                                        <div className="input-group input-group-sm">
+                                            <button onClick={this.copyHandler} type="button"
+                                                    className="btn btn-light border" data-for="copy-tip" data-tip>
+                                                <Octicon icon={Clippy}/>
+                                            </button>
+                                            <input className="form-control" id="request-link" type="text" readOnly
+                                                   value={this.state.link} aria-describedby="requestLinkHelp"/>
+                                        </div>
+                                        <small id="requestLinkHelp" className="form-text text-muted">Send this upload
+                                            link to whoever should send you files</small>
+                                    </div>
+                                </div>
+                            )}
+
+                            <br/>
+                            <Alert error={this.state.error}/>
+                            <div className="text-center col-sm-12">
+                                <Link to="/">Upload a file</Link>
+                            </div>
+                            <Login/>
+                        </div>
+                        {cards.length > 0 && (
+                            <div className="col-sm">
+                                <h6 className="text-center">File requests</h6>
+                                <div className="saved-files overflow-auto">
+                                    {cards}
+                                </div>
+                            </div>
+                        )}
+                    </div>
+                    <Tooltip id="copy-tip" openOnClick={false} render={() => this.state.copy} delayHide={1000}/>
+                    <Tooltip id="close-tip" variant="info" place="bottom" content="Close request"/>
+                </div>
+            </div>
+        )
+    }
+}
@@ -0,0 +1,152 @@
+import React from 'react'
+import Classnames from 'classnames'
+import Alert from './Alert'
+import Success from './Success'
+import { withTranslation } from 'react-i18next'
+
+// Upload page of a file request, opened by the external party. The key is in
+// the fragment like on download links. Requests with a public key have none,
+// a new key is wrapped for the requester's public key instead.
+export class RequestUpload extends React.Component {
+    constructor() {
+        super()
+        this.handleUpload = this.handleUpload.bind(this)
+
+        this.state = {
+            error: null,
+            mask: false,
+            info: null,
+            uploaded: 0,
+        }
+    }
+
+    async componentDidMount() {
+        this.requestId = window.location.pathname.split('/').pop()
+        this.url = gdprshare.config.apiPrefix + '/requests/' + this.requestId
+
+        try {
+            const response = await window.fetch(this.url)
+            const fetchData = await response.json()
+            if (!response.ok)
+                return gdprshare.displayErr.call(this, gdprshare.serverErrorText(fetchData))
+
+            if (!fetchData.publicKey && !window.location.hash.substring(1))
+                return gdprshare.displayErr.call(this, this.props.t('errors.keyMissing'))
+
+            this.setState({ info: fetchData })
+        } catch (error) {
+            gdprshare.displayErr.call(this, error)
+        }
+    }
+
+    async wrapKey(key) {
+        const publicKey = await window.crypto.subtle.importKey(
+            'spki',
+            Buffer.from(this.state.info.publicKey, 'base64'),
+            { name: 'RSA-OAEP', hash: 'SHA-256' },
+            false,
+            ['encrypt'],
+        )
+        const wrapped = await window.crypto.subtle.encrypt({ name: 'RSA-OAEP' }, publicKey, key)
+
+        return Buffer.from(wrapped).toString('base64')
+    }
+
+    async handleUpload(event) {
+        event.preventDefault()
+        if (this.state.mask)
+            return
+
+        const info = this.state.info
+        const file = this.refs.file.files[0]
+        if (file.size > info.maxSize) {
+            return this.setState({
+                error: this.props.t('errors.server.upload_too_large'),
+            })
+        }
+
+        this.setState({
+            error: null,
+            mask: true,
+        })
+
+        try {
+            var formData = new FormData()
+            let key
+            if (info.publicKey) {
+                key = window.crypto.getRandomValues(new Uint8Array(gdprshare.config.keyLength))
+                formData.append('wrapped-key', await this.wrapKey(key))
+            } else {
+                key = gdprshare.keyFromB64(window.location.hash.substring(1))
+            }
+
+            const encName = await gdprshare.encrypt(new TextEncoder().encode(file.name), key)
+            const filename = Buffer.from(encName).toString('base64')
+            const cipherText = await gdprshare.encrypt(await file.arrayBuffer(), key)
+
+            formData.append('type', 'file')
+            formData.append('filename', filename)
+            formData.append('file', new File([cipherText], filename, { type: 'application/octet-stream' }), filename)
+
+            const response = await window.fetch(this.url + '/files', {
+                method: 'POST',
+                body: formData,
+            })
+            const fetchData = await response.json()
+            if (!response.ok)
+                return gdprshare.displayErr.call(this, gdprshare.serverErrorText(fetchData))
+
+            this.refs.form.reset()
+            this.setState({
+                mask: false,
+                uploaded: this.state.uploaded + 1,
+                info: Object.assign({}, info, { remaining: info.remaining - 1 }),
+            })
+        } catch (error) {
+            gdprshare.displayErr.call(this, error)
+        }
+    }
+
+    render() {
+        const t = this.props.t
+        const info = this.state.info
+
+        return (
+            <div className="container-fluid col-sm-4">
+                <div className={Classnames({ 'app-outer': true, 'loading-mask': this.state.mask })}>
+                    <h4 className="text-center">{t('requestUpload.title')}</h4>
+                    {info && info.message && (
+                        <div className="mb-3">
+                            <small className="text-muted">{t('requestUpload.message')}</small>
+                            <p className="long-text">{info.message}</p>
+                        </div>
+                    )}
+                    {info && info.remaining > 0 && (
+                        <form ref="form" className="app-inner" onSubmit={this.handleUpload}>
+                            <p className="text-center">
+                                {t('requestUpload.limits', {
+                                    files: info.remaining,
+                                    size: Math.floor(info.maxSize / 1024 / 1024),
+                                    date: new Date(info.expiryDate).toLocaleString(),
+                                })}
+                            </p>
+                            <div className="mb-3 row">
+                                <label htmlFor="content" className="col-sm-3 col-form-label">{t('requestUpload.file')}</label>
+                                <div className="col-sm-9">
+                                    <input className="form-control" id="content" type="file" ref="file" required autoFocus />
+                                </div>
+                            </div>
+                            <div className="text-center col-sm-12">
+                                <input type="submit" className="btn btn-primary" value={t('requestUpload.submit')} />
+                            </div>
+                        </form>
+                    )}
+                    {this.state.uploaded > 0 && <Success message={t('requestUpload.success')} />}
+                    <Alert error={this.state.error} />
+                </div>
+            </div>
+        )
+    }
+}
+
+export default withTranslation()(RequestUpload)
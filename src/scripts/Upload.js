@@ -1,7 +1,9 @@
 import React from 'react'
+import { Link } from 'react-router-dom'
 import Classnames from 'classnames'
 import Octicon, {Clippy, CloudUpload, Trashcan} from '@primer/octicons-react'
 import Alert from './Alert'
+import Login from './Login'
 import { Tooltip } from 'react-tooltip'
 import { withRouter } from './withRouter'
 import { stripMetadata, loadPdfLib } from './strip'
@@ -29,6 +31,8 @@ class Upload extends React.Component {
         this.handleCountrySearch = this.handleCountrySearch.bind(this)
         this.handleDeselectAll = this.handleDeselectAll.bind(this)
         this.handleDelayChange = this.handleDelayChange.bind(this)
+        this.handleApprovalChange = this.handleApprovalChange.bind(this)
+        this.handleExpiryUnitChange = this.handleExpiryUnitChange.bind(this)
 
         this.state = {
             error: null,
@@ -44,6 +48,8 @@ class Upload extends React.Component {
             countrySearch: '',
             customCountriesUsed: false,
             delay: '0',
+            approval: false,
+            expiryUnit: 'days',
             ephemeral: '0',
             strip: false,
         }
@@ -94,7 +100,7 @@ class Upload extends React.Component {
 
         let response
         try {
-            response = await window.fetch(gdprshare.config.apiUrl + '/' + 'validate', {
+            response = await window.fetch(gdprshare.config.apiUrl + '/' + 'status', {
                 method: 'POST',
                 body: JSON.stringify(fileIds),
             })
@@ -110,13 +116,13 @@ class Upload extends React.Component {
         }
 
         if (!response.ok) {
-            let error = 'fetching file validity failed: ' + fetchData.message
+            let error = 'fetching file status failed: ' + fetchData.message
             // TODO: mask removal could be a race with something else
             return gdprshare.displayErr.call(this, error)
         }
 
         this.setState({
-            fileInfo: fetchData.fileInfo
+            fileInfo: fetchData.files
         })
     }
 
@@ -157,13 +163,20 @@ class Upload extends React.Component {
         formData.append('file', file, encFilename)
         formData.append('filename', encFilename)
         formData.append('count', this.refs.count.value)
-        formData.append('expiry', this.refs.expiry.value)
+        if (this.state.expiryUnit === 'hours')
+            formData.append('expiry-hours', this.refs.expiry.value)
+        else
+            formData.append('expiry', this.refs.expiry.value)
         formData.append('email', email)
+        if (this.refs.recipientEmail.value)
+            formData.append('recipient-email', this.refs.recipientEmail.value)
         if (this.state.geoRestriction !== 'none') {
             formData.append('allowed-countries', this.state.selectedCountries.join(','))
         }
         if (this.state.delay !== '0')
             formData.append('delay', this.state.delay)
+        if (this.state.approval)
+            formData.append('approval', 'true')
         if (this.state.type === 'image' && this.state.ephemeral !== '0')
             formData.append('ephemeral', this.state.ephemeral)
 
@@ -499,6 +512,18 @@ class Upload extends React.Component {
         })
     }
 
+    handleApprovalChange(event) {
+        this.setState({
+            approval: event.target.checked
+        })
+    }
+
+    handleExpiryUnitChange(event) {
+        this.setState({
+            expiryUnit: event.target.value
+        })
+    }
+
     render() {
         var savedFiles = []
         var files = {}
@@ -541,6 +566,14 @@ class Upload extends React.Component {
                     let s = file.count > 1 ? 's' : ''
                     text = `${countText} DL${s} or ${expires}`
                 }
+                if (file.downloads > 0 || file.denied > 0) {
+                    text += `, ${file.downloads} downloaded`
+                    if (file.denied > 0)
+                        text += `, ${file.denied} denied`
+                }
+                if (file.pending > 0) {
+                    text += `, ${file.pending} awaiting approval`
+                }
                 expiry = (
                     <span className={classes}>
                         {text}
@@ -658,19 +691,34 @@ class Upload extends React.Component {
                                                    ref="email" placeholder="Enter email (optional)" maxLength="255"
                                                    aria-describedby="emailHelp"
                                                    defaultValue={window.localStorage.getItem('email')} minLength="6"
+                                                   required={this.state.approval}
                                             />
                                             <small id="emailHelp" className="form-text text-muted">Email to receive
                                                 download notifications</small>
                                         </div>
                                     </div>
 
+                                    <div className="mb-3 row">
+                                        <label htmlFor="recipient-email" className="col-sm-3 col-form-label col-form-label-sm">
+                                            Recipient
+                                        </label>
+                                        <div className="col-sm-9">
+                                            <input className="form-control form-control-sm" id="recipient-email" type="email"
+                                                   ref="recipientEmail" placeholder="Enter email (optional)" maxLength="255"
+                                                   aria-describedby="recipientEmailHelp" minLength="6"
+                                            />
+                                            <small id="recipientEmailHelp" className="form-text text-muted">Each download
+                                                needs a one-time code sent to this address</small>
+                                        </div>
+                                    </div>
+
                                     <div className="mb-3 row">
                                         <label htmlFor="count" className="col-sm-3 col-form-label col-form-label-sm">
                                             Count
                                         </label>
                                         <div className="col-sm-9">
                                             <input className="form-control form-control-sm" id="count" type="number"
-                                                   ref="count" min="1" max="15" defaultValue="1" required
+                                                   ref="count" min="1" max={gdprshare.config.maxCount} defaultValue="1" required
                                                    aria-describedby="countHelp"/>
                                             <small id="countHelp" className="form-text text-muted">Maximum downloads
                                                 before link expires</small>
@@ -682,10 +730,19 @@ class Upload extends React.Component {
                                             Expiry
                                         </label>
                                         <div className="col-sm-9">
-                                            <input className="form-control form-control-sm" id="expiry" type="number"
-                                                   ref="expiry" min="1" max="14" defaultValue="7" required
-                                                   aria-describedby="expiryHelp"/>
-                                            <small id="expiryHelp" className="form-text text-muted">Maximum days before
+                                            <div className="input-group input-group-sm">
+                                                <input className="form-control form-control-sm" id="expiry" type="number"
+                                                       ref="expiry" min="1"
+                                                       max={gdprshare.config.maxExpiry * (this.state.expiryUnit === 'hours' ? 24 : 1)}
+                                                       defaultValue="7" required aria-describedby="expiryHelp"/>
+                                                <select className="form-select form-select-sm" id="expiry-unit"
+                                                        value={this.state.expiryUnit}
+                                                        onChange={this.handleExpiryUnitChange}>
+                                                    <option value="days">days</option>
+                                                    <option value="hours">hours</option>
+                                                </select>
+                                            </div>
+                                            <small id="expiryHelp" className="form-text text-muted">Maximum time before
                                                 link expires</small>
                                         </div>
                                     </div>
@@ -779,6 +836,26 @@ class Upload extends React.Component {
                                         </div>
                                     </div>
 
+                                    <div className="mb-3 row">
+                                        <label htmlFor="approval" className="col-sm-3 col-form-label col-form-label-sm">
+                                            Approval
+                                        </label>
+                                        <div className="col-sm-9">
+                                            <div className="form-check">
+                                                <input className="form-check-input" type="checkbox" id="approval"
+                                                       checked={this.state.approval}
+                                                       onChange={this.handleApprovalChange}
+                                                       aria-describedby="approvalHelp"/>
+                                                <label className="form-check-label col-form-label-sm" htmlFor="approval">
+                                                    Approve each download
+                                                </label>
+                                            </div>
+                                            <small id="approvalHelp" className="form-text text-muted">Downloads wait
+                                                until you approve them. The request, with the recipient's location and
+                                                connection details, is sent to the email address above.</small>
+                                        </div>
+                                    </div>
+
                                     {this.state.type === 'file' && (
                                         <div className="mb-3 row">
                                             <label htmlFor="strip" className="col-sm-3 col-form-label col-form-label-sm">
@@ -832,6 +909,10 @@ class Upload extends React.Component {
 
                             <br/>
                             <Alert error={this.state.error}/>
+                            <div className="text-center col-sm-12">
+                                <Link to="/request">Request files from someone</Link>
+                            </div>
+                            <Login/>
                         </div>
                         {filesCol}
                         <Tooltip id="copy-tip" openOnClick={false} render={() => this.state.copy} delayHide={1000}/>
@@ -83,6 +83,45 @@ describe('readWithProgress', () => {
         expect(new Uint8Array(buffer)).toEqual(new Uint8Array([]))
     })
 
+    test('resumes with the remaining bytes after the connection drops', async () => {
+        var failed = false
+        const dropping = streamingResponse([new Uint8Array([1, 2])], 4)
+        dropping.body.getReader = () => ({
+            read: () => {
+                if (failed)
+                    return Promise.reject(new Error('network error'))
+                failed = true
+                return Promise.resolve({ done: false, value: new Uint8Array([1, 2]) })
+            },
+        })
+        const offsets = []
+        const resume = (received) => {
+            offsets.push(received)
+            return Promise.resolve(Object.assign(
+                streamingResponse([new Uint8Array([3, 4])], 2),
+                { ok: true, status: 206 },
+            ))
+        }
+        const { component, seen } = subject()
+
+        const buffer = await component.readWithProgress(dropping, resume)
+
+        expect(offsets).toEqual([2])
+        expect(new Uint8Array(buffer)).toEqual(new Uint8Array([1, 2, 3, 4]))
+        expect(seen.map((s) => s.progress)).toEqual([50, 100])
+    })
+
+    test('gives up when the download cannot be resumed', async () => {
+        const dropping = streamingResponse([], 4)
+        dropping.body.getReader = () => ({
+            read: () => Promise.reject(new Error('network error')),
+        })
+        const resume = () => Promise.resolve({ ok: false, status: 410 })
+        const { component } = subject()
+
+        await expect(component.readWithProgress(dropping, resume)).rejects.toThrow('network error')
+    })
+
     test('falls back to a plain buffer read without streaming support', async () => {
         const expected = new Uint8Array([9, 8, 7]).buffer
         const { component, seen } = subject()
@@ -98,3 +137,42 @@ describe('readWithProgress', () => {
         expect(seen).toHaveLength(0)
     })
 })
+
+describe('awaitApproval', () => {
+    test('waits while the request is pending, then retries with it', async () => {
+        const states = ['pending', 'pending', 'approved']
+        const calls = []
+        window.fetch = jest.fn((url, options) => {
+            calls.push({ url, options })
+            if (url.indexOf('/approvals/') === -1)
+                return Promise.resolve({ ok: true, status: 200 })
+            return Promise.resolve({
+                ok: true,
+                json: () => Promise.resolve({ state: states.shift() }),
+            })
+        })
+        const { component, seen } = subject()
+
+        const response = await component.awaitApproval('/api/v1/files/abc', 'req1')
+
+        expect(response.status).toBe(200)
+        expect(calls.map((c) => c.url)).toEqual([
+            '/api/v1/files/abc/approvals/req1?wait=30',
+            '/api/v1/files/abc/approvals/req1?wait=30',
+            '/api/v1/files/abc/approvals/req1?wait=30',
+            '/api/v1/files/abc',
+        ])
+        expect(calls[3].options.headers['X-Approval-Request']).toBe('req1')
+        expect(seen.map((s) => s.phase)).toEqual(['awaitingApproval', 'downloading'])
+    })
+
+    test('hands back a failed status request for the error display', async () => {
+        window.fetch = jest.fn(() => Promise.resolve({ ok: false, status: 404 }))
+        const { component } = subject()
+
+        const response = await component.awaitApproval('/api/v1/files/abc', 'req1')
+
+        expect(response.status).toBe(404)
+        expect(window.fetch).toHaveBeenCalledTimes(1)
+    })
+})
@@ -8,6 +8,9 @@ import ErrPage from './ErrPage'
 import Upload from './Upload'
 import Uploaded from './Uploaded'
 import Download from './Download'
+import Approve from './Approve'
+import Request from './Request'
+import RequestUpload from './RequestUpload'
 
 import './Polyfills'
 import i18n, { initI18n, serverErrorText } from './i18n'
@@ -23,6 +26,8 @@ gdprshare.config = {
     keyLength: 32,
     saveFiles: true,
     showCountdown: false,
+    maxExpiry: 14,
+    maxCount: 15,
     apiPrefix: '/api/v1',
     apiUrl: '/api/v1/files',
 }
@@ -198,6 +203,9 @@ Promise.all([gdprshare.loadConfig(), initI18n()]).then(function () {
                 <Route path="/" element={<Upload />} />
                 <Route path="/uploaded" element={<Uploaded />} />
                 <Route path="/d/:fileId" element={<Download />} />
+                <Route path="/approve/:fileId/:requestId" element={<Approve />} />
+                <Route path="/request" element={<Request />} />
+                <Route path="/r/:requestId" element={<RequestUpload />} />
             </Routes>
         </BrowserRouter>
     )